@@ -0,0 +1,600 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// NewZipFS opens a zip file as a read-only filesystem rooted at the path of
+// the archive. Entry modes and modification times are reported by Stat and
+// ListDir, and entry comments become the "comment" attribute. Entries are
+// decompressed as they are read.
+//
+// Mutating operations fail with ErrReadOnly. Journaling, versioning and
+// the backend in opts are ignored; hooks run as usual.
+func NewZipFS(archivePath string, opts *Options) (*SimpleFS, error) {
+	return newArchiveFS(archivePath, opts, loadZip)
+}
+
+// NewTarFS opens a tar file, optionally gzip-compressed, as a read-only
+// filesystem rooted at the path of the archive. Entry modes and
+// modification times are reported by Stat and ListDir, and PAX records
+// become attributes: SCHILY.xattr.<name> records under <name>, others
+// apart from the standard header fields under their own key. The content
+// of the archive is held in memory. Hard links share the content of their
+// target; symbolic links and special files are left out.
+//
+// Mutating operations fail with ErrReadOnly. Journaling, versioning and
+// the backend in opts are ignored; hooks run as usual.
+func NewTarFS(archivePath string, opts *Options) (*SimpleFS, error) {
+	return newArchiveFS(archivePath, opts, loadTar)
+}
+
+// newArchiveFS opens an archive with load and serves it read-only
+func newArchiveFS(archivePath string, opts *Options, load func(a *archiveBackend, f vfs.File, size int64) error) (*SimpleFS, error) {
+	root, err := filepath.Abs(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive path: %w", err)
+	}
+
+	file, err := vfs.Open(vfs.Default, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	a := newArchiveBackend(root, info.ModTime())
+	if err := load(a, file, info.Size()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read archive %s: %w", archivePath, err)
+	}
+	if a.release == nil {
+		// The content was read into memory
+		file.Close()
+	}
+	if err := a.addAttributes(); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to read archive %s: %w", archivePath, err)
+	}
+
+	archiveOpts := DefaultOptions()
+	if opts != nil {
+		copied := *opts
+		archiveOpts = &copied
+	}
+	archiveOpts.EnableJournaling = false
+	archiveOpts.EnableVersioning = false
+	archiveOpts.Backend = a
+
+	fs, err := NewSimpleFS(root, archiveOpts)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	fs.readOnly = true
+	fs.release = a
+	return fs, nil
+}
+
+// loadZip adds the entries of a zip file. The file stays open so entries
+// can be decompressed on demand.
+func loadZip(a *archiveBackend, f vfs.File, size int64) error {
+	r, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range r.File {
+		info := zf.FileInfo()
+		node := &archiveNode{mode: info.Mode(), modTime: info.ModTime(), size: info.Size(), header: &zf.FileHeader}
+		if zf.Comment != "" {
+			node.attrs = map[string]string{"comment": zf.Comment}
+		}
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			node.open = zf.Open
+		}
+		a.add(zf.Name, node)
+	}
+
+	a.release = f
+	return nil
+}
+
+// loadTar reads the entries of a tar file, decompressing it first when it
+// starts with the gzip magic number
+func loadTar(a *archiveBackend, f vfs.File, size int64) error {
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		info := hdr.FileInfo()
+		node := &archiveNode{mode: info.Mode(), modTime: info.ModTime(), header: hdr, attrs: paxAttributes(hdr.PAXRecords),
+			owned: true, uid: hdr.Uid, gid: hdr.Gid, atime: hdr.AccessTime}
+		switch {
+		case hdr.Typeflag == tar.TypeLink:
+			target, ok := a.nodes[a.name(hdr.Linkname)]
+			if !ok || target.mode.IsDir() {
+				continue
+			}
+			node.mode, node.data, node.size, node.open = target.mode, target.data, target.size, target.open
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			node.data, node.size = data, int64(len(data))
+		default:
+			continue
+		}
+		a.add(hdr.Name, node)
+	}
+}
+
+// paxStandardKeys are PAX records that duplicate header fields
+var paxStandardKeys = map[string]bool{
+	"path": true, "linkpath": true, "size": true, "uid": true, "gid": true,
+	"uname": true, "gname": true, "mtime": true, "atime": true, "ctime": true,
+	"charset": true, "hdrcharset": true,
+}
+
+// paxAttributes maps the PAX records of an entry to attributes
+func paxAttributes(records map[string]string) map[string]string {
+	var attrs map[string]string
+	for key, value := range records {
+		if paxStandardKeys[key] || strings.HasPrefix(key, "GNU.sparse.") {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = value
+	}
+	return attrs
+}
+
+// archiveBackend is a read-only Backend serving the entries of an archive
+// below root
+type archiveBackend struct {
+	root    string
+	modTime time.Time               // Modification time of the archive, used for implicit directories
+	nodes   map[string]*archiveNode // Entries by host path, including root
+	release io.Closer               // Archive file entries are read from on demand, if any
+}
+
+// archiveNode is a file or directory of an archive
+type archiveNode struct {
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	header   interface{}                   // *tar.Header or *zip.FileHeader, nil for implicit directories
+	attrs    map[string]string             // Attributes from the entry metadata
+	owned    bool                          // Whether the entry records its owner, as tar entries do
+	uid, gid int                           // Owner of the entry, if owned
+	atime    time.Time                     // Last access recorded for the entry, if any
+	data     []byte                        // Content held in memory
+	open     func() (io.ReadCloser, error) // Decompresses content kept in the archive, if set
+	children map[string]*archiveNode       // Entries of a directory by name
+}
+
+func newArchiveBackend(root string, modTime time.Time) *archiveBackend {
+	a := &archiveBackend{root: root, modTime: modTime, nodes: make(map[string]*archiveNode)}
+	a.nodes[root] = &archiveNode{mode: os.ModeDir | 0755, modTime: modTime, children: make(map[string]*archiveNode)}
+	return a
+}
+
+// name maps an entry name to a host path below root. Names cannot escape
+// the root.
+func (a *archiveBackend) name(entry string) string {
+	return filepath.Join(a.root, filepath.FromSlash(path.Clean("/"+entry)))
+}
+
+// add inserts an entry, creating missing parent directories. A later entry
+// with the same name replaces an earlier one, as when extracting.
+func (a *archiveBackend) add(entry string, node *archiveNode) {
+	name := a.name(entry)
+	if name == a.root {
+		return
+	}
+	if node.mode.IsDir() {
+		node.children = make(map[string]*archiveNode)
+		if existing, ok := a.nodes[name]; ok && existing.mode.IsDir() {
+			node.children = existing.children
+		}
+	}
+
+	parent := a.dir(filepath.Dir(name))
+	parent.children[filepath.Base(name)] = node
+	a.nodes[name] = node
+	if !node.mode.IsDir() {
+		a.forget(name)
+	}
+}
+
+// dir returns the directory at name, creating it and its parents if needed
+func (a *archiveBackend) dir(name string) *archiveNode {
+	if node, ok := a.nodes[name]; ok && node.mode.IsDir() {
+		return node
+	}
+	node := &archiveNode{mode: os.ModeDir | 0755, modTime: a.modTime}
+	a.add(strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(name, a.root)), "/"), node)
+	return node
+}
+
+// forget drops the entries below a directory that was replaced by a file
+func (a *archiveBackend) forget(name string) {
+	prefix := name + string(filepath.Separator)
+	for other := range a.nodes {
+		if strings.HasPrefix(other, prefix) {
+			delete(a.nodes, other)
+		}
+	}
+}
+
+// addAttributes stores the attributes of the entries where SimpleFS looks
+// for them. Attribute files shipped in the archive, as in an archived
+// SimpleFS root, take precedence.
+func (a *archiveBackend) addAttributes() error {
+	names := make([]string, 0, len(a.nodes))
+	for name, node := range a.nodes {
+		if len(node.attrs) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rel, err := filepath.Rel(a.root, name)
+		if err != nil {
+			return err
+		}
+		attrs := make(map[string]string)
+		for key, value := range a.nodes[name].attrs {
+			attrs[key] = value
+		}
+
+		attrPath := filepath.ToSlash(filepath.Join(".attributes", utils.HashString(filepath.ToSlash(rel))+".json"))
+		if existing, ok := a.nodes[a.name(attrPath)]; ok && !existing.mode.IsDir() {
+			data, err := existing.content()
+			if err != nil {
+				return err
+			}
+			shipped := make(map[string]string)
+			if err := json.Unmarshal(data, &shipped); err == nil {
+				for key, value := range shipped {
+					attrs[key] = value
+				}
+			}
+		}
+
+		data, err := json.MarshalIndent(attrs, "", "  ")
+		if err != nil {
+			return err
+		}
+		a.add(attrPath, &archiveNode{mode: 0644, modTime: a.modTime, size: int64(len(data)), data: data})
+	}
+	return nil
+}
+
+// Close releases the archive file
+func (a *archiveBackend) Close() error {
+	if a.release == nil {
+		return nil
+	}
+	return a.release.Close()
+}
+
+// content returns the content of a file
+func (n *archiveNode) content() ([]byte, error) {
+	if n.open == nil {
+		return n.data, nil
+	}
+	rc, err := n.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (a *archiveBackend) lookup(op, name string) (*archiveNode, error) {
+	node, ok := a.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return node, nil
+}
+
+func readOnlyErr(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: ErrReadOnly}
+}
+
+func (a *archiveBackend) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	if isWriteFlag(flag) || flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, readOnlyErr("open", name)
+	}
+	node, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &archiveFile{archiveReader: bytes.NewReader(node.data), name: name, info: node.info(filepath.Base(name))}
+	if node.open != nil && !node.mode.IsDir() {
+		rc, err := node.open()
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		f.stream = &archiveStream{open: node.open, size: node.size, rc: rc}
+		f.archiveReader = f.stream
+	}
+	return f, nil
+}
+
+func (a *archiveBackend) Stat(name string) (os.FileInfo, error) {
+	node, err := a.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (a *archiveBackend) Lstat(name string) (os.FileInfo, error) {
+	return a.Stat(name)
+}
+
+func (a *archiveBackend) ReadDir(name string) ([]os.DirEntry, error) {
+	node, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+
+	entries := make([]os.DirEntry, 0, len(node.children))
+	for child, n := range node.children {
+		entries = append(entries, iofs.FileInfoToDirEntry(n.info(child)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (a *archiveBackend) Mkdir(name string, perm os.FileMode) error {
+	return readOnlyErr("mkdir", name)
+}
+
+// MkdirAll succeeds for directories that exist, so opening the archive as
+// a filesystem finds its root
+func (a *archiveBackend) MkdirAll(name string, perm os.FileMode) error {
+	if node, err := a.lookup("mkdir", name); err == nil && node.mode.IsDir() {
+		return nil
+	}
+	return readOnlyErr("mkdir", name)
+}
+
+func (a *archiveBackend) Remove(name string) error    { return readOnlyErr("remove", name) }
+func (a *archiveBackend) RemoveAll(name string) error { return readOnlyErr("remove", name) }
+
+func (a *archiveBackend) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrReadOnly}
+}
+
+func (a *archiveBackend) Chmod(name string, mode os.FileMode) error {
+	return readOnlyErr("chmod", name)
+}
+
+func (a *archiveBackend) Chown(name string, uid, gid int) error {
+	return readOnlyErr("chown", name)
+}
+
+func (a *archiveBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return readOnlyErr("chtimes", name)
+}
+
+func (a *archiveBackend) Truncate(name string, size int64) error {
+	return readOnlyErr("truncate", name)
+}
+
+func (a *archiveBackend) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrReadOnly}
+}
+
+// Readlink always fails, since symlinks in archives are skipped
+func (a *archiveBackend) Readlink(name string) (string, error) {
+	if _, err := a.lookup("readlink", name); err != nil {
+		return "", err
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+}
+
+func (a *archiveBackend) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: ErrReadOnly}
+}
+
+func (n *archiveNode) info(name string) os.FileInfo {
+	return &archiveInfo{name: name, node: n}
+}
+
+// archiveInfo describes an entry of an archive. Sys returns its
+// *tar.Header or *zip.FileHeader, and the owner and access time of tar
+// entries are reported through Owner and AccessTime.
+type archiveInfo struct {
+	name string
+	node *archiveNode
+}
+
+func (i *archiveInfo) Name() string       { return i.name }
+func (i *archiveInfo) Size() int64        { return i.node.size }
+func (i *archiveInfo) Mode() os.FileMode  { return i.node.mode }
+func (i *archiveInfo) ModTime() time.Time { return i.node.modTime }
+func (i *archiveInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i *archiveInfo) Sys() interface{}   { return i.node.header }
+
+// Owner returns the user and group recorded for the entry
+func (i *archiveInfo) Owner() (uid, gid int, ok bool) {
+	return i.node.uid, i.node.gid, i.node.owned
+}
+
+// AccessTime returns the access time recorded for the entry
+func (i *archiveInfo) AccessTime() (time.Time, bool) {
+	return i.node.atime, !i.node.atime.IsZero()
+}
+
+// archiveReader reads the content of an open entry
+type archiveReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// archiveFile is an open entry of an archive
+type archiveFile struct {
+	archiveReader
+	name   string
+	info   os.FileInfo
+	stream *archiveStream // Set when the content is decompressed as it is read
+}
+
+func (f *archiveFile) Name() string               { return f.name }
+func (f *archiveFile) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *archiveFile) Sync() error                { return nil }
+func (f *archiveFile) Close() error {
+	if f.stream == nil {
+		return nil
+	}
+	return f.stream.Close()
+}
+func (f *archiveFile) Write(p []byte) (int, error) { return 0, readOnlyErr("write", f.name) }
+func (f *archiveFile) Truncate(size int64) error   { return readOnlyErr("truncate", f.name) }
+func (f *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, readOnlyErr("write", f.name)
+}
+
+// archiveStream reads an entry that is decompressed as it is read, so
+// opening a large entry does not load it into memory. Seeking backwards
+// starts decompressing again from the beginning, and ReadAt decompresses
+// the entry up to the offset each time.
+type archiveStream struct {
+	open func() (io.ReadCloser, error)
+	size int64
+	rc   io.ReadCloser // Decompressor, positioned at at
+	at   int64         // Offset of the next byte rc returns
+	pos  int64         // Offset of the next byte Read returns
+}
+
+func (s *archiveStream) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.rc == nil || s.at > s.pos {
+		if s.rc != nil {
+			s.rc.Close()
+			s.rc = nil
+		}
+		rc, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		s.rc, s.at = rc, 0
+	}
+	if s.at < s.pos {
+		n, err := io.CopyN(io.Discard, s.rc, s.pos-s.at)
+		s.at += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.rc.Read(p)
+	s.at += int64(n)
+	s.pos = s.at
+	return n, err
+}
+
+func (s *archiveStream) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	rc, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	if _, err := io.CopyN(io.Discard, rc, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *archiveStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *archiveStream) Close() error {
+	if s.rc == nil {
+		return nil
+	}
+	err := s.rc.Close()
+	s.rc = nil
+	return err
+}
@@ -0,0 +1,158 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestZipFS(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name, content, comment string
+	}{
+		{"a.txt", "a", "first"},
+		{"dir/b.txt", "bb", ""},
+		{"c.txt", "0123456789", ""},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Comment: entry.comment, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := NewZipFS(path, nil)
+	if err != nil {
+		t.Fatalf("NewZipFS: %v", err)
+	}
+	defer fs.Close()
+
+	wantContent(t, fs, "a.txt", "a")
+	wantContent(t, fs, "dir/b.txt", "bb")
+	wantAttribute(t, fs, "a.txt", "comment", "first")
+	entries, err := fs.ListDir("")
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Name != "a.txt" || entries[1].Name != "c.txt" || entries[2].Name != "dir" || !entries[2].IsDir {
+		t.Fatalf("ListDir = %v, want a.txt, c.txt and dir", entries)
+	}
+	wantStreamedReads(t, fs, "c.txt", "0123456789")
+	wantArchiveReadOnly(t, fs)
+}
+
+func TestTarFS(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "a.txt", Mode: 0640, Size: 1, ModTime: mtime, Uid: 1000, Gid: 100, Format: tar.FormatPAX,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.tag": "x", "comment": "first"}},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "a.txt", ModTime: mtime},
+		{Name: "sym", Typeflag: tar.TypeSymlink, Linkname: "a.txt", ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("a")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := NewTarFS(path, nil)
+	if err != nil {
+		t.Fatalf("NewTarFS: %v", err)
+	}
+	defer fs.Close()
+
+	wantContent(t, fs, "a.txt", "a")
+	wantContent(t, fs, "hard", "a")
+	wantMissing(t, fs, "sym")
+	wantAttribute(t, fs, "a.txt", "user.tag", "x")
+	wantAttribute(t, fs, "a.txt", "comment", "first")
+	info, err := fs.Stat("a.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode.Perm() != 0640 || !info.ModTime.Equal(mtime) {
+		t.Fatalf("Stat = mode %v, time %v, want 0640 and %v", info.Mode, info.ModTime, mtime)
+	}
+	if info.UID != 1000 || info.GID != 100 {
+		t.Fatalf("Stat = owner %d:%d, want 1000:100", info.UID, info.GID)
+	}
+	wantArchiveReadOnly(t, fs)
+}
+
+// wantArchiveReadOnly checks that mutating operations fail with ErrReadOnly
+func wantArchiveReadOnly(t *testing.T, fs *SimpleFS) {
+	t.Helper()
+	for name, err := range map[string]error{
+		"WriteFile":    fs.WriteFile("new.txt", []byte("new")),
+		"DeleteFile":   fs.DeleteFile("a.txt"),
+		"CreateDir":    fs.CreateDir("new"),
+		"SetAttribute": fs.SetAttribute("a.txt", "k", "v"),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%s = %v, want ErrReadOnly", name, err)
+		}
+	}
+	wantContent(t, fs, "a.txt", "a")
+}
+
+// wantStreamedReads reads path sequentially, after seeking back and at an
+// offset, and checks each read against want
+func wantStreamedReads(t *testing.T, fs *SimpleFS, path, want string) {
+	t.Helper()
+	f, err := fs.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != want[:4] {
+		t.Fatalf("Read = %q, %v, want %q", buf, err, want[:4])
+	}
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || string(rest) != want[2:] {
+		t.Fatalf("Read after Seek = %q, %v, want %q", rest, err, want[2:])
+	}
+	n, err := f.ReadAt(buf, int64(len(want)-2))
+	if n != 2 || err != io.EOF || string(buf[:n]) != want[len(want)-2:] {
+		t.Fatalf("ReadAt = %q, %v, want %q and EOF", buf[:n], err, want[len(want)-2:])
+	}
+}
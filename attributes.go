@@ -3,36 +3,31 @@ package fs
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
 )
 
 // SetAttribute sets an extended attribute on a file
 func (fs *SimpleFS) SetAttribute(path, key, value string) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.SetAttribute(rel, key, value)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return err
 	}
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if _, err := fs.fsys.Stat(fullPath); os.IsNotExist(err) {
 		return fmt.Errorf("file does not exist: %s", path)
 	}
 
-	// Create attributes directory if it doesn't exist
-	attrDir := filepath.Join(fs.rootPath, ".attributes")
-	if _, err := os.Stat(attrDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(attrDir, 0755); err != nil {
-			return fmt.Errorf("failed to create attributes directory: %w", err)
-		}
-	}
-
-	// Create a hashed path for the attributes file
-	// Using a hash to avoid issues with special characters in filenames
-	hashedName := utils.HashString(path)
-	hashedPath := filepath.Join(attrDir, hashedName+".json")
+	hashedPath := fs.attributesPath(path)
 
 	attrLock := fs.getFileLock(hashedPath)
 	attrLock.Lock()
@@ -48,36 +43,29 @@ func (fs *SimpleFS) SetAttribute(path, key, value string) error {
 		return err
 	}
 
-	attrs := make(map[string]string)
-	if data, err := os.ReadFile(hashedPath); err == nil {
-		if err := json.Unmarshal(data, &attrs); err != nil {
-			// If file exists but is corrupted, start with empty map
-			attrs = make(map[string]string)
-		}
-	}
-	attrs[key] = value
-
-	// Write back to file
-	data, err := json.MarshalIndent(attrs, "", "  ")
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalSetAttr,
+		Path:      path,
+		Timestamp: getNow(),
+		Attributes: map[string]string{
+			key: value,
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal attributes: %w", err)
+		return fmt.Errorf("failed to log attribute set: %w", err)
 	}
 
-	if fs.journal != nil {
-		if err := fs.journal.Log(JournalEntry{
-			Operation: "setattr",
-			Path:      path,
-			Timestamp: getNow(),
-			Attributes: map[string]string{
-				key: value,
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to log attribute set: %w", err)
-		}
+	attrs, err := fs.readAttributes(hashedPath)
+	if err != nil {
+		// If file exists but is corrupted, start with empty map
+		attrs = make(map[string]string)
 	}
+	attrs[key] = value
 
-	if err := os.WriteFile(hashedPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write attributes file: %w", err)
+	err = fs.writeAttributes(hashedPath, attrs)
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
 	}
 
 	return fs.executeHooks(HookTypePost, ctx)
@@ -85,9 +73,11 @@ func (fs *SimpleFS) SetAttribute(path, key, value string) error {
 
 // GetAttribute gets an extended attribute from a file
 func (fs *SimpleFS) GetAttribute(path, key string) (string, error) {
-	attrDir := filepath.Join(fs.rootPath, ".attributes")
-	hashedName := utils.HashString(path)
-	hashedPath := filepath.Join(attrDir, hashedName+".json")
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.GetAttribute(rel, key)
+	}
+
+	hashedPath := fs.attributesPath(path)
 
 	// Lock the attributes file for reading
 	attrLock := fs.getFileLock(hashedPath)
@@ -103,7 +93,7 @@ func (fs *SimpleFS) GetAttribute(path, key string) (string, error) {
 		return "", err
 	}
 
-	data, err := os.ReadFile(hashedPath)
+	data, err := vfs.ReadFile(fs.fsys, hashedPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read attributes: %w", err)
 	}
@@ -127,11 +117,13 @@ func (fs *SimpleFS) GetAttribute(path, key string) (string, error) {
 
 // GetAllAttributes gets all extended attributes from a file
 func (fs *SimpleFS) GetAllAttributes(path string) (map[string]string, error) {
-	attrDir := filepath.Join(fs.rootPath, ".attributes")
-	hashedName := utils.HashString(path)
-	hashedPath := filepath.Join(attrDir, hashedName+".json")
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.GetAllAttributes(rel)
+	}
+
+	hashedPath := fs.attributesPath(path)
 
-	if _, err := os.Stat(hashedPath); os.IsNotExist(err) {
+	if _, err := fs.fsys.Stat(hashedPath); os.IsNotExist(err) {
 		return make(map[string]string), nil
 	}
 
@@ -147,7 +139,7 @@ func (fs *SimpleFS) GetAllAttributes(path string) (map[string]string, error) {
 		return nil, err
 	}
 
-	data, err := os.ReadFile(hashedPath)
+	data, err := vfs.ReadFile(fs.fsys, hashedPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read attributes: %w", err)
 	}
@@ -166,15 +158,17 @@ func (fs *SimpleFS) GetAllAttributes(path string) (map[string]string, error) {
 
 // DeleteAttribute deletes an extended attribute from a file
 func (fs *SimpleFS) DeleteAttribute(path, key string) error {
-	attrDir := filepath.Join(fs.rootPath, ".attributes")
-	hashedName := utils.HashString(path)
-	hashedPath := filepath.Join(attrDir, hashedName+".json")
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.DeleteAttribute(rel, key)
+	}
+
+	hashedPath := fs.attributesPath(path)
 
 	attrLock := fs.getFileLock(hashedPath)
 	attrLock.Lock()
 	defer attrLock.Unlock()
 
-	if _, err := os.Stat(hashedPath); os.IsNotExist(err) {
+	if _, err := fs.fsys.Stat(hashedPath); os.IsNotExist(err) {
 		return fmt.Errorf("no attributes found for %s", path)
 	}
 
@@ -187,7 +181,7 @@ func (fs *SimpleFS) DeleteAttribute(path, key string) error {
 		return err
 	}
 
-	data, err := os.ReadFile(hashedPath)
+	data, err := vfs.ReadFile(fs.fsys, hashedPath)
 	if err != nil {
 		return fmt.Errorf("failed to read attributes: %w", err)
 	}
@@ -203,41 +197,127 @@ func (fs *SimpleFS) DeleteAttribute(path, key string) error {
 
 	delete(attrs, key)
 
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalDeleteAttr,
+		Path:      path,
+		Timestamp: getNow(),
+		Attributes: map[string]string{
+			key: "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log attribute deletion: %w", err)
+	}
+
 	// If no attributes left, delete the file
 	if len(attrs) == 0 {
-		if err := os.Remove(hashedPath); err != nil {
-			return fmt.Errorf("failed to delete empty attributes file: %w", err)
+		err = fs.fsys.Remove(hashedPath)
+		if err != nil {
+			err = fmt.Errorf("failed to delete empty attributes file: %w", err)
 		}
+	} else {
+		err = fs.writeAttributes(hashedPath, attrs)
+	}
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
+	}
+
+	return fs.executeHooks(HookTypePost, ctx)
+}
 
-		return fs.executeHooks(HookTypePost, ctx)
+// attributesPath returns the file storing the attributes of a path, which
+// belong to the file itself while it has several links
+func (fs *SimpleFS) attributesPath(path string) string {
+	if key, ok := fs.sharedKey(path); ok {
+		return fs.inodeAttributesPath(key)
 	}
+	return fs.pathAttributesPath(path)
+}
 
-	newData, err := json.MarshalIndent(attrs, "", "  ")
+// pathAttributesPath returns the file storing the attributes kept under a
+// path. The path is hashed to avoid issues with special characters in
+// filenames.
+func (fs *SimpleFS) pathAttributesPath(path string) string {
+	return filepath.Join(fs.rootPath, ".attributes", utils.HashString(path)+".json")
+}
+
+// readAttributes reads an attributes file without locking or running hooks.
+// A missing file yields an empty map.
+func (fs *SimpleFS) readAttributes(hashedPath string) (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	data, err := vfs.ReadFile(fs.fsys, hashedPath)
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal attributes: %w", err)
+		return nil, fmt.Errorf("failed to read attributes: %w", err)
 	}
 
-	if fs.journal != nil {
-		if err := fs.journal.Log(JournalEntry{
-			Operation: "deleteattr",
-			Path:      path,
-			Timestamp: getNow(),
-			Attributes: map[string]string{
-				key: "",
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to log attribute deletion: %w", err)
-		}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attributes: %w", err)
 	}
+	return attrs, nil
+}
 
-	if err := os.WriteFile(hashedPath, newData, 0644); err != nil {
-		return fmt.Errorf("failed to write attributes file: %w", err)
+// writeAttributes writes an attributes file without locking or running
+// hooks, creating the attributes directory if needed. It always goes
+// through a temporary file: the journal only records the keys changed, so
+// a torn attributes file could not be rebuilt from it.
+func (fs *SimpleFS) writeAttributes(hashedPath string, attrs map[string]string) error {
+	data, err := json.MarshalIndent(attrs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal attributes: %w", err)
 	}
 
-	return fs.executeHooks(HookTypePost, ctx)
+	err = fs.replaceWith(hashedPath, 0644, true, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write attributes file: %w", err)
+	}
+	return nil
 }
 
 // Helper function to get current time
 var getNow = func() time.Time {
 	return time.Now()
 }
+
+// attributesEntries returns the journal entries that carry the attributes
+// of src over to dst, for operations that copy or move a file
+func (fs *SimpleFS) attributesEntries(src, dst string, ts time.Time) []JournalEntry {
+	hashedPath := fs.attributesPath(src)
+
+	attrLock := fs.getFileLock(hashedPath)
+	attrLock.RLock()
+	defer attrLock.RUnlock()
+
+	attrs, err := fs.readAttributes(hashedPath)
+	if err != nil || len(attrs) == 0 {
+		return nil
+	}
+	return []JournalEntry{{
+		Operation:  JournalSetAttr,
+		Path:       dst,
+		Timestamp:  ts,
+		Attributes: attrs,
+	}}
+}
+
+// applyAttributes applies attribute entries journaled as part of another
+// operation
+func (fs *SimpleFS) applyAttributes(entries []JournalEntry) error {
+	for _, entry := range entries {
+		attrLock := fs.getFileLock(fs.attributesPath(entry.Path))
+		attrLock.Lock()
+		err := applyAttr(fs, "", entry)
+		attrLock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to copy attributes: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// Backend is the storage a SimpleFS keeps its files, attributes, versions
+// and journal on. Every filesystem call SimpleFS makes goes through it.
+//
+// Names are absolute paths in the host syntax, and errors should wrap the
+// os errors (os.ErrNotExist, os.ErrExist, ...) so SimpleFS can tell them
+// apart. Directories are synced by opening them and calling Sync. Symlinks
+// in paths are resolved beneath the root with Lstat and Readlink before
+// the other methods see them. Hard links, owners and access times are
+// recognized by the Sys of a FileInfo, which is either a *syscall.Stat_t
+// as on Unix hosts or a *BackendStat.
+type Backend interface {
+	OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldpath, newpath string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Truncate(name string, size int64) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Link(oldname, newname string) error
+}
+
+// BackendFile is a file opened through a Backend. It is read, written and
+// synced like an *os.File, which implements it.
+type BackendFile = interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// The backends shipped with the package satisfy Backend
+var (
+	_ Backend = OSBackend{}
+	_ Backend = (*MemoryBackend)(nil)
+)
+
+// BackendStat is returned by the Sys method of the FileInfos of backends
+// not stored on the host filesystem, to report the identity, link count,
+// owner and access time of files
+type BackendStat = vfs.Stat
+
+// FileID identifies a file independently of the names linking to it
+type FileID = vfs.FileID
+
+// OSBackend stores files on the host filesystem
+type OSBackend = vfs.OS
+
+// MemoryBackend keeps files in memory, which suits tests that should not
+// touch the disk. Content written to a file only survives Crash once the
+// file has been synced, as on a real disk.
+type MemoryBackend = vfs.Mem
+
+// NewMemoryBackend returns an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return vfs.NewMem()
+}
+
+// backendOrDefault returns b, or the process-wide default backend (the
+// host filesystem) when b is nil
+func backendOrDefault(b Backend) Backend {
+	if b == nil {
+		return vfs.Default
+	}
+	return b
+}
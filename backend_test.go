@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend is a Backend defined outside the package's own backends,
+// built the way a caller would: by wrapping another Backend
+type countingBackend struct {
+	Backend
+	opens atomic.Int64
+}
+
+func (b *countingBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	b.opens.Add(1)
+	return b.Backend.OpenFile(name, flag, perm)
+}
+
+// TestCustomBackend runs the public API on a Backend implemented outside
+// the package and checks that the files it writes are found again when
+// the filesystem is reopened on it
+func TestCustomBackend(t *testing.T) {
+	backend := &countingBackend{Backend: NewMemoryBackend()}
+	opts := DefaultOptions()
+	opts.EnableVersioning = true
+	opts.Backend = backend
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+
+	if err := fs.CreateDir("dir"); err != nil {
+		t.Fatalf("CreateDir: %v", err)
+	}
+	if err := fs.WriteFile("dir/a.txt", []byte("one")); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := fs.WriteFile("dir/a.txt", []byte("two")); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	listing, err := fs.ListVersions("dir/a.txt")
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(listing.Versions) == 0 {
+		t.Fatal("no versions were kept")
+	}
+	if err := fs.MoveFile("dir/a.txt", "b.txt"); err != nil {
+		t.Fatalf("MoveFile: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if backend.opens.Load() == 0 {
+		t.Fatal("the filesystem never opened a file through the backend")
+	}
+
+	fs, err = NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	wantContent(t, fs, "b.txt", "two")
+	wantMissing(t, fs, "dir/a.txt")
+	entries, err := fs.ListDir("dir")
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("dir has %d entries, want none", len(entries))
+	}
+}
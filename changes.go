@@ -0,0 +1,443 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// ErrCursorExpired is returned when the journal records a cursor points
+// into have been compacted away, so changes may have been missed
+var ErrCursorExpired = errors.New("change cursor has expired")
+
+// Cursor is a resumable position in the change feed. The zero Cursor
+// starts at the oldest change still in the journal.
+type Cursor struct {
+	LSN   uint64 // Checkpoint record of the transaction the position is in
+	Index int    // Changes of that transaction already delivered
+	Scan  uint64 // Oldest LSN that must be read to resume, used to skip segments
+}
+
+// String encodes the cursor so it can be stored between runs
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d-%d", c.LSN, c.Index, c.Scan)
+}
+
+// ParseCursor decodes a cursor produced by Cursor.String
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	if _, err := fmt.Sscanf(s, "%d-%d-%d", &c.LSN, &c.Index, &c.Scan); err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor %q: %w", s, err)
+	}
+	return c, nil
+}
+
+// Change is an operation that has been applied to the filesystem
+type Change struct {
+	Path       string            // Path the operation changed
+	Operation  string            // Journal operation (write, delete, mkdir, ...)
+	Timestamp  time.Time         // When the operation was logged
+	TxID       uint64            // Transaction the operation belongs to
+	LSN        uint64            // Log sequence number of the operation
+	Attributes map[string]string // Keys set or removed by attribute operations, new values of chmod, chown and chtimes
+	Cursor     Cursor            // Position right after this change
+}
+
+// ChangesSince calls fn for every change applied after cursor, in the
+// order the changes took effect, and returns the cursor after the last
+// change delivered. It stops at the first error returned by fn.
+//
+// A change is delivered once its transaction has been checkpointed, so
+// operations that were rolled back never appear. Delivery is at least
+// once: a transaction whose checkpoint was lost in a crash is delivered
+// again after recovery redoes it.
+func (fs *SimpleFS) ChangesSince(cursor Cursor, fn func(Change) error) (Cursor, error) {
+	if fs.parent != nil {
+		return fs.parent.ChangesSince(cursor, fs.viewChanges(fn))
+	}
+	if fs.journal == nil {
+		return cursor, errors.New("journaling is not enabled")
+	}
+	return fs.journal.changesSince(cursor, fn)
+}
+
+// Subscribe delivers changes after cursor like ChangesSince, then blocks
+// and delivers new changes as they are logged until ctx is cancelled, fn
+// returns an error or the filesystem is closed, which is reported as
+// ErrJournalClosed.
+func (fs *SimpleFS) Subscribe(ctx context.Context, cursor Cursor, fn func(Change) error) error {
+	if fs.parent != nil {
+		return fs.parent.Subscribe(ctx, cursor, fs.viewChanges(fn))
+	}
+	if fs.journal == nil {
+		return errors.New("journaling is not enabled")
+	}
+
+	var tail *feedTail
+	defer func() { tail.close() }()
+
+	for {
+		// Taken before reading so that records logged meanwhile wake us up
+		changed, gen, open := fs.journal.changes()
+		if !open {
+			return ErrJournalClosed
+		}
+
+		// Only new records of the active file are read, unless it was
+		// sealed or truncated since the last read
+		var err error
+		if tail == nil || tail.gen != gen {
+			tail.close()
+			tail, err = fs.journal.newTail(cursor, gen, fn)
+		} else {
+			err = tail.read(fn)
+		}
+		if err != nil {
+			return err
+		}
+		cursor = tail.state.cursor
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// changes returns a channel that is closed when new records are written,
+// the generation of the active file and whether the journal is still open
+func (j *Journal) changes() (<-chan struct{}, uint64, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.changed, j.activeGen, j.file != nil
+}
+
+// feedTail follows the active journal file for a subscriber, so that each
+// wakeup only reads the records written since the last one
+type feedTail struct {
+	state  *feedState
+	file   vfs.File      // Active journal file, kept open between reads
+	gen    uint64        // Generation of the active file the tail follows
+	format JournalFormat // Record format of the file
+	offset int64         // End of the last complete record read
+}
+
+// newTail delivers the changes after cursor from every journal file and
+// returns a tail following the active file from there. The tail is only
+// valid while the active file is still of generation gen.
+func (j *Journal) newTail(cursor Cursor, gen uint64, fn func(Change) error) (*feedTail, error) {
+	emit := changeFunc(fn)
+	var state *feedState
+	var active *journalScan
+	for {
+		files, err := j.feedFiles()
+		if err != nil {
+			return nil, err
+		}
+		state = newFeedState(cursor)
+		active, err = state.files(j.fsys, files, emit)
+		if err == errStaleListing {
+			cursor = state.cursor
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	tail := &feedTail{state: state, gen: gen}
+	j.mu.Lock()
+	tail.format = j.format
+	j.mu.Unlock()
+	if active != nil {
+		tail.format = active.format
+		tail.offset = active.validSize
+	}
+
+	file, err := vfs.Open(j.fsys, j.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal file: %w", err)
+	}
+	tail.file = file
+	return tail, nil
+}
+
+// read delivers the changes of the records appended since the last read
+func (t *feedTail) read(fn func(Change) error) error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read journal file: %w", err)
+	}
+	if info.Size() <= t.offset {
+		return nil
+	}
+
+	scan, err := scanJournalFrom(t.file, t.format, t.offset, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read journal file: %w", err)
+	}
+	t.offset = scan.validSize
+
+	emit := changeFunc(fn)
+	for _, entry := range scan.entries {
+		if err := t.state.entry(entry, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the file of the tail, if any
+func (t *feedTail) close() {
+	if t != nil && t.file != nil {
+		t.file.Close()
+	}
+}
+
+// changeFunc adapts a change callback to the feed
+func changeFunc(fn func(Change) error) func(JournalEntry, Cursor) error {
+	return func(entry JournalEntry, next Cursor) error {
+		return fn(newChange(entry, next))
+	}
+}
+
+// notify wakes up subscribers waiting for new records. The caller must
+// hold j.mu.
+func (j *Journal) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// journalFile is a journal file together with the first LSN it may hold
+type journalFile struct {
+	path     string
+	firstLSN uint64
+}
+
+// feedFiles returns the archived segments, sealed segments and active
+// file in log order
+func (j *Journal) feedFiles() ([]journalFile, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var segments []journalSegment
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		archived, err := listSegments(j.fsys, filepath.Join(archive, filepath.Base(j.path)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list archived journal segments: %w", err)
+		}
+		segments = archived
+	}
+
+	sealed, err := listSegments(j.fsys, j.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal segments: %w", err)
+	}
+	segments = append(segments, sealed...)
+
+	files := make([]journalFile, 0, len(segments)+1)
+	for _, segment := range segments {
+		files = append(files, journalFile{path: segment.path, firstLSN: segment.firstLSN})
+	}
+	return append(files, journalFile{path: j.path, firstLSN: j.segmentStart}), nil
+}
+
+// feedTx collects the operations of a transaction until it is resolved
+type feedTx struct {
+	begin   uint64
+	entries []JournalEntry
+}
+
+func (j *Journal) changesSince(cursor Cursor, fn func(Change) error) (Cursor, error) {
+	cursor, _, err := feed(j.fsys, j.feedFiles, cursor, changeFunc(fn))
+	return cursor, err
+}
+
+// errStaleListing signals that journal files were sealed or retired while
+// being read, so they have to be listed again
+var errStaleListing = errors.New("journal files changed while being read")
+
+// feed calls fn for every operation applied after cursor, with the cursor
+// right after it, and returns the cursor after the last operation
+// delivered and the LSN of the last record read
+func feed(fsys vfs.FS, list func() ([]journalFile, error), cursor Cursor, fn func(JournalEntry, Cursor) error) (Cursor, uint64, error) {
+	for {
+		files, err := list()
+		if err != nil {
+			return cursor, 0, err
+		}
+
+		var last uint64
+		cursor, last, err = feedFiles(fsys, files, cursor, fn)
+		if err != errStaleListing {
+			return cursor, last, err
+		}
+	}
+}
+
+// feedFiles runs the feed over one listing of the journal files
+func feedFiles(fsys vfs.FS, files []journalFile, cursor Cursor, fn func(JournalEntry, Cursor) error) (Cursor, uint64, error) {
+	state := newFeedState(cursor)
+	_, err := state.files(fsys, files, fn)
+	return state.cursor, state.last, err
+}
+
+// feedState is the position of the feed and the transactions it has seen
+// begin but not yet resolve
+type feedState struct {
+	cursor Cursor             // Position after the last operation delivered
+	txs    map[uint64]*feedTx // Transactions not yet checkpointed or aborted
+	last   uint64             // LSN of the last record read
+}
+
+func newFeedState(cursor Cursor) *feedState {
+	return &feedState{cursor: cursor, txs: make(map[uint64]*feedTx)}
+}
+
+// files feeds the records of one listing of the journal files and returns
+// the scan of the last file read
+func (s *feedState) files(fsys vfs.FS, files []journalFile, fn func(JournalEntry, Cursor) error) (*journalScan, error) {
+	if s.cursor.Scan > 0 && files[0].firstLSN > s.cursor.Scan {
+		return nil, ErrCursorExpired
+	}
+
+	// Skip files that end before the oldest record the cursor still needs.
+	// A first LSN of 0 is unknown, so such a file is never skipped to.
+	start := 0
+	for start+1 < len(files) && files[start+1].firstLSN != 0 && files[start+1].firstLSN <= s.cursor.Scan {
+		start++
+	}
+
+	var scan *journalScan
+	for n, file := range files[start:] {
+		var err error
+		scan, err = scanJournalFile(fsys, file.path)
+		if err != nil {
+			// Segments can be retired by compaction while being read
+			if os.IsNotExist(err) {
+				return nil, errStaleListing
+			}
+			return nil, fmt.Errorf("failed to read journal file %s: %w", file.path, err)
+		}
+
+		if len(scan.entries) > 0 && scan.entries[0].LSN != 0 {
+			first := scan.entries[0].LSN
+			// LSNs are contiguous, so a gap means the active file was
+			// sealed after the files were listed
+			if (file.firstLSN != 0 && first > file.firstLSN) || (s.last != 0 && first > s.last+1) {
+				return nil, errStaleListing
+			}
+			if n == 0 && s.cursor.Scan > 0 && first > s.cursor.Scan {
+				return nil, ErrCursorExpired
+			}
+		}
+
+		for _, entry := range scan.entries {
+			if err := s.entry(entry, fn); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return scan, nil
+}
+
+// entry feeds one record, calling fn for the operations it resolves
+func (s *feedState) entry(entry JournalEntry, fn func(JournalEntry, Cursor) error) error {
+	if entry.LSN != 0 {
+		s.last = entry.LSN
+	}
+
+	var resolved []JournalEntry
+	var at, begin uint64
+
+	switch {
+	case entry.TxID == 0:
+		// Legacy entries take effect on their own
+		if entry.IsControl() {
+			return nil
+		}
+		resolved, at, begin = []JournalEntry{entry}, entry.LSN, entry.LSN
+
+	case entry.Operation == JournalBegin, entry.Operation == JournalCommit:
+		if s.txs[entry.TxID] == nil {
+			s.txs[entry.TxID] = &feedTx{begin: entry.LSN}
+		}
+		return nil
+
+	case entry.Operation == JournalAbort:
+		delete(s.txs, entry.TxID)
+		return nil
+
+	case entry.Operation == JournalCheckpoint:
+		tx := s.txs[entry.TxID]
+		delete(s.txs, entry.TxID)
+		if tx == nil {
+			return nil
+		}
+		resolved, at, begin = tx.entries, entry.LSN, tx.begin
+
+	default:
+		tx := s.txs[entry.TxID]
+		if tx == nil {
+			tx = &feedTx{begin: entry.LSN}
+			s.txs[entry.TxID] = tx
+		}
+		tx.entries = append(tx.entries, entry)
+		return nil
+	}
+
+	if at < s.cursor.LSN {
+		return nil
+	}
+
+	// Resuming after this point requires every transaction still open
+	scanFrom := at + 1
+	for _, tx := range s.txs {
+		if tx.begin < scanFrom {
+			scanFrom = tx.begin
+		}
+	}
+
+	for i, op := range resolved {
+		if at == s.cursor.LSN && i < s.cursor.Index {
+			continue
+		}
+
+		next := Cursor{LSN: at, Index: i + 1, Scan: scanFrom}
+		if i+1 < len(resolved) && begin < scanFrom {
+			// Resuming mid-transaction needs the transaction's own records
+			next.Scan = begin
+		}
+		if err := fn(op, next); err != nil {
+			return err
+		}
+		s.cursor = next
+	}
+	return nil
+}
+
+// newChange converts a journal entry into a change
+func newChange(entry JournalEntry, cursor Cursor) Change {
+	change := Change{
+		Path:      entry.Path,
+		Operation: entry.Operation,
+		Timestamp: entry.Timestamp,
+		TxID:      entry.TxID,
+		LSN:       entry.LSN,
+		Cursor:    cursor,
+	}
+	switch entry.Operation {
+	case JournalSetAttr, JournalDeleteAttr, JournalChmod, JournalChown, JournalChtimes:
+		change.Attributes = entry.Attributes
+	}
+	return change
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSubscribe commits changes while a subscriber is waiting, sealing the
+// journal in between, and checks that each is delivered exactly once and
+// in order, and that a subscriber resuming from a cursor continues right
+// after it
+func TestSubscribe(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	if err := fs.WriteFile("before.txt", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(ctx context.Context, cursor Cursor) (<-chan Change, <-chan error) {
+		changes := make(chan Change, 100)
+		done := make(chan error, 1)
+		go func() {
+			done <- fs.Subscribe(ctx, cursor, func(c Change) error {
+				changes <- c
+				return nil
+			})
+		}()
+		return changes, done
+	}
+	receive := func(changes <-chan Change, want ...string) []Change {
+		t.Helper()
+		var got []Change
+		var paths []string
+		for len(got) < len(want) {
+			select {
+			case c := <-changes:
+				got = append(got, c)
+				paths = append(paths, c.Path)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %v, want %v", paths, want)
+			}
+		}
+		if strings.Join(paths, ",") != strings.Join(want, ",") {
+			t.Fatalf("received %v, want %v", paths, want)
+		}
+		// Nothing is delivered twice
+		select {
+		case c := <-changes:
+			t.Fatalf("unexpected change of %s after %v", c.Path, paths)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return got
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, done := subscribe(ctx, Cursor{})
+	receive(changes, "before.txt")
+
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if err := fs.WriteFile(path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := receive(changes, "a.txt", "b.txt")
+	if err := fs.Journal().Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	for _, path := range []string{"c.txt", "d.txt"} {
+		if err := fs.WriteFile(path, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(changes, "c.txt", "d.txt")
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Subscribe = %v, want context.Canceled", err)
+	}
+
+	// Resuming after b.txt, from a cursor that went through a string
+	cursor, err := ParseCursor(got[1].Cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	changes, _ = subscribe(ctx, cursor)
+	receive(changes, "c.txt", "d.txt")
+	if err := fs.WriteFile("e.txt", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	receive(changes, "e.txt")
+}
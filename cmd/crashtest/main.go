@@ -0,0 +1,87 @@
+// Command crashtest runs random operation sequences against SimpleFS,
+// crashes it at every filesystem call and checks that recovery restores a
+// consistent state.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	fs "github.com/unkn0wn-root/simplefs"
+	"github.com/unkn0wn-root/simplefs/internal/crashtest"
+)
+
+var (
+	seed          = flag.Int64("seed", time.Now().UnixNano(), "Seed for the random operation sequences")
+	sequences     = flag.Int("sequences", 10, "Number of operation sequences to run")
+	ops           = flag.Int("ops", 20, "Operations per sequence")
+	fail          = flag.Bool("fail", false, "Inject a persistent I/O failure instead of a crash")
+	tornWrites    = flag.Bool("torn-writes", false, "Persist half of the write interrupted by the crash")
+	dropSyncs     = flag.Bool("drop-syncs", false, "Make syncs no-ops and only check that recovery runs")
+	journalFormat = flag.String("journal-format", "binary", "Journal record format (json or binary)")
+	segmentSize   = flag.Int64("segment-size", 512, "Journal segment size in bytes")
+	spill         = flag.Int64("spill", 64, "Journal spill threshold in bytes")
+	atomicWrites  = flag.Bool("atomic-writes", true, "Write files through a synced temporary file")
+	versioning    = flag.Bool("versioning", false, "Enable file versioning")
+	maxFailures   = flag.Int("max-failures", 5, "Number of failures to print")
+	verbose       = flag.Bool("verbose", false, "Enable verbose output")
+)
+
+func main() {
+	flag.Parse()
+
+	opts := &fs.Options{
+		JournalSegmentSize:    *segmentSize,
+		JournalSpillThreshold: *spill,
+		AtomicWrites:          *atomicWrites,
+		EnableVersioning:      *versioning,
+		MaxVersions:           3,
+	}
+	switch *journalFormat {
+	case "json":
+		opts.JournalFormat = fs.JournalFormatJSON
+	case "binary":
+		opts.JournalFormat = fs.JournalFormatBinary
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown journal format: %s\n", *journalFormat)
+		os.Exit(1)
+	}
+
+	cfg := crashtest.Config{
+		Seed:       *seed,
+		Sequences:  *sequences,
+		Ops:        *ops,
+		Fail:       *fail,
+		TornWrites: *tornWrites,
+		DropSyncs:  *dropSyncs,
+		Options:    opts,
+	}
+	if *verbose {
+		cfg.Verbose = func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		}
+	}
+
+	fmt.Printf("Seed: %d\n", *seed)
+	result, err := crashtest.Run(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running crash test: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Sequences: %d, fault points: %d, failures: %d\n",
+		result.Sequences, result.FaultPoints, len(result.Failures))
+	for i, failure := range result.Failures {
+		if i == *maxFailures {
+			fmt.Printf("... %d more\n", len(result.Failures)-i)
+			break
+		}
+		fmt.Print(failure)
+	}
+
+	if len(result.Failures) > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	fs "github.com/unkn0wn-root/simplefs"
@@ -16,6 +21,7 @@ var (
 	enableVersioning = flag.Bool("versioning", false, "Enable file versioning")
 	enableJournaling = flag.Bool("journaling", true, "Enable journaling for crash recovery")
 	maxVersions      = flag.Int("max-versions", 10, "Maximum number of versions to keep per file")
+	journalFormat    = flag.String("journal-format", "json", "Record format of a new journal (json or binary)")
 	verbose          = flag.Bool("verbose", false, "Enable verbose output")
 )
 
@@ -34,6 +40,16 @@ func main() {
 	opts.EnableJournaling = *enableJournaling
 	opts.MaxVersions = *maxVersions
 
+	switch *journalFormat {
+	case "json":
+		opts.JournalFormat = fs.JournalFormatJSON
+	case "binary":
+		opts.JournalFormat = fs.JournalFormatBinary
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown journal format: %s\n", *journalFormat)
+		os.Exit(1)
+	}
+
 	fileSystem, err := fs.NewSimpleFS(*rootPath, opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating filesystem: %v\n", err)
@@ -59,6 +75,18 @@ func main() {
 		handleCopy(fileSystem, cmdArgs)
 	case "mv", "move":
 		handleMove(fileSystem, cmdArgs)
+	case "ln":
+		handleSymlink(fileSystem, cmdArgs)
+	case "link":
+		handleLink(fileSystem, cmdArgs)
+	case "readlink":
+		handleReadLink(fileSystem, cmdArgs)
+	case "chmod":
+		handleChmod(fileSystem, cmdArgs)
+	case "chown":
+		handleChown(fileSystem, cmdArgs)
+	case "chtimes":
+		handleChtimes(fileSystem, cmdArgs)
 	case "attr", "attributes":
 		handleAttributes(fileSystem, cmdArgs)
 	case "version", "versions":
@@ -69,6 +97,8 @@ func main() {
 		handleBackup(fileSystem, cmdArgs)
 	case "recover":
 		handleRecover(fileSystem, cmdArgs)
+	case "journal":
+		handleJournal(fileSystem, cmdArgs)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
 		printUsage()
@@ -89,11 +119,18 @@ func printUsage() {
 	fmt.Println("  rm, delete <path>                 Delete file or directory")
 	fmt.Println("  cp, copy <src> <dst>              Copy file")
 	fmt.Println("  mv, move <src> <dst>              Move file")
+	fmt.Println("  ln <target> <link>                Create a symlink")
+	fmt.Println("  readlink <path>                   Show the target of a symlink")
+	fmt.Println("  link <src> <dst>                  Create a hard link")
+	fmt.Println("  chmod <path> <mode>               Change the mode (octal)")
+	fmt.Println("  chown <path> <uid> <gid>          Change the owner (-1 = unchanged)")
+	fmt.Println("  chtimes <path> <atime> <mtime>    Change the times (RFC 3339)")
 	fmt.Println("  attr, attributes <command> [args] Manage file attributes")
 	fmt.Println("  version, versions <command> [args] Manage file versions")
 	fmt.Println("  stat <path>                       Show file information")
 	fmt.Println("  backup <path> <dst>               Backup a file or directory")
-	fmt.Println("  recover                           Attempt to recover from crash")
+	fmt.Println("  recover [-dry-run] [-json]        Attempt to recover from crash")
+	fmt.Println("  journal <command> [args]          Inspect and maintain the journal")
 
 	fmt.Println("\nAttribute commands:")
 	fmt.Println("  set <path> <key> <value>          Set attribute")
@@ -107,6 +144,14 @@ func printUsage() {
 	fmt.Println("  restore <path> <version-id>       Restore to a specific version")
 	fmt.Println("  describe <path> <version-id> <text> Set version description")
 	fmt.Println("  delete <path> <version-id>        Delete a specific version")
+
+	fmt.Println("\nJournal commands:")
+	fmt.Println("  list [-path p] [-op ops] [-since t] [-until t] [-json]  List journal entries")
+	fmt.Println("  show [-data] <lsn>                Show a journal entry")
+	fmt.Println("  stats                             Show journal statistics")
+	fmt.Println("  rotate                            Seal the active journal segment")
+	fmt.Println("  truncate                          Discard the whole journal")
+	fmt.Println("  verify                            Check records, LSNs and blobs")
 }
 
 func handleList(fileSystem *fs.SimpleFS, args []string) {
@@ -272,6 +317,128 @@ func handleMove(fileSystem *fs.SimpleFS, args []string) {
 	fmt.Printf("Moved %s to %s\n", src, dst)
 }
 
+func handleSymlink(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Error: Missing target or link path\n")
+		os.Exit(1)
+	}
+
+	target, link := args[0], args[1]
+
+	err := fileSystem.CreateSymlink(target, link)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating symlink: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Linked %s to %s\n", link, target)
+}
+
+func handleLink(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Error: Missing source or destination path\n")
+		os.Exit(1)
+	}
+
+	src, dst := args[0], args[1]
+
+	err := fileSystem.Link(src, dst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating link: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Linked %s to %s\n", dst, src)
+}
+
+func handleReadLink(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Error: Missing path\n")
+		os.Exit(1)
+	}
+
+	target, err := fileSystem.ReadLink(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading symlink: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(target)
+}
+
+func handleChmod(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Error: Missing path or mode\n")
+		os.Exit(1)
+	}
+
+	mode, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid mode: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fileSystem.Chmod(args[0], os.FileMode(mode))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error changing mode: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Changed mode of %s to %s\n", args[0], os.FileMode(mode).Perm())
+}
+
+func handleChown(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "Error: Missing path, uid or gid\n")
+		os.Exit(1)
+	}
+
+	uid, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid uid: %v\n", err)
+		os.Exit(1)
+	}
+	gid, err := strconv.Atoi(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid gid: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fileSystem.Chown(args[0], uid, gid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error changing owner: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Changed owner of %s to %d:%d\n", args[0], uid, gid)
+}
+
+func handleChtimes(fileSystem *fs.SimpleFS, args []string) {
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "Error: Missing path, access time or modification time\n")
+		os.Exit(1)
+	}
+
+	atime, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid access time: %v\n", err)
+		os.Exit(1)
+	}
+	mtime, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid modification time: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fileSystem.Chtimes(args[0], atime, mtime)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error changing times: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Changed times of %s\n", args[0])
+}
+
 func handleAttributes(fileSystem *fs.SimpleFS, args []string) {
 	if len(args) < 1 {
 		fmt.Fprintf(os.Stderr, "Error: Missing attribute command\n")
@@ -502,6 +669,16 @@ func handleStat(fileSystem *fs.SimpleFS, args []string) {
 		if err == nil {
 			fmt.Printf("Mode:      %s\n", fileInfo.Mode.String())
 			fmt.Printf("Modified:  %s\n", fileInfo.ModTime.Format(time.RFC3339))
+			if !fileInfo.AccessTime.IsZero() {
+				fmt.Printf("Accessed:  %s\n", fileInfo.AccessTime.Format(time.RFC3339))
+			}
+			if fileInfo.UID >= 0 {
+				fmt.Printf("Owner:     %d:%d\n", fileInfo.UID, fileInfo.GID)
+			}
+			if fileInfo.Links > 0 {
+				fmt.Printf("Links:     %d\n", fileInfo.Links)
+				fmt.Printf("Inode:     %d\n", fileInfo.Inode)
+			}
 
 			if len(fileInfo.Attributes) > 0 {
 				fmt.Println("Attributes:")
@@ -590,12 +767,315 @@ func handleRecover(fileSystem *fs.SimpleFS, args []string) {
 		os.Exit(1)
 	}
 
-	fmt.Println("Attempting to recover from journal...")
-	err := fileSystem.Recover()
+	recoverFlags := flag.NewFlagSet("recover", flag.ExitOnError)
+	dryRun := recoverFlags.Bool("dry-run", false, "Report what would be recovered without changing anything")
+	asJSON := recoverFlags.Bool("json", false, "Print the recovery report as JSON")
+	recoverFlags.Parse(args)
+
+	var report *fs.RecoveryReport
+	var err error
+	if *dryRun {
+		report, err = fileSystem.RecoverDryRun()
+	} else {
+		report, err = fileSystem.Recover()
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error during recovery: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println("Recovery completed successfully")
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding report: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	printRecoveryReport(report)
+}
+
+func printRecoveryReport(report *fs.RecoveryReport) {
+	if report.DryRun {
+		fmt.Println("Recovery dry run (nothing was changed)")
+	}
+
+	fmt.Printf("Entries read:     %d\n", report.EntriesRead)
+	fmt.Printf("Corrupted:        %d\n", len(report.Corrupted))
+	fmt.Printf("Rolled back:      %d transactions\n", len(report.RolledBack))
+	fmt.Printf("Applied:          %d\n", report.Applied)
+	fmt.Printf("Skipped:          %d\n", report.Skipped)
+	fmt.Printf("Failed:           %d\n", report.Failed)
+	fmt.Printf("Temp files:       %d removed\n", report.TempsRemoved)
+	fmt.Printf("Duration:         %s\n", report.Duration)
+
+	for _, corrupted := range report.Corrupted {
+		fmt.Printf("Corrupted entry in %s at offset %d: %s\n", filepath.Base(corrupted.File), corrupted.Offset, corrupted.Error)
+	}
+
+	if len(report.Operations) == 0 {
+		return
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LSN\tTX\tOPERATION\tPATH\tSTATUS\tERROR")
+	for _, op := range report.Operations {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n",
+			op.LSN, op.TxID, op.Operation, op.Path, op.Status, op.Error)
+	}
+	w.Flush()
+}
+
+func handleJournal(fileSystem *fs.SimpleFS, args []string) {
+	journal := fileSystem.Journal()
+	if journal == nil {
+		fmt.Fprintf(os.Stderr, "Error: Journaling is not enabled\n")
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Error: Missing journal command\n")
+		os.Exit(1)
+	}
+
+	cmd := args[0]
+	cmdArgs := args[1:]
+
+	switch cmd {
+	case "list", "ls":
+		handleJournalList(journal, cmdArgs)
+
+	case "show":
+		handleJournalShow(journal, cmdArgs)
+
+	case "stats":
+		stats, err := journal.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading journal: %v\n", err)
+			os.Exit(1)
+		}
+		printJournalStats(stats)
+
+	case "rotate":
+		if err := journal.Rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating journal: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Journal rotated")
+
+	case "truncate":
+		if err := journal.Truncate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error truncating journal: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Journal truncated")
+
+	case "verify":
+		problems, err := journal.Verify()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying journal: %v\n", err)
+			os.Exit(1)
+		}
+		if len(problems) == 0 {
+			fmt.Println("Journal is consistent")
+			return
+		}
+
+		for _, problem := range problems {
+			location := filepath.Base(problem.File)
+			if problem.LSN != 0 {
+				location += fmt.Sprintf(" LSN %d", problem.LSN)
+			} else {
+				location += fmt.Sprintf(" offset %d", problem.Offset)
+			}
+			fmt.Printf("%s: %s\n", location, problem.Problem)
+		}
+		fmt.Fprintf(os.Stderr, "Found %d problems\n", len(problems))
+		os.Exit(1)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown journal command: %s\n", cmd)
+		os.Exit(1)
+	}
+}
+
+func handleJournalList(journal *fs.Journal, args []string) {
+	listFlags := flag.NewFlagSet("journal list", flag.ExitOnError)
+	path := listFlags.String("path", "", "Only entries at or below this path")
+	ops := listFlags.String("op", "", "Comma-separated operations to include")
+	since := listFlags.String("since", "", "Only entries at or after this time (RFC 3339)")
+	until := listFlags.String("until", "", "Only entries before this time (RFC 3339)")
+	asJSON := listFlags.Bool("json", false, "Print entries as JSON lines")
+	listFlags.Parse(args)
+
+	filter := fs.JournalFilter{PathPrefix: *path}
+	if *ops != "" {
+		filter.Operations = strings.Split(*ops, ",")
+	}
+	filter.Since = parseTimeFlag("since", *since)
+	filter.Until = parseTimeFlag("until", *until)
+
+	reader, err := journal.NewReader(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading journal: %v\n", err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintln(w, "LSN\tTX\tTIME\tOPERATION\tPATH\tSIZE")
+	}
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading journal: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *asJSON {
+			if err := encoder.Encode(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding entry: %v\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+
+		size := fmt.Sprintf("%d", len(entry.Data))
+		if entry.Blob() != "" {
+			size = "blob"
+		} else if entry.IsControl() {
+			size = "-"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n",
+			entry.LSN, entry.TxID, entry.Timestamp.Format(time.RFC3339), entry.Operation, entry.Path, size)
+	}
+	w.Flush()
+
+	for _, corrupted := range reader.Corrupted() {
+		fmt.Fprintf(os.Stderr, "Corrupted entry in %s at offset %d: %s\n",
+			filepath.Base(corrupted.File), corrupted.Offset, corrupted.Error)
+	}
+}
+
+func handleJournalShow(journal *fs.Journal, args []string) {
+	showFlags := flag.NewFlagSet("journal show", flag.ExitOnError)
+	showData := showFlags.Bool("data", false, "Write the entry's payload to stdout")
+	showFlags.Parse(args)
+
+	if showFlags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Error: show requires <lsn>\n")
+		os.Exit(1)
+	}
+	lsn, err := strconv.ParseUint(showFlags.Arg(0), 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid LSN: %s\n", showFlags.Arg(0))
+		os.Exit(1)
+	}
+
+	reader, err := journal.NewReader(fs.JournalFilter{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading journal: %v\n", err)
+		os.Exit(1)
+	}
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			fmt.Fprintf(os.Stderr, "Error: no journal entry with LSN %d\n", lsn)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading journal: %v\n", err)
+			os.Exit(1)
+		}
+		if entry.LSN != lsn {
+			continue
+		}
+
+		data := entry.Data
+		if hash := entry.Blob(); hash != "" {
+			if data, err = journal.ReadBlob(hash); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading payload: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if *showData {
+			os.Stdout.Write(data)
+			return
+		}
+
+		fmt.Printf("LSN:         %d\n", entry.LSN)
+		fmt.Printf("Transaction: %d\n", entry.TxID)
+		fmt.Printf("Operation:   %s\n", entry.Operation)
+		fmt.Printf("Path:        %s\n", entry.Path)
+		fmt.Printf("Time:        %s\n", entry.Timestamp.Format(time.RFC3339Nano))
+		if !entry.IsControl() {
+			fmt.Printf("Data:        %d bytes\n", len(data))
+		}
+		if len(entry.Attributes) > 0 {
+			fmt.Println("Attributes:")
+			keys := make([]string, 0, len(entry.Attributes))
+			for k := range entry.Attributes {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("  %s: %s\n", k, entry.Attributes[k])
+			}
+		}
+		return
+	}
+}
+
+func printJournalStats(stats *fs.JournalStats) {
+	fmt.Printf("Format:           %s\n", stats.Format)
+	fmt.Printf("Files:            %d (%d bytes)\n", stats.Files, stats.Size)
+	fmt.Printf("Archived:         %d segments\n", stats.Archived)
+	fmt.Printf("Blobs:            %d (%d bytes)\n", stats.Blobs, stats.BlobSize)
+	fmt.Printf("Entries:          %d\n", stats.Entries)
+	fmt.Printf("Corrupted:        %d\n", stats.Corrupted)
+	fmt.Printf("Transactions:     %d (%d committed, %d aborted, %d pending)\n",
+		stats.Transactions, stats.Committed, stats.Aborted, stats.Pending)
+	if stats.Entries > 0 {
+		fmt.Printf("LSN range:        %d - %d\n", stats.FirstLSN, stats.LastLSN)
+		fmt.Printf("Time range:       %s - %s\n",
+			stats.FirstTime.Format(time.RFC3339), stats.LastTime.Format(time.RFC3339))
+	}
+
+	if len(stats.Operations) == 0 {
+		return
+	}
+
+	fmt.Println("\nOperations:")
+	ops := make([]string, 0, len(stats.Operations))
+	for op := range stats.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Printf("  %-12s %d\n", op, stats.Operations[op])
+	}
+}
+
+// parseTimeFlag parses an optional RFC 3339 time flag
+func parseTimeFlag(name, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -%s time: %v\n", name, err)
+		os.Exit(1)
+	}
+	return t
 }
@@ -0,0 +1,401 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// File is an open handle to a file within a SimpleFS.
+//
+// The per-path lock is held for the whole lifetime of the handle: a shared
+// lock for read-only handles and an exclusive lock for writable ones. Other
+// operations on the same path block until the handle is closed, so a handle
+// must not be used together with ReadFile/WriteFile on the same path from
+// the same goroutine.
+//
+// Writes through a handle go to the file in place, even with AtomicWrites,
+// and are only journaled when the handle is closed. Until then a crash can
+// leave the file half written, and recovery has no record to repair it
+// from; the content it had before the handle was opened is kept as a
+// version if versioning is enabled.
+type File struct {
+	fs       *SimpleFS
+	path     string        // Relative path within the filesystem
+	name     string        // Path the file was opened with, outside of mounts and views
+	file     vfs.File      // Underlying file handle
+	lock     *sync.RWMutex // Per-path lock held until Close
+	flag     int           // Flags the file was opened with
+	mode     os.FileMode   // Mode the file was opened with
+	writable bool          // Whether the handle allows writing
+	dirty    bool          // Whether the handle has written any data
+	mu       sync.Mutex    // Guards closed and dirty
+	closed   bool          // Whether Close has been called
+}
+
+// ErrFileClosed is returned when operating on a closed File
+var ErrFileClosed = errors.New("file already closed")
+
+// Open opens a file for reading
+func (fs *SimpleFS) Open(path string) (*File, error) {
+	return fs.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a file and opens it for reading and writing
+func (fs *SimpleFS) Create(path string) (*File, error) {
+	return fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// OpenFile opens a file with the given flags and permissions
+func (fs *SimpleFS) OpenFile(path string, flag int, perm os.FileMode) (*File, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		f, err := target.OpenFile(rel, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		f.name = path
+		return f, nil
+	}
+
+	fullPath, err := fs.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writable := isWriteFlag(flag)
+
+	fileLock := fs.getFileLock(fullPath)
+	if writable {
+		fileLock.Lock()
+	} else {
+		fileLock.RLock()
+	}
+
+	f, err := fs.openFileLocked(path, fullPath, flag, perm, writable)
+	if err != nil {
+		if writable {
+			fileLock.Unlock()
+		} else {
+			fileLock.RUnlock()
+		}
+		return nil, err
+	}
+	f.lock = fileLock
+
+	return f, nil
+}
+
+// openFileLocked runs the open hooks and opens the file; the caller holds the path lock
+func (fs *SimpleFS) openFileLocked(path, fullPath string, flag int, perm os.FileMode, writable bool) (*File, error) {
+	ctx := &HookContext{
+		Operation: OpOpenFile,
+		Path:      path,
+		Mode:      perm,
+		Flag:      flag,
+	}
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return nil, err
+	}
+
+	exists := fs.FileExists(path)
+
+	// Version the current content before the handle can modify it
+	if writable && fs.versioning && exists {
+		if err := fs.createVersion(path); err != nil {
+			return nil, fmt.Errorf("failed to create version: %w", err)
+		}
+	}
+
+	var handle vfs.File
+	var err error
+	if writable && flag&os.O_CREATE != 0 && !exists {
+		handle, err = fs.createFile(path, fullPath, flag, perm)
+	} else {
+		handle, err = fs.fsys.OpenFile(fullPath, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.executeHooks(HookTypePost, ctx); err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return &File{
+		fs:       fs,
+		path:     path,
+		name:     path,
+		file:     handle,
+		flag:     flag,
+		mode:     perm,
+		writable: writable,
+		// Truncating a file is a modification even if nothing is written.
+		// Creating one is journaled by createFile.
+		dirty: writable && flag&os.O_TRUNC != 0 && exists,
+	}, nil
+}
+
+// createFile creates the file at fullPath and its missing parent
+// directories, journaled as one transaction so that recovery and followers
+// see the file even if the handle is never closed
+func (fs *SimpleFS) createFile(path, fullPath string, flag int, perm os.FileMode) (vfs.File, error) {
+	now := time.Now()
+	var entries []JournalEntry
+	if _, err := fs.fsys.Stat(filepath.Dir(fullPath)); os.IsNotExist(err) {
+		entries = append(entries, JournalEntry{
+			Operation: JournalMkdir,
+			Path:      filepath.Dir(path),
+			Timestamp: now,
+		})
+	}
+	entries = append(entries, JournalEntry{
+		Operation: JournalWrite,
+		Path:      path,
+		Timestamp: now,
+		Attributes: map[string]string{
+			"mode": fmt.Sprintf("%d", perm.Perm()),
+		},
+	})
+
+	txID, err := fs.logTx(entries...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log file creation: %w", err)
+	}
+
+	var handle vfs.File
+	err = fs.fsys.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err == nil {
+		handle, err = fs.fsys.OpenFile(fullPath, flag, perm)
+	}
+	fs.finishTx(txID, err)
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// isWriteFlag reports whether the open flags allow modifying the file
+func isWriteFlag(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+}
+
+// Name returns the path the file was opened with
+func (f *File) Name() string {
+	return f.name
+}
+
+// Read reads up to len(p) bytes from the file
+func (f *File) Read(p []byte) (int, error) {
+	if err := f.checkOpen(); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+// ReadAt reads len(p) bytes from the file starting at byte offset off
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.checkOpen(); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+// Write writes len(p) bytes to the file
+func (f *File) Write(p []byte) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(p)
+	f.markDirty(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the file starting at byte offset off
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.WriteAt(p, off)
+	f.markDirty(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.checkOpen(); err != nil {
+		return 0, err
+	}
+	return f.file.Seek(offset, whence)
+}
+
+// Sync commits the file's contents to stable storage
+func (f *File) Sync() error {
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Stat returns file info for the open file
+func (f *File) Stat() (*FileInfo, error) {
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, _ := f.fs.GetAllAttributes(f.path)
+
+	return newFileInfo(info, attrs), nil
+}
+
+// Close closes the file, journals its final content if it was modified
+// and releases the path lock. A pre-hook error is returned after the
+// content has been journaled.
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrFileClosed
+	}
+	f.closed = true
+	dirty := f.dirty
+	f.mu.Unlock()
+
+	defer func() {
+		if f.writable {
+			f.lock.Unlock()
+		} else {
+			f.lock.RUnlock()
+		}
+	}()
+
+	ctx := &HookContext{
+		Operation: OpCloseFile,
+		Path:      f.path,
+		Mode:      f.mode,
+		Flag:      f.flag,
+	}
+	// The writes are already in the file, so a pre-hook rejecting the close
+	// can't undo them: they are still synced and journaled, and only the
+	// post-hooks are skipped
+	hookErr := f.fs.executeHooks(HookTypePre, ctx)
+
+	if dirty {
+		if err := f.file.Sync(); err != nil {
+			f.file.Close()
+			return err
+		}
+	}
+
+	if dirty && f.fs.journal != nil {
+		if err := f.logWrite(); err != nil {
+			f.file.Close()
+			return err
+		}
+	}
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if hookErr != nil {
+		return hookErr
+	}
+
+	return f.fs.executeHooks(HookTypePost, ctx)
+}
+
+// logWrite journals the current content of the file as a write. The
+// content is streamed into a blob, so files of any size are journaled
+// without buffering them.
+func (f *File) logWrite() error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file for journaling: %w", err)
+	}
+
+	hash, err := f.storeContent()
+	if err != nil {
+		return err
+	}
+
+	entry := JournalEntry{
+		Operation: JournalWrite,
+		Path:      f.path,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			// The mode the handle was opened with is 0 for existing files
+			"mode":        fmt.Sprintf("%d", info.Mode().Perm()),
+			blobAttribute: hash,
+		},
+	}
+
+	// The data is already on disk, so the transaction is applied as soon as it commits
+	txID, err := f.fs.logTx(entry)
+	if err != nil {
+		f.fs.journal.releaseBlob(hash)
+		return fmt.Errorf("failed to log file write: %w", err)
+	}
+	f.fs.finishTx(txID, nil)
+
+	return nil
+}
+
+// storeContent streams the content of the file into a journal blob
+func (f *File) storeContent() (string, error) {
+	fullPath, err := f.fs.fullPath(f.path)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := vfs.Open(f.fs.fsys, fullPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file for journaling: %w", err)
+	}
+	defer src.Close()
+
+	hash, err := f.fs.journal.storeBlob(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to store file content in journal: %w", err)
+	}
+	return hash, nil
+}
+
+func (f *File) checkOpen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrFileClosed
+	}
+	return nil
+}
+
+func (f *File) checkWritable() error {
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	if !f.writable {
+		return errors.New("file is not open for writing")
+	}
+	return nil
+}
+
+func (f *File) markDirty(n int) {
+	if n == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	f.dirty = true
+	f.mu.Unlock()
+}
@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// changes returns the journaled changes as "operation path", in order
+func changes(t *testing.T, fs *SimpleFS) []string {
+	t.Helper()
+	var changes []string
+	if _, err := fs.ChangesSince(Cursor{}, func(c Change) error {
+		changes = append(changes, c.Operation+" "+c.Path)
+		return nil
+	}); err != nil {
+		t.Fatalf("ChangesSince: %v", err)
+	}
+	return changes
+}
+
+func TestOpenFileJournalsCreate(t *testing.T) {
+	fs, err := NewSimpleFS(t.TempDir(), DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	defer fs.Close()
+
+	f, err := fs.OpenFile("new.txt", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := changes(t, fs); len(got) != 1 || got[0] != "write new.txt" {
+		t.Fatalf("changes = %v, want the create of new.txt", got)
+	}
+
+	// Opening the file again creates nothing
+	f, err = fs.OpenFile("new.txt", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := changes(t, fs); len(got) != 1 {
+		t.Fatalf("changes = %v, want only the create", got)
+	}
+}
+
+// TestOpenFileCreatesParents checks that creating a file in a missing
+// directory journals the directory with the file, and that a rejected
+// open leaves nothing behind
+func TestOpenFileCreatesParents(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	fs.RegisterHook(OpOpenFile, HookTypePre, ReadOnlyHook())
+	if _, err := fs.OpenFile("x/y.txt", os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		t.Fatal("OpenFile succeeded despite ReadOnlyHook")
+	}
+	if fs.PathExists("x") {
+		t.Fatal("rejected OpenFile created the parent directory")
+	}
+
+	fs = openTestFS(t, t.TempDir())
+	f, err := fs.OpenFile("x/y.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	// Journaled before the handle is closed
+	if got := changes(t, fs); len(got) != 2 || got[0] != "mkdir x" || got[1] != "write x/y.txt" {
+		t.Fatalf("changes = %v, want the mkdir of x and the create of x/y.txt", got)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// TestCloseJournalsDespiteHook checks that content written through a file
+// is journaled even when a pre-hook rejects closing it
+func TestCloseJournalsDespiteHook(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	f, err := fs.OpenFile("a.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("written")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	rejected := errors.New("rejected")
+	fs.RegisterHook(OpCloseFile, HookTypePre, func(ctx *HookContext) error { return rejected })
+	if err := f.Close(); !errors.Is(err, rejected) {
+		t.Fatalf("Close = %v, want the hook error", err)
+	}
+	if got := changes(t, fs); len(got) != 2 || got[1] != "write a.txt" {
+		t.Fatalf("changes = %v, want the create and the write of a.txt", got)
+	}
+}
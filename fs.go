@@ -6,8 +6,13 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
 )
 
 // FileInfo represents metadata about a file
@@ -18,35 +23,87 @@ type FileInfo struct {
 	IsDir      bool              // Is this a directory?
 	Mode       os.FileMode       // File mode bits
 	Attributes map[string]string // Extended attributes
+	Links      uint64            // Number of hard links, 0 if the backend does not track them
+	Device     uint64            // Device the file is on
+	Inode      uint64            // Inode number; together with Device it identifies the file
+	UID        int               // User owning the file, -1 if the backend does not track owners
+	GID        int               // Group owning the file, -1 if the backend does not track owners
+	AccessTime time.Time         // Last access, zero if the backend does not track it
+}
+
+// newFileInfo returns the FileInfo for a backend's file information
+func newFileInfo(info os.FileInfo, attrs map[string]string) *FileInfo {
+	fi := &FileInfo{
+		Name:       info.Name(),
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		IsDir:      info.IsDir(),
+		Mode:       info.Mode(),
+		Attributes: attrs,
+		UID:        -1,
+		GID:        -1,
+	}
+	if id, links, ok := vfs.Identity(info); ok {
+		fi.Links, fi.Device, fi.Inode = links, id.Dev, id.Ino
+	}
+	if uid, gid, ok := vfs.Owner(info); ok {
+		fi.UID, fi.GID = uid, gid
+	}
+	fi.AccessTime, _ = vfs.AccessTime(info)
+	return fi
 }
 
 // SimpleFS represents our file system
 type SimpleFS struct {
-	rootPath    string                   // Root directory of the file system
-	journal     *Journal                 // Journal for crash recovery
-	locks       map[string]*sync.RWMutex // File-level locks for concurrency control
-	locksGuard  sync.Mutex               // Guard for the locks map
-	hooks       map[HookKey][]HookFunc   // Registered hooks
-	hooksGuard  sync.RWMutex             // Guard for the hooks map
-	versioning  bool                     // Whether versioning is enabled
-	versionPath string                   // Path to store versions
-	maxVersions int                      // Maximum number of versions to keep
-	lockManager *ExplicitLockManager
+	rootPath      string                   // Root directory of the file system
+	fsys          vfs.FS                   // Filesystem the root directory lives on
+	journal       *Journal                 // Journal for crash recovery
+	sharedJournal bool                     // Whether the journal belongs to another SimpleFS, as for an overlay
+	locks         map[string]*sync.RWMutex // File-level locks for concurrency control
+	locksGuard    sync.Mutex               // Guard for the locks map
+	hooks         map[HookKey][]HookFunc   // Registered hooks
+	hooksGuard    sync.RWMutex             // Guard for the hooks map
+	versioning    bool                     // Whether versioning is enabled
+	versionPath   string                   // Path to store versions
+	maxVersions   int                      // Maximum number of versions to keep
+	atomicWrites  bool                     // Whether files are replaced through a temporary file
+	readOnly      bool                     // Whether mutating operations are rejected, as for archives
+	release       io.Closer                // Storage the filesystem owns and closes with it, if any
+	lockManager   *ExplicitLockManager
+	follower      *Follower         // Replication follower while the filesystem follows a leader
+	followGuard   sync.Mutex        // Guard for follower
+	mounts        map[string]*mount // Filesystems mounted below relative paths
+	mountsGuard   sync.RWMutex      // Guard for mounts
+	parent        *SimpleFS         // Filesystem serving every path of a Sub view
+	prefix        string            // Root of a Sub view in its parent
 }
 
 // Options configures the file system
 type Options struct {
-	EnableJournaling bool // Whether to enable journaling
-	EnableVersioning bool // Whether to enable versioning
-	MaxVersions      int  // Maximum number of versions to keep (0 = unlimited)
+	EnableJournaling          bool             // Whether to enable journaling
+	JournalFormat             JournalFormat    // Record format of a new journal file
+	JournalSegmentSize        int64            // Size at which the journal starts a new segment (0 = never)
+	JournalCheckpointInterval time.Duration    // How often old journal segments are compacted (0 = when a segment fills up)
+	JournalRetention          JournalRetention // Whether compacted segments are deleted or archived
+	JournalSpillThreshold     int64            // Write payloads larger than this are journaled as separate blobs (0 = only those over 32 MiB)
+	JournalGroupCommit        bool             // Coalesce concurrent journal syncs into one fsync
+	JournalMaxBatchDelay      time.Duration    // How long a group commit waits for more writers (0 = sync immediately)
+	AtomicWrites              bool             // Write files through a synced temporary file renamed into place
+	EnableVersioning          bool             // Whether to enable versioning
+	MaxVersions               int              // Maximum number of versions to keep (0 = unlimited)
+	Backend                   Backend          // Storage for files and bookkeeping (nil = host filesystem)
 }
 
 // DefaultOptions returns the default options
 func DefaultOptions() *Options {
 	return &Options{
-		EnableJournaling: true,
-		EnableVersioning: false,
-		MaxVersions:      10,
+		EnableJournaling:          true,
+		JournalSegmentSize:        64 << 20,
+		JournalCheckpointInterval: 5 * time.Minute,
+		JournalSpillThreshold:     64 << 10,
+		AtomicWrites:              true,
+		EnableVersioning:          false,
+		MaxVersions:               10,
 	}
 }
 
@@ -61,32 +118,52 @@ func NewSimpleFS(rootPath string, opts *Options) (*SimpleFS, error) {
 		return nil, fmt.Errorf("invalid root path: %w", err)
 	}
 
-	if _, err := os.Stat(absRootPath); os.IsNotExist(err) {
-		err = os.MkdirAll(absRootPath, 0755)
+	fsys := backendOrDefault(opts.Backend)
+	if _, err := fsys.Stat(absRootPath); os.IsNotExist(err) {
+		err = fsys.MkdirAll(absRootPath, 0755)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create root directory: %w", err)
 		}
 	}
 
+	// On the host filesystem of Linux the kernel keeps every operation
+	// below the root, even one racing a symlink swapped in after
+	// resolvePath checked its path
+	fsys, confined := vfs.Confine(fsys, absRootPath)
+
 	fs := &SimpleFS{
-		rootPath:    absRootPath,
-		locks:       make(map[string]*sync.RWMutex),
-		hooks:       make(map[HookKey][]HookFunc),
-		versioning:  opts.EnableVersioning,
-		maxVersions: opts.MaxVersions,
+		rootPath:     absRootPath,
+		fsys:         fsys,
+		release:      confined,
+		locks:        make(map[string]*sync.RWMutex),
+		hooks:        make(map[HookKey][]HookFunc),
+		versioning:   opts.EnableVersioning,
+		maxVersions:  opts.MaxVersions,
+		atomicWrites: opts.AtomicWrites,
 	}
 
 	if opts.EnableJournaling {
 		journalPath := filepath.Join(absRootPath, ".journal")
-		if _, err := os.Stat(journalPath); os.IsNotExist(err) {
-			err = os.MkdirAll(journalPath, 0755)
+		if _, err := fs.fsys.Stat(journalPath); os.IsNotExist(err) {
+			err = fs.fsys.MkdirAll(journalPath, 0755)
 			if err != nil {
+				fs.Close()
 				return nil, fmt.Errorf("failed to create journal directory: %w", err)
 			}
 		}
 
-		journal, err := NewJournal(filepath.Join(journalPath, "fs.log"))
+		journal, err := OpenJournal(filepath.Join(journalPath, "fs.log"), JournalOptions{
+			Format:             opts.JournalFormat,
+			SegmentSize:        opts.JournalSegmentSize,
+			CheckpointInterval: opts.JournalCheckpointInterval,
+			Retention:          opts.JournalRetention,
+			SpillThreshold:     opts.JournalSpillThreshold,
+			GroupCommit:        opts.JournalGroupCommit,
+			MaxBatchDelay:      opts.JournalMaxBatchDelay,
+			Backend:            fs.fsys,
+		})
 		if err != nil {
+			fs.Close()
 			return nil, fmt.Errorf("failed to initialize journal: %w", err)
 		}
 		fs.journal = journal
@@ -94,9 +171,10 @@ func NewSimpleFS(rootPath string, opts *Options) (*SimpleFS, error) {
 
 	if opts.EnableVersioning {
 		versionPath := filepath.Join(absRootPath, ".versions")
-		if _, err := os.Stat(versionPath); os.IsNotExist(err) {
-			err = os.MkdirAll(versionPath, 0755)
+		if _, err := fs.fsys.Stat(versionPath); os.IsNotExist(err) {
+			err = fs.fsys.MkdirAll(versionPath, 0755)
 			if err != nil {
+				fs.Close()
 				return nil, fmt.Errorf("failed to create versions directory: %w", err)
 			}
 		}
@@ -106,12 +184,33 @@ func NewSimpleFS(rootPath string, opts *Options) (*SimpleFS, error) {
 	return fs, nil
 }
 
+// Journal returns the journal of the file system, or nil when journaling
+// is disabled. Sub views journal through their parent and have none.
+func (fs *SimpleFS) Journal() *Journal {
+	return fs.journal
+}
+
 // Close properly closes the file system
 func (fs *SimpleFS) Close() error {
-	if fs.journal != nil {
-		return fs.journal.Close()
+	fs.followGuard.Lock()
+	follower := fs.follower
+	fs.followGuard.Unlock()
+	if follower != nil && follower.running() {
+		follower.Stop()
 	}
-	return nil
+
+	err := fs.closeMounts()
+	if fs.journal != nil && !fs.sharedJournal {
+		if journalErr := fs.journal.Close(); err == nil {
+			err = journalErr
+		}
+	}
+	if fs.release != nil {
+		if releaseErr := fs.release.Close(); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
 }
 
 // getFileLock returns a lock for the given path, creating one if it doesn't exist
@@ -128,8 +227,59 @@ func (fs *SimpleFS) getFileLock(path string) *sync.RWMutex {
 	return lock
 }
 
-// fullPath returns the absolute path for a given relative path
+// fullPath returns the absolute path for a given relative path, inside the
+// root of the mounted filesystem for paths below a mount point. Symlinks
+// are followed, including one in the last component.
 func (fs *SimpleFS) fullPath(path string) (string, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.fullPath(rel)
+	}
+	return fs.localPath(path)
+}
+
+// linkPath is fullPath for operations acting on a symlink itself: a
+// symlink in the last component is not followed
+func (fs *SimpleFS) linkPath(path string) (string, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.linkPath(rel)
+	}
+	return fs.localLinkPath(path)
+}
+
+// localPath returns the absolute path for a given relative path in the
+// root of the filesystem itself, ignoring mounts
+func (fs *SimpleFS) localPath(path string) (string, error) {
+	return fs.resolvePath(path, true)
+}
+
+// localLinkPath is localPath without following a final symlink
+func (fs *SimpleFS) localLinkPath(path string) (string, error) {
+	return fs.resolvePath(path, false)
+}
+
+// resolvePath resolves the symlinks of a path component by component,
+// failing when a resolution leaves the root. On the host filesystem of
+// Linux the kernel does so with RESOLVE_BENEATH.
+func (fs *SimpleFS) resolvePath(path string, follow bool) (string, error) {
+	fullPath, err := fs.lexicalPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(fs.rootPath, fullPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid path: %w", err)
+	}
+	resolved, err := vfs.ResolveBeneath(fs.fsys, fs.rootPath, rel, follow)
+	if errors.Is(err, vfs.ErrOutside) {
+		return "", errors.New("path attempts to escape the root directory through a symlink")
+	}
+	return resolved, err
+}
+
+// lexicalPath returns the absolute path for a given relative path in the
+// root of the filesystem, without looking at the disk
+func (fs *SimpleFS) lexicalPath(path string) (string, error) {
 	// Clean the path to remove any ../ components
 	cleanPath := filepath.Clean(path)
 
@@ -148,8 +298,42 @@ func (fs *SimpleFS) fullPath(path string) (string, error) {
 	return fullPath, nil
 }
 
+// logTx journals the entries as one committed transaction and returns its
+// ID, or 0 when journaling is disabled
+func (fs *SimpleFS) logTx(entries ...JournalEntry) (uint64, error) {
+	if fs.journal == nil {
+		return 0, nil
+	}
+	return fs.journal.LogTransaction(entries...)
+}
+
+// finishTx records whether a logged transaction was applied. Errors are
+// ignored: a lost checkpoint only causes a redo during recovery.
+func (fs *SimpleFS) finishTx(txID uint64, err error) {
+	if fs.journal == nil || txID == 0 {
+		return
+	}
+
+	if err != nil {
+		fs.journal.Abort(txID)
+	} else {
+		fs.journal.Checkpoint(txID)
+	}
+}
+
+// isInternalName reports whether a name is one of the hidden directories
+// SimpleFS uses for its own bookkeeping or a temporary file of a write
+func isInternalName(name string) bool {
+	return name == ".journal" || name == ".attributes" || name == ".versions" || name == replicationStateName ||
+		strings.HasPrefix(name, atomicTempPrefix)
+}
+
 // CreateDir creates a new directory
 func (fs *SimpleFS) CreateDir(path string) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.CreateDir(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return err
@@ -168,18 +352,17 @@ func (fs *SimpleFS) CreateDir(path string) error {
 		return err
 	}
 
-	if fs.journal != nil {
-		err := fs.journal.Log(JournalEntry{
-			Operation: "mkdir",
-			Path:      path,
-			Timestamp: time.Now(),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to log directory creation: %w", err)
-		}
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalMkdir,
+		Path:      path,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log directory creation: %w", err)
 	}
 
-	err = os.MkdirAll(fullPath, 0755)
+	err = fs.fsys.MkdirAll(fullPath, 0755)
+	fs.finishTx(txID, err)
 	if err != nil {
 		return err
 	}
@@ -194,16 +377,15 @@ func (fs *SimpleFS) WriteFile(path string, data []byte) error {
 
 // WriteFileWithMode writes data to a file with specific permissions
 func (fs *SimpleFS) WriteFileWithMode(path string, data []byte, mode os.FileMode) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.WriteFileWithMode(rel, data, mode)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return err
 	}
 
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories: %w", err)
-	}
-
 	// Lock the file for writing
 	fileLock := fs.getFileLock(fullPath)
 	fileLock.Lock()
@@ -226,22 +408,23 @@ func (fs *SimpleFS) WriteFileWithMode(path string, data []byte, mode os.FileMode
 		}
 	}
 
-	if fs.journal != nil {
-		err := fs.journal.Log(JournalEntry{
-			Operation: "write",
-			Path:      path,
-			Data:      data,
-			Timestamp: time.Now(),
-			Attributes: map[string]string{
-				"mode": fmt.Sprintf("%d", mode),
-			},
-		})
-		if err != nil {
-			return fmt.Errorf("failed to log file write: %w", err)
-		}
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalWrite,
+		Path:      path,
+		Data:      data,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			"mode": fmt.Sprintf("%d", mode),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log file write: %w", err)
 	}
 
-	err = os.WriteFile(fullPath, data, mode)
+	// Parent directories are created once the write is journaled, so
+	// a crash never leaves them behind without it
+	err = fs.writeFile(fullPath, data, mode)
+	fs.finishTx(txID, err)
 	if err != nil {
 		return err
 	}
@@ -251,6 +434,10 @@ func (fs *SimpleFS) WriteFileWithMode(path string, data []byte, mode os.FileMode
 
 // ReadFile reads the content of a file
 func (fs *SimpleFS) ReadFile(path string) ([]byte, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.ReadFile(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return nil, err
@@ -268,7 +455,7 @@ func (fs *SimpleFS) ReadFile(path string) ([]byte, error) {
 		return nil, err
 	}
 
-	data, err := os.ReadFile(fullPath)
+	data, err := vfs.ReadFile(fs.fsys, fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -282,6 +469,10 @@ func (fs *SimpleFS) ReadFile(path string) ([]byte, error) {
 
 // ListDir lists the contents of a directory
 func (fs *SimpleFS) ListDir(path string) ([]FileInfo, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.ListDir(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return nil, err
@@ -299,7 +490,7 @@ func (fs *SimpleFS) ListDir(path string) ([]FileInfo, error) {
 		return nil, err
 	}
 
-	entries, err := os.ReadDir(fullPath)
+	entries, err := fs.fsys.ReadDir(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -314,23 +505,32 @@ func (fs *SimpleFS) ListDir(path string) ([]FileInfo, error) {
 		entryPath := filepath.Join(path, info.Name())
 
 		// Skip hidden files/directories
-		if info.Name() == ".journal" ||
-			info.Name() == ".attributes" ||
-			info.Name() == ".versions" {
+		if isInternalName(info.Name()) {
 			continue
 		}
 
 		// Read extended attributes if any
 		attrs, _ := fs.GetAllAttributes(entryPath)
 
-		infos = append(infos, FileInfo{
-			Name:       info.Name(),
-			Size:       info.Size(),
-			ModTime:    info.ModTime(),
-			IsDir:      info.IsDir(),
-			Mode:       info.Mode(),
-			Attributes: attrs,
-		})
+		infos = append(infos, *newFileInfo(info, attrs))
+	}
+
+	// Mount points show the root of the filesystem mounted on them
+	for name, target := range fs.mountsIn(path) {
+		root, err := target.Stat("")
+		if err != nil {
+			continue
+		}
+		root.Name = name
+		found := false
+		for i := range infos {
+			if infos[i].Name == name {
+				infos[i], found = *root, true
+			}
+		}
+		if !found {
+			infos = append(infos, *root)
+		}
 	}
 
 	if err := fs.executeHooks(HookTypePost, ctx); err != nil {
@@ -342,12 +542,17 @@ func (fs *SimpleFS) ListDir(path string) ([]FileInfo, error) {
 
 // DeleteFile removes a file
 func (fs *SimpleFS) DeleteFile(path string) error {
-	fullPath, err := fs.fullPath(path)
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.DeleteFile(rel)
+	}
+
+	// A symlink is deleted itself, not its target
+	fullPath, err := fs.linkPath(path)
 	if err != nil {
 		return err
 	}
 
-	info, err := os.Stat(fullPath)
+	info, err := fs.fsys.Lstat(fullPath)
 	if err != nil {
 		return err
 	}
@@ -372,34 +577,51 @@ func (fs *SimpleFS) DeleteFile(path string) error {
 		return err
 	}
 
-	if fs.versioning {
+	// Symlinks have no content of their own to version
+	if fs.versioning && info.Mode()&os.ModeSymlink == 0 {
 		if err := fs.createVersion(path); err != nil {
 			return fmt.Errorf("failed to create version before deletion: %w", err)
 		}
 	}
 
-	if fs.journal != nil {
-		err := fs.journal.Log(JournalEntry{
-			Operation: "delete",
-			Path:      path,
-			Timestamp: time.Now(),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to log file deletion: %w", err)
-		}
+	if err := fs.unshareMeta(path, fullPath); err != nil {
+		return fmt.Errorf("failed to move metadata of deleted file: %w", err)
+	}
+	key, links, _ := fs.fileKey(fullPath)
+
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalDelete,
+		Path:      path,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log file deletion: %w", err)
 	}
 
-	err = os.Remove(fullPath)
+	err = fs.fsys.Remove(fullPath)
+	fs.finishTx(txID, err)
 	if err != nil {
 		return err
 	}
+	if links == 2 {
+		if err := fs.settleMeta(key, true); err != nil {
+			return fmt.Errorf("failed to move metadata to the remaining link: %w", err)
+		}
+	}
 
 	return fs.executeHooks(HookTypePost, ctx)
 }
 
 // DeleteDir removes a directory and all its contents
 func (fs *SimpleFS) DeleteDir(path string) error {
-	fullPath, err := fs.fullPath(path)
+	if point, ok := fs.mountBelow(path); ok {
+		return fmt.Errorf("directory contains mount point %s", point)
+	}
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.DeleteDir(rel)
+	}
+
+	fullPath, err := fs.linkPath(path)
 	if err != nil {
 		return err
 	}
@@ -420,27 +642,45 @@ func (fs *SimpleFS) DeleteDir(path string) error {
 		return err
 	}
 
-	if fs.journal != nil {
-		err := fs.journal.Log(JournalEntry{
-			Operation: "delete",
-			Path:      path,
-			Timestamp: time.Now(),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to log directory deletion: %w", err)
-		}
+	remaining, err := fs.unshareTree(path, fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to move metadata of deleted files: %w", err)
 	}
 
-	err = os.RemoveAll(fullPath)
+	txID, err := fs.logTx(JournalEntry{
+		Operation: JournalRmdir,
+		Path:      path,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log directory deletion: %w", err)
+	}
+
+	err = fs.fsys.RemoveAll(fullPath)
+	fs.finishTx(txID, err)
 	if err != nil {
 		return err
 	}
+	for _, key := range remaining {
+		if err := fs.settleMeta(key, true); err != nil {
+			return fmt.Errorf("failed to move metadata to the remaining link: %w", err)
+		}
+	}
 
 	return fs.executeHooks(HookTypePost, ctx)
 }
 
 // CopyFile copies a file from src to dst
 func (fs *SimpleFS) CopyFile(src, dst string) error {
+	srcFS, srcRel := fs.resolve(src)
+	dstFS, dstRel := fs.resolve(dst)
+	if srcFS != dstFS {
+		return transfer(srcFS, srcRel, dstFS, dstRel, false)
+	}
+	if srcFS != fs {
+		return srcFS.CopyFile(srcRel, dstRel)
+	}
+
 	srcPath, err := fs.fullPath(src)
 	if err != nil {
 		return err
@@ -450,6 +690,9 @@ func (fs *SimpleFS) CopyFile(src, dst string) error {
 	if err != nil {
 		return err
 	}
+	if srcPath == dstPath || fs.sameFile(srcPath, dstPath) {
+		return fmt.Errorf("source and destination are the same file: %s", src)
+	}
 
 	srcLock := fs.getFileLock(srcPath)
 	srcLock.RLock()
@@ -474,73 +717,227 @@ func (fs *SimpleFS) CopyFile(src, dst string) error {
 		}
 	}
 
-	sourceFile, err := os.Open(srcPath)
+	sourceInfo, err := fs.fsys.Stat(srcPath)
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories: %w", err)
-	}
+	// Attributes follow the content in the same transaction
+	attrs := fs.attributesEntries(src, dst, time.Now())
 
-	destFile, err := os.Create(dstPath)
+	txID, err := fs.logCopy(src, dst, srcPath, sourceInfo, attrs...)
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
+	err = fs.copyContent(srcPath, dstPath, sourceInfo.Mode())
+	if err == nil {
+		err = fs.applyAttributes(attrs)
+	}
+	fs.finishTx(txID, err)
 	if err != nil {
 		return err
 	}
 
-	sourceInfo, err := os.Stat(srcPath)
+	return fs.executeHooks(HookTypePost, ctx)
+}
+
+// logCopy journals a copy together with the copied content. Large files
+// are streamed straight into a blob instead of being buffered.
+func (fs *SimpleFS) logCopy(src, dst, srcPath string, info os.FileInfo, attrs ...JournalEntry) (uint64, error) {
+	if fs.journal == nil {
+		return 0, nil
+	}
+
+	entry := JournalEntry{
+		Operation: JournalCopy,
+		Path:      dst,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			"src":  src,
+			"mode": fmt.Sprintf("%d", info.Mode().Perm()),
+		},
+	}
+
+	var hash string
+	if fs.journal.spills(info.Size()) {
+		sourceFile, err := vfs.Open(fs.fsys, srcPath)
+		if err != nil {
+			return 0, err
+		}
+		hash, err = fs.journal.storeBlob(sourceFile)
+		sourceFile.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to store copied content in journal: %w", err)
+		}
+		entry.Attributes[blobAttribute] = hash
+	} else {
+		data, err := vfs.ReadFile(fs.fsys, srcPath)
+		if err != nil {
+			return 0, err
+		}
+		entry.Data = data
+	}
+
+	txID, err := fs.logTx(append([]JournalEntry{entry}, attrs...)...)
+	if err != nil {
+		if hash != "" {
+			fs.journal.releaseBlob(hash)
+		}
+		return 0, fmt.Errorf("failed to log file copy: %w", err)
+	}
+	return txID, nil
+}
+
+// copyContent copies the content of a file and sets the mode of the copy
+func (fs *SimpleFS) copyContent(srcPath, dstPath string, mode os.FileMode) error {
+	sourceFile, err := vfs.Open(fs.fsys, srcPath)
 	if err != nil {
 		return err
 	}
+	defer sourceFile.Close()
+
+	return fs.writeWith(dstPath, mode, func(w io.Writer) error {
+		_, err := io.Copy(w, sourceFile)
+		return err
+	})
+}
 
-	if err = os.Chmod(dstPath, sourceInfo.Mode()); err != nil {
+// atomicTempPrefix starts the name of the temporary file an atomic write
+// goes through. Leftovers of a crash are hidden and reused by the next
+// write of the same file.
+const atomicTempPrefix = ".simplefs-tmp-"
+
+// writeFile replaces the content of a file and sets its mode, creating the
+// parent directories
+func (fs *SimpleFS) writeFile(fullPath string, data []byte, mode os.FileMode) error {
+	return fs.writeWith(fullPath, mode, func(w io.Writer) error {
+		_, err := w.Write(data)
 		return err
+	})
+}
+
+// writeWith replaces the content of a file with what write produces. With
+// atomic writes the content goes to a temporary file in the same directory
+// that is renamed over the target, so readers and crashes see either the
+// old or the new content. Files with several links are written in place,
+// since a rename would split them. Either way the file and its directory
+// are synced before returning, as the journal checkpoints the write next.
+func (fs *SimpleFS) writeWith(fullPath string, mode os.FileMode, write func(io.Writer) error) error {
+	return fs.replaceWith(fullPath, mode, fs.atomicWrites && !fs.linked(fullPath), write)
+}
+
+// replaceWith is writeWith choosing whether to go through a temporary file
+func (fs *SimpleFS) replaceWith(fullPath string, mode os.FileMode, atomic bool, write func(io.Writer) error) error {
+	dir := filepath.Dir(fullPath)
+	if err := fs.fsys.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create parent directories: %w", err)
+	}
+
+	target := fullPath
+	if atomic {
+		// Writers of a file hold its lock, so one name per file is enough
+		target = filepath.Join(dir, atomicTempPrefix+filepath.Base(fullPath))
 	}
 
-	attrs, err := fs.GetAllAttributes(src)
-	if err == nil && len(attrs) > 0 {
-		for k, v := range attrs {
-			fs.SetAttribute(dst, k, v)
+	file, err := fs.fsys.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// An existing file keeps its mode when it is opened
+		err = fs.fsys.Chmod(target, mode)
+	}
+	if err != nil {
+		if target != fullPath {
+			fs.fsys.Remove(target)
 		}
+		return err
+	}
+	if target == fullPath {
+		// The file may be new
+		vfs.SyncDir(fs.fsys, dir)
+		return nil
 	}
 
-	return fs.executeHooks(HookTypePost, ctx)
+	if err := fs.fsys.Rename(target, fullPath); err != nil {
+		fs.fsys.Remove(target)
+		return err
+	}
+	vfs.SyncDir(fs.fsys, dir)
+	return nil
+}
+
+// removeWriteTemps removes the temporary files of interrupted writes below
+// dir and returns how many it removed. The journal is left alone.
+func (fs *SimpleFS) removeWriteTemps(dir string) (int, error) {
+	entries, err := fs.fsys.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case strings.HasPrefix(entry.Name(), atomicTempPrefix):
+			if err := fs.fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed++
+		case entry.IsDir() && !(dir == fs.rootPath && entry.Name() == ".journal"):
+			n, err := fs.removeWriteTemps(path)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
 }
 
 // MoveFile moves a file from src to dst
 func (fs *SimpleFS) MoveFile(src, dst string) error {
-	srcPath, err := fs.fullPath(src)
+	srcFS, srcRel := fs.resolve(src)
+	dstFS, dstRel := fs.resolve(dst)
+	if srcFS != dstFS {
+		// Files cannot be renamed across filesystems
+		return transfer(srcFS, srcRel, dstFS, dstRel, true)
+	}
+	if srcFS != fs {
+		return srcFS.MoveFile(srcRel, dstRel)
+	}
+
+	// Symlinks are moved themselves, like a rename does
+	srcPath, err := fs.linkPath(src)
 	if err != nil {
 		return err
 	}
 
-	dstPath, err := fs.fullPath(dst)
+	dstPath, err := fs.linkPath(dst)
 	if err != nil {
 		return err
 	}
+	if srcPath == dstPath || fs.sameFile(srcPath, dstPath) {
+		// Journaled as write and delete, replaying it would lose the file
+		return fmt.Errorf("source and destination are the same file: %s", src)
+	}
 
-	srcLock := fs.getFileLock(srcPath)
-	srcLock.Lock()
-	defer srcLock.Unlock()
-
-	dstLock := fs.getFileLock(dstPath)
-	dstLock.Lock()
-	defer dstLock.Unlock()
-
-	srcDirLock := fs.getFileLock(filepath.Dir(srcPath))
-	srcDirLock.Lock()
-	defer srcDirLock.Unlock()
-
-	dstDirLock := fs.getFileLock(filepath.Dir(dstPath))
-	dstDirLock.Lock()
-	defer dstDirLock.Unlock()
+	// Each lock is taken once, also for moves within one directory
+	keys := []string{srcPath, dstPath}
+	for _, dir := range []string{filepath.Dir(srcPath), filepath.Dir(dstPath)} {
+		if !slices.Contains(keys, dir) {
+			keys = append(keys, dir)
+		}
+	}
+	sortLockKeys(keys)
+	defer fs.lockAll(keys)()
 
 	ctx := &HookContext{
 		Operation: OpMoveFile,
@@ -557,92 +954,186 @@ func (fs *SimpleFS) MoveFile(src, dst string) error {
 		}
 	}
 
-	dstDir := filepath.Dir(dstPath)
-	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return err
+	// The replaced destination loses a name, maybe its last one
+	dstKey, dstLinks, _ := fs.fileKey(dstPath)
+	if err := fs.unshareMeta(dst, dstPath); err != nil {
+		return fmt.Errorf("failed to move metadata of destination: %w", err)
 	}
 
-	attrs, _ := fs.GetAllAttributes(src)
+	now := time.Now()
+	attrs := fs.attributesEntries(src, dst, now)
 
+	var txID uint64
 	if fs.journal != nil {
-		// Log source deletion
-		if err := fs.journal.Log(JournalEntry{
-			Operation: "delete",
-			Path:      src,
-			Timestamp: time.Now(),
-		}); err != nil {
-			return fmt.Errorf("failed to log move source deletion: %w", err)
-		}
-
-		data, err := fs.ReadFile(src)
+		// Read directly: the source is already locked for writing
+		moved, hash, err := fs.movedEntries(src, srcPath, dst, now)
 		if err != nil {
 			return fmt.Errorf("failed to read source file for move: %w", err)
 		}
 
-		if err := fs.journal.Log(JournalEntry{
-			Operation:  "write",
-			Path:       dst,
-			Data:       data,
-			Timestamp:  time.Now(),
-			Attributes: attrs,
-		}); err != nil {
-			return fmt.Errorf("failed to log move destination write: %w", err)
+		// The move is journaled as one transaction: write destination,
+		// delete source and carry the attributes over. A destination
+		// symlink or a destination with other links is deleted first, as
+		// replaying the write would follow the symlink the rename replaces
+		// or change the other links too.
+		var entries []JournalEntry
+		if info, err := fs.fsys.Lstat(dstPath); err == nil && info.Mode()&os.ModeSymlink != 0 ||
+			dstLinks > 1 && moved[0].Operation == JournalWrite {
+			entries = append(entries, JournalEntry{
+				Operation: JournalDelete,
+				Path:      dst,
+				Timestamp: now,
+			})
+		}
+		entries = append(entries, moved...)
+		entries = append(entries, JournalEntry{
+			Operation: JournalDelete,
+			Path:      src,
+			Timestamp: now,
+		})
+		entries = append(entries, attrs...)
+		txID, err = fs.logTx(entries...)
+		if err != nil {
+			if hash != "" {
+				fs.journal.releaseBlob(hash)
+			}
+			return fmt.Errorf("failed to log file move: %w", err)
 		}
 	}
 
-	if err := os.Rename(srcPath, dstPath); err != nil {
+	err = fs.fsys.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err == nil {
+		err = fs.fsys.Rename(srcPath, dstPath)
+	}
+	if err == nil {
+		err = fs.applyAttributes(attrs)
+	}
+	fs.finishTx(txID, err)
+	if err != nil {
 		return err
 	}
-
-	if len(attrs) > 0 {
-		for k, v := range attrs {
-			fs.SetAttribute(dst, k, v)
+	if dstLinks == 2 {
+		if err := fs.settleMeta(dstKey, true); err != nil {
+			return fmt.Errorf("failed to move metadata to the remaining link of destination: %w", err)
 		}
 	}
 
 	return fs.executeHooks(HookTypePost, ctx)
 }
 
+// movedEntries returns the journal entries recreating the file src at
+// srcPath as dst: a write of its content that keeps its owner and times,
+// for a symlink the same symlink, and for a file with links a link to it,
+// so the links stay shared. Large content is streamed into a blob like a
+// copy's; its hash is returned so the caller can release it if the entries
+// are not logged.
+func (fs *SimpleFS) movedEntries(src, srcPath, dst string, ts time.Time) ([]JournalEntry, string, error) {
+	info, err := fs.fsys.Lstat(srcPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if key, _, ok := fs.fileKey(srcPath); ok && fs.linked(srcPath) {
+		return []JournalEntry{linkEntry(dst, src, key, ts)}, "", nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := fs.fsys.Readlink(srcPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return []JournalEntry{symlinkEntry(dst, target, ts)}, "", nil
+	}
+
+	var entry JournalEntry
+	var hash string
+	if fs.journal.spills(info.Size()) {
+		sourceFile, err := vfs.Open(fs.fsys, srcPath)
+		if err != nil {
+			return nil, "", err
+		}
+		hash, err = fs.journal.storeBlob(sourceFile)
+		sourceFile.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to store moved content in journal: %w", err)
+		}
+		entry = writeEntry(dst, nil, info.Mode().Perm(), ts)
+		entry.Attributes[blobAttribute] = hash
+	} else {
+		data, err := vfs.ReadFile(fs.fsys, srcPath)
+		if err != nil {
+			return nil, "", err
+		}
+		entry = writeEntry(dst, data, info.Mode().Perm(), ts)
+	}
+	return append([]JournalEntry{entry}, metaEntries(dst, info, ts)...), hash, nil
+}
+
 // FileExists checks if a file exists
 func (fs *SimpleFS) FileExists(path string) bool {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.FileExists(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return false
 	}
 
-	_, err = os.Stat(fullPath)
+	_, err = fs.fsys.Stat(fullPath)
 	return err == nil
 }
 
 // Stat returns file info
 func (fs *SimpleFS) Stat(path string) (*FileInfo, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.Stat(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := os.Stat(fullPath)
+	info, err := fs.fsys.Stat(fullPath)
 	if err != nil {
 		return nil, err
 	}
 
 	attrs, _ := fs.GetAllAttributes(path)
 
-	return &FileInfo{
-		Name:       info.Name(),
-		Size:       info.Size(),
-		ModTime:    info.ModTime(),
-		IsDir:      info.IsDir(),
-		Mode:       info.Mode(),
-		Attributes: attrs,
-	}, nil
+	return newFileInfo(info, attrs), nil
 }
 
 // Recover attempts to recover from a crash by replaying the journal
-func (fs *SimpleFS) Recover() error {
+func (fs *SimpleFS) Recover() (*RecoveryReport, error) {
+	if fs.parent != nil {
+		return nil, errors.New("recovery must run on the parent of a sub view")
+	}
 	if fs.journal == nil {
-		return errors.New("journaling is not enabled")
+		return nil, errors.New("journaling is not enabled")
+	}
+
+	return fs.journal.Recover(fs, false)
+}
+
+// RecoverDryRun reports what Recover would do without modifying anything
+func (fs *SimpleFS) RecoverDryRun() (*RecoveryReport, error) {
+	if fs.parent != nil {
+		return nil, errors.New("recovery must run on the parent of a sub view")
+	}
+	if fs.journal == nil {
+		return nil, errors.New("journaling is not enabled")
+	}
+
+	return fs.journal.Recover(fs, true)
+}
+
+// hashFile returns the hash of the content of a file on fsys
+func hashFile(fsys vfs.FS, path string) (string, error) {
+	file, err := vfs.Open(fsys, path)
+	if err != nil {
+		return "", err
 	}
+	defer file.Close()
 
-	return fs.journal.Recover(fs)
+	return utils.HashReader(file)
 }
@@ -2,4 +2,7 @@ module github.com/unkn0wn-root/simplefs
 
 go 1.21
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/google/uuid v1.6.0
+	golang.org/x/sys v0.30.0
+)
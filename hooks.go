@@ -4,6 +4,8 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // OperationType defines the type of filesystem operation
@@ -23,16 +25,22 @@ type HookFunc func(ctx *HookContext) error
 
 // HookContext provides context to hook functions
 type HookContext struct {
-	Operation OperationType          // Type of operation
-	Path      string                 // Path of the file or directory
-	SrcPath   string                 // Source path for copy/move operations
-	Data      []byte                 // Data for write operations
-	Mode      os.FileMode            // File mode for write operations
-	Key       string                 // Key for attribute operations
-	Value     string                 // Value for attribute operations
-	Error     error                  // Error from the operation (in post hooks)
-	FS        *SimpleFS              // Reference to the filesystem
-	Custom    map[string]interface{} // Custom data for hooks
+	Operation  OperationType          // Type of operation
+	Path       string                 // Path of the file or directory
+	SrcPath    string                 // Source path for copy/move operations
+	Data       []byte                 // Data for write operations
+	Mode       os.FileMode            // File mode for write and chmod operations
+	Flag       int                    // Open flags for open/close operations
+	Key        string                 // Key for attribute operations
+	Value      string                 // Value for attribute operations
+	Target     string                 // Target of a symlink being created
+	UID        int                    // New owner for chown operations, -1 to keep it
+	GID        int                    // New group for chown operations, -1 to keep it
+	AccessTime time.Time              // New access time for chtimes operations, zero to keep it
+	ModTime    time.Time              // New modification time for chtimes operations, zero to keep it
+	Error      error                  // Error from the operation (in post hooks)
+	FS         *SimpleFS              // Reference to the filesystem
+	Custom     map[string]interface{} // Custom data for hooks
 }
 
 // Operation types
@@ -52,6 +60,15 @@ const (
 	OpCreateVersion    OperationType = "createVersion"
 	OpGetVersion       OperationType = "getVersion"
 	OpListVersions     OperationType = "listVersions"
+	OpOpenFile         OperationType = "openFile"
+	OpCloseFile        OperationType = "closeFile"
+	OpCreateSymlink    OperationType = "createSymlink"
+	OpReadLink         OperationType = "readLink"
+	OpLstat            OperationType = "lstat"
+	OpLink             OperationType = "link"
+	OpChmod            OperationType = "chmod"
+	OpChown            OperationType = "chown"
+	OpChtimes          OperationType = "chtimes"
 )
 
 // Hook types
@@ -62,6 +79,11 @@ const (
 
 // RegisterHook registers a hook function for a specific operation and hook type
 func (fs *SimpleFS) RegisterHook(op OperationType, typ HookType, hook HookFunc) {
+	if fs.parent != nil {
+		fs.parent.RegisterHook(op, typ, hook)
+		return
+	}
+
 	fs.hooksGuard.Lock()
 	defer fs.hooksGuard.Unlock()
 
@@ -76,6 +98,11 @@ func (fs *SimpleFS) RegisterHook(op OperationType, typ HookType, hook HookFunc)
 
 // UnregisterHook unregisters all hooks for a specific operation and hook type
 func (fs *SimpleFS) UnregisterHook(op OperationType, typ HookType) {
+	if fs.parent != nil {
+		fs.parent.UnregisterHook(op, typ)
+		return
+	}
+
 	fs.hooksGuard.Lock()
 	defer fs.hooksGuard.Unlock()
 
@@ -85,14 +112,44 @@ func (fs *SimpleFS) UnregisterHook(op OperationType, typ HookType) {
 
 // UnregisterAllHooks unregisters all hooks
 func (fs *SimpleFS) UnregisterAllHooks() {
+	if fs.parent != nil {
+		fs.parent.UnregisterAllHooks()
+		return
+	}
+
 	fs.hooksGuard.Lock()
 	defer fs.hooksGuard.Unlock()
 
 	fs.hooks = make(map[HookKey][]HookFunc)
 }
 
+// mutatingOps are the operations rejected while the filesystem is read-only
+var mutatingOps = map[OperationType]bool{
+	OpCreateDir:       true,
+	OpWriteFile:       true,
+	OpDeleteFile:      true,
+	OpDeleteDir:       true,
+	OpCopyFile:        true,
+	OpMoveFile:        true,
+	OpSetAttribute:    true,
+	OpDeleteAttribute: true,
+	OpCreateVersion:   true,
+	OpCreateSymlink:   true,
+	OpLink:            true,
+	OpChmod:           true,
+	OpChown:           true,
+	OpChtimes:         true,
+}
+
 // executeHooks executes all hooks for a specific operation and hook type
 func (fs *SimpleFS) executeHooks(typ HookType, ctx *HookContext) error {
+	// Every mutating operation runs its pre hooks first
+	if typ == HookTypePre && (mutatingOps[ctx.Operation] || (ctx.Operation == OpOpenFile && isWriteFlag(ctx.Flag))) {
+		if err := fs.checkWritable(); err != nil {
+			return err
+		}
+	}
+
 	fs.hooksGuard.RLock()
 	defer fs.hooksGuard.RUnlock()
 
@@ -140,7 +197,7 @@ func LoggingHook(logPath string) (HookFunc, error) {
 		case OpCreateDir:
 			message = "CREATE_DIR " + ctx.Path
 		case OpWriteFile:
-			message = "WRITE_FILE " + ctx.Path + " (" + string(len(ctx.Data)) + " bytes)"
+			message = "WRITE_FILE " + ctx.Path + " (" + strconv.Itoa(len(ctx.Data)) + " bytes)"
 		case OpReadFile:
 			message = "READ_FILE " + ctx.Path
 		case OpListDir:
@@ -167,6 +224,10 @@ func LoggingHook(logPath string) (HookFunc, error) {
 			message = "GET_VERSION " + ctx.Path
 		case OpListVersions:
 			message = "LIST_VERSIONS " + ctx.Path
+		case OpOpenFile:
+			message = "OPEN_FILE " + ctx.Path
+		case OpCloseFile:
+			message = "CLOSE_FILE " + ctx.Path
 		default:
 			message = string(ctx.Operation) + " " + ctx.Path
 		}
@@ -177,13 +238,20 @@ func LoggingHook(logPath string) (HookFunc, error) {
 	}, nil
 }
 
-// ReadOnlyHook creates a hook that prevents write operations
+// ReadOnlyHook creates a hook that prevents write operations. Only the
+// operations known to be reads are allowed, anything else is denied.
 func ReadOnlyHook() HookFunc {
 	return func(ctx *HookContext) error {
 		// Allow read operations
 		switch ctx.Operation {
-		case OpReadFile, OpListDir, OpGetAttribute, OpGetAllAttributes, OpGetVersion, OpListVersions:
+		case OpReadFile, OpListDir, OpGetAttribute, OpGetAllAttributes, OpGetVersion, OpListVersions,
+			OpLstat, OpReadLink:
 			return nil
+		case OpOpenFile, OpCloseFile:
+			// Handles opened without write flags are reads
+			if !isWriteFlag(ctx.Flag) {
+				return nil
+			}
 		}
 
 		// Deny write operations
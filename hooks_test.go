@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"os"
+	"testing"
+)
+
+// allOps lists every operation hooks can be registered for
+var allOps = []OperationType{
+	OpCreateDir, OpWriteFile, OpReadFile, OpListDir, OpDeleteFile, OpDeleteDir,
+	OpCopyFile, OpMoveFile, OpSetAttribute, OpGetAttribute, OpGetAllAttributes,
+	OpDeleteAttribute, OpCreateVersion, OpGetVersion, OpListVersions, OpOpenFile,
+	OpCloseFile, OpCreateSymlink, OpReadLink, OpLstat, OpLink, OpChmod, OpChown,
+	OpChtimes,
+}
+
+// readOps are the operations that do not modify anything, opening and
+// closing without write flags included
+var readOps = map[OperationType]bool{
+	OpReadFile: true, OpListDir: true, OpGetAttribute: true, OpGetAllAttributes: true,
+	OpGetVersion: true, OpListVersions: true, OpOpenFile: true, OpCloseFile: true,
+	OpReadLink: true, OpLstat: true,
+}
+
+func TestReadOnlyHook(t *testing.T) {
+	hook := ReadOnlyHook()
+	for _, op := range allOps {
+		err := hook(&HookContext{Operation: op, Flag: os.O_RDONLY})
+		if readOps[op] && err != nil {
+			t.Errorf("ReadOnlyHook rejected %s: %v", op, err)
+		}
+		if !readOps[op] && err == nil {
+			t.Errorf("ReadOnlyHook allowed %s", op)
+		}
+	}
+	for _, op := range []OperationType{OpOpenFile, OpCloseFile} {
+		if err := hook(&HookContext{Operation: op, Flag: os.O_RDWR}); err == nil {
+			t.Errorf("ReadOnlyHook allowed %s for writing", op)
+		}
+	}
+	// Operations it does not know are denied
+	if err := hook(&HookContext{Operation: "unknown"}); err == nil {
+		t.Error("ReadOnlyHook allowed an unknown operation")
+	}
+}
+
+// TestReadOnlyHookAllowsReads registers ReadOnlyHook for every operation
+// and checks that reading still works, symlinks included
+func TestReadOnlyHookAllowsReads(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	if err := fs.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSymlink("a.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range allOps {
+		fs.RegisterHook(op, HookTypePre, ReadOnlyHook())
+	}
+
+	wantContent(t, fs, "link", "a")
+	if _, err := fs.Lstat("link"); err != nil {
+		t.Errorf("Lstat: %v", err)
+	}
+	if _, err := fs.ReadLink("link"); err != nil {
+		t.Errorf("ReadLink: %v", err)
+	}
+	if _, err := fs.ListDir(""); err != nil {
+		t.Errorf("ListDir: %v", err)
+	}
+	if _, err := fs.GetAllAttributes("a.txt"); err != nil {
+		t.Errorf("GetAllAttributes: %v", err)
+	}
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := fs.WriteFile("a.txt", []byte("b")); err == nil {
+		t.Error("WriteFile succeeded through ReadOnlyHook")
+	}
+}
@@ -0,0 +1,699 @@
+// Package crashtest checks that SimpleFS survives crashes. It runs random
+// operation sequences on an in-memory filesystem, crashes it at every
+// filesystem call in turn, recovers from the journal and checks that the
+// result is the state before or after the interrupted operation.
+package crashtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sfs "github.com/unkn0wn-root/simplefs"
+	"github.com/unkn0wn-root/simplefs/internal/faultfs"
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// root is where the filesystem under test lives on the in-memory FS
+const root = "/simplefs"
+
+// Config configures a harness run
+type Config struct {
+	Seed       int64                                    // Seed for the random operation sequences
+	Sequences  int                                      // Number of sequences to run (default 10)
+	Ops        int                                      // Operations per sequence (default 20)
+	Fail       bool                                     // Inject a persistent I/O failure instead of a crash
+	TornWrites bool                                     // A write interrupted by the crash persists its first half
+	DropSyncs  bool                                     // Syncs make nothing durable, so only that recovery runs is checked
+	Options    *sfs.Options                             // Filesystem options; journaling is always enabled
+	Verbose    func(format string, args ...interface{}) // Receives progress messages, if set
+}
+
+// Failure is an invariant that did not hold after a crash
+type Failure struct {
+	Sequence int      // Index of the sequence
+	Ops      []string // Operations of the sequence
+	FaultAt  int      // Filesystem call at which the fault was injected
+	During   int      // Index of the operation the fault interrupted
+	Problem  string   // What is wrong
+}
+
+func (f Failure) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sequence %d, fault at call %d during op %d: %s\n", f.Sequence, f.FaultAt, f.During, f.Problem)
+	for i, op := range f.Ops {
+		marker := " "
+		if i == f.During {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "  %s %2d %s\n", marker, i, op)
+	}
+	return b.String()
+}
+
+// Result summarizes a harness run
+type Result struct {
+	Sequences   int       // Sequences run
+	FaultPoints int       // Faults injected across all sequences
+	Failures    []Failure // Invariants that did not hold
+}
+
+// Run executes the harness
+func Run(cfg Config) (*Result, error) {
+	if cfg.Sequences <= 0 {
+		cfg.Sequences = 10
+	}
+	if cfg.Ops <= 0 {
+		cfg.Ops = 20
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	result := &Result{}
+	for seq := 0; seq < cfg.Sequences; seq++ {
+		if err := runSequence(cfg, generate(rng, cfg.Ops), result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// runSequence injects a fault at every call the sequence makes and adds
+// the outcome to result
+func runSequence(cfg Config, ops []op, result *Result) error {
+	seq := result.Sequences
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.name
+	}
+
+	states, calls, err := dryRun(cfg, ops)
+	if err != nil {
+		return fmt.Errorf("sequence %d: %w", seq, err)
+	}
+	if cfg.Verbose != nil {
+		cfg.Verbose("sequence %d: %d ops, %d calls", seq, len(ops), calls)
+	}
+
+	for at := 1; at <= calls; at++ {
+		during, problem := faultRun(cfg, ops, states, at)
+		result.FaultPoints++
+		if problem != "" {
+			result.Failures = append(result.Failures, Failure{
+				Sequence: seq,
+				Ops:      names,
+				FaultAt:  at,
+				During:   during,
+				Problem:  problem,
+			})
+		}
+	}
+	result.Sequences++
+	return nil
+}
+
+// options returns the filesystem options of a run on the given backend
+func options(cfg Config, backend sfs.Backend) *sfs.Options {
+	opts := &sfs.Options{}
+	if cfg.Options != nil {
+		copied := *cfg.Options
+		opts = &copied
+	}
+	opts.EnableJournaling = true
+	opts.Backend = backend
+	// Background compaction would make the calls of a run unpredictable
+	opts.JournalCheckpointInterval = 0
+	return opts
+}
+
+// dryRun runs the sequence without faults and returns the state after
+// each operation, the initial state first, and the number of calls made
+func dryRun(cfg Config, ops []op) ([]state, int, error) {
+	mem := vfs.NewMem()
+	counter := faultfs.New(mem, faultfs.Faults{})
+
+	fs, err := sfs.NewSimpleFS(root, options(cfg, counter))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	states := []state{snapshot(mem)}
+	for _, op := range ops {
+		op.run(fs)
+		states = append(states, snapshot(mem))
+	}
+	if err := fs.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return states, counter.Ops(), nil
+}
+
+// faultRun runs the sequence with a fault injected at the given call,
+// recovers and checks the invariants. It returns the operation the fault
+// interrupted and the problem found, if any.
+func faultRun(cfg Config, ops []op, states []state, at int) (int, string) {
+	mem := vfs.NewMem()
+	faults := faultfs.Faults{TornWrites: cfg.TornWrites, DropSyncs: cfg.DropSyncs}
+	if cfg.Fail {
+		faults.FailAt = at
+	} else {
+		faults.CrashAt = at
+	}
+	faulty := faultfs.New(mem, faults)
+
+	during := 0
+	if fs, err := sfs.NewSimpleFS(root, options(cfg, faulty)); err == nil {
+		for ; during < len(ops); during++ {
+			ops[during].run(fs)
+			if faulty.Faulted() {
+				break
+			}
+		}
+		fs.Close()
+	}
+
+	// Restart on the surviving state without faults
+	fs, err := sfs.NewSimpleFS(root, options(cfg, mem))
+	if err != nil {
+		return during, fmt.Sprintf("reopen failed: %v", err)
+	}
+	defer fs.Close()
+
+	report, err := fs.Recover()
+	if err != nil {
+		return during, fmt.Sprintf("recovery failed: %v", err)
+	}
+	if cfg.DropSyncs {
+		// Nothing was durable, not even the journal, so there is nothing
+		// recovery could be expected to restore
+		return during, ""
+	}
+	if report.Failed > 0 {
+		for _, op := range report.Operations {
+			if op.Status == sfs.RecoveryFailed {
+				return during, fmt.Sprintf("recovery could not redo %s %s: %s", op.Operation, op.Path, op.Error)
+			}
+		}
+	}
+
+	problems, err := fs.Journal().Verify()
+	if err != nil {
+		return during, fmt.Sprintf("journal verification failed: %v", err)
+	}
+	if len(problems) > 0 {
+		return during, fmt.Sprintf("journal is damaged: %s", problems[0].Problem)
+	}
+
+	got := snapshot(mem)
+	before := states[during]
+	after := states[len(states)-1]
+	if during+1 < len(states) {
+		after = states[during+1]
+	}
+	if during < len(ops) && ops[during].inPlace != "" {
+		// Content written through a handle is only journaled when the
+		// handle is closed, so a fault may leave it half written
+		path := before.resolve(ops[during].inPlace)
+		got, before, after = got.without(path), before.without(path), after.without(path)
+	}
+	if got.equal(before) || got.equal(after) || got.versionedBetween(before, after) {
+		return during, ""
+	}
+	return during, fmt.Sprintf("state matches neither side of the operation: %s", got.diff(after))
+}
+
+// state maps every user-visible path to a description of its content
+type state map[string]string
+
+// snapshot records the files, directories, symlinks, attributes and
+// versions on mem, leaving out the journal and replication state. Hard
+// links are recorded by the first path of their file, which also stands in
+// for the inode in the names of shared attributes and versions. Metadata a
+// file with a single link keeps under its identity is recorded under its
+// path, where it would be read from just the same.
+func snapshot(mem *vfs.Mem) state {
+	type file struct {
+		first string
+		links uint64
+	}
+	inodes := make(map[string]file)
+	for _, path := range mem.Paths() {
+		info, err := mem.Lstat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if id, links, ok := vfs.Identity(info); ok {
+			key := fmt.Sprintf("%x-%x", id.Dev, id.Ino)
+			if _, ok := inodes[key]; !ok {
+				rel, _ := filepath.Rel(root, path)
+				inodes[key] = file{rel, links}
+			}
+		}
+	}
+
+	// byInode renames metadata kept under the identity of a file
+	byInode := func(meta, key, suffix string) string {
+		f, ok := inodes[key]
+		switch {
+		case !ok:
+			return filepath.Join(meta, "inodes", key+suffix)
+		case f.links > 1:
+			return filepath.Join(meta, "inodes", f.first)
+		default:
+			return filepath.Join(meta, utils.HashString(f.first)+suffix)
+		}
+	}
+
+	s := make(state)
+	for _, path := range mem.Paths() {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		switch strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] {
+		case ".journal", ".replication":
+			continue
+		case ".versions":
+			if dir := filepath.Dir(rel); dir != ".versions" && dir != filepath.Join(".versions", "inodes") {
+				// Described as a whole with its directory
+				continue
+			}
+		}
+
+		info, err := mem.Lstat(path)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, _ := mem.Readlink(path)
+			s[rel] = "symlink to " + target
+			continue
+		}
+		if info.IsDir() {
+			switch dir, name := filepath.Split(rel); filepath.Clean(dir) {
+			case ".versions":
+				if name != "inodes" {
+					s.versions(mem, path, rel)
+				}
+				continue
+			case filepath.Join(".versions", "inodes"):
+				s.versions(mem, path, byInode(".versions", name, ""))
+				continue
+			}
+			s[rel] = "dir"
+			continue
+		}
+		data, err := vfs.ReadFile(mem, path)
+		if err != nil {
+			s[rel] = "unreadable: " + err.Error()
+			continue
+		}
+		uid, gid, _ := vfs.Owner(info)
+		desc := fmt.Sprintf("%v %d:%d %s", info.Mode().Perm(), uid, gid, utils.ShortHash(string(data)))
+		// Only times set by chtimes are predictable
+		if info.ModTime().Before(fixedTimes) {
+			desc += " modified " + info.ModTime().UTC().Format(time.RFC3339)
+		}
+		if atime, ok := vfs.AccessTime(info); ok && atime.Before(fixedTimes) {
+			desc += " accessed " + atime.UTC().Format(time.RFC3339)
+		}
+		if id, links, ok := vfs.Identity(info); ok && links > 1 {
+			desc += " linked to " + inodes[fmt.Sprintf("%x-%x", id.Dev, id.Ino)].first
+		}
+		if dir, name := filepath.Split(rel); filepath.Clean(dir) == filepath.Join(".attributes", "inodes") {
+			rel = byInode(".attributes", strings.TrimSuffix(name, ".json"), ".json")
+		}
+		s[rel] = desc
+	}
+	return s
+}
+
+// versions adds the versions in a version directory to the state, by
+// content and description since their IDs and times differ between runs.
+// Each is recorded with the number of versions that look alike.
+func (s state) versions(mem *vfs.Mem, dir, rel string) {
+	add := func(desc string) {
+		var n int
+		fmt.Sscan(s[filepath.Join(rel, desc)], &n)
+		s[filepath.Join(rel, desc)] = fmt.Sprint(n + 1)
+	}
+
+	entries, err := mem.ReadDir(dir)
+	if err != nil {
+		add("unreadable: " + err.Error())
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			if _, err := mem.Stat(filepath.Join(dir, strings.TrimSuffix(entry.Name(), ".data")+".json")); err != nil {
+				add("stray " + entry.Name())
+			}
+			continue
+		}
+		var info sfs.VersionInfo
+		meta, err := vfs.ReadFile(mem, filepath.Join(dir, entry.Name()))
+		if err != nil || json.Unmarshal(meta, &info) != nil {
+			add("unreadable metadata")
+			continue
+		}
+		data, err := vfs.ReadFile(mem, filepath.Join(dir, id+".data"))
+		if err != nil {
+			add("missing data")
+			continue
+		}
+		add(fmt.Sprintf("%s %q", utils.ShortHash(string(data)), info.Description))
+	}
+}
+
+// resolve follows the symlinks of path
+func (s state) resolve(path string) string {
+	for hops := 0; hops < 8; hops++ {
+		target, ok := strings.CutPrefix(s[path], "symlink to ")
+		if !ok {
+			break
+		}
+		path = filepath.Join(filepath.Dir(path), target)
+	}
+	return path
+}
+
+// without returns the state without the file at path and its hard links
+func (s state) without(path string) state {
+	var linked string
+	if i := strings.Index(s[path], " linked to "); i >= 0 {
+		linked = s[path][i:]
+	}
+	out := make(state, len(s))
+	for p, desc := range s {
+		if p == path || linked != "" && strings.HasSuffix(desc, linked) {
+			continue
+		}
+		out[p] = desc
+	}
+	return out
+}
+
+// versionedBetween reports whether the state is the one before an
+// operation with only some of the versions it creates or prunes. Versions
+// of the old content are kept before the operation changes it, so a fault
+// may land between the two. Versions are counted by content alone, as the
+// directory of a file with links is named by a path the operation may
+// change.
+func (s state) versionedBetween(before, after state) bool {
+	versioned := func(path string) bool {
+		return strings.HasPrefix(path, ".versions"+string(filepath.Separator))
+	}
+	for path, desc := range before {
+		if !versioned(path) && s[path] != desc {
+			return false
+		}
+	}
+	for path := range s {
+		if _, ok := before[path]; !ok && !versioned(path) {
+			return false
+		}
+	}
+
+	count := func(s state) map[string]int {
+		counts := make(map[string]int)
+		for path, desc := range s {
+			if versioned(path) {
+				var n int
+				fmt.Sscan(desc, &n)
+				counts[filepath.Base(path)] += n
+			}
+		}
+		return counts
+	}
+	got, from, to := count(s), count(before), count(after)
+	for _, counts := range []map[string]int{got, from, to} {
+		for version := range counts {
+			if n := got[version]; n < from[version] && n < to[version] || n > from[version] && n > to[version] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s state) equal(other state) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for path, desc := range s {
+		if other[path] != desc {
+			return false
+		}
+	}
+	return true
+}
+
+// diff describes how s differs from want
+func (s state) diff(want state) string {
+	paths := make(map[string]bool)
+	for path := range s {
+		paths[path] = true
+	}
+	for path := range want {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, path := range sorted {
+		got, ok := s[path]
+		exp, expOK := want[path]
+		switch {
+		case !ok:
+			diffs = append(diffs, path+" missing")
+		case !expOK:
+			diffs = append(diffs, path+" unexpected")
+		case got != exp:
+			diffs = append(diffs, fmt.Sprintf("%s is %q, want %q", path, got, exp))
+		}
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// op is a filesystem operation of a sequence
+type op struct {
+	name    string
+	run     func(fs *sfs.SimpleFS) error
+	inPlace string // File the operation writes in place, which a fault may leave half written
+}
+
+// Paths the operations work on, few enough that they collide often
+var (
+	files = []string{"a", "b", "d/c", "d/e/f"}
+	dirs  = []string{"d", "d/e", "g"}
+)
+
+// fixedTimes is later than every time chtimes sets and earlier than the
+// times of the runs, which snapshots leave out
+var fixedTimes = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// versionID returns the ID of the oldest or newest version of path. IDs
+// are only known at run time, so operations pick versions by age.
+func versionID(fs *sfs.SimpleFS, path string, oldest bool) (string, error) {
+	listing, err := fs.ListVersions(path)
+	if err != nil {
+		return "", err
+	}
+	if len(listing.Versions) == 0 {
+		return "", fmt.Errorf("no versions of %s", path)
+	}
+	if oldest {
+		return listing.Versions[len(listing.Versions)-1].VersionID, nil
+	}
+	return listing.Versions[0].VersionID, nil
+}
+
+// generate returns a random operation sequence
+func generate(rng *rand.Rand, n int) []op {
+	pick := func(list []string) string { return list[rng.Intn(len(list))] }
+	content := func() []byte {
+		// Sizes on both sides of small spill thresholds and segment sizes
+		return []byte(strings.Repeat(string(rune('a'+rng.Intn(26))), 1+rng.Intn(200)))
+	}
+
+	ops := make([]op, 0, n)
+	for len(ops) < n {
+		var o op
+		switch rng.Intn(16) {
+		case 0, 1:
+			path, data := pick(files), content()
+			mode := os.FileMode(0644)
+			if rng.Intn(4) == 0 {
+				mode = 0600
+			}
+			o = op{name: fmt.Sprintf("write %s (%d bytes, %v)", path, len(data), mode), run: func(fs *sfs.SimpleFS) error {
+				return fs.WriteFileWithMode(path, data, mode)
+			}}
+		case 2:
+			src, dst := pick(files), pick(files)
+			o = op{name: fmt.Sprintf("copy %s %s", src, dst), run: func(fs *sfs.SimpleFS) error {
+				return fs.CopyFile(src, dst)
+			}}
+		case 3:
+			src, dst := pick(files), pick(files)
+			o = op{name: fmt.Sprintf("move %s %s", src, dst), run: func(fs *sfs.SimpleFS) error {
+				return fs.MoveFile(src, dst)
+			}}
+		case 4:
+			path := pick(files)
+			o = op{name: "delete " + path, run: func(fs *sfs.SimpleFS) error {
+				return fs.DeleteFile(path)
+			}}
+		case 5:
+			path := pick(dirs)
+			if rng.Intn(2) == 0 {
+				o = op{name: "mkdir " + path, run: func(fs *sfs.SimpleFS) error {
+					return fs.CreateDir(path)
+				}}
+			} else {
+				o = op{name: "rmdir " + path, run: func(fs *sfs.SimpleFS) error {
+					return fs.DeleteDir(path)
+				}}
+			}
+		case 6:
+			path, key, value := pick(files), pick([]string{"owner", "tag"}), fmt.Sprint(rng.Intn(100))
+			o = op{name: fmt.Sprintf("setattr %s %s=%s", path, key, value), run: func(fs *sfs.SimpleFS) error {
+				return fs.SetAttribute(path, key, value)
+			}}
+		case 7:
+			path, key := pick(files), pick([]string{"owner", "tag"})
+			o = op{name: fmt.Sprintf("deleteattr %s %s", path, key), run: func(fs *sfs.SimpleFS) error {
+				return fs.DeleteAttribute(path, key)
+			}}
+		case 8:
+			first, second := pick(files), pick(files)
+			data := content()
+			// Moving the written file moves content of the transaction,
+			// any other file is renamed on disk
+			moved := first
+			if rng.Intn(2) == 0 {
+				moved = pick(files)
+			}
+			o = op{name: fmt.Sprintf("tx {write %s (%d bytes); move %s %s}", first, len(data), moved, second), run: func(fs *sfs.SimpleFS) error {
+				tx := fs.Begin()
+				if err := tx.WriteFile(first, data); err != nil {
+					tx.Rollback()
+					return err
+				}
+				if err := tx.MoveFile(moved, second); err != nil {
+					tx.Rollback()
+					return err
+				}
+				return tx.Commit()
+			}}
+		case 9:
+			src, dst := pick(files), pick(files)
+			o = op{name: fmt.Sprintf("link %s %s", src, dst), run: func(fs *sfs.SimpleFS) error {
+				return fs.Link(src, dst)
+			}}
+		case 10:
+			path, mode := pick(files), []os.FileMode{0600, 0640, 0644}[rng.Intn(3)]
+			o = op{name: fmt.Sprintf("chmod %s %v", path, mode), run: func(fs *sfs.SimpleFS) error {
+				return fs.Chmod(path, mode)
+			}}
+		case 11:
+			link, target := pick(files), pick(files)
+			rel, _ := filepath.Rel(filepath.Dir(link), target)
+			o = op{name: fmt.Sprintf("symlink %s -> %s", link, rel), run: func(fs *sfs.SimpleFS) error {
+				return fs.CreateSymlink(rel, link)
+			}}
+		case 12:
+			path, uid, gid := pick(files), []int{-1, 1000, 1001}[rng.Intn(3)], []int{-1, 1000, 1001}[rng.Intn(3)]
+			o = op{name: fmt.Sprintf("chown %s %d:%d", path, uid, gid), run: func(fs *sfs.SimpleFS) error {
+				return fs.Chown(path, uid, gid)
+			}}
+		case 13:
+			path := pick(files)
+			atime := time.Date(2000, 1, 1+rng.Intn(28), 0, 0, 0, 0, time.UTC)
+			mtime := time.Date(2000, 2, 1+rng.Intn(28), 0, 0, 0, 0, time.UTC)
+			if rng.Intn(3) == 0 {
+				atime = time.Time{}
+			}
+			o = op{name: fmt.Sprintf("chtimes %s %s %s", path, atime.Format("01-02"), mtime.Format("01-02")), run: func(fs *sfs.SimpleFS) error {
+				return fs.Chtimes(path, atime, mtime)
+			}}
+		case 14:
+			path, data := pick(files), content()
+			if rng.Intn(2) == 0 {
+				o = op{name: fmt.Sprintf("create %s (%d bytes)", path, len(data)), run: func(fs *sfs.SimpleFS) error {
+					f, err := fs.Create(path)
+					if err != nil {
+						return err
+					}
+					if _, err := f.Write(data); err != nil {
+						f.Close()
+						return err
+					}
+					return f.Close()
+				}}
+			} else {
+				// Existing files keep their mode, which perm 0 must not replace
+				off := int64(rng.Intn(50))
+				o = op{name: fmt.Sprintf("open %s, write %d bytes at %d", path, len(data), off), run: func(fs *sfs.SimpleFS) error {
+					f, err := fs.OpenFile(path, os.O_RDWR, 0)
+					if err != nil {
+						return err
+					}
+					if _, err := f.WriteAt(data, off); err != nil {
+						f.Close()
+						return err
+					}
+					return f.Close()
+				}}
+			}
+			o.inPlace = path
+		case 15:
+			path, oldest := pick(files), rng.Intn(2) == 0
+			which := map[bool]string{true: "oldest", false: "newest"}[oldest]
+			version := func(fs *sfs.SimpleFS) (string, error) {
+				return versionID(fs, path, oldest)
+			}
+			switch rng.Intn(3) {
+			case 0:
+				o = op{name: fmt.Sprintf("restoreversion %s %s", path, which), run: func(fs *sfs.SimpleFS) error {
+					id, err := version(fs)
+					if err != nil {
+						return err
+					}
+					return fs.RestoreVersion(path, id)
+				}}
+			case 1:
+				o = op{name: fmt.Sprintf("deleteversion %s %s", path, which), run: func(fs *sfs.SimpleFS) error {
+					id, err := version(fs)
+					if err != nil {
+						return err
+					}
+					return fs.DeleteVersion(path, id)
+				}}
+			default:
+				desc := fmt.Sprint(rng.Intn(100))
+				o = op{name: fmt.Sprintf("versiondesc %s %s %s", path, which, desc), run: func(fs *sfs.SimpleFS) error {
+					id, err := version(fs)
+					if err != nil {
+						return err
+					}
+					return fs.SetVersionDescription(path, id, desc)
+				}}
+			}
+		}
+		ops = append(ops, o)
+	}
+	return ops
+}
@@ -0,0 +1,283 @@
+package crashtest
+
+import (
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	sfs "github.com/unkn0wn-root/simplefs"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		inPlace bool
+		json    bool
+	}{
+		{name: "crash", cfg: Config{Seed: 1}},
+		{name: "torn writes", cfg: Config{Seed: 2, TornWrites: true}},
+		{name: "failure", cfg: Config{Seed: 3, Fail: true}},
+		{name: "in place", cfg: Config{Seed: 4, TornWrites: true}, inPlace: true},
+		{name: "json", cfg: Config{Seed: 5}, json: true},
+		{name: "drop syncs", cfg: Config{Seed: 6, DropSyncs: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := sfs.JournalFormatBinary
+			if tt.json {
+				format = sfs.JournalFormatJSON
+			}
+			cfg := tt.cfg
+			cfg.Options = &sfs.Options{
+				JournalFormat:         format,
+				JournalSegmentSize:    512,
+				JournalSpillThreshold: 64,
+				AtomicWrites:          !tt.inPlace,
+				EnableVersioning:      true,
+				MaxVersions:           3,
+			}
+			cfg.Sequences, cfg.Ops = 2, 20
+			if testing.Short() {
+				cfg.Sequences, cfg.Ops = 1, 10
+			}
+
+			result, err := Run(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, failure := range result.Failures {
+				if i == 3 {
+					t.Errorf("... %d more", len(result.Failures)-i)
+					break
+				}
+				t.Error(failure)
+			}
+		})
+	}
+}
+
+func TestGenerateCoversOperations(t *testing.T) {
+	seen := make(map[string]bool)
+	rng := rand.New(rand.NewSource(1))
+	for _, op := range generate(rng, 500) {
+		seen[strings.Fields(op.name)[0]] = true
+	}
+
+	for _, name := range []string{
+		"write", "copy", "move", "delete", "mkdir", "rmdir", "setattr", "deleteattr",
+		"link", "tx", "chmod", "symlink", "chown", "chtimes", "create", "open",
+		"restoreversion", "deleteversion", "versiondesc",
+	} {
+		if !seen[name] {
+			t.Errorf("no %s operation generated", name)
+		}
+	}
+}
+
+func TestJournaledOperations(t *testing.T) {
+	write := func(path, data string) op {
+		return op{name: "write " + path, run: func(fs *sfs.SimpleFS) error {
+			return fs.WriteFile(path, []byte(data))
+		}}
+	}
+	withVersion := func(name, path string, oldest bool, run func(fs *sfs.SimpleFS, id string) error) op {
+		return op{name: name, run: func(fs *sfs.SimpleFS) error {
+			id, err := versionID(fs, path, oldest)
+			if err != nil {
+				return err
+			}
+			return run(fs, id)
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		record string // Journal record the operation must write
+		setup  []op
+		op     op
+	}{
+		{
+			name:   "copy",
+			record: sfs.JournalCopy,
+			setup:  []op{write("a", "copied")},
+			op: op{name: "copy a b", run: func(fs *sfs.SimpleFS) error {
+				return fs.CopyFile("a", "b")
+			}},
+		},
+		{
+			name:   "rmdir",
+			record: sfs.JournalRmdir,
+			setup: []op{
+				write("d/e/f", "nested"),
+				op{name: "setattr d/e/f", run: func(fs *sfs.SimpleFS) error {
+					return fs.SetAttribute("d/e/f", "owner", "1")
+				}},
+			},
+			op: op{name: "rmdir d", run: func(fs *sfs.SimpleFS) error {
+				return fs.DeleteDir("d")
+			}},
+		},
+		{
+			name:   "deleteattr",
+			record: sfs.JournalDeleteAttr,
+			setup: []op{
+				write("a", "attributed"),
+				op{name: "setattr a", run: func(fs *sfs.SimpleFS) error {
+					return fs.SetAttribute("a", "owner", "1")
+				}},
+			},
+			// The last key, which removes the attributes file
+			op: op{name: "deleteattr a", run: func(fs *sfs.SimpleFS) error {
+				return fs.DeleteAttribute("a", "owner")
+			}},
+		},
+		{
+			name:   "version",
+			record: sfs.JournalVersion,
+			setup:  []op{write("a", "first")},
+			op:     write("a", "second"),
+		},
+		{
+			name:   "deleteversion",
+			record: sfs.JournalDeleteVersion,
+			setup:  []op{write("a", "first"), write("a", "second"), write("a", "third")},
+			op: withVersion("deleteversion a", "a", true, func(fs *sfs.SimpleFS, id string) error {
+				return fs.DeleteVersion("a", id)
+			}),
+		},
+		{
+			name:   "versiondesc",
+			record: sfs.JournalVersionDesc,
+			setup:  []op{write("a", "first"), write("a", "second")},
+			op: withVersion("versiondesc a", "a", false, func(fs *sfs.SimpleFS, id string) error {
+				return fs.SetVersionDescription("a", id, "described")
+			}),
+		},
+		{
+			name:   "restoreversion",
+			record: sfs.JournalWrite,
+			setup:  []op{write("a", "first"), write("a", "second")},
+			op: withVersion("restoreversion a", "a", true, func(fs *sfs.SimpleFS, id string) error {
+				return fs.RestoreVersion("a", id)
+			}),
+		},
+	}
+
+	faults := []struct {
+		name    string
+		cfg     Config
+		inPlace bool
+	}{
+		{name: "crash"},
+		{name: "torn writes", cfg: Config{TornWrites: true}},
+		{name: "failure", cfg: Config{Fail: true}},
+		{name: "in place", cfg: Config{TornWrites: true}, inPlace: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := append(tt.setup, tt.op)
+
+			// The operation has to reach the journal for recovery to redo it
+			mem := vfs.NewMem()
+			fs, err := sfs.NewSimpleFS(root, options(Config{Options: &sfs.Options{EnableVersioning: true}}, mem))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range ops {
+				if err := op.run(fs); err != nil {
+					t.Fatalf("%s: %v", op.name, err)
+				}
+			}
+			reader, err := fs.Journal().NewReader(sfs.JournalFilter{Operations: []string{tt.record}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records int
+			for {
+				if _, err := reader.Next(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				records++
+			}
+			fs.Close()
+			if records == 0 {
+				t.Fatalf("no %s record journaled", tt.record)
+			}
+
+			for _, fault := range faults {
+				cfg := fault.cfg
+				cfg.Options = &sfs.Options{
+					AtomicWrites:     !fault.inPlace,
+					EnableVersioning: true,
+				}
+				result := &Result{}
+				if err := runSequence(cfg, ops, result); err != nil {
+					t.Fatalf("%s: %v", fault.name, err)
+				}
+				for _, failure := range result.Failures {
+					t.Errorf("%s: %s", fault.name, failure)
+				}
+			}
+		})
+	}
+}
+
+// TestTransactionCrash crashes a transaction at every call, both before
+// and after its commit record reaches the journal, and checks that
+// recovery applies either all of its operations or none
+func TestTransactionCrash(t *testing.T) {
+	write := func(path, data string) op {
+		return op{name: "write " + path, run: func(fs *sfs.SimpleFS) error {
+			return fs.WriteFile(path, []byte(data))
+		}}
+	}
+	ops := []op{
+		write("a", "old"),
+		write("b", "deleted"),
+		write("d/c", "moved"),
+		{name: "tx", run: func(fs *sfs.SimpleFS) error {
+			tx := fs.Begin()
+			for _, err := range []error{
+				tx.WriteFile("a", []byte("new")),
+				tx.SetAttribute("a", "tag", "new"),
+				tx.DeleteFile("b"),
+				tx.MoveFile("d/c", "d/e/f"),
+				tx.CreateDir("g"),
+			} {
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			return tx.Commit()
+		}},
+	}
+
+	for _, fault := range []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "crash"},
+		{name: "torn writes", cfg: Config{TornWrites: true}},
+		{name: "failure", cfg: Config{Fail: true}},
+	} {
+		t.Run(fault.name, func(t *testing.T) {
+			cfg := fault.cfg
+			cfg.Options = &sfs.Options{AtomicWrites: true, EnableVersioning: true}
+			result := &Result{}
+			if err := runSequence(cfg, ops, result); err != nil {
+				t.Fatal(err)
+			}
+			for _, failure := range result.Failures {
+				t.Error(failure)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Package faultfs wraps a vfs.FS and injects faults into the operations
+// passing through it: failures, crashes, torn writes and dropped fsyncs.
+package faultfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// ErrInjected is returned by operations once the injected failure started
+var ErrInjected = errors.New("injected fault")
+
+// ErrCrashed is returned by every operation once the simulated crash happened
+var ErrCrashed = errors.New("simulated crash")
+
+// Crasher is implemented by filesystems that can simulate losing power,
+// such as vfs.Mem
+type Crasher interface {
+	Crash()
+}
+
+// Faults selects the faults to inject. Operations are counted from 1 and
+// include every call on the FS and on files opened through it.
+type Faults struct {
+	FailAt     int  // Operation from which every operation fails with ErrInjected (0 = never)
+	CrashAt    int  // Operation at which the system crashes (0 = never)
+	TornWrites bool // A write interrupted by the crash persists its first half
+	DropSyncs  bool // Syncs report success without making anything durable
+}
+
+// FS injects faults into the operations of another FS
+type FS struct {
+	inner  vfs.FS
+	faults Faults
+
+	mu      sync.Mutex
+	ops     int  // Operations performed so far
+	failed  bool // Whether the injected failure has started
+	crashed bool // Whether the crash has happened
+}
+
+// New wraps inner and injects the given faults
+func New(inner vfs.FS, faults Faults) *FS {
+	return &FS{inner: inner, faults: faults}
+}
+
+// Ops returns the number of operations performed so far
+func (f *FS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ops
+}
+
+// Faulted reports whether the injected failure or the crash has happened
+func (f *FS) Faulted() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.failed || f.crashed
+}
+
+// step counts an operation and reports whether it may run. torn is called
+// with the lock held when a write is the operation that crashes.
+func (f *FS) step(torn func()) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	f.ops++
+	if f.failed || f.ops == f.faults.FailAt {
+		f.failed = true
+		return ErrInjected
+	}
+	if f.ops == f.faults.CrashAt {
+		if torn != nil && f.faults.TornWrites {
+			torn()
+		}
+		f.crashed = true
+		if c, ok := f.inner.(Crasher); ok {
+			c.Crash()
+		}
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	if err := f.step(nil); err != nil {
+		return nil, err
+	}
+	file, err := f.inner.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	if err := f.step(nil); err != nil {
+		return nil, err
+	}
+	return f.inner.Stat(name)
+}
+
+func (f *FS) Lstat(name string) (os.FileInfo, error) {
+	if err := f.step(nil); err != nil {
+		return nil, err
+	}
+	return f.inner.Lstat(name)
+}
+
+func (f *FS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.step(nil); err != nil {
+		return nil, err
+	}
+	return f.inner.ReadDir(name)
+}
+
+func (f *FS) Mkdir(name string, perm os.FileMode) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Mkdir(name, perm)
+}
+
+func (f *FS) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.MkdirAll(name, perm)
+}
+
+func (f *FS) Remove(name string) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Remove(name)
+}
+
+func (f *FS) RemoveAll(name string) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.RemoveAll(name)
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Rename(oldpath, newpath)
+}
+
+func (f *FS) Chmod(name string, mode os.FileMode) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Chmod(name, mode)
+}
+
+func (f *FS) Chown(name string, uid, gid int) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Chown(name, uid, gid)
+}
+
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Chtimes(name, atime, mtime)
+}
+
+func (f *FS) Truncate(name string, size int64) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Truncate(name, size)
+}
+
+func (f *FS) Symlink(oldname, newname string) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Symlink(oldname, newname)
+}
+
+func (f *FS) Readlink(name string) (string, error) {
+	if err := f.step(nil); err != nil {
+		return "", err
+	}
+	return f.inner.Readlink(name)
+}
+
+func (f *FS) Link(oldname, newname string) error {
+	if err := f.step(nil); err != nil {
+		return err
+	}
+	return f.inner.Link(oldname, newname)
+}
+
+// faultFile injects faults into the operations on an open file
+type faultFile struct {
+	vfs.File
+	fs *FS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.step(nil); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.step(nil); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// Write persists the first half of p when it is torn by the crash, as if
+// only some sectors reached the disk
+func (f *faultFile) Write(p []byte) (int, error) {
+	torn := func() {
+		f.File.Write(p[:len(p)/2])
+		f.File.Sync()
+	}
+	if err := f.fs.step(torn); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	torn := func() {
+		f.File.WriteAt(p[:len(p)/2], off)
+		f.File.Sync()
+	}
+	if err := f.fs.step(torn); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fs.step(nil); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.step(nil); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.step(nil); err != nil {
+		return err
+	}
+	if f.fs.faults.DropSyncs {
+		return nil
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.step(nil); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	// Closing releases the handle even after the crash
+	err := f.fs.step(nil)
+	f.File.Close()
+	return err
+}
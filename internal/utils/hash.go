@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"strings"
 )
 
@@ -13,6 +14,21 @@ func HashString(s string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// HashBytes creates a consistent hash for a byte slice
+func HashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashReader creates a hash of everything read from r
+func HashReader(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // ShortHash creates a shorter hash for a string (first 16 characters)
 func ShortHash(s string) string {
 	return HashString(s)[:16]
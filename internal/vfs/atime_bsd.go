@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package vfs
+
+import (
+	"syscall"
+	"time"
+)
+
+// sysAccessTime reads the access time from the stat result of the host
+func sysAccessTime(sys interface{}) (time.Time, bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(st.Atimespec.Sec), int64(st.Atimespec.Nsec)), true
+}
@@ -0,0 +1,366 @@
+//go:build linux
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Confine returns an FS performing the operations of fsys on names below
+// root relative to a descriptor of root, with openat2 and RESOLVE_BENEATH
+// or the *at calls on a parent directory opened that way. A symlink
+// swapped in after ResolveBeneath checked a path therefore cannot lead
+// out of root. Names outside of root, and root itself, are passed to fsys.
+//
+// Only the host filesystem is confined. Other FSs, and kernels without
+// openat2, get fsys back with a nil closer. Otherwise the closer releases
+// the descriptor of root.
+func Confine(fsys FS, root string) (FS, io.Closer) {
+	if _, ok := fsys.(OS); !ok {
+		return fsys, nil
+	}
+	dirfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fsys, nil
+	}
+	fd, err := openBeneath(dirfd, ".", unix.O_PATH, 0)
+	if err != nil {
+		unix.Close(dirfd)
+		return fsys, nil
+	}
+	unix.Close(fd)
+
+	c := &confined{root: root, dirfd: dirfd}
+	return c, c
+}
+
+// confined is the host filesystem confined to a root directory
+type confined struct {
+	OS
+	root  string // Absolute path of the root directory
+	dirfd int    // O_PATH descriptor of the root directory
+}
+
+// Close releases the descriptor of the root directory
+func (c *confined) Close() error {
+	return unix.Close(c.dirfd)
+}
+
+// rel returns name relative to the root if it is below it
+func (c *confined) rel(name string) (string, bool) {
+	if !filepath.IsAbs(name) {
+		return "", false
+	}
+	rel, err := filepath.Rel(c.root, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// open opens a name below the root
+func (c *confined) open(rel string, flags int, mode uint32) (*os.File, error) {
+	fd, err := openBeneath(c.dirfd, rel, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(c.root, rel)), nil
+}
+
+// inParent calls fn with a descriptor of the parent directory of a name
+// below the root and the last component of the name
+func (c *confined) inParent(rel string, fn func(dirfd int, base string) error) error {
+	dir, err := c.open(filepath.Dir(rel), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return fn(int(dir.Fd()), filepath.Base(rel))
+}
+
+// onFile calls fn with the /proc path of the file a name below the root
+// refers to, following a final symlink beneath the root. Chmod, Chown and
+// Chtimes act on the file through this magic link, which cannot be
+// swapped for another file.
+func (c *confined) onFile(op, name, rel string, fn func(path string) error) error {
+	f, err := c.open(rel, unix.O_PATH, 0)
+	if err == nil {
+		err = fn(procPath(int(f.Fd())))
+		f.Close()
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.OpenFile(name, flag, perm)
+	}
+	f, err := c.open(rel, flag, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+func (c *confined) Stat(name string) (os.FileInfo, error) {
+	return c.stat("stat", name, unix.O_PATH)
+}
+
+func (c *confined) Lstat(name string) (os.FileInfo, error) {
+	return c.stat("lstat", name, unix.O_PATH|unix.O_NOFOLLOW)
+}
+
+func (c *confined) stat(op, name string, flags int) (os.FileInfo, error) {
+	rel, ok := c.rel(name)
+	if !ok {
+		if flags&unix.O_NOFOLLOW != 0 {
+			return c.OS.Lstat(name)
+		}
+		return c.OS.Stat(name)
+	}
+	f, err := c.open(rel, flags, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (c *confined) ReadDir(name string) ([]os.DirEntry, error) {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.ReadDir(name)
+	}
+	f, err := c.open(rel, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+func (c *confined) Mkdir(name string, perm os.FileMode) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Mkdir(name, perm)
+	}
+	err := c.inParent(rel, func(dirfd int, base string) error {
+		return unix.Mkdirat(dirfd, base, uint32(perm.Perm()))
+	})
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) MkdirAll(name string, perm os.FileMode) error {
+	if _, ok := c.rel(name); !ok {
+		return c.OS.MkdirAll(name, perm)
+	}
+	if info, err := c.Stat(name); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: unix.ENOTDIR}
+	}
+	if err := c.MkdirAll(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	if err := c.Mkdir(name, perm); err != nil {
+		// Created concurrently
+		if info, serr := c.Lstat(name); serr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory, as os.Remove does
+func (c *confined) Remove(name string) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Remove(name)
+	}
+	err := c.inParent(rel, func(dirfd int, base string) error {
+		err := unix.Unlinkat(dirfd, base, 0)
+		if err == nil {
+			return nil
+		}
+		rmErr := unix.Unlinkat(dirfd, base, unix.AT_REMOVEDIR)
+		if rmErr == nil {
+			return nil
+		}
+		if rmErr != unix.ENOTDIR {
+			err = rmErr
+		}
+		return err
+	})
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) RemoveAll(name string) error {
+	if _, ok := c.rel(name); !ok {
+		return c.OS.RemoveAll(name)
+	}
+	info, err := c.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := c.ReadDir(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if err := c.RemoveAll(filepath.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Rename and Link confine both names only if both are below the root
+func (c *confined) Rename(oldpath, newpath string) error {
+	oldRel, oldOK := c.rel(oldpath)
+	newRel, newOK := c.rel(newpath)
+	if !oldOK || !newOK {
+		return c.OS.Rename(oldpath, newpath)
+	}
+	err := c.inParent(oldRel, func(oldfd int, oldBase string) error {
+		return c.inParent(newRel, func(newfd int, newBase string) error {
+			return unix.Renameat(oldfd, oldBase, newfd, newBase)
+		})
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) Link(oldname, newname string) error {
+	oldRel, oldOK := c.rel(oldname)
+	newRel, newOK := c.rel(newname)
+	if !oldOK || !newOK {
+		return c.OS.Link(oldname, newname)
+	}
+	err := c.inParent(oldRel, func(oldfd int, oldBase string) error {
+		return c.inParent(newRel, func(newfd int, newBase string) error {
+			return unix.Linkat(oldfd, oldBase, newfd, newBase, 0)
+		})
+	})
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) Symlink(oldname, newname string) error {
+	rel, ok := c.rel(newname)
+	if !ok {
+		return c.OS.Symlink(oldname, newname)
+	}
+	err := c.inParent(rel, func(dirfd int, base string) error {
+		return unix.Symlinkat(oldname, dirfd, base)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (c *confined) Readlink(name string) (string, error) {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Readlink(name)
+	}
+	var target string
+	err := c.inParent(rel, func(dirfd int, base string) error {
+		for size := 128; ; size *= 2 {
+			buf := make([]byte, size)
+			n, err := unix.Readlinkat(dirfd, base, buf)
+			if err != nil {
+				return err
+			}
+			if n < size {
+				target = string(buf[:n])
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+func (c *confined) Chmod(name string, mode os.FileMode) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Chmod(name, mode)
+	}
+	return c.onFile("chmod", name, rel, func(path string) error {
+		return unix.Chmod(path, uint32(mode.Perm()))
+	})
+}
+
+func (c *confined) Chown(name string, uid, gid int) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Chown(name, uid, gid)
+	}
+	return c.onFile("chown", name, rel, func(path string) error {
+		return unix.Chown(path, uid, gid)
+	})
+}
+
+func (c *confined) Chtimes(name string, atime, mtime time.Time) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Chtimes(name, atime, mtime)
+	}
+	return c.onFile("chtimes", name, rel, func(path string) error {
+		err := os.Chtimes(path, atime, mtime)
+		if pe, ok := err.(*os.PathError); ok {
+			return pe.Err
+		}
+		return err
+	})
+}
+
+func (c *confined) Truncate(name string, size int64) error {
+	rel, ok := c.rel(name)
+	if !ok {
+		return c.OS.Truncate(name, size)
+	}
+	f, err := c.open(rel, unix.O_WRONLY, 0)
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: name, Err: err}
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
@@ -0,0 +1,69 @@
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// FileID identifies a file independently of the names linking to it
+type FileID struct {
+	Dev uint64 // Device the file is on
+	Ino uint64 // Inode number, unique per device
+}
+
+// Stat is what the FileInfos of FSs not stored on the host filesystem
+// return from Sys, so that Identity, Owner and AccessTime work for them
+// as well
+type Stat struct {
+	ID    FileID
+	Nlink uint64    // Number of names linking to the file
+	Uid   int       // User owning the file
+	Gid   int       // Group owning the file
+	Atime time.Time // Last access
+}
+
+// Identity returns the identity of the file described by info and the
+// number of names linking to it. It reports false when the FS does not
+// keep track of file identity, as for archives.
+func Identity(info os.FileInfo) (FileID, uint64, bool) {
+	if st, ok := info.Sys().(*Stat); ok {
+		return st.ID, st.Nlink, true
+	}
+	return sysIdentity(info.Sys())
+}
+
+// ownerInfo is implemented by FileInfos that report their owner
+// themselves, as those of archive entries do
+type ownerInfo interface {
+	Owner() (uid, gid int, ok bool)
+}
+
+// accessTimeInfo is implemented by FileInfos that report their access time
+// themselves
+type accessTimeInfo interface {
+	AccessTime() (time.Time, bool)
+}
+
+// Owner returns the user and group owning the file described by info. It
+// reports false when the FS does not keep track of owners.
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	if oi, ok := info.(ownerInfo); ok {
+		return oi.Owner()
+	}
+	if st, ok := info.Sys().(*Stat); ok {
+		return st.Uid, st.Gid, true
+	}
+	return sysOwner(info.Sys())
+}
+
+// AccessTime returns when the file described by info was last accessed.
+// It reports false when the FS does not keep track of access times.
+func AccessTime(info os.FileInfo) (time.Time, bool) {
+	if ai, ok := info.(accessTimeInfo); ok {
+		return ai.AccessTime()
+	}
+	if st, ok := info.Sys().(*Stat); ok {
+		return st.Atime, true
+	}
+	return sysAccessTime(info.Sys())
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package vfs
+
+import "time"
+
+// sysIdentity reports false: os.FileInfo does not expose the file index
+// outside of Unix
+func sysIdentity(sys interface{}) (FileID, uint64, bool) {
+	return FileID{}, 0, false
+}
+
+// sysOwner reports false: files have no numeric owners outside of Unix
+func sysOwner(sys interface{}) (int, int, bool) {
+	return 0, 0, false
+}
+
+// sysAccessTime reports false, as the other host information is not read
+// outside of Unix
+func sysAccessTime(sys interface{}) (time.Time, bool) {
+	return time.Time{}, false
+}
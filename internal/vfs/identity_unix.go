@@ -0,0 +1,23 @@
+//go:build unix
+
+package vfs
+
+import "syscall"
+
+// sysIdentity reads the identity from the stat result of the host
+func sysIdentity(sys interface{}) (FileID, uint64, bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, 0, false
+	}
+	return FileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
+
+// sysOwner reads the owner from the stat result of the host
+func sysOwner(sys interface{}) (int, int, bool) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,687 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memDevices hands out the device numbers of Mems, so that files of
+// different Mems never share an identity
+var memDevices atomic.Uint64
+
+// Mem is an in-memory FS that models what survives a crash. File content
+// becomes durable when the file is synced; namespace changes (create,
+// rename, remove, mkdir) and metadata changes (chmod, chown, chtimes) are
+// durable as soon as they return. Access times are only set by Chtimes,
+// as on a filesystem mounted noatime. Crash throws
+// away everything that is not durable and invalidates open files.
+type Mem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // Files, directories and symlinks by cleaned path
+	epoch int                 // Incremented by Crash to invalidate open files
+	dev   uint64              // Device number of the files
+	inos  uint64              // Last inode number handed out
+}
+
+// memNode is a file, directory or symlink. Hard links share one node.
+type memNode struct {
+	id      FileID
+	nlink   uint64 // Number of paths the node is stored under
+	dir     bool
+	mode    os.FileMode
+	uid     int
+	gid     int
+	modTime time.Time
+	atime   time.Time
+	data    []byte // Current content
+	durable []byte // Content as of the last sync
+	link    string // Target of a symlink
+}
+
+// NewMem returns an empty in-memory FS holding only the root directory
+func NewMem() *Mem {
+	m := &Mem{nodes: make(map[string]*memNode), dev: memDevices.Add(1)}
+	m.nodes[string(filepath.Separator)] = m.newNode(&memNode{dir: true, mode: os.ModeDir | 0755, modTime: time.Now()})
+	return m
+}
+
+// newNode gives a node created under one path its identity, the owner of
+// the process and an access time. The caller must hold m.mu.
+func (m *Mem) newNode(n *memNode) *memNode {
+	m.inos++
+	n.id = FileID{Dev: m.dev, Ino: m.inos}
+	n.nlink = 1
+	n.uid, n.gid = os.Getuid(), os.Getgid()
+	n.atime = n.modTime
+	return n
+}
+
+// Crash discards all content that was not synced and closes every open file
+func (m *Mem) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.epoch++
+	for _, n := range m.nodes {
+		if !n.dir {
+			n.data = append([]byte(nil), n.durable...)
+		}
+	}
+}
+
+// Paths returns every path in the FS in sorted order
+func (m *Mem) Paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := make([]string, 0, len(m.nodes))
+	for p := range m.nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func pathErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve follows the symlinks in name, and in its last component only
+// with follow set. The caller must hold m.mu.
+func (m *Mem) resolve(op, name string, follow bool) (string, error) {
+	parts := splitName(name)
+	resolved := string(filepath.Separator)
+
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		n, ok := m.nodes[next]
+		if !ok || n.mode&os.ModeSymlink == 0 || (len(parts) == 0 && !follow) {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", pathErr(op, name, errors.New("too many levels of symbolic links"))
+		}
+		if filepath.IsAbs(n.link) {
+			resolved = string(filepath.Separator)
+		}
+		parts = append(splitName(n.link), parts...)
+	}
+	return resolved, nil
+}
+
+// parent returns the directory node that would hold name. The caller must
+// hold m.mu.
+func (m *Mem) parent(op, name string) error {
+	dir, ok := m.nodes[filepath.Dir(name)]
+	if !ok {
+		return pathErr(op, name, os.ErrNotExist)
+	}
+	if !dir.dir {
+		return pathErr(op, name, errors.New("not a directory"))
+	}
+	return nil
+}
+
+func (m *Mem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := m.nodes[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathErr("open", name, os.ErrNotExist)
+	case !ok:
+		if err := m.parent("open", name); err != nil {
+			return nil, err
+		}
+		n = m.newNode(&memNode{mode: perm.Perm(), modTime: time.Now()})
+		m.nodes[name] = n
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if n.dir && writable {
+		return nil, pathErr("open", name, errors.New("is a directory"))
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+
+	return &memFile{m: m, name: name, node: n, flag: flag, epoch: m.epoch}, nil
+}
+
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	return m.stat("stat", name, true)
+}
+
+func (m *Mem) Lstat(name string) (os.FileInfo, error) {
+	return m.stat("lstat", name, false)
+}
+
+func (m *Mem) stat(op, name string, follow bool) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, pathErr(op, name, os.ErrNotExist)
+	}
+	return n.info(name), nil
+}
+
+func (m *Mem) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, pathErr("readdir", name, os.ErrNotExist)
+	}
+	if !n.dir {
+		return nil, pathErr("readdir", name, errors.New("not a directory"))
+	}
+
+	var entries []os.DirEntry
+	for p, child := range m.nodes {
+		if p != name && filepath.Dir(p) == name {
+			entries = append(entries, iofs.FileInfoToDirEntry(child.info(p)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *Mem) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.nodes[name]; ok {
+		return pathErr("mkdir", name, os.ErrExist)
+	}
+	if err := m.parent("mkdir", name); err != nil {
+		return err
+	}
+	m.nodes[name] = m.newNode(&memNode{dir: true, mode: os.ModeDir | perm.Perm(), modTime: time.Now()})
+	return nil
+}
+
+func (m *Mem) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	name, err := m.resolve("mkdir", name, true)
+	n, ok := m.nodes[name]
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if !n.dir {
+			return pathErr("mkdir", name, errors.New("not a directory"))
+		}
+		return nil
+	}
+
+	if parent := filepath.Dir(name); parent != name {
+		if err := m.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := m.Mkdir(name, perm); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return pathErr("remove", name, os.ErrNotExist)
+	}
+	if n.dir {
+		for p := range m.nodes {
+			if p != name && filepath.Dir(p) == name {
+				return pathErr("remove", name, errors.New("directory not empty"))
+			}
+		}
+	}
+	n.nlink--
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *Mem) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("removeall", name, false)
+	if err != nil {
+		return err
+	}
+	below := name + string(filepath.Separator)
+	for p, n := range m.nodes {
+		if p == name || strings.HasPrefix(p, below) {
+			n.nlink--
+			delete(m.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (m *Mem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, err := m.resolve("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	if newpath, err = m.resolve("rename", newpath, false); err != nil {
+		return err
+	}
+	n, ok := m.nodes[oldpath]
+	if !ok {
+		return pathErr("rename", oldpath, os.ErrNotExist)
+	}
+	if err := m.parent("rename", newpath); err != nil {
+		return err
+	}
+	target, replaced := m.nodes[newpath]
+	if replaced && target.dir != n.dir {
+		return pathErr("rename", newpath, os.ErrExist)
+	}
+	if replaced && target != n {
+		target.nlink--
+	}
+
+	moved := map[string]*memNode{newpath: n}
+	delete(m.nodes, oldpath)
+	if n.dir {
+		below := oldpath + string(filepath.Separator)
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, below) {
+				delete(m.nodes, p)
+				moved[filepath.Join(newpath, strings.TrimPrefix(p, below))] = child
+			}
+		}
+	}
+	for p, child := range moved {
+		m.nodes[p] = child
+	}
+	return nil
+}
+
+func (m *Mem) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return pathErr("chmod", name, os.ErrNotExist)
+	}
+	n.mode = n.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+// Chown changes the owner of a file, leaving an ID of -1 unchanged
+func (m *Mem) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("chown", name, true)
+	if err != nil {
+		return err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return pathErr("chown", name, os.ErrNotExist)
+	}
+	if uid != -1 {
+		n.uid = uid
+	}
+	if gid != -1 {
+		n.gid = gid
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of a file, leaving a
+// zero time unchanged
+func (m *Mem) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return pathErr("chtimes", name, os.ErrNotExist)
+	}
+	if !atime.IsZero() {
+		n.atime = atime
+	}
+	if !mtime.IsZero() {
+		n.modTime = mtime
+	}
+	return nil
+}
+
+func (m *Mem) Truncate(name string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("truncate", name, true)
+	if err != nil {
+		return err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return pathErr("truncate", name, os.ErrNotExist)
+	}
+	n.truncate(size)
+	return nil
+}
+
+func (m *Mem) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newname, err := m.resolve("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.nodes[newname]; ok {
+		return pathErr("symlink", newname, os.ErrExist)
+	}
+	if err := m.parent("symlink", newname); err != nil {
+		return err
+	}
+	m.nodes[newname] = m.newNode(&memNode{mode: os.ModeSymlink | 0777, modTime: time.Now(), link: oldname})
+	return nil
+}
+
+// Link stores the node of oldname under newname as well. As with link(2)
+// on Linux, a symlink in oldname is linked itself.
+func (m *Mem) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldname, err := m.resolve("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if newname, err = m.resolve("link", newname, false); err != nil {
+		return err
+	}
+	n, ok := m.nodes[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if n.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	if _, ok := m.nodes[newname]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if err := m.parent("link", newname); err != nil {
+		return err
+	}
+	n.nlink++
+	m.nodes[newname] = n
+	return nil
+}
+
+func (m *Mem) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := m.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return "", pathErr("readlink", name, os.ErrNotExist)
+	}
+	if n.mode&os.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, errors.New("invalid argument"))
+	}
+	return n.link, nil
+}
+
+func (n *memNode) truncate(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.modTime = time.Now()
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+		sys:     &Stat{ID: n.id, Nlink: n.nlink, Uid: n.uid, Gid: n.gid, Atime: n.atime},
+	}
+}
+
+// memInfo describes a node of a Mem
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     *Stat
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() os.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() interface{}   { return i.sys }
+
+// memFile is an open file of a Mem
+type memFile struct {
+	m      *Mem
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	epoch  int
+	closed bool
+}
+
+// check fails once the file is closed or the FS has crashed. The caller
+// must hold f.m.mu.
+func (f *memFile) check(op string) error {
+	if f.closed || f.epoch != f.m.epoch {
+		return pathErr(op, f.name, os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, pathErr("read", f.name, errors.New("bad file descriptor"))
+	}
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, off)
+	f.offset = off + int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathErr("write", f.name, errors.New("bad file descriptor"))
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.truncate(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, errors.New("invalid argument"))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	f.node.durable = append(f.node.durable[:0:0], f.node.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	f.node.truncate(size)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if f.closed {
+		return pathErr("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
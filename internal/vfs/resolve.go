@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutside is returned when resolving a name leaves the directory it is
+// resolved beneath, through ".." or a symlink
+var ErrOutside = errors.New("path resolves outside of the directory")
+
+// maxLinks is the number of symlinks a resolution follows before giving
+// up, as on Linux
+const maxLinks = 40
+
+// Resolver is implemented by FSs that can resolve a name beneath a
+// directory in one step, the way openat2 with RESOLVE_BENEATH does on
+// Linux. ResolveBeneath returns errors.ErrUnsupported when it cannot be
+// used, so that the portable resolution is used instead.
+type Resolver interface {
+	ResolveBeneath(dir, name string, follow bool) (string, error)
+}
+
+// ResolveBeneath resolves name relative to dir, following symlinks
+// component by component, and returns the resulting path below dir.
+// Resolutions leaving dir fail with ErrOutside; that includes every
+// absolute symlink. A final symlink is only followed with follow set, so
+// that operations can act on the link itself. Components that do not
+// exist are taken as they are.
+func ResolveBeneath(fsys FS, dir, name string, follow bool) (string, error) {
+	if r, ok := fsys.(Resolver); ok {
+		resolved, err := r.ResolveBeneath(dir, name, follow)
+		// Missing files are resolved by walking up to the first missing
+		// component, which also follows a dangling final symlink
+		if !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, os.ErrNotExist) {
+			return resolved, err
+		}
+	}
+	return walkBeneath(fsys, dir, name, follow)
+}
+
+// walkBeneath resolves name below dir with Lstat and Readlink
+func walkBeneath(fsys FS, dir, name string, follow bool) (string, error) {
+	parts := splitName(name)
+	resolved := dir
+	missing := false // Whether a component did not exist, so none below can be a symlink
+
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		if part == ".." {
+			if resolved == dir {
+				return "", &os.PathError{Op: "resolve", Path: name, Err: ErrOutside}
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		if missing || (len(parts) == 0 && !follow) {
+			resolved = next
+			continue
+		}
+
+		info, err := fsys.Lstat(next)
+		if os.IsNotExist(err) {
+			missing = true
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		target, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: ErrOutside}
+		}
+		parts = append(splitName(target), parts...)
+	}
+
+	return resolved, nil
+}
+
+// splitName splits a relative name into its components, dropping empty
+// and "." components
+func splitName(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ResolveBeneath resolves name with openat2 and RESOLVE_BENEATH, so the
+// kernel rejects every step out of dir, and reads the result back from
+// /proc. Kernels before 5.6 and sandboxes blocking openat2 fall back to
+// the portable resolution.
+func (OS) ResolveBeneath(dir, name string, follow bool) (string, error) {
+	dirfd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(dirfd)
+
+	rel := strings.TrimLeft(name, "/")
+	if rel == "" || rel == "." {
+		return dir, nil
+	}
+
+	flags := unix.O_PATH
+	if !follow {
+		flags |= unix.O_NOFOLLOW
+	}
+	fd, err := openBeneath(dirfd, rel, flags, 0)
+	if err == unix.ENOSYS || err == unix.EPERM {
+		return "", errors.ErrUnsupported
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "openat2", Path: name, Err: err}
+	}
+	defer unix.Close(fd)
+
+	// The kernel reports real paths, so the result is rebased onto dir in
+	// case dir itself contains symlinks
+	realDir, err := fdPath(dirfd)
+	if err != nil {
+		return "", errors.ErrUnsupported
+	}
+	resolved, err := fdPath(fd)
+	if err != nil {
+		return "", errors.ErrUnsupported
+	}
+	below, err := filepath.Rel(realDir, resolved)
+	if err != nil || below == ".." || strings.HasPrefix(below, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "openat2", Path: name, Err: ErrOutside}
+	}
+	return filepath.Join(dir, below), nil
+}
+
+// openBeneath opens name relative to dirfd with openat2, failing with
+// ErrOutside for any resolution leaving dirfd
+func openBeneath(dirfd int, name string, flags int, mode uint32) (int, error) {
+	how := &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	var err error
+	// EAGAIN reports a concurrent rename the kernel could not rule out
+	for i := 0; i < 8; i++ {
+		var fd int
+		fd, err = unix.Openat2(dirfd, name, how)
+		if err == nil {
+			return fd, nil
+		}
+		if err != unix.EAGAIN && err != unix.EINTR {
+			break
+		}
+	}
+	if err == unix.EXDEV {
+		return -1, ErrOutside
+	}
+	return -1, err
+}
+
+// fdPath returns the path an open file descriptor refers to
+func fdPath(fd int) (string, error) {
+	return os.Readlink(procPath(fd))
+}
+
+// procPath returns the magic link of an open file descriptor in /proc
+func procPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
@@ -0,0 +1,145 @@
+// Package vfs abstracts the filesystem operations SimpleFS performs, so
+// that tests can run them against an in-memory or fault-injecting
+// implementation instead of the operating system.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// FS is the set of filesystem operations SimpleFS performs. Names are
+// absolute paths in the host syntax.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldpath, newpath string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Truncate(name string, size int64) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Link(oldname, newname string) error
+}
+
+// File is an open file of an FS. It is an alias of an unnamed interface
+// so that the public BackendFile, declared with the same methods, is the
+// identical type and an FS satisfies the public Backend.
+type File = interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Default is the FS used by filesystems and journals opened without a
+// backend of their own
+var Default FS = OS{}
+
+// OS performs the operations on the host filesystem
+type OS struct{}
+
+func (OS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a typed nil
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OS) Lstat(name string) (os.FileInfo, error)       { return os.Lstat(name) }
+func (OS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (OS) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (OS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (OS) Remove(name string) error                     { return os.Remove(name) }
+func (OS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (OS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (OS) Chown(name string, uid, gid int) error        { return os.Chown(name, uid, gid) }
+func (OS) Truncate(name string, size int64) error       { return os.Truncate(name, size) }
+func (OS) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (OS) Readlink(name string) (string, error)         { return os.Readlink(name) }
+func (OS) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+
+func (OS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Open opens a file for reading
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a file for reading and writing
+func Create(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// ReadFile reads a whole file
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// WriteFile writes data to a file, creating it with perm if needed
+func WriteFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// tempSeq makes temporary names unique within the process
+var tempSeq atomic.Uint64
+
+// CreateTemp creates a new file in dir whose name starts with prefix
+func CreateTemp(fsys FS, dir, prefix string) (File, error) {
+	for i := 0; i < 100; i++ {
+		suffix := strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(tempSeq.Add(1), 36)
+		f, err := fsys.OpenFile(filepath.Join(dir, prefix+suffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// SyncDir makes the entries of a directory durable. Errors are ignored,
+// since not every platform can sync directories.
+func SyncDir(fsys FS, dir string) {
+	if d, err := Open(fsys, dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
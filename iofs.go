@@ -0,0 +1,276 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ioFS adapts a SimpleFS to the io/fs interfaces
+type ioFS struct {
+	fs     *SimpleFS
+	prefix string // Directory the view is rooted at, "." for the filesystem root
+}
+
+// AsIOFS returns a view of the filesystem implementing io/fs.FS, fs.ReadDirFS,
+// fs.ReadFileFS, fs.StatFS and fs.SubFS. Internal directories (.journal,
+// .attributes, .versions) are hidden and FileInfo.Sys returns the file's
+// extended attributes as a map[string]string.
+func (fs *SimpleFS) AsIOFS() iofs.FS {
+	return &ioFS{fs: fs, prefix: "."}
+}
+
+var (
+	_ iofs.ReadDirFS  = (*ioFS)(nil)
+	_ iofs.ReadFileFS = (*ioFS)(nil)
+	_ iofs.StatFS     = (*ioFS)(nil)
+	_ iofs.SubFS      = (*ioFS)(nil)
+)
+
+// resolve validates an io/fs name and maps it to a SimpleFS path
+func (f *ioFS) resolve(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		if isInternalName(elem) {
+			return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+		}
+	}
+
+	return path.Join(f.prefix, name), nil
+}
+
+// Open opens the named file or directory
+func (f *ioFS) Open(name string) (iofs.File, error) {
+	p, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.fs.Stat(p)
+	if err != nil {
+		return nil, toPathError("open", name, err)
+	}
+
+	if info.IsDir {
+		return &ioDir{fsys: f, name: name, info: ioFileInfo{info: *info, name: path.Base(name)}}, nil
+	}
+
+	file, err := f.fs.Open(p)
+	if err != nil {
+		return nil, toPathError("open", name, err)
+	}
+
+	return &ioFile{file: file, name: path.Base(name)}, nil
+}
+
+// ReadFile reads the named file
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	p, err := f.resolve("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.fs.ReadFile(p)
+	if err != nil {
+		return nil, toPathError("readfile", name, err)
+	}
+
+	return data, nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name
+func (f *ioFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	p, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := f.fs.ListDir(p)
+	if err != nil {
+		return nil, toPathError("readdir", name, err)
+	}
+
+	entries := make([]iofs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, iofs.FileInfoToDirEntry(ioFileInfo{info: info, name: info.Name}))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// Stat returns file info for the named file
+func (f *ioFS) Stat(name string) (iofs.FileInfo, error) {
+	p, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.fs.Stat(p)
+	if err != nil {
+		return nil, toPathError("stat", name, err)
+	}
+
+	return ioFileInfo{info: *info, name: path.Base(name)}, nil
+}
+
+// Sub returns a view rooted at dir
+func (f *ioFS) Sub(dir string) (iofs.FS, error) {
+	p, err := f.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == "." {
+		return f, nil
+	}
+
+	info, err := f.fs.Stat(p)
+	if err != nil {
+		return nil, toPathError("sub", dir, err)
+	}
+	if !info.IsDir {
+		return nil, &iofs.PathError{Op: "sub", Path: dir, Err: errors.New("not a directory")}
+	}
+
+	return &ioFS{fs: f.fs, prefix: p}, nil
+}
+
+// toPathError rewrites errors from the underlying filesystem so they
+// reference the io/fs name rather than the absolute OS path
+func toPathError(op, name string, err error) error {
+	var pe *iofs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// ioFileInfo adapts FileInfo to io/fs.FileInfo
+type ioFileInfo struct {
+	info FileInfo
+	name string
+}
+
+func (i ioFileInfo) Name() string                 { return i.name }
+func (i ioFileInfo) Size() int64                  { return i.info.Size }
+func (i ioFileInfo) Mode() iofs.FileMode          { return i.info.Mode }
+func (i ioFileInfo) ModTime() time.Time           { return i.info.ModTime }
+func (i ioFileInfo) IsDir() bool                  { return i.info.IsDir }
+func (i ioFileInfo) Sys() interface{}             { return i.info.Attributes }
+func (i ioFileInfo) String() string               { return iofs.FormatFileInfo(i) }
+func (i ioFileInfo) Type() iofs.FileMode          { return i.info.Mode.Type() }
+func (i ioFileInfo) Info() (iofs.FileInfo, error) { return i, nil }
+
+// ioFile adapts a File to io/fs.File. It only exposes reading, so the
+// view cannot be written through with a type assertion.
+type ioFile struct {
+	file *File
+	name string
+}
+
+// Read reads up to len(p) bytes from the file
+func (f *ioFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+// ReadAt reads len(p) bytes from the file starting at byte offset off
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+// Seek sets the offset for the next Read
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+// Stat returns io/fs file info for the open file
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ioFileInfo{info: *info, name: f.name}, nil
+}
+
+// Close closes the file
+func (f *ioFile) Close() error {
+	return f.file.Close()
+}
+
+// ioDir is an open directory implementing io/fs.ReadDirFile
+type ioDir struct {
+	fsys    *ioFS
+	name    string
+	info    ioFileInfo
+	entries []iofs.DirEntry
+	loaded  bool
+	offset  int
+	closed  bool
+}
+
+// Stat returns file info for the directory
+func (d *ioDir) Stat() (iofs.FileInfo, error) {
+	if d.closed {
+		return nil, &iofs.PathError{Op: "stat", Path: d.name, Err: iofs.ErrClosed}
+	}
+	return d.info, nil
+}
+
+// Read always fails, directories can't be read as files
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// Close closes the directory
+func (d *ioDir) Close() error {
+	if d.closed {
+		return &iofs.PathError{Op: "close", Path: d.name, Err: iofs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
+
+// ReadDir reads the directory contents following the io/fs.ReadDirFile contract
+func (d *ioDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if d.closed {
+		return nil, &iofs.PathError{Op: "readdir", Path: d.name, Err: iofs.ErrClosed}
+	}
+
+	if !d.loaded {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.loaded = true
+	}
+
+	remaining := len(d.entries) - d.offset
+	if n <= 0 {
+		entries := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return entries, nil
+	}
+
+	if remaining == 0 {
+		return nil, io.EOF
+	}
+	if n > remaining {
+		n = remaining
+	}
+
+	entries := d.entries[d.offset : d.offset+n]
+	d.offset += n
+	return entries, nil
+}
@@ -0,0 +1,57 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAsIOFS(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	for path, content := range map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     "bb",
+		"dir/sub/c.txt": "ccc",
+	} {
+		if err := fs.WriteFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Versions, attributes and the journal must stay hidden
+	if err := fs.WriteFile("a.txt", []byte("a2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("a.txt", "tag", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fs.AsIOFS()
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "dir/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := iofs.Sub(fsys, "dir")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+	if err := fstest.TestFS(sub, "b.txt", "sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsIOFSIsReadOnly(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	if err := fs.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.AsIOFS().Open("a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if _, ok := f.(io.Writer); ok {
+		t.Fatal("file opened through AsIOFS can be written to")
+	}
+}
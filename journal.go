@@ -1,16 +1,51 @@
 package fs
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// Journal operations
+const (
+	JournalWrite         = "write"         // File content written
+	JournalDelete        = "delete"        // File or directory removed
+	JournalMkdir         = "mkdir"         // Directory created
+	JournalSetAttr       = "setattr"       // Extended attribute set
+	JournalDeleteAttr    = "deleteattr"    // Extended attribute removed
+	JournalCopy          = "copy"          // File copied, with the copied content
+	JournalRmdir         = "rmdir"         // Directory removed with its contents
+	JournalVersion       = "version"       // Version of a file created
+	JournalDeleteVersion = "deleteversion" // Version of a file removed
+	JournalVersionDesc   = "versiondesc"   // Description of a version changed
+	JournalSymlink       = "symlink"       // Symlink created, pointing to the "target" attribute
+	JournalLink          = "link"          // Hard link created to the "source" attribute
+	JournalChmod         = "chmod"         // Permission bits changed to the "mode" attribute
+	JournalChown         = "chown"         // Owner changed to the "uid" and "gid" attributes
+	JournalChtimes       = "chtimes"       // Times changed to the "atime" and "mtime" attributes
+)
+
+// Journal transaction control records
+const (
+	JournalBegin      = "begin"      // Transaction started
+	JournalCommit     = "commit"     // Transaction durable, must be applied
+	JournalAbort      = "abort"      // Transaction discarded
+	JournalCheckpoint = "checkpoint" // Transaction applied to disk
 )
 
+// maxJournalBuffer is the largest write buffer the journal keeps between appends
+const maxJournalBuffer = 1 << 20
+
 // JournalEntry represents a single operation in the journal
 type JournalEntry struct {
+	LSN        uint64            // Log sequence number, increasing across the journal
+	TxID       uint64            // Transaction the entry belongs to (0 for legacy entries)
 	Operation  string            // Type of operation (write, delete, mkdir, etc.)
 	Path       string            // Relative path within the filesystem
 	Data       []byte            // File data for write operations
@@ -18,205 +53,495 @@ type JournalEntry struct {
 	Attributes map[string]string // Associated attributes
 }
 
-// Journal handles transaction logging for crash recovery
+// Journal is a write-ahead log for crash recovery.
+//
+// Every mutating operation is written as a transaction: a begin record, the
+// operation records and a commit record, flushed to disk before the
+// operation touches the filesystem. Once the operation has been applied a
+// checkpoint record is appended; if it fails an abort record is appended
+// instead. Recovery redoes transactions that committed but never reached a
+// checkpoint and rolls back the ones that never committed.
 type Journal struct {
-	path   string     // Path to the journal file
-	mu     sync.Mutex // Mutex for thread safety
-	file   *os.File   // Journal file handle
-	buffer []byte     // Buffer for journal operations
+	path         string              // Path to the active journal file
+	fsys         vfs.FS              // Filesystem the journal files live on
+	format       JournalFormat       // Record format of the journal file
+	opts         JournalOptions      // Segmenting and retention settings
+	mu           sync.Mutex          // Mutex for thread safety
+	file         vfs.File            // Journal file handle
+	size         int64               // Current size of the active file
+	buffer       []byte              // Buffer for journal operations
+	nextLSN      uint64              // Next log sequence number to assign
+	nextTxID     uint64              // Next transaction ID to assign
+	segmentStart uint64              // LSN of the first record in the active file
+	activeGen    uint64              // Bumped whenever the active file is replaced by sealing or truncation
+	open         map[uint64]uint64   // Begin LSN of transactions not yet checkpointed or aborted
+	pinned       map[string]int      // Blobs stored for writes that are not journaled yet
+	blobRefs     map[string]int      // References to each blob from the retained journal files
+	fileBlobs    map[string][]string // Blobs referenced by each retained journal file
+	compactedAt  uint64              // Next LSN at the time of the last journal-wide checkpoint
+	tornAt       int64               // Offset of an incomplete record found at the end of the active file on open
+	tornBytes    int64               // Length of that record, 0 once a recovery has reported it
+	tornCut      bool                // Whether that record has been cut off the file
+	syncMu       sync.Mutex          // Serializes group commit fsyncs
+	synced       atomic.Uint64       // Highest LSN known to be on stable storage
+	changed      chan struct{}       // Closed and replaced whenever records are written
+	stop         chan struct{}       // Closed to stop the checkpoint loop
+	done         chan struct{}       // Closed when the checkpoint loop has exited
+	closeOnce    sync.Once           // Stops the checkpoint loop once
+}
+
+// JournalOptions configures a journal
+type JournalOptions struct {
+	Format             JournalFormat    // Record format of a new journal; an existing one keeps its format
+	SegmentSize        int64            // Size at which the active file is sealed into a segment (0 = never)
+	CheckpointInterval time.Duration    // How often the journal is compacted (0 = only when a segment is sealed)
+	Retention          JournalRetention // What happens to compacted segments
+	SpillThreshold     int64            // Write payloads larger than this are stored as blobs (0 = only those over 32 MiB)
+	GroupCommit        bool             // Share fsyncs between concurrent callers
+	MaxBatchDelay      time.Duration    // How long a group commit waits for more callers before syncing
+	Backend            Backend          // Storage the journal files live on (nil = host filesystem)
 }
 
+// ErrJournalClosed is returned by operations on a closed journal, and by
+// Subscribe once the filesystem is closed
+var ErrJournalClosed = errors.New("journal is closed")
+
 // NewJournal creates a new journal at the specified path
 func NewJournal(path string) (*Journal, error) {
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return OpenJournal(path, JournalOptions{})
+}
+
+// OpenJournal opens or creates a journal at the specified path. A torn
+// record at the end of an existing file, left by a crash mid-write, is
+// truncated away by the first write or recovery, and reported by the first
+// recovery. An existing journal is read and appended to in its own
+// format whatever opts.Format says.
+//
+// The file at path is the active segment. When it grows past
+// opts.SegmentSize it is sealed under the name path.<first LSN> and a new
+// active file is started. Sealed segments are retired once every
+// transaction in them has been checkpointed or aborted.
+func OpenJournal(path string, opts JournalOptions) (*Journal, error) {
+	if opts.Retention.ArchiveDir != "" && !filepath.IsAbs(opts.Retention.ArchiveDir) {
+		opts.Retention.ArchiveDir = filepath.Join(filepath.Dir(path), opts.Retention.ArchiveDir)
+	}
+
+	j := &Journal{
+		path:     path,
+		fsys:     backendOrDefault(opts.Backend),
+		format:   opts.Format,
+		opts:     opts,
+		buffer:   make([]byte, 0, 4096),
+		nextLSN:  1,
+		nextTxID: 1,
+		pinned:   make(map[string]int),
+		changed:  make(chan struct{}),
+
+		blobRefs:  make(map[string]int),
+		fileBlobs: make(map[string][]string),
+	}
+	removeBlobTemps(j.fsys, j.blobDir())
+
+	// An existing journal keeps its format, converting it is left to ConvertJournal
+	existing, ok, err := detectJournalFormat(j.fsys, path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read journal file: %w", err)
+	}
+	if ok {
+		j.format = existing
+	}
+
+	scan, err := scanJournal(j.fsys, path)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read journal file: %w", err)
+	}
+	// A torn record at the end is only cut off before the next write, so
+	// that a dry-run recovery can report it without touching the journal
+	if scan.torn {
+		j.tornAt = scan.validSize
+	}
+
+	// Continue numbering after whatever is already in the journal
+	for _, entry := range scan.entries {
+		if entry.LSN >= j.nextLSN {
+			j.nextLSN = entry.LSN + 1
+		}
+		if entry.TxID >= j.nextTxID {
+			j.nextTxID = entry.TxID + 1
+		}
+	}
+	j.open = openTransactions(scan.entries)
+	for file, hashes := range scan.blobs {
+		j.addBlobRefs(file, hashes...)
+	}
+	if err := j.loadArchivedBlobRefs(); err != nil {
+		return nil, err
+	}
+	j.synced.Store(j.nextLSN - 1)
+	j.compactedAt = j.nextLSN
+
+	j.segmentStart = j.nextLSN
+	if scan.activeStart != 0 {
+		j.segmentStart = scan.activeStart
+	}
+
+	if err := j.openFile(); err != nil {
 		return nil, fmt.Errorf("failed to open journal file: %w", err)
 	}
+	if scan.torn {
+		j.tornBytes = j.size - scan.validSize
+		j.size = scan.validSize
+	}
 
-	return &Journal{
-		path:   path,
-		file:   file,
-		buffer: make([]byte, 0, 4096),
-	}, nil
+	if opts.CheckpointInterval > 0 {
+		j.stop = make(chan struct{})
+		j.done = make(chan struct{})
+		go j.checkpointLoop(opts.CheckpointInterval)
+	}
+
+	return j, nil
 }
 
-// Log adds an entry to the journal
-func (j *Journal) Log(entry JournalEntry) error {
-	j.mu.Lock()
-	defer j.mu.Unlock()
+// Format returns the record format of the journal
+func (j *Journal) Format() JournalFormat {
+	return j.format
+}
 
-	data, err := json.Marshal(entry)
+// openFile opens the journal file for appending, writing the format
+// header if the file is new. The caller must hold j.mu or own j.
+func (j *Journal) openFile() error {
+	file, err := j.fsys.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to marshal journal entry: %w", err)
+		return err
 	}
 
-	data = append(data, '\n')
-	_, err = j.file.Write(data)
+	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to write to journal: %w", err)
+		file.Close()
+		return err
+	}
+	j.size = info.Size()
+
+	if j.format == JournalFormatBinary && j.size == 0 {
+		if _, err := file.Write(binaryJournalMagic); err != nil {
+			file.Close()
+			return err
+		}
+		j.size = int64(len(binaryJournalMagic))
 	}
 
-	return j.file.Sync()
+	j.file = file
+	return nil
 }
 
-// Close closes the journal file
-func (j *Journal) Close() error {
+// Log adds a standalone entry to the journal and returns once it is durable
+func (j *Journal) Log(entry JournalEntry) error {
+	entries := []JournalEntry{entry}
+	release, err := j.spill(entries)
+	if err != nil {
+		return err
+	}
+
 	j.mu.Lock()
-	defer j.mu.Unlock()
+	err = j.append(true, entries...)
+	lsn := j.nextLSN - 1
+	j.mu.Unlock()
 
-	if j.file != nil {
-		err := j.file.Close()
-		j.file = nil
+	if err != nil {
+		release()
 		return err
 	}
-	return nil
+	return j.awaitSync(lsn)
 }
 
-// IsDir checks if the entry represents a directory
-func (e *JournalEntry) IsDir() bool {
-	return len(e.Data) == 0 && e.Operation == "mkdir"
-}
-
-// Recover attempts to recover from a crash by replaying the journal
-func (j *Journal) Recover(fs *SimpleFS) error {
+// Begin starts a new transaction and returns its ID
+func (j *Journal) Begin() (uint64, error) {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
-	// Close the current file if open
-	if j.file != nil {
-		j.file.Close()
-		j.file = nil
+	txID := j.nextTxID
+	j.nextTxID++
+
+	if err := j.append(false, JournalEntry{TxID: txID, Operation: JournalBegin}); err != nil {
+		return 0, err
+	}
+	return txID, nil
+}
+
+// LogTx adds an operation to an open transaction
+func (j *Journal) LogTx(txID uint64, entry JournalEntry) error {
+	entry.TxID = txID
+	entries := []JournalEntry{entry}
+	release, err := j.spill(entries)
+	if err != nil {
+		return err
 	}
 
-	file, err := os.Open(j.path)
+	j.mu.Lock()
+	err = j.append(false, entries...)
+	j.mu.Unlock()
+
 	if err != nil {
-		return fmt.Errorf("failed to open journal for recovery: %w", err)
+		release()
 	}
-	defer file.Close()
+	return err
+}
 
-	fmt.Println("Starting recovery from journal...")
+// Commit marks a transaction as durable; its operations must be applied
+func (j *Journal) Commit(txID uint64) error {
+	return j.control(txID, JournalCommit, true)
+}
 
-	// Temporary map to track the latest state of each file
-	fileState := make(map[string]JournalEntry)
+// Abort marks a transaction as discarded
+func (j *Journal) Abort(txID uint64) error {
+	return j.control(txID, JournalAbort, true)
+}
 
-	scanner := json.NewDecoder(file)
-	entryCount := 0
-	for {
-		var entry JournalEntry
-		if err := scanner.Decode(&entry); err != nil {
-			if err == io.EOF {
-				break
-			}
-			// Skip corrupted entries
-			fmt.Printf("Warning: Skipping corrupted journal entry: %v\n", err)
-			continue
-		}
+// Checkpoint marks a committed transaction as applied to disk
+func (j *Journal) Checkpoint(txID uint64) error {
+	// Not synced: losing a checkpoint only causes an extra redo
+	return j.control(txID, JournalCheckpoint, false)
+}
 
-		fileState[entry.Path] = entry
-		entryCount++
+// LogTransaction writes the entries as a single committed transaction
+// with one write and one sync, and returns the transaction ID
+func (j *Journal) LogTransaction(entries ...JournalEntry) (uint64, error) {
+	records := make([]JournalEntry, 0, len(entries)+2)
+	records = append(records, JournalEntry{Operation: JournalBegin})
+	records = append(records, entries...)
+	records = append(records, JournalEntry{Operation: JournalCommit})
+	release, err := j.spill(records)
+	if err != nil {
+		return 0, err
 	}
 
-	fmt.Printf("Read %d journal entries, %d unique paths\n", entryCount, len(fileState))
+	j.mu.Lock()
+	txID := j.nextTxID
+	j.nextTxID++
+	for i := range records {
+		records[i].TxID = txID
+	}
 
-	for path, entry := range fileState {
-		fmt.Printf("Recovering: %s (operation: %s)\n", path, entry.Operation)
+	err = j.append(true, records...)
+	lsn := j.nextLSN - 1
+	j.mu.Unlock()
 
-		switch entry.Operation {
-		case "write":
-			// Extract mode if available
-			mode := os.FileMode(0644) // Default mode
-			if modeStr, ok := entry.Attributes["mode"]; ok {
-				var modeVal uint64
-				fmt.Sscanf(modeStr, "%o", &modeVal)
-				if modeVal > 0 {
-					mode = os.FileMode(modeVal)
-				}
-			}
+	if err != nil {
+		release()
+		return 0, err
+	}
+	if err := j.awaitSync(lsn); err != nil {
+		return 0, err
+	}
+	return txID, nil
+}
 
-			if err := fs.WriteFileWithMode(path, entry.Data, mode); err != nil {
-				fmt.Printf("Warning: Failed to recover file %s: %v\n", path, err)
-			}
+// control appends a transaction control record
+func (j *Journal) control(txID uint64, op string, sync bool) error {
+	j.mu.Lock()
+	err := j.append(sync, JournalEntry{TxID: txID, Operation: op})
+	lsn := j.nextLSN - 1
+	j.mu.Unlock()
 
-		case "mkdir":
-			if err := fs.CreateDir(path); err != nil {
-				fmt.Printf("Warning: Failed to recover directory %s: %v\n", path, err)
-			}
+	if err != nil || !sync {
+		return err
+	}
+	return j.awaitSync(lsn)
+}
 
-		case "delete":
-			// If the path is in the delete list, delete it
-			if entry.IsDir() {
-				if err := fs.DeleteDir(path); err != nil {
-					fmt.Printf("Note: Could not delete directory %s: %v\n", path, err)
-				}
-			} else {
-				if err := fs.DeleteFile(path); err != nil {
-					fmt.Printf("Note: Could not delete file %s: %v\n", path, err)
-				}
-			}
+// append writes the entries and then seals and compacts the journal if
+// the active file has grown past the segment size. With group commit the
+// entries are not synced here; the caller must release j.mu and call
+// awaitSync. The caller must hold j.mu.
+func (j *Journal) append(sync bool, entries ...JournalEntry) error {
+	if err := j.write(sync && !j.opts.GroupCommit, entries...); err != nil {
+		return err
+	}
+	j.maintain()
+	return nil
+}
 
-		case "setattr":
-			for k, v := range entry.Attributes {
-				if err := fs.SetAttribute(path, k, v); err != nil {
-					fmt.Printf("Warning: Failed to recover attribute %s for %s: %v\n", k, path, err)
-				}
-			}
+// write assigns LSNs, writes the entries and optionally syncs the file.
+// Payloads must already be spilled. A failed write is cut off the file
+// and its LSNs are reused, so no partial record is left behind for the
+// next write to follow. The caller must hold j.mu.
+func (j *Journal) write(sync bool, entries ...JournalEntry) error {
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+	if err := j.cutTorn(); err != nil {
+		return err
+	}
+
+	buf := j.buffer[:0]
+	lsn := j.nextLSN
+	for i := range entries {
+		entry := &entries[i]
+		entry.LSN = lsn
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = time.Now()
+		}
+
+		var err error
+		if buf, err = encodeRecord(buf, j.format, *entry); err != nil {
+			return err
 		}
+		lsn++
+	}
+	// Keep the buffer for reuse unless a large write grew it
+	if cap(buf) <= maxJournalBuffer {
+		j.buffer = buf[:0]
 	}
 
-	// Reopen journal for writing
-	newFile, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	n, err := j.file.Write(buf)
 	if err != nil {
-		return fmt.Errorf("failed to reopen journal after recovery: %w", err)
+		if n > 0 {
+			if truncErr := j.file.Truncate(j.size); truncErr != nil {
+				j.size += int64(n)
+				return fmt.Errorf("failed to write to journal: %w (removing the partial write failed: %v)", err, truncErr)
+			}
+		}
+		return fmt.Errorf("failed to write to journal: %w", err)
+	}
+	j.size += int64(n)
+	j.nextLSN = lsn
+
+	for _, entry := range entries {
+		j.track(entry)
+		// Blobs stored ahead of their records are now referenced
+		if hash := entry.Blob(); hash != "" {
+			j.addBlobRefs(j.path, hash)
+			j.unpin(hash)
+		}
 	}
-	j.file = newFile
+	j.notify()
 
-	fmt.Println("Recovery completed")
+	if sync {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+		j.markSynced(j.nextLSN - 1)
+	}
 	return nil
 }
 
-// Rotate rotates the journal file
-func (j *Journal) Rotate() error {
+// cutTorn cuts the incomplete record found on open off the active file, so
+// that records are appended after the last complete one. The caller must
+// hold j.mu.
+func (j *Journal) cutTorn() error {
+	if j.tornBytes == 0 || j.tornCut {
+		return nil
+	}
+	if err := j.file.Truncate(j.size); err != nil {
+		return fmt.Errorf("failed to truncate torn journal record: %w", err)
+	}
+	j.tornCut = true
+	return nil
+}
+
+// Close stops the checkpoint loop and closes the journal file
+func (j *Journal) Close() error {
+	j.closeOnce.Do(func() {
+		if j.stop != nil {
+			close(j.stop)
+			<-j.done
+		}
+	})
+
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
 	if j.file != nil {
-		j.file.Close()
+		// Group commit may have left records that are written but not synced
+		err := j.file.Sync()
+		if err == nil {
+			j.markSynced(j.nextLSN - 1)
+		}
+		if closeErr := j.file.Close(); err == nil {
+			err = closeErr
+		}
 		j.file = nil
+		// Wake up subscribers so they notice the journal is gone
+		j.notify()
+		return err
 	}
+	return nil
+}
 
-	backupPath := j.path + "." + time.Now().Format("20060102-150405")
-	if err := os.Rename(j.path, backupPath); err != nil {
-		return fmt.Errorf("failed to rename journal file: %w", err)
+// IsDir checks if the entry represents a directory
+func (e *JournalEntry) IsDir() bool {
+	return len(e.Data) == 0 && (e.Operation == JournalMkdir || e.Operation == JournalRmdir)
+}
+
+// hasPayload reports whether the entry carries file content
+func (e *JournalEntry) hasPayload() bool {
+	switch e.Operation {
+	case JournalWrite, JournalCopy, JournalVersion:
+		return true
 	}
+	return false
+}
 
-	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create new journal file: %w", err)
+// IsControl reports whether the entry is a transaction control record
+func (e *JournalEntry) IsControl() bool {
+	switch e.Operation {
+	case JournalBegin, JournalCommit, JournalAbort, JournalCheckpoint:
+		return true
 	}
-	j.file = file
+	return false
+}
 
-	return nil
+// CorruptedEntry describes a journal record that could not be decoded
+type CorruptedEntry struct {
+	File   string // Journal file or segment containing the record
+	Offset int64  // Byte offset of the record in the file
+	Error  string // Why the record could not be decoded
 }
 
-// Truncate truncates the journal file
+// Rotate seals the active journal file into a segment and starts a new one
+func (j *Journal) Rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.seal()
+}
+
+// Truncate discards the whole journal, including sealed segments. It
+// returns ErrJournalClosed once the journal is closed.
 func (j *Journal) Truncate() error {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
-	if j.file != nil {
-		j.file.Close()
-		j.file = nil
+	if j.file == nil {
+		return ErrJournalClosed
 	}
+	j.file.Close()
+	j.file = nil
 
-	if err := os.Truncate(j.path, 0); err != nil {
+	segments, err := listSegments(j.fsys, j.path)
+	if err != nil {
+		return fmt.Errorf("failed to list journal segments: %w", err)
+	}
+	for _, segment := range segments {
+		if err := j.fsys.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete journal segment: %w", err)
+		}
+		j.dropBlobRefs(segment.path)
+	}
+
+	if err := j.fsys.Truncate(j.path, 0); err != nil {
 		return fmt.Errorf("failed to truncate journal file: %w", err)
 	}
+	j.dropBlobRefs(j.path)
+	j.tornCut = true
 
-	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	if err := j.openFile(); err != nil {
 		return fmt.Errorf("failed to reopen journal file after truncation: %w", err)
 	}
-	j.file = file
+	j.segmentStart = j.nextLSN
+	j.compactedAt = j.nextLSN
+	j.activeGen++
+	j.open = make(map[uint64]uint64)
 
-	return nil
+	return j.collectBlobs()
 }
@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// blobAttribute is the write entry attribute holding the hash of a payload
+// that was spilled to a blob file instead of being stored in the record
+const blobAttribute = "blob"
+
+// blobTempPrefix marks blob files that are still being written
+const blobTempPrefix = ".tmp-"
+
+// Blob returns the hash of the blob holding the entry's payload, or "" if
+// the payload is stored in the entry itself
+func (e *JournalEntry) Blob() string {
+	return e.Attributes[blobAttribute]
+}
+
+// blobDir returns the directory holding the journal's payload blobs
+func (j *Journal) blobDir() string {
+	return filepath.Join(filepath.Dir(j.path), "blobs")
+}
+
+// spills reports whether a write payload of the given size is stored as a
+// blob. Payloads too large for a record always are.
+func (j *Journal) spills(size int64) bool {
+	return j.opts.SpillThreshold > 0 && size > j.opts.SpillThreshold || size > maxInlineData
+}
+
+// spill moves the payloads of large entries to blobs and references them
+// by hash. The blobs are protected from garbage collection until the
+// entries are written; if they are not, the caller must call release
+// after dropping j.mu. The caller must not hold j.mu.
+func (j *Journal) spill(entries []JournalEntry) (release func(), err error) {
+	var hashes []string
+	release = func() {
+		for _, hash := range hashes {
+			j.releaseBlob(hash)
+		}
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.hasPayload() || !j.spills(int64(len(entry.Data))) || entry.Blob() != "" {
+			continue
+		}
+
+		hash := utils.HashBytes(entry.Data)
+		j.mu.Lock()
+		j.pinned[hash]++
+		j.mu.Unlock()
+		hashes = append(hashes, hash)
+		if _, err := j.fsys.Stat(filepath.Join(j.blobDir(), hash)); os.IsNotExist(err) {
+			if _, err := j.writeBlob(bytes.NewReader(entry.Data), false); err != nil {
+				release()
+				return nil, err
+			}
+		}
+
+		// Copy the attributes so the caller's map is left untouched
+		attrs := make(map[string]string, len(entry.Attributes)+1)
+		for k, v := range entry.Attributes {
+			attrs[k] = v
+		}
+		attrs[blobAttribute] = hash
+
+		entry.Attributes = attrs
+		entry.Data = nil
+	}
+	return release, nil
+}
+
+// storeBlob streams r into a blob without holding the journal lock and
+// returns its hash. The blob is protected from garbage collection until an
+// entry referencing it is written or releaseBlob is called.
+func (j *Journal) storeBlob(r io.Reader) (string, error) {
+	return j.writeBlob(r, true)
+}
+
+// releaseBlob drops the protection taken by storeBlob for a blob that
+// will not be referenced after all
+func (j *Journal) releaseBlob(hash string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.unpin(hash)
+}
+
+// unpin drops one protection of a blob. The caller must hold j.mu.
+func (j *Journal) unpin(hash string) {
+	if j.pinned[hash] <= 1 {
+		delete(j.pinned, hash)
+		return
+	}
+	j.pinned[hash]--
+}
+
+// writeBlob writes the content of r to a durable blob named by its hash.
+// With pin set the blob is protected from garbage collection before it
+// becomes visible; the caller must not hold j.mu in that case.
+func (j *Journal) writeBlob(r io.Reader, pin bool) (string, error) {
+	dir := j.blobDir()
+	if err := j.fsys.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := vfs.CreateTemp(j.fsys, dir, blobTempPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer j.fsys.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to sync blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if pin {
+		j.mu.Lock()
+		j.pinned[hash]++
+		j.mu.Unlock()
+	}
+
+	if err := j.fsys.Rename(tmp.Name(), filepath.Join(dir, hash)); err != nil {
+		if pin {
+			j.releaseBlob(hash)
+		}
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	// Make the rename durable before any record refers to the blob
+	vfs.SyncDir(j.fsys, dir)
+
+	return hash, nil
+}
+
+// ReadBlob returns the payload stored in the blob with the given hash
+func (j *Journal) ReadBlob(hash string) ([]byte, error) {
+	if !utils.IsValidHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash: %q", hash)
+	}
+
+	data, err := vfs.ReadFile(j.fsys, filepath.Join(j.blobDir(), hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", hash, err)
+	}
+	if utils.HashBytes(data) != hash {
+		return nil, fmt.Errorf("blob %s is corrupted", hash)
+	}
+	return data, nil
+}
+
+// loadPayload fills in the data of an entry whose payload was spilled
+func (j *Journal) loadPayload(entry *JournalEntry) error {
+	hash := entry.Blob()
+	if hash == "" || entry.Data != nil {
+		return nil
+	}
+
+	data, err := j.ReadBlob(hash)
+	if err != nil {
+		return err
+	}
+	entry.Data = data
+	return nil
+}
+
+// collectBlobs deletes blobs that are no longer referenced by the journal,
+// its archived segments or a pending write. The references are kept up to
+// date as records are written and files retired, so no journal file is
+// read. The caller must hold j.mu.
+func (j *Journal) collectBlobs() error {
+	dir := j.blobDir()
+	blobs, err := j.fsys.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	for _, blob := range blobs {
+		name := blob.Name()
+		// Blobs still being written are protected once they are renamed
+		if strings.HasPrefix(name, blobTempPrefix) || j.blobRefs[name] > 0 || j.pinned[name] > 0 {
+			continue
+		}
+		if err := j.fsys.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// addBlobRefs records that the journal file holds records referencing
+// the blobs. The caller must hold j.mu or own j.
+func (j *Journal) addBlobRefs(file string, hashes ...string) {
+	for _, hash := range hashes {
+		j.fileBlobs[file] = append(j.fileBlobs[file], hash)
+		j.blobRefs[hash]++
+	}
+}
+
+// dropBlobRefs forgets the blob references of a deleted or truncated
+// journal file. The caller must hold j.mu.
+func (j *Journal) dropBlobRefs(file string) {
+	for _, hash := range j.fileBlobs[file] {
+		if j.blobRefs[hash] <= 1 {
+			delete(j.blobRefs, hash)
+		} else {
+			j.blobRefs[hash]--
+		}
+	}
+	delete(j.fileBlobs, file)
+}
+
+// moveBlobRefs carries the blob references of a journal file over to its
+// new name when it is sealed or archived. The caller must hold j.mu.
+func (j *Journal) moveBlobRefs(from, to string) {
+	if hashes, ok := j.fileBlobs[from]; ok {
+		j.fileBlobs[to] = append(j.fileBlobs[to], hashes...)
+		delete(j.fileBlobs, from)
+	}
+}
+
+// loadArchivedBlobRefs records the blobs referenced by archived segments,
+// which are only read once, when the journal is opened
+func (j *Journal) loadArchivedBlobRefs() error {
+	archive := j.opts.Retention.ArchiveDir
+	if archive == "" {
+		return nil
+	}
+	archived, err := listSegments(j.fsys, filepath.Join(archive, filepath.Base(j.path)))
+	if err != nil {
+		return fmt.Errorf("failed to list archived journal segments: %w", err)
+	}
+	for _, segment := range archived {
+		scan, err := scanJournalFile(j.fsys, segment.path)
+		if err != nil {
+			return fmt.Errorf("failed to read journal segment %s: %w", segment.path, err)
+		}
+		for _, entry := range scan.entries {
+			if hash := entry.Blob(); hash != "" {
+				j.addBlobRefs(segment.path, hash)
+			}
+		}
+	}
+	return nil
+}
+
+// removeBlobTemps deletes blob files left half-written by a crash
+func removeBlobTemps(fsys vfs.FS, dir string) {
+	blobs, err := fsys.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, blob := range blobs {
+		if strings.HasPrefix(blob.Name(), blobTempPrefix) {
+			fsys.Remove(filepath.Join(dir, blob.Name()))
+		}
+	}
+}
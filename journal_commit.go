@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+)
+
+// awaitSync returns once every record up to lsn is on stable storage. It
+// is a no-op unless group commit is enabled, in which case records are
+// written without syncing and the first caller to get here becomes the
+// leader: it optionally waits MaxBatchDelay for more records to arrive,
+// then syncs everything written so far with a single fsync. Callers whose
+// records were covered by that fsync return without syncing again.
+//
+// The caller must not hold j.mu.
+func (j *Journal) awaitSync(lsn uint64) error {
+	if !j.opts.GroupCommit {
+		return nil
+	}
+
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+
+	if j.synced.Load() >= lsn {
+		return nil
+	}
+
+	if j.opts.MaxBatchDelay > 0 {
+		time.Sleep(j.opts.MaxBatchDelay)
+	}
+
+	j.mu.Lock()
+	file := j.file
+	target := j.nextLSN - 1
+	j.mu.Unlock()
+
+	if file == nil {
+		if j.synced.Load() >= lsn {
+			return nil
+		}
+		return ErrJournalClosed
+	}
+
+	if err := file.Sync(); err != nil {
+		// The file may have been sealed or closed, which syncs it first
+		if j.synced.Load() >= lsn {
+			return nil
+		}
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.markSynced(target)
+
+	return nil
+}
+
+// markSynced records that every record up to lsn is on stable storage
+func (j *Journal) markSynced(lsn uint64) {
+	for {
+		current := j.synced.Load()
+		if current >= lsn || j.synced.CompareAndSwap(current, lsn) {
+			return
+		}
+	}
+}
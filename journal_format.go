@@ -0,0 +1,506 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// JournalFormat selects how journal records are encoded on disk
+type JournalFormat int
+
+const (
+	// JournalFormatJSON writes newline-delimited JSON records (legacy format)
+	JournalFormatJSON JournalFormat = iota
+	// JournalFormatBinary writes length-prefixed records protected by a CRC32C checksum
+	JournalFormatBinary
+)
+
+// String returns the name of the format
+func (f JournalFormat) String() string {
+	switch f {
+	case JournalFormatJSON:
+		return "json"
+	case JournalFormatBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("JournalFormat(%d)", int(f))
+}
+
+// binaryJournalMagic starts every binary journal file
+var binaryJournalMagic = []byte{'S', 'F', 'S', 'J', 0, 1}
+
+// Binary record layout: 4-byte big-endian payload length, 4-byte CRC32C of
+// the payload, then the payload itself
+const binaryRecordHeader = 8
+
+// maxBinaryRecord bounds the payload length of a binary record, so that a
+// corrupted length prefix can be told from a real one. Larger payloads are
+// rejected when writing; write data over maxInlineData is always spilled to
+// a blob whatever the SpillThreshold, which keeps records below the limit.
+const maxBinaryRecord = 64 << 20
+
+// maxInlineData is the largest write payload stored in a record itself
+const maxInlineData = maxBinaryRecord / 2
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecord appends the encoded entry to buf
+func encodeRecord(buf []byte, format JournalFormat, entry JournalEntry) ([]byte, error) {
+	if format == JournalFormatJSON {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return buf, fmt.Errorf("failed to marshal journal entry: %w", err)
+		}
+		buf = append(buf, data...)
+		return append(buf, '\n'), nil
+	}
+
+	payload := encodeBinaryEntry(entry)
+	if len(payload) > maxBinaryRecord {
+		return buf, fmt.Errorf("journal record of %d bytes exceeds the limit of %d bytes", len(payload), maxBinaryRecord)
+	}
+	var header [binaryRecordHeader]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crc32c))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...), nil
+}
+
+// encodeBinaryEntry serializes an entry's fields in a fixed order
+func encodeBinaryEntry(entry JournalEntry) []byte {
+	buf := make([]byte, 0, 64+len(entry.Path)+len(entry.Data))
+	buf = binary.AppendUvarint(buf, entry.LSN)
+	buf = binary.AppendUvarint(buf, entry.TxID)
+
+	var ts int64
+	if !entry.Timestamp.IsZero() {
+		ts = entry.Timestamp.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, ts)
+
+	buf = appendBytes(buf, []byte(entry.Operation))
+	buf = appendBytes(buf, []byte(entry.Path))
+	buf = appendBytes(buf, entry.Data)
+
+	keys := make([]string, 0, len(entry.Attributes))
+	for k := range entry.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = appendBytes(buf, []byte(k))
+		buf = appendBytes(buf, []byte(entry.Attributes[k]))
+	}
+
+	return buf
+}
+
+// decodeBinaryEntry is the inverse of encodeBinaryEntry
+func decodeBinaryEntry(payload []byte) (JournalEntry, error) {
+	var entry JournalEntry
+	r := bytes.NewReader(payload)
+
+	var err error
+	if entry.LSN, err = binary.ReadUvarint(r); err != nil {
+		return entry, err
+	}
+	if entry.TxID, err = binary.ReadUvarint(r); err != nil {
+		return entry, err
+	}
+
+	ts, err := binary.ReadVarint(r)
+	if err != nil {
+		return entry, err
+	}
+	if ts != 0 {
+		entry.Timestamp = time.Unix(0, ts)
+	}
+
+	op, err := readBytes(r)
+	if err != nil {
+		return entry, err
+	}
+	entry.Operation = string(op)
+
+	path, err := readBytes(r)
+	if err != nil {
+		return entry, err
+	}
+	entry.Path = string(path)
+
+	if entry.Data, err = readBytes(r); err != nil {
+		return entry, err
+	}
+	if len(entry.Data) == 0 {
+		entry.Data = nil
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return entry, err
+	}
+	if n > 0 {
+		entry.Attributes = make(map[string]string, n)
+	}
+	for i := uint64(0); i < n; i++ {
+		k, err := readBytes(r)
+		if err != nil {
+			return entry, err
+		}
+		v, err := readBytes(r)
+		if err != nil {
+			return entry, err
+		}
+		entry.Attributes[string(k)] = string(v)
+	}
+
+	if r.Len() != 0 {
+		return entry, errors.New("trailing bytes in record")
+	}
+	return entry, nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// journalScan is the result of reading a journal file
+type journalScan struct {
+	format      JournalFormat       // Format the file is written in
+	entries     []JournalEntry      // Decoded entries in log order
+	corrupted   []CorruptedEntry    // Records that could not be decoded
+	validSize   int64               // File length up to the end of the last complete record
+	torn        bool                // Whether the file ends with an incomplete record
+	activeStart uint64              // LSN of the first record in the active file (0 if empty)
+	blobs       map[string][]string // Blobs referenced by each file added to the scan
+}
+
+// detectJournalFormat reports the format of a journal file from its first
+// bytes; empty files have no format yet
+func detectJournalFormat(fsys vfs.FS, path string) (JournalFormat, bool, error) {
+	file, err := vfs.Open(fsys, path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, len(binaryJournalMagic))
+	n, err := io.ReadFull(file, head)
+	if n == 0 {
+		return 0, false, nil
+	}
+	if err == nil && bytes.Equal(head, binaryJournalMagic) {
+		return JournalFormatBinary, true, nil
+	}
+	return JournalFormatJSON, true, nil
+}
+
+// scanJournalFile reads all records of a journal file in log order. Records
+// that fail to decode are reported as corrupted and skipped; an incomplete
+// record at the end of the file is reported as a torn tail.
+func scanJournalFile(fsys vfs.FS, path string) (*journalScan, error) {
+	format, _, err := detectJournalFormat(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := vfs.Open(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if format == JournalFormatBinary {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return scanBinary(file, info.Size())
+	}
+	return scanJSON(bufio.NewReader(file))
+}
+
+// scanJournalFrom reads the records of an open journal file of the given
+// format and size that start at offset, the end of a complete record
+func scanJournalFrom(file vfs.File, format JournalFormat, offset, size int64) (*journalScan, error) {
+	if format == JournalFormatBinary {
+		return scanBinaryFrom(file, offset, size)
+	}
+	return scanJSONFrom(bufio.NewReader(io.NewSectionReader(file, offset, size-offset)), offset)
+}
+
+func scanJSON(reader *bufio.Reader) (*journalScan, error) {
+	return scanJSONFrom(reader, 0)
+}
+
+// scanJSONFrom reads JSON records from reader, which starts at offset
+func scanJSONFrom(reader *bufio.Reader, offset int64) (*journalScan, error) {
+	scan := &journalScan{format: JournalFormatJSON, validSize: offset}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// A record is only complete once its newline is written
+				scan.torn = true
+			}
+			return scan, nil
+		}
+		if err != nil {
+			return scan, err
+		}
+
+		var entry JournalEntry
+		if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+			scan.corrupted = append(scan.corrupted, CorruptedEntry{Offset: offset, Error: jsonErr.Error()})
+		} else {
+			scan.entries = append(scan.entries, entry)
+		}
+		offset += int64(len(line))
+		scan.validSize = offset
+	}
+}
+
+// scanBinary reads the records of a binary journal file of the given size.
+// A record whose length runs past a sane size or past the end of the file
+// is a torn tail only if nothing decodable follows it; otherwise its length
+// was corrupted, and scanning resumes at the next record.
+func scanBinary(file io.ReaderAt, size int64) (*journalScan, error) {
+	if size < int64(len(binaryJournalMagic)) {
+		return &journalScan{format: JournalFormatBinary}, io.ErrUnexpectedEOF
+	}
+	return scanBinaryFrom(file, int64(len(binaryJournalMagic)), size)
+}
+
+// scanBinaryFrom is scanBinary starting at offset, the end of a record or
+// of the header
+func scanBinaryFrom(file io.ReaderAt, offset, size int64) (*journalScan, error) {
+	scan := &journalScan{format: JournalFormatBinary, validSize: offset}
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+
+	var header [binaryRecordHeader]byte
+	for {
+		n, err := io.ReadFull(reader, header[:])
+		if err == io.EOF {
+			return scan, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			scan.torn = n > 0
+			return scan, nil
+		}
+		if err != nil {
+			return scan, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if uint64(length) > maxBinaryRecord || int64(length) > size-offset-binaryRecordHeader {
+			next, err := nextBinaryRecord(file, offset+1, size)
+			if err != nil {
+				return scan, err
+			}
+			if next < 0 {
+				// The last record was never completely written
+				scan.torn = true
+				return scan, nil
+			}
+			// The length itself is garbage, the records after it are kept
+			scan.corrupted = append(scan.corrupted, CorruptedEntry{Offset: offset, Error: "invalid record length"})
+			offset = next
+			scan.validSize = offset
+			reader.Reset(io.NewSectionReader(file, offset, size-offset))
+			continue
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				scan.torn = true
+				return scan, nil
+			}
+			return scan, err
+		}
+
+		if crc32.Checksum(payload, crc32c) != checksum {
+			scan.corrupted = append(scan.corrupted, CorruptedEntry{Offset: offset, Error: "checksum mismatch"})
+			// A plausible but corrupted length would skip valid records,
+			// so scanning resumes at the next record that checks out
+			next, err := nextBinaryRecord(file, offset+1, size)
+			if err != nil {
+				return scan, err
+			}
+			if next >= 0 {
+				offset = next
+				scan.validSize = offset
+				reader.Reset(io.NewSectionReader(file, offset, size-offset))
+				continue
+			}
+		} else if entry, err := decodeBinaryEntry(payload); err != nil {
+			scan.corrupted = append(scan.corrupted, CorruptedEntry{Offset: offset, Error: err.Error()})
+		} else {
+			scan.entries = append(scan.entries, entry)
+		}
+
+		offset += binaryRecordHeader + int64(length)
+		scan.validSize = offset
+	}
+}
+
+// resyncWindow is how much of a binary journal nextBinaryRecord reads at a
+// time while looking for the next record
+const resyncWindow = 1 << 20
+
+// nextBinaryRecord returns the offset of the first record at or after from
+// whose checksum matches and which decodes, or -1 if there is none. The
+// file is read a window at a time; the payload of a candidate reaching
+// past the window is checksummed straight from the file and only read
+// into memory if it matches.
+func nextBinaryRecord(file io.ReaderAt, from, size int64) (int64, error) {
+	buf := make([]byte, resyncWindow)
+	for start := from; start+binaryRecordHeader <= size; {
+		window := buf[:min(int64(len(buf)), size-start)]
+		if _, err := file.ReadAt(window, start); err != nil && err != io.EOF {
+			return -1, err
+		}
+
+		last := len(window) - binaryRecordHeader
+		for i := 0; i <= last; i++ {
+			at := start + int64(i)
+			length := binary.BigEndian.Uint32(window[i : i+4])
+			if uint64(length) > maxBinaryRecord || int64(length) > size-at-binaryRecordHeader {
+				continue
+			}
+			checksum := binary.BigEndian.Uint32(window[i+4 : i+8])
+
+			var payload []byte
+			if end := i + binaryRecordHeader + int(length); end <= len(window) {
+				payload = window[i+binaryRecordHeader : end]
+				if crc32.Checksum(payload, crc32c) != checksum {
+					continue
+				}
+			} else {
+				section := io.NewSectionReader(file, at+binaryRecordHeader, int64(length))
+				hash := crc32.New(crc32c)
+				if _, err := io.Copy(hash, section); err != nil {
+					return -1, err
+				}
+				if hash.Sum32() != checksum {
+					continue
+				}
+				payload = make([]byte, length)
+				if _, err := file.ReadAt(payload, at+binaryRecordHeader); err != nil && err != io.EOF {
+					return -1, err
+				}
+			}
+			if _, err := decodeBinaryEntry(payload); err == nil {
+				return at, nil
+			}
+		}
+		start += int64(last + 1)
+	}
+	return -1, nil
+}
+
+// writeJournalFile writes entries to a new journal file in the given format
+func writeJournalFile(fsys vfs.FS, path string, format JournalFormat, entries []JournalEntry) error {
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	if format == JournalFormatBinary {
+		if _, err := w.Write(binaryJournalMagic); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, entry := range entries {
+		if buf, err = encodeRecord(buf[:0], format, entry); err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ConvertJournal rewrites the journal at src, its active file and sealed
+// segments, into dst using the given format. backend is the storage the
+// journal lives on (nil = host filesystem). Corrupted records and a torn
+// tail are dropped. src and dst may be the same journal. Archived segments
+// are left as they are, since every journal file is read in its own
+// format.
+func ConvertJournal(src, dst string, format JournalFormat, backend Backend) error {
+	fsys := backendOrDefault(backend)
+	segments, err := listSegments(fsys, src)
+	if err != nil {
+		return fmt.Errorf("failed to list journal segments: %w", err)
+	}
+	for _, segment := range segments {
+		if err := convertJournal(fsys, segment.path, segmentPath(dst, segment.firstLSN), format); err != nil {
+			return err
+		}
+	}
+	return convertJournal(fsys, src, dst, format)
+}
+
+func convertJournal(fsys vfs.FS, src, dst string, format JournalFormat) error {
+	scan, err := scanJournalFile(fsys, src)
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	tmp := dst + ".convert"
+	if err := writeJournalFile(fsys, tmp, format, scan.entries); err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("failed to write converted journal: %w", err)
+	}
+
+	if err := fsys.Rename(tmp, dst); err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("failed to replace journal: %w", err)
+	}
+	return nil
+}
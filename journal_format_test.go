@@ -0,0 +1,256 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// TestOpenJournalKeepsRecordsAfterCorruptLength corrupts the length of a
+// record in the middle of a binary journal and checks that OpenJournal
+// skips it instead of truncating the records after it as a torn tail
+func TestOpenJournalKeepsRecordsAfterCorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.log")
+	j, err := OpenJournal(path, JournalOptions{Format: JournalFormatBinary})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := vfs.ReadFile(vfs.Default, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(binaryJournalMagic)
+	second := first + binaryRecordHeader + int(binary.BigEndian.Uint32(data[first:]))
+	data[second] = 0xff
+	if err := vfs.WriteFile(vfs.Default, path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path, JournalOptions{})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := NewJournalReader(path, JournalFilter{})
+	if err != nil {
+		t.Fatalf("NewJournalReader: %v", err)
+	}
+	var paths []string
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		paths = append(paths, entry.Path)
+	}
+	if fmt.Sprint(paths) != "[f0 f2 f3]" {
+		t.Fatalf("entries = %v, want f0, f2 and f3", paths)
+	}
+	if corrupted := r.Corrupted(); len(corrupted) != 1 || corrupted[0].Offset != int64(second) {
+		t.Fatalf("corrupted = %v, want the record at offset %d", corrupted, second)
+	}
+}
+
+// TestOpenJournalTruncatesTornTail checks that an incomplete last record
+// is left alone by OpenJournal and truncated away by the next write
+func TestOpenJournalTruncatesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.log")
+	j, err := OpenJournal(path, JournalOptions{Format: JournalFormatBinary})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	info, err := vfs.Default.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.Default.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	j, err = OpenJournal(path, JournalOptions{})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	if torn, err := vfs.Default.Stat(path); err != nil || torn.Size() != info.Size()-3 {
+		t.Fatalf("size after open = %v (%v), want %d", torn, err, info.Size()-3)
+	}
+	if err := j.Log(JournalEntry{Operation: JournalWrite, Path: "f2", Data: []byte("data")}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	scan, err := scanJournalFile(vfs.Default, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.entries) != 2 || scan.entries[1].Path != "f2" || scan.torn || len(scan.corrupted) != 0 {
+		t.Fatalf("scan = %d entries, torn %v, corrupted %v, want f0 and f2", len(scan.entries), scan.torn, scan.corrupted)
+	}
+}
+
+// TestOpenJournalKeepsRecordsAfterChecksumMismatch corrupts the length of a
+// record so that it still fits in the file but covers the records after
+// it, and checks that the scan resyncs instead of skipping them
+func TestOpenJournalKeepsRecordsAfterChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.log")
+	j, err := OpenJournal(path, JournalOptions{Format: JournalFormatBinary})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := vfs.ReadFile(vfs.Default, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(binaryJournalMagic)
+	second := first + binaryRecordHeader + int(binary.BigEndian.Uint32(data[first:]))
+	length := binary.BigEndian.Uint32(data[second:])
+	binary.BigEndian.PutUint32(data[second:], length*2)
+	if err := vfs.WriteFile(vfs.Default, path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scan, err := scanJournalFile(vfs.Default, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range scan.entries {
+		paths = append(paths, entry.Path)
+	}
+	if fmt.Sprint(paths) != "[f0 f2 f3]" {
+		t.Fatalf("entries = %v, want f0, f2 and f3", paths)
+	}
+	if len(scan.corrupted) != 1 || scan.corrupted[0].Offset != int64(second) || scan.torn {
+		t.Fatalf("corrupted = %v, torn %v, want the record at offset %d", scan.corrupted, scan.torn, second)
+	}
+}
+
+// TestNextBinaryRecordAcrossWindows checks that a record is found when it
+// starts past the first window and its payload crosses into the next one
+func TestNextBinaryRecordAcrossWindows(t *testing.T) {
+	record, err := encodeRecord(nil, JournalFormatBinary, JournalEntry{Operation: JournalWrite, Path: "f", Data: bytes.Repeat([]byte("x"), 64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := 2*resyncWindow - binaryRecordHeader - 1 - 16
+	data := append(make([]byte, at), record...)
+
+	got, err := nextBinaryRecord(bytes.NewReader(data), 1, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != int64(at) {
+		t.Fatalf("nextBinaryRecord = %d, want %d", got, at)
+	}
+}
+
+// TestConvertJournalSegments converts a JSON journal with sealed segments
+// on a memory backend to the binary format and checks that every file was
+// converted and the journal still reads back in order
+func TestConvertJournalSegments(t *testing.T) {
+	mem := NewMemoryBackend()
+	if err := mem.MkdirAll("/j", 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := "/j/fs.log"
+	j, err := OpenJournal(path, JournalOptions{Backend: mem})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+		if i%2 == 1 {
+			if err := j.Rotate(); err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := ConvertJournal(path, path, JournalFormatBinary, mem); err != nil {
+		t.Fatalf("ConvertJournal: %v", err)
+	}
+	segments, err := listSegments(mem, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(segments))
+	}
+	for _, file := range []string{path, segments[0].path, segments[1].path} {
+		data, err := vfs.ReadFile(mem, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(binaryJournalMagic)) {
+			t.Fatalf("%s was not converted", file)
+		}
+	}
+
+	j, err = OpenJournal(path, JournalOptions{Backend: mem})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer j.Close()
+	r, err := j.NewReader(JournalFilter{})
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var paths []string
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		paths = append(paths, entry.Path)
+	}
+	if fmt.Sprint(paths) != "[f0 f1 f2 f3]" {
+		t.Fatalf("entries = %v, want f0 to f3", paths)
+	}
+}
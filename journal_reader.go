@@ -0,0 +1,371 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// JournalFilter selects the entries returned by a JournalReader.
+// Zero-valued fields match every entry.
+type JournalFilter struct {
+	PathPrefix string    // Only entries for this path or paths below it
+	Operations []string  // Only entries with one of these operations
+	Since      time.Time // Only entries written at or after this time
+	Until      time.Time // Only entries written before this time
+}
+
+// match reports whether an entry passes the filter
+func (f *JournalFilter) match(entry *JournalEntry) bool {
+	if f.PathPrefix != "" {
+		prefix := cleanRelPath(f.PathPrefix)
+		path := cleanRelPath(entry.Path)
+		if entry.Path == "" || (prefix != "" && path != prefix &&
+			!strings.HasPrefix(path, prefix+string(filepath.Separator))) {
+			return false
+		}
+	}
+
+	if len(f.Operations) > 0 {
+		found := false
+		for _, op := range f.Operations {
+			if op == entry.Operation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Timestamp.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// JournalReader iterates over journal records in log order. Journal files
+// are read one at a time, so only a single segment is held in memory.
+// Payloads spilled to blobs are not loaded; use Journal.ReadBlob with
+// JournalEntry.Blob to fetch them.
+type JournalReader struct {
+	fsys      vfs.FS           // Filesystem the journal files live on
+	files     []string         // Journal files still to be read, in log order
+	current   string           // Journal file the remaining entries come from
+	filter    JournalFilter    // Entries to return
+	entries   []JournalEntry   // Remaining entries of the current file
+	corrupted []CorruptedEntry // Records that could not be decoded so far
+}
+
+// NewJournalReader returns a reader over the sealed segments and the
+// active file of the journal at path
+func NewJournalReader(path string, filter JournalFilter) (*JournalReader, error) {
+	return newJournalReader(vfs.Default, path, filter)
+}
+
+func newJournalReader(fsys vfs.FS, path string, filter JournalFilter) (*JournalReader, error) {
+	segments, err := listSegments(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal segments: %w", err)
+	}
+
+	files := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		files = append(files, segment.path)
+	}
+	files = append(files, path)
+
+	return &JournalReader{fsys: fsys, files: files, filter: filter}, nil
+}
+
+// NewReader returns a reader over the whole journal, including archived
+// segments
+func (j *Journal) NewReader(filter JournalFilter) (*JournalReader, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var files []string
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		archived, err := listSegments(j.fsys, filepath.Join(archive, filepath.Base(j.path)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list archived journal segments: %w", err)
+		}
+		for _, segment := range archived {
+			files = append(files, segment.path)
+		}
+	}
+
+	reader, err := newJournalReader(j.fsys, j.path, filter)
+	if err != nil {
+		return nil, err
+	}
+	reader.files = append(files, reader.files...)
+
+	return reader, nil
+}
+
+// Next returns the next entry that matches the filter, or io.EOF when the
+// journal has been read completely
+func (r *JournalReader) Next() (JournalEntry, error) {
+	for {
+		for len(r.entries) > 0 {
+			entry := r.entries[0]
+			r.entries = r.entries[1:]
+			if r.filter.match(&entry) {
+				return entry, nil
+			}
+		}
+
+		if len(r.files) == 0 {
+			return JournalEntry{}, io.EOF
+		}
+
+		file := r.files[0]
+		r.files = r.files[1:]
+
+		scan, err := scanJournalFile(r.fsys, file)
+		if err != nil {
+			// Segments can be retired by compaction while being read
+			if os.IsNotExist(err) {
+				continue
+			}
+			return JournalEntry{}, fmt.Errorf("failed to read journal file %s: %w", file, err)
+		}
+
+		r.current = file
+		r.entries = scan.entries
+		for _, corrupted := range scan.corrupted {
+			corrupted.File = file
+			r.corrupted = append(r.corrupted, corrupted)
+		}
+		// Only the active file, read last, may end in a record being written
+		if scan.torn && len(r.files) > 0 {
+			r.corrupted = append(r.corrupted, CorruptedEntry{
+				File:   file,
+				Offset: scan.validSize,
+				Error:  "incomplete record",
+			})
+		}
+	}
+}
+
+// Corrupted returns the records that could not be decoded in the files
+// read so far
+func (r *JournalReader) Corrupted() []CorruptedEntry {
+	return r.corrupted
+}
+
+// JournalStats summarizes the content of a journal
+type JournalStats struct {
+	Format       JournalFormat  // Record format of the active file
+	Files        int            // Journal files, including sealed segments
+	Size         int64          // Total size of the journal files in bytes
+	Archived     int            // Archived segments
+	Blobs        int            // Spilled payload blobs
+	BlobSize     int64          // Total size of the blobs in bytes
+	Entries      int            // Decoded records
+	Corrupted    int            // Records that could not be decoded
+	Operations   map[string]int // Records per operation
+	Transactions int            // Transactions started
+	Committed    int            // Transactions committed
+	Aborted      int            // Transactions aborted
+	Pending      int            // Transactions not yet checkpointed or aborted
+	FirstLSN     uint64         // LSN of the oldest record
+	LastLSN      uint64         // LSN of the newest record
+	FirstTime    time.Time      // Time of the oldest record
+	LastTime     time.Time      // Time of the newest record
+}
+
+// Stats reads the journal, excluding archived segments, and summarizes it.
+// The files are listed under the journal lock and read after releasing it,
+// so writers are not held up while a large journal is scanned.
+func (j *Journal) Stats() (*JournalStats, error) {
+	stats, files, err := j.statsFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if info, err := j.fsys.Stat(file); err == nil {
+			stats.Files++
+			stats.Size += info.Size()
+		}
+	}
+
+	if blobs, err := j.fsys.ReadDir(j.blobDir()); err == nil {
+		for _, blob := range blobs {
+			if strings.HasPrefix(blob.Name(), blobTempPrefix) {
+				continue
+			}
+			if info, err := blob.Info(); err == nil {
+				stats.Blobs++
+				stats.BlobSize += info.Size()
+			}
+		}
+	}
+
+	var entries []JournalEntry
+	for i, file := range files {
+		scan, err := scanJournalFile(j.fsys, file)
+		if err != nil {
+			// Segments can be retired by compaction while being read
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read journal file %s: %w", file, err)
+		}
+		entries = append(entries, scan.entries...)
+		stats.Corrupted += len(scan.corrupted)
+		// Only the active file, read last, may end in a record being written
+		if scan.torn && i < len(files)-1 {
+			stats.Corrupted++
+		}
+	}
+
+	stats.Entries = len(entries)
+	for _, entry := range entries {
+		stats.Operations[entry.Operation]++
+		switch entry.Operation {
+		case JournalBegin:
+			stats.Transactions++
+		case JournalCommit:
+			stats.Committed++
+		case JournalAbort:
+			stats.Aborted++
+		}
+	}
+
+	if n := len(entries); n > 0 {
+		stats.FirstLSN = entries[0].LSN
+		stats.FirstTime = entries[0].Timestamp
+		stats.LastLSN = entries[n-1].LSN
+		stats.LastTime = entries[n-1].Timestamp
+	}
+
+	return stats, nil
+}
+
+// statsFiles fills in the parts of the stats kept in memory and returns
+// the sealed segments and active file in log order
+func (j *Journal) statsFiles() (*JournalStats, []string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats := &JournalStats{
+		Format:     j.format,
+		Operations: make(map[string]int),
+		Pending:    len(j.open),
+	}
+
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		archived, err := listSegments(j.fsys, filepath.Join(archive, filepath.Base(j.path)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list archived journal segments: %w", err)
+		}
+		stats.Archived = len(archived)
+	}
+
+	segments, err := listSegments(j.fsys, j.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list journal segments: %w", err)
+	}
+	files := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		files = append(files, segment.path)
+	}
+	return stats, append(files, j.path), nil
+}
+
+// JournalProblem describes an inconsistency found by Journal.Verify
+type JournalProblem struct {
+	File    string // Journal file containing the record
+	LSN     uint64 // LSN of the record, if it could be decoded
+	Offset  int64  // Byte offset of the record, for undecodable records
+	Problem string // What is wrong
+}
+
+// Verify checks every journal file, including sealed and archived
+// segments: that all records decode and pass their checksums, that LSNs
+// increase monotonically and that every referenced blob exists and
+// matches its hash. It returns the problems found.
+func (j *Journal) Verify() ([]JournalProblem, error) {
+	reader, err := j.NewReader(JournalFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []JournalProblem
+	checked := make(map[string]bool)
+	var lastLSN uint64
+
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Legacy entries carry no LSN
+		if entry.LSN != 0 {
+			if entry.LSN <= lastLSN {
+				problems = append(problems, JournalProblem{
+					File:    reader.current,
+					LSN:     entry.LSN,
+					Problem: fmt.Sprintf("LSN does not increase (previous %d)", lastLSN),
+				})
+			}
+			lastLSN = entry.LSN
+		}
+
+		hash := entry.Blob()
+		if hash == "" || checked[hash] {
+			continue
+		}
+		checked[hash] = true
+
+		if err := verifyBlob(j.fsys, filepath.Join(j.blobDir(), hash), hash); err != nil {
+			problems = append(problems, JournalProblem{
+				File:    reader.current,
+				LSN:     entry.LSN,
+				Problem: err.Error(),
+			})
+		}
+	}
+
+	for _, corrupted := range reader.Corrupted() {
+		problems = append(problems, JournalProblem{
+			File:    corrupted.File,
+			Offset:  corrupted.Offset,
+			Problem: corrupted.Error,
+		})
+	}
+
+	return problems, nil
+}
+
+// verifyBlob checks that a blob exists and matches its hash
+func verifyBlob(fsys vfs.FS, path, hash string) error {
+	actual, err := hashFile(fsys, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("blob %s is missing", hash)
+		}
+		return fmt.Errorf("failed to read blob %s: %w", hash, err)
+	}
+	if actual != hash {
+		return fmt.Errorf("blob %s is corrupted", hash)
+	}
+	return nil
+}
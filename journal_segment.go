@@ -0,0 +1,365 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// JournalRetention controls what happens to journal segments once every
+// transaction in them has been checkpointed or aborted
+type JournalRetention struct {
+	ArchiveDir  string        // Directory compacted segments are moved to ("" = delete them)
+	MaxArchived int           // Maximum number of archived segments to keep (0 = unlimited)
+	MaxAge      time.Duration // Age after which archived segments are deleted (0 = unlimited)
+}
+
+// journalSegment is a sealed journal file
+type journalSegment struct {
+	path     string // Location of the segment file
+	firstLSN uint64 // LSN of the first record in the segment
+}
+
+// segmentDigits is the width of the LSN suffix of sealed segment names, so
+// that segments sort lexically in log order
+const segmentDigits = 20
+
+// segmentPath returns the name a segment starting at firstLSN is sealed under
+func segmentPath(path string, firstLSN uint64) string {
+	return fmt.Sprintf("%s.%0*d", path, segmentDigits, firstLSN)
+}
+
+// listSegments returns the sealed segments of the journal at path in log order
+func listSegments(fsys vfs.FS, path string) ([]journalSegment, error) {
+	entries, err := fsys.ReadDir(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	prefix := filepath.Base(path) + "."
+	var segments []journalSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		suffix := strings.TrimPrefix(name, prefix)
+		if len(suffix) != segmentDigits {
+			continue
+		}
+		lsn, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, journalSegment{
+			path:     filepath.Join(filepath.Dir(path), name),
+			firstLSN: lsn,
+		})
+	}
+
+	sort.Slice(segments, func(i, k int) bool {
+		return segments[i].firstLSN < segments[k].firstLSN
+	})
+	return segments, nil
+}
+
+// scanJournal reads the sealed segments and then the active file of the
+// journal at path. The torn tail and valid size of the result refer to the
+// active file, the only one that is ever appended to.
+func scanJournal(fsys vfs.FS, path string) (*journalScan, error) {
+	segments, err := listSegments(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &journalScan{}
+	for _, segment := range segments {
+		scan, err := scanJournalFile(fsys, segment.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal segment %s: %w", segment.path, err)
+		}
+		result.add(segment.path, scan)
+		if scan.torn {
+			result.corrupted = append(result.corrupted, CorruptedEntry{
+				File:   segment.path,
+				Offset: scan.validSize,
+				Error:  "incomplete record",
+			})
+		}
+	}
+
+	active, err := scanJournalFile(fsys, path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if active != nil {
+		result.add(path, active)
+		result.format = active.format
+		result.validSize = active.validSize
+		result.torn = active.torn
+		if len(active.entries) > 0 {
+			result.activeStart = active.entries[0].LSN
+		}
+	}
+
+	return result, nil
+}
+
+// add appends the records of one journal file to the scan
+func (s *journalScan) add(file string, scan *journalScan) {
+	s.entries = append(s.entries, scan.entries...)
+	for _, entry := range scan.entries {
+		if hash := entry.Blob(); hash != "" {
+			if s.blobs == nil {
+				s.blobs = make(map[string][]string)
+			}
+			s.blobs[file] = append(s.blobs[file], hash)
+		}
+	}
+	for _, corrupted := range scan.corrupted {
+		corrupted.File = file
+		s.corrupted = append(s.corrupted, corrupted)
+	}
+}
+
+// openTransactions returns the begin LSN of every transaction in entries
+// that has not been checkpointed or aborted
+func openTransactions(entries []JournalEntry) map[uint64]uint64 {
+	open := make(map[uint64]uint64)
+	for _, entry := range entries {
+		switch {
+		case entry.Operation == JournalBegin:
+			open[entry.TxID] = entry.LSN
+		case entry.Operation == JournalAbort, entry.Operation == JournalCheckpoint && entry.TxID != 0:
+			delete(open, entry.TxID)
+		case entry.Operation == JournalCheckpoint:
+			horizon := entry.horizon()
+			for txID, lsn := range open {
+				if lsn < horizon {
+					delete(open, txID)
+				}
+			}
+		}
+	}
+	return open
+}
+
+// horizon returns the LSN below which a journal-wide checkpoint record
+// declares every transaction resolved
+func (e *JournalEntry) horizon() uint64 {
+	lsn, _ := strconv.ParseUint(e.Attributes["lsn"], 10, 64)
+	return lsn
+}
+
+// track updates the set of open transactions for an appended record.
+// The caller must hold j.mu.
+func (j *Journal) track(entry JournalEntry) {
+	switch entry.Operation {
+	case JournalBegin:
+		j.open[entry.TxID] = entry.LSN
+	case JournalAbort, JournalCheckpoint:
+		if entry.TxID != 0 {
+			delete(j.open, entry.TxID)
+		}
+	}
+}
+
+// Compact writes a journal-wide checkpoint and retires every sealed
+// segment whose transactions have all been checkpointed or aborted.
+// Retired segments are deleted or archived according to the retention
+// policy.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.compact()
+}
+
+// compact is Compact with j.mu held
+func (j *Journal) compact() error {
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+
+	// Every transaction that began before the oldest open one is resolved
+	horizon := j.nextLSN
+	for _, lsn := range j.open {
+		if lsn < horizon {
+			horizon = lsn
+		}
+	}
+
+	if j.nextLSN != j.compactedAt {
+		// Synced so that the checkpoints of retired transactions can't be lost
+		if err := j.write(true, JournalEntry{
+			Operation:  JournalCheckpoint,
+			Attributes: map[string]string{"lsn": strconv.FormatUint(horizon, 10)},
+		}); err != nil {
+			return err
+		}
+		j.compactedAt = j.nextLSN
+	}
+
+	segments, err := listSegments(j.fsys, j.path)
+	if err != nil {
+		return fmt.Errorf("failed to list journal segments: %w", err)
+	}
+
+	for i, segment := range segments {
+		// A segment ends where the next one, or the active file, begins
+		end := j.segmentStart
+		if i+1 < len(segments) {
+			end = segments[i+1].firstLSN
+		}
+		if end > horizon {
+			break
+		}
+		if err := j.retire(segment); err != nil {
+			return err
+		}
+	}
+
+	if err := j.pruneArchive(); err != nil {
+		return err
+	}
+	return j.collectBlobs()
+}
+
+// retire deletes or archives a compacted segment
+func (j *Journal) retire(segment journalSegment) error {
+	dir := j.opts.Retention.ArchiveDir
+	if dir == "" {
+		if err := j.fsys.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete journal segment: %w", err)
+		}
+		j.dropBlobRefs(segment.path)
+		return nil
+	}
+
+	if err := j.fsys.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create journal archive: %w", err)
+	}
+	archived := filepath.Join(dir, filepath.Base(segment.path))
+	if err := j.fsys.Rename(segment.path, archived); err != nil {
+		return fmt.Errorf("failed to archive journal segment: %w", err)
+	}
+	j.moveBlobRefs(segment.path, archived)
+	return nil
+}
+
+// pruneArchive enforces the retention limits on archived segments
+func (j *Journal) pruneArchive() error {
+	retention := j.opts.Retention
+	if retention.ArchiveDir == "" || (retention.MaxArchived <= 0 && retention.MaxAge <= 0) {
+		return nil
+	}
+
+	archived, err := listSegments(j.fsys, filepath.Join(retention.ArchiveDir, filepath.Base(j.path)))
+	if err != nil {
+		return fmt.Errorf("failed to list archived journal segments: %w", err)
+	}
+
+	now := time.Now()
+	for i, segment := range archived {
+		remove := retention.MaxArchived > 0 && len(archived)-i > retention.MaxArchived
+		if !remove && retention.MaxAge > 0 {
+			info, err := j.fsys.Stat(segment.path)
+			if err != nil {
+				continue
+			}
+			remove = now.Sub(info.ModTime()) > retention.MaxAge
+		}
+
+		if remove {
+			if err := j.fsys.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete archived journal segment: %w", err)
+			}
+			j.dropBlobRefs(segment.path)
+		}
+	}
+
+	return nil
+}
+
+// seal closes the active file and renames it to a segment named after its
+// first LSN, then starts a new active file. The caller must hold j.mu.
+func (j *Journal) seal() error {
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+	if j.nextLSN == j.segmentStart {
+		// Nothing has been written to the active file yet
+		return nil
+	}
+	if err := j.cutTorn(); err != nil {
+		return err
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal segment: %w", err)
+	}
+	j.markSynced(j.nextLSN - 1)
+	j.file.Close()
+	j.file = nil
+
+	if err := j.fsys.Rename(j.path, segmentPath(j.path, j.segmentStart)); err != nil {
+		// Keep appending to the same file rather than losing the journal
+		if reopenErr := j.openFile(); reopenErr != nil {
+			return reopenErr
+		}
+		return fmt.Errorf("failed to seal journal segment: %w", err)
+	}
+
+	j.moveBlobRefs(j.path, segmentPath(j.path, j.segmentStart))
+
+	j.activeGen++
+	if err := j.openFile(); err != nil {
+		return fmt.Errorf("failed to create journal segment: %w", err)
+	}
+	j.segmentStart = j.nextLSN
+	return nil
+}
+
+// maintain seals the active file once it reaches the segment size and
+// compacts the journal. The caller must hold j.mu.
+func (j *Journal) maintain() {
+	if j.opts.SegmentSize <= 0 || j.size < j.opts.SegmentSize {
+		return
+	}
+
+	// The records that triggered this are already durable, so failures
+	// only postpone compaction until the next append or checkpoint
+	if err := j.seal(); err != nil {
+		return
+	}
+	j.compact()
+}
+
+// checkpointLoop compacts the journal at the configured interval until the
+// journal is closed
+func (j *Journal) checkpointLoop(interval time.Duration) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.Compact()
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+)
+
+// shortWriteBackend makes the next write to any file persist only half
+// of its data and fail, as when the disk fills up
+type shortWriteBackend struct {
+	Backend
+	fail bool
+}
+
+func (b *shortWriteBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	file, err := b.Backend.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shortWriteFile{BackendFile: file, backend: b}, nil
+}
+
+type shortWriteFile struct {
+	BackendFile
+	backend *shortWriteBackend
+}
+
+func (f *shortWriteFile) Write(p []byte) (int, error) {
+	if !f.backend.fail {
+		return f.BackendFile.Write(p)
+	}
+	f.backend.fail = false
+	n, _ := f.BackendFile.Write(p[:len(p)/2])
+	return n, errors.New("injected short write")
+}
+
+// syncCountingBackend counts the syncs of the files opened through it
+type syncCountingBackend struct {
+	Backend
+	syncs atomic.Int64
+}
+
+func (b *syncCountingBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	file, err := b.Backend.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{BackendFile: file, backend: b}, nil
+}
+
+type syncCountingFile struct {
+	BackendFile
+	backend *syncCountingBackend
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.backend.syncs.Add(1)
+	return f.BackendFile.Sync()
+}
+
+// TestJournalFailedWriteLeavesNoRecord fails a write halfway through and
+// checks that the next record follows the last complete one, with the
+// LSN the failed record would have used
+func TestJournalFailedWriteLeavesNoRecord(t *testing.T) {
+	for _, format := range []JournalFormat{JournalFormatJSON, JournalFormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			backend := &shortWriteBackend{Backend: NewMemoryBackend()}
+			opts := JournalOptions{Format: format, Backend: backend}
+			j, err := OpenJournal("/fs.log", opts)
+			if err != nil {
+				t.Fatalf("OpenJournal: %v", err)
+			}
+			log := func(path string) error {
+				return j.Log(JournalEntry{Operation: JournalWrite, Path: path, Data: []byte("data")})
+			}
+			if err := log("a"); err != nil {
+				t.Fatalf("Log: %v", err)
+			}
+			backend.fail = true
+			if err := log("lost"); err == nil {
+				t.Fatal("Log succeeded despite the failing write")
+			}
+			if err := log("b"); err != nil {
+				t.Fatalf("Log: %v", err)
+			}
+			if err := j.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			scan, err := scanJournalFile(backend, "/fs.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range scan.entries {
+				got = append(got, fmt.Sprintf("%d %s", entry.LSN, entry.Path))
+			}
+			if fmt.Sprint(got) != "[1 a 2 b]" || len(scan.corrupted) != 0 || scan.torn {
+				t.Fatalf("entries = %v, corrupted %v, torn %v, want a and b at LSNs 1 and 2", got, scan.corrupted, scan.torn)
+			}
+		})
+	}
+}
+
+// TestJournalCollectsBlobs checks that compaction deletes the blobs of
+// retired segments, keeps those of archived segments and of the active
+// file, and still knows about the archived ones after reopening
+func TestJournalCollectsBlobs(t *testing.T) {
+	for name, archive := range map[string]string{"delete": "", "archive": "archive"} {
+		t.Run(name, func(t *testing.T) {
+			mem := NewMemoryBackend()
+			if err := mem.MkdirAll("/j", 0755); err != nil {
+				t.Fatal(err)
+			}
+			opts := JournalOptions{
+				SpillThreshold: 4,
+				Retention:      JournalRetention{ArchiveDir: archive},
+				Backend:        mem,
+			}
+			j, err := OpenJournal("/j/fs.log", opts)
+			if err != nil {
+				t.Fatalf("OpenJournal: %v", err)
+			}
+			log := func(data string) string {
+				t.Helper()
+				if err := j.Log(JournalEntry{Operation: JournalWrite, Path: "a", Data: []byte(data)}); err != nil {
+					t.Fatalf("Log: %v", err)
+				}
+				return utils.HashBytes([]byte(data))
+			}
+			check := func(retired, active string) {
+				t.Helper()
+				if err := j.Compact(); err != nil {
+					t.Fatalf("Compact: %v", err)
+				}
+				if _, err := mem.Stat("/j/blobs/" + active); err != nil {
+					t.Fatalf("blob of the active file was deleted: %v", err)
+				}
+				_, err := mem.Stat("/j/blobs/" + retired)
+				if archive == "" && !os.IsNotExist(err) {
+					t.Fatalf("blob of a deleted segment was kept: %v", err)
+				}
+				if archive != "" && err != nil {
+					t.Fatalf("blob of an archived segment was deleted: %v", err)
+				}
+			}
+
+			retired := log("retired payload")
+			if err := j.Rotate(); err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+			active := log("active payload")
+			check(retired, active)
+
+			if err := j.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if j, err = OpenJournal("/j/fs.log", opts); err != nil {
+				t.Fatalf("OpenJournal: %v", err)
+			}
+			defer j.Close()
+			check(retired, active)
+		})
+	}
+}
+
+// TestJournalTruncate checks that Truncate leaves an empty journal that a
+// compaction has nothing to checkpoint in, and that it fails without
+// touching the files once the journal is closed
+func TestJournalTruncate(t *testing.T) {
+	mem := NewMemoryBackend()
+	if err := mem.MkdirAll("/j", 0755); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal("/j/fs.log", JournalOptions{Backend: mem})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := j.Truncate(); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if err := j.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if scan, err := scanJournalFile(mem, "/j/fs.log"); err != nil || len(scan.entries) != 0 {
+		t.Fatalf("journal after Truncate and Compact = %d entries, %v, want none", len(scan.entries), err)
+	}
+
+	if err := j.Log(JournalEntry{Operation: JournalWrite, Path: "kept", Data: []byte("data")}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := j.Truncate(); !errors.Is(err, ErrJournalClosed) {
+		t.Fatalf("Truncate after Close = %v, want ErrJournalClosed", err)
+	}
+	if scan, err := scanJournalFile(mem, "/j/fs.log"); err != nil || len(scan.entries) != 1 {
+		t.Fatalf("journal after a closed Truncate = %d entries, %v, want the one written before Close", len(scan.entries), err)
+	}
+}
+
+// TestJournalGroupCommit logs from concurrent writers with group commit
+// and checks that they share fsyncs, and that every record a Log call
+// returned for survives a crash right after
+func TestJournalGroupCommit(t *testing.T) {
+	const writers = 16
+	mem := NewMemoryBackend()
+	if err := mem.MkdirAll("/j", 0755); err != nil {
+		t.Fatal(err)
+	}
+	backend := &syncCountingBackend{Backend: mem}
+	j, err := OpenJournal("/j/fs.log", JournalOptions{GroupCommit: true, MaxBatchDelay: 5 * time.Millisecond, Backend: backend})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	before := backend.syncs.Load()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- j.Log(JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if syncs := backend.syncs.Load() - before; syncs >= writers {
+		t.Fatalf("%d writers synced %d times, want fewer syncs than writers", writers, syncs)
+	}
+
+	mem.Crash()
+	scan, err := scanJournalFile(mem, "/j/fs.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.entries) != writers {
+		t.Fatalf("%d records survived the crash, want %d", len(scan.entries), writers)
+	}
+}
+
+// TestJournalSegments seals a segment after every record and checks that
+// compaction keeps the segments of an open transaction, then retires them
+// once it is checkpointed, deleting them or archiving at most MaxArchived
+func TestJournalSegments(t *testing.T) {
+	for name, retention := range map[string]JournalRetention{
+		"delete":  {},
+		"archive": {ArchiveDir: "/j/archive", MaxArchived: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mem := NewMemoryBackend()
+			if err := mem.MkdirAll("/j", 0755); err != nil {
+				t.Fatal(err)
+			}
+			j, err := OpenJournal("/j/fs.log", JournalOptions{SegmentSize: 1, Retention: retention, Backend: mem})
+			if err != nil {
+				t.Fatalf("OpenJournal: %v", err)
+			}
+			defer j.Close()
+
+			txID, err := j.Begin()
+			if err != nil {
+				t.Fatalf("Begin: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := j.LogTx(txID, JournalEntry{Operation: JournalWrite, Path: fmt.Sprintf("f%d", i), Data: []byte("data")}); err != nil {
+					t.Fatalf("LogTx: %v", err)
+				}
+			}
+			if err := j.Commit(txID); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+			segments, err := listSegments(mem, "/j/fs.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The begin, the three writes and the commit
+			if len(segments) != 5 {
+				t.Fatalf("segments before the checkpoint = %d, want 5", len(segments))
+			}
+
+			if err := j.Checkpoint(txID); err != nil {
+				t.Fatalf("Checkpoint: %v", err)
+			}
+			if err := j.Compact(); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+			if segments, err = listSegments(mem, "/j/fs.log"); err != nil || len(segments) != 0 {
+				t.Fatalf("segments after the checkpoint = %d, %v, want none", len(segments), err)
+			}
+			archived, err := listSegments(mem, "/j/archive/fs.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(archived) != retention.MaxArchived {
+				t.Fatalf("archived segments = %d, want %d", len(archived), retention.MaxArchived)
+			}
+		})
+	}
+}
+
+// TestJournalStats summarizes a journal with a sealed segment, a spilled
+// payload and transactions that were checkpointed, aborted or left open
+func TestJournalStats(t *testing.T) {
+	mem := NewMemoryBackend()
+	if err := mem.MkdirAll("/j", 0755); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal("/j/fs.log", JournalOptions{SpillThreshold: 4, Backend: mem})
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer j.Close()
+
+	txID, err := j.LogTransaction(JournalEntry{Operation: JournalWrite, Path: "a", Data: []byte("spilled payload")})
+	if err != nil {
+		t.Fatalf("LogTransaction: %v", err)
+	}
+	if err := j.Checkpoint(txID); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if err := j.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if txID, err = j.Begin(); err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := j.Abort(txID); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	if _, err := j.Begin(); err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+
+	stats, err := j.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Files != 2 || stats.Blobs != 1 || stats.Corrupted != 0 {
+		t.Fatalf("stats = %d files, %d blobs, %d corrupted, want 2, 1 and 0", stats.Files, stats.Blobs, stats.Corrupted)
+	}
+	if stats.Entries != 7 || stats.Operations[JournalWrite] != 1 || stats.LastLSN-stats.FirstLSN != 6 {
+		t.Fatalf("stats = %d entries, %v, LSNs %d to %d, want 7 with one write", stats.Entries, stats.Operations, stats.FirstLSN, stats.LastLSN)
+	}
+	if stats.Transactions != 3 || stats.Committed != 1 || stats.Aborted != 1 || stats.Pending != 1 {
+		t.Fatalf("stats = %d transactions, %d committed, %d aborted, %d pending, want 3, 1, 1 and 1",
+			stats.Transactions, stats.Committed, stats.Aborted, stats.Pending)
+	}
+}
@@ -0,0 +1,408 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// inodeMetaDir is the directory of .attributes and .versions holding the
+// metadata of files with several links, named after the file's identity
+const inodeMetaDir = "inodes"
+
+// Link creates dst as a hard link to the file src, so that both names
+// share one file: content written through either name is seen through
+// both, and the file exists until its last name is deleted. Attributes
+// and versions belong to the file rather than to a name while it has
+// several links, so every link sees the same metadata.
+//
+// A symlink in src is followed. Directories cannot be linked, dst must
+// not exist, and links cannot reach across mounted filesystems.
+func (fs *SimpleFS) Link(src, dst string) error {
+	srcFS, srcRel := fs.resolve(src)
+	dstFS, dstRel := fs.resolve(dst)
+	if srcFS != dstFS {
+		return &os.LinkError{Op: "link", Old: src, New: dst, Err: errors.New("cannot link across mounted filesystems")}
+	}
+	if srcFS != fs {
+		return srcFS.Link(srcRel, dstRel)
+	}
+
+	if isInternalName(strings.SplitN(filepath.ToSlash(cleanRelPath(dst)), "/", 2)[0]) {
+		return fmt.Errorf("cannot create a link in internal directory: %s", dst)
+	}
+
+	srcPath, err := fs.fullPath(src)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err := fs.linkPath(dst)
+	if err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return &os.LinkError{Op: "link", Old: src, New: dst, Err: os.ErrExist}
+	}
+
+	// A fixed order keeps Link(a, b) and Link(b, a) from deadlocking. The
+	// parent of dst is src itself when dst is below a file, and then only
+	// locked once so that Link fails instead of hanging.
+	keys := []string{srcPath, dstPath}
+	if dir := filepath.Dir(dstPath); dir != srcPath {
+		keys = append(keys, dir)
+	}
+	sortLockKeys(keys)
+	defer fs.lockAll(keys)()
+
+	ctx := &HookContext{
+		Operation: OpLink,
+		Path:      dst,
+		SrcPath:   src,
+	}
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return err
+	}
+
+	info, err := fs.fsys.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot link a directory: %s", src)
+	}
+	if _, err := fs.fsys.Lstat(dstPath); err == nil {
+		return &os.LinkError{Op: "link", Old: src, New: dst, Err: os.ErrExist}
+	}
+	key, _, _ := fs.fileKey(srcPath)
+
+	// Guards the move of the metadata of src to the file's identity
+	defer fs.lockMeta(fs.pathAttributesPath(src), fs.inodeAttributesPath(key))()
+
+	txID, err := fs.logTx(linkEntry(dst, src, key, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to log link creation: %w", err)
+	}
+
+	err = fs.linkFile(src, srcPath, dstPath)
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
+	}
+
+	return fs.executeHooks(HookTypePost, ctx)
+}
+
+// linkFile links dstPath to the file at srcPath without locking, running
+// hooks or journaling. The metadata of src moves to the file's identity
+// first, so a crash in between leaves it visible. Callers hold the locks
+// of the attributes files involved, see shareMeta.
+func (fs *SimpleFS) linkFile(src, srcPath, dstPath string) error {
+	if err := fs.shareMeta(src, srcPath); err != nil {
+		return fmt.Errorf("failed to move metadata to the linked file: %w", err)
+	}
+	if err := fs.fsys.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	return fs.fsys.Link(srcPath, dstPath)
+}
+
+// linkEntry returns the journal entry of creating a hard link to src,
+// which is the file with the given key when the backend tracks identity
+func linkEntry(path, src, key string, ts time.Time) JournalEntry {
+	entry := JournalEntry{
+		Operation: JournalLink,
+		Path:      path,
+		Timestamp: ts,
+		Attributes: map[string]string{
+			"source": src,
+		},
+	}
+	if key != "" {
+		entry.Attributes["file"] = key
+	}
+	return entry
+}
+
+// fileKey returns the key of the file at fullPath in the inode metadata
+// directories and its number of links. It reports false for directories
+// and backends that do not track file identity.
+func (fs *SimpleFS) fileKey(fullPath string) (string, uint64, bool) {
+	info, err := fs.fsys.Lstat(fullPath)
+	if err != nil || info.IsDir() {
+		return "", 0, false
+	}
+	id, links, ok := vfs.Identity(info)
+	if !ok {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%x-%x", id.Dev, id.Ino), links, true
+}
+
+// sharedKey returns the key the metadata of path is kept under when it
+// belongs to the file rather than the path: from the moment the file gets
+// a second link until its last link is deleted
+func (fs *SimpleFS) sharedKey(path string) (string, bool) {
+	fullPath, err := fs.localPath(path)
+	if err != nil {
+		return "", false
+	}
+	key, links, ok := fs.fileKey(fullPath)
+	if !ok {
+		return "", false
+	}
+	return key, links > 1 || fs.hasInodeMeta(key)
+}
+
+// hasInodeMeta reports whether a file has attributes or versions kept
+// under its identity
+func (fs *SimpleFS) hasInodeMeta(key string) bool {
+	for _, path := range []string{fs.inodeAttributesPath(key), fs.inodeVersionDir(key)} {
+		if _, err := fs.fsys.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *SimpleFS) inodeAttributesPath(key string) string {
+	return filepath.Join(fs.rootPath, ".attributes", inodeMetaDir, key+".json")
+}
+
+func (fs *SimpleFS) inodeVersionDir(key string) string {
+	return filepath.Join(fs.rootPath, ".versions", inodeMetaDir, key)
+}
+
+// shareMeta moves the attributes and versions of path to the identity of
+// its file, unless the file already has several links. Unlike unshareMeta
+// it leaves locking to its callers, which for transactions hold the locks
+// of all attributes files involved already.
+func (fs *SimpleFS) shareMeta(path, fullPath string) error {
+	key, links, ok := fs.fileKey(fullPath)
+	if !ok || links > 1 || fs.hasInodeMeta(key) {
+		return nil
+	}
+	return fs.moveMeta(fs.pathAttributesPath(path), fs.inodeAttributesPath(key),
+		fs.pathVersionDir(path), fs.inodeVersionDir(key))
+}
+
+// unshareMeta moves the attributes and versions of the file at fullPath
+// back to path before its last link is deleted, so they stay reachable by
+// path and are not picked up by a later file reusing the inode
+func (fs *SimpleFS) unshareMeta(path, fullPath string) error {
+	key, ok := fs.lastLink(fullPath)
+	if !ok {
+		return nil
+	}
+	defer fs.lockMeta(fs.inodeAttributesPath(key), fs.pathAttributesPath(path))()
+	return fs.unshareKey(path, key)
+}
+
+// unshareKey moves the metadata kept under key to path, with the locks of
+// both attributes files held
+func (fs *SimpleFS) unshareKey(path, key string) error {
+	return fs.moveMeta(fs.inodeAttributesPath(key), fs.pathAttributesPath(path),
+		fs.inodeVersionDir(key), fs.pathVersionDir(path))
+}
+
+// lastLink returns the key of the file at fullPath if fullPath is its last
+// link and it has metadata kept under its identity
+func (fs *SimpleFS) lastLink(fullPath string) (string, bool) {
+	key, links, ok := fs.fileKey(fullPath)
+	if !ok || links != 1 || !fs.hasInodeMeta(key) {
+		return "", false
+	}
+	return key, true
+}
+
+// settleMeta moves the metadata kept under key to the path of the file's
+// remaining link once the other one is gone, so that metadata is only kept
+// under an identity while several links share it. The link is found by
+// walking the tree, which is only done for files that had metadata shared
+// by two links. If the move fails or is interrupted, the remaining link
+// still finds the metadata under the identity. With lock unset the caller
+// holds the attribute locks, as transactions do.
+func (fs *SimpleFS) settleMeta(key string, lock bool) error {
+	if !fs.hasInodeMeta(key) {
+		return nil
+	}
+	path, ok, err := fs.findLink(key, "")
+	if err != nil || !ok {
+		return err
+	}
+	if _, links, _ := fs.fileKey(filepath.Join(fs.rootPath, path)); links != 1 {
+		return nil
+	}
+	if lock {
+		defer fs.lockMeta(fs.inodeAttributesPath(key), fs.pathAttributesPath(path))()
+	}
+	return fs.unshareKey(path, key)
+}
+
+// findLink returns the path of a link of the file with the given key other
+// than the one at skip, searching the tree outside the internal directories
+func (fs *SimpleFS) findLink(key, skip string) (string, bool, error) {
+	var walk func(dir string) (string, bool, error)
+	walk = func(dir string) (string, bool, error) {
+		entries, err := fs.fsys.ReadDir(filepath.Join(fs.rootPath, dir))
+		if err != nil {
+			return "", false, err
+		}
+		for _, entry := range entries {
+			if dir == "" && isInternalName(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if found, ok, err := walk(path); err != nil || ok {
+					return found, ok, err
+				}
+				continue
+			}
+			fullPath := filepath.Join(fs.rootPath, path)
+			if k, _, ok := fs.fileKey(fullPath); ok && k == key && fullPath != skip {
+				return path, true, nil
+			}
+		}
+		return "", false, nil
+	}
+	return walk("")
+}
+
+// unshareTree unshares the metadata of every file below the directory
+// dir whose links are all inside it, before the directory is deleted. It
+// returns the keys of the files left with a single link outside of dir,
+// whose metadata is settled once the directory is gone.
+func (fs *SimpleFS) unshareTree(dir, fullPath string) ([]string, error) {
+	if !fs.hasSharedMeta() {
+		return nil, nil
+	}
+
+	type file struct {
+		path        string // First name of the file found below dir
+		links, seen uint64
+	}
+	files := make(map[string]*file)
+	var walk func(path, fullPath string) error
+	walk = func(path, fullPath string) error {
+		entries, err := fs.fsys.ReadDir(fullPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryPath, entryFull := filepath.Join(path, entry.Name()), filepath.Join(fullPath, entry.Name())
+			if entry.IsDir() {
+				if err := walk(entryPath, entryFull); err != nil {
+					return err
+				}
+				continue
+			}
+			key, links, ok := fs.fileKey(entryFull)
+			if !ok {
+				continue
+			}
+			if f, ok := files[key]; ok {
+				f.seen++
+			} else {
+				files[key] = &file{path: entryPath, links: links, seen: 1}
+			}
+		}
+		return nil
+	}
+	if err := walk(dir, fullPath); err != nil {
+		return nil, err
+	}
+
+	var remaining []string
+	for key, f := range files {
+		if f.seen+1 == f.links && fs.hasInodeMeta(key) {
+			remaining = append(remaining, key)
+		}
+		if f.seen < f.links || !fs.hasInodeMeta(key) {
+			continue
+		}
+		unlock := fs.lockMeta(fs.inodeAttributesPath(key), fs.pathAttributesPath(f.path))
+		err := fs.unshareKey(f.path, key)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return remaining, nil
+}
+
+// hasSharedMeta reports whether any file has metadata kept under its
+// identity
+func (fs *SimpleFS) hasSharedMeta() bool {
+	for _, meta := range []string{".attributes", ".versions"} {
+		entries, err := fs.fsys.ReadDir(filepath.Join(fs.rootPath, meta, inodeMetaDir))
+		if err == nil && len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lockMeta locks two attributes files in a fixed order and returns a
+// function releasing them
+func (fs *SimpleFS) lockMeta(fromAttrs, toAttrs string) func() {
+	keys := []string{fromAttrs, toAttrs}
+	sort.Strings(keys)
+	return fs.lockAll(keys)
+}
+
+// moveMeta moves an attributes file and a version directory to new keys,
+// with the locks of both attributes files held. Attributes already at the
+// new key are replaced, versions are merged. Each step is a rename, so a
+// crash leaves every version in one place or the other.
+func (fs *SimpleFS) moveMeta(fromAttrs, toAttrs, fromVersions, toVersions string) error {
+	if _, err := fs.fsys.Stat(fromAttrs); err == nil {
+		if err := fs.fsys.MkdirAll(filepath.Dir(toAttrs), 0755); err != nil {
+			return err
+		}
+		if err := fs.fsys.Rename(fromAttrs, toAttrs); err != nil {
+			return err
+		}
+	}
+
+	entries, err := fs.fsys.ReadDir(fromVersions)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fs.fsys.Stat(toVersions); os.IsNotExist(err) {
+		if err := fs.fsys.MkdirAll(filepath.Dir(toVersions), 0755); err != nil {
+			return err
+		}
+		return fs.fsys.Rename(fromVersions, toVersions)
+	}
+	for _, entry := range entries {
+		if err := fs.fsys.Rename(filepath.Join(fromVersions, entry.Name()), filepath.Join(toVersions, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return fs.fsys.Remove(fromVersions)
+}
+
+// sameFile reports whether two paths name the same file, which for
+// different paths means they are hard links of each other
+func (fs *SimpleFS) sameFile(a, b string) bool {
+	aKey, _, aOK := fs.fileKey(a)
+	bKey, _, bOK := fs.fileKey(b)
+	return aOK && bOK && aKey == bKey
+}
+
+// linked reports whether the file at fullPath has metadata shared between
+// links, which it keeps as long as it is written in place
+func (fs *SimpleFS) linked(fullPath string) bool {
+	key, links, ok := fs.fileKey(fullPath)
+	return ok && (links > 1 || fs.hasInodeMeta(key))
+}
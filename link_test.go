@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"testing"
+)
+
+// TestLinkMetaFollowsLastLink drops a file with shared metadata to a
+// single link in every way there is and checks that the metadata moves to
+// the remaining name, so nothing is left under the file's identity for a
+// later file reusing its inode to pick up
+func TestLinkMetaFollowsLastLink(t *testing.T) {
+	for name, unlink := range map[string]func(fs *SimpleFS) error{
+		"DeleteFile": func(fs *SimpleFS) error {
+			return fs.DeleteFile("dir/b.txt")
+		},
+		"DeleteDir": func(fs *SimpleFS) error {
+			if err := fs.DeleteFile("dir/other.txt"); err != nil {
+				return err
+			}
+			return fs.DeleteDir("dir")
+		},
+		"MoveFile": func(fs *SimpleFS) error {
+			return fs.MoveFile("dir/other.txt", "dir/b.txt")
+		},
+		"Tx": func(fs *SimpleFS) error {
+			tx := fs.Begin()
+			if err := tx.DeleteFile("dir/b.txt"); err != nil {
+				return err
+			}
+			return tx.Commit()
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := openTestFS(t, t.TempDir())
+			if err := fs.WriteFile("a.txt", []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.WriteFile("dir/other.txt", []byte("other")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Link("a.txt", "dir/b.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.SetAttribute("dir/b.txt", "tag", "shared"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.WriteFile("dir/b.txt", []byte("v2")); err != nil {
+				t.Fatal(err)
+			}
+			if !fs.hasSharedMeta() {
+				t.Fatal("linked file keeps no metadata under its identity")
+			}
+			before, err := fs.ListVersions("a.txt")
+			if err != nil {
+				t.Fatalf("ListVersions: %v", err)
+			}
+
+			if err := unlink(fs); err != nil {
+				t.Fatal(err)
+			}
+			if fs.hasSharedMeta() {
+				t.Fatal("metadata is still kept under the identity of a file with one link")
+			}
+			wantContent(t, fs, "a.txt", "v2")
+			wantAttribute(t, fs, "a.txt", "tag", "shared")
+			listing, err := fs.ListVersions("a.txt")
+			if err != nil {
+				t.Fatalf("ListVersions: %v", err)
+			}
+			// Deleting a link versions the content first
+			if len(listing.Versions) < len(before.Versions) {
+				t.Fatalf("a.txt has %d versions, want at least the %d it had", len(listing.Versions), len(before.Versions))
+			}
+
+			// The remaining link is an ordinary file again
+			if err := fs.WriteFile("a.txt", []byte("v3")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.DeleteFile("a.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if fs.hasSharedMeta() {
+				t.Fatal("deleting the last link left metadata under its identity")
+			}
+		})
+	}
+}
@@ -200,14 +200,35 @@ func (lm *ExplicitLockManager) GetAllLocks() []*LockInfo {
 	return locks
 }
 
-// WithExplicitLocking adds explicit locking capability to the filesystem
+// WithExplicitLocking adds explicit locking capability to the filesystem.
+// Sub views share the locks of their parent, so for a view it enables them
+// on the parent unless they already are.
 func (fs *SimpleFS) WithExplicitLocking() *SimpleFS {
+	if fs.parent != nil {
+		if fs.parent.lockManager == nil {
+			fs.parent.WithExplicitLocking()
+		}
+		return fs
+	}
+
 	fs.lockManager = NewExplicitLockManager()
 	return fs
 }
 
 // LockFile acquires an explicit lock on a file
 func (fs *SimpleFS) LockFile(path, owner string, lockType LockType, timeout time.Duration) (*LockInfo, error) {
+	if fs.parent != nil {
+		parentPath, err := fs.parentPath(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := fs.parent.LockFile(parentPath, owner, lockType, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return fs.viewLock(info, path), nil
+	}
+
 	if fs.lockManager == nil {
 		return nil, fmt.Errorf("explicit locking is not enabled")
 	}
@@ -217,6 +238,14 @@ func (fs *SimpleFS) LockFile(path, owner string, lockType LockType, timeout time
 
 // UnlockFile releases an explicit lock on a file
 func (fs *SimpleFS) UnlockFile(path, owner string) error {
+	if fs.parent != nil {
+		parentPath, err := fs.parentPath(path)
+		if err != nil {
+			return err
+		}
+		return fs.parent.UnlockFile(parentPath, owner)
+	}
+
 	if fs.lockManager == nil {
 		return fmt.Errorf("explicit locking is not enabled")
 	}
@@ -226,6 +255,11 @@ func (fs *SimpleFS) UnlockFile(path, owner string) error {
 
 // IsFileLocked checks if a file has an explicit lock
 func (fs *SimpleFS) IsFileLocked(path string) bool {
+	if fs.parent != nil {
+		parentPath, err := fs.parentPath(path)
+		return err == nil && fs.parent.IsFileLocked(parentPath)
+	}
+
 	if fs.lockManager == nil {
 		return false
 	}
@@ -235,6 +269,18 @@ func (fs *SimpleFS) IsFileLocked(path string) bool {
 
 // GetFileLockInfo gets information about a file's lock
 func (fs *SimpleFS) GetFileLockInfo(path string) (*LockInfo, bool) {
+	if fs.parent != nil {
+		parentPath, err := fs.parentPath(path)
+		if err != nil {
+			return nil, false
+		}
+		info, ok := fs.parent.GetFileLockInfo(parentPath)
+		if !ok {
+			return nil, false
+		}
+		return fs.viewLock(info, path), true
+	}
+
 	if fs.lockManager == nil {
 		return nil, false
 	}
@@ -244,9 +290,22 @@ func (fs *SimpleFS) GetFileLockInfo(path string) (*LockInfo, bool) {
 
 // WaitForFileLock waits for a file's lock to be released
 func (fs *SimpleFS) WaitForFileLock(path string, waitTime time.Duration) bool {
+	if fs.parent != nil {
+		parentPath, err := fs.parentPath(path)
+		return err == nil && fs.parent.WaitForFileLock(parentPath, waitTime)
+	}
+
 	if fs.lockManager == nil {
 		return true
 	}
 
 	return fs.lockManager.WaitForLock(path, waitTime)
 }
+
+// viewLock returns a copy of a lock of the parent of a Sub view with the
+// path the view knows it by
+func (fs *SimpleFS) viewLock(info *LockInfo, path string) *LockInfo {
+	copied := *info
+	copied.Path = path
+	return &copied
+}
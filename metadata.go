@@ -0,0 +1,197 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// Chmod changes the permission bits of a file or directory. A symlink in
+// path is followed.
+func (fs *SimpleFS) Chmod(path string, mode os.FileMode) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.Chmod(rel, mode)
+	}
+
+	ctx := &HookContext{
+		Operation: OpChmod,
+		Path:      path,
+		Mode:      mode.Perm(),
+	}
+	return fs.changeMeta(ctx, JournalEntry{
+		Operation: JournalChmod,
+		Path:      path,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			"mode": fmt.Sprintf("%d", mode.Perm()),
+		},
+	})
+}
+
+// Chown changes the user and group owning a file or directory. An ID of
+// -1 is left unchanged. A symlink in path is followed.
+func (fs *SimpleFS) Chown(path string, uid, gid int) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.Chown(rel, uid, gid)
+	}
+
+	ctx := &HookContext{
+		Operation: OpChown,
+		Path:      path,
+		UID:       uid,
+		GID:       gid,
+	}
+	return fs.changeMeta(ctx, JournalEntry{
+		Operation: JournalChown,
+		Path:      path,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			"uid": strconv.Itoa(uid),
+			"gid": strconv.Itoa(gid),
+		},
+	})
+}
+
+// Chtimes changes the access and modification times of a file or
+// directory, for instance to keep the times of imported data. A zero time
+// is left unchanged. A symlink in path is followed.
+func (fs *SimpleFS) Chtimes(path string, atime, mtime time.Time) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.Chtimes(rel, atime, mtime)
+	}
+
+	ctx := &HookContext{
+		Operation:  OpChtimes,
+		Path:       path,
+		AccessTime: atime,
+		ModTime:    mtime,
+	}
+	return fs.changeMeta(ctx, JournalEntry{
+		Operation: JournalChtimes,
+		Path:      path,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			"atime": formatEntryTime(atime),
+			"mtime": formatEntryTime(mtime),
+		},
+	})
+}
+
+// changeMeta journals and applies a change of the metadata of an existing
+// file, which its journal handler performs
+func (fs *SimpleFS) changeMeta(ctx *HookContext, entry JournalEntry) error {
+	fullPath, err := fs.fullPath(ctx.Path)
+	if err != nil {
+		return err
+	}
+
+	fileLock := fs.getFileLock(fullPath)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return err
+	}
+
+	if _, err := fs.fsys.Stat(fullPath); err != nil {
+		return err
+	}
+
+	txID, err := fs.logTx(entry)
+	if err != nil {
+		return fmt.Errorf("failed to log %s: %w", entry.Operation, err)
+	}
+
+	err = fs.applyEntry(entry)
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
+	}
+
+	return fs.executeHooks(HookTypePost, ctx)
+}
+
+// metaEntries returns the journal entries giving path the owner and times
+// of info, which rewriting the file on replay would lose
+func metaEntries(path string, info os.FileInfo, ts time.Time) []JournalEntry {
+	var atime time.Time
+	if t, ok := vfs.AccessTime(info); ok {
+		atime = t
+	}
+	entries := []JournalEntry{{
+		Operation: JournalChtimes,
+		Path:      path,
+		Timestamp: ts,
+		Attributes: map[string]string{
+			"atime": formatEntryTime(atime),
+			"mtime": formatEntryTime(info.ModTime()),
+		},
+	}}
+	if uid, gid, ok := vfs.Owner(info); ok {
+		entries = append(entries, JournalEntry{
+			Operation: JournalChown,
+			Path:      path,
+			Timestamp: ts,
+			Attributes: map[string]string{
+				"uid": strconv.Itoa(uid),
+				"gid": strconv.Itoa(gid),
+			},
+		})
+	}
+	return entries
+}
+
+// perm returns the permission bits recorded with a chmod entry. Unlike
+// mode it has no default, since 0 is a valid mode to change to.
+func (e *JournalEntry) perm() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(e.Attributes["mode"], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode in %s entry: %w", e.Operation, err)
+	}
+	return os.FileMode(mode).Perm(), nil
+}
+
+// owner returns the IDs recorded with a chown entry
+func (e *JournalEntry) owner() (int, int, error) {
+	uid, err := strconv.Atoi(e.Attributes["uid"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid in %s entry: %w", e.Operation, err)
+	}
+	gid, err := strconv.Atoi(e.Attributes["gid"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid in %s entry: %w", e.Operation, err)
+	}
+	return uid, gid, nil
+}
+
+// times returns the times recorded with a chtimes entry
+func (e *JournalEntry) times() (time.Time, time.Time, error) {
+	atime, err := parseEntryTime(e.Attributes["atime"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid atime in %s entry: %w", e.Operation, err)
+	}
+	mtime, err := parseEntryTime(e.Attributes["mtime"])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid mtime in %s entry: %w", e.Operation, err)
+	}
+	return atime, mtime, nil
+}
+
+// formatEntryTime formats a time for a journal entry attribute, the zero
+// time as the empty string
+func formatEntryTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseEntryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestChangeMeta changes the mode, owner and times of a file on the host
+// and in memory and checks that Stat reports them, with zero times and
+// IDs of -1 left unchanged
+func TestChangeMeta(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) *SimpleFS{
+		"OS": func(t *testing.T) *SimpleFS {
+			return openTestFS(t, t.TempDir())
+		},
+		"Memory": func(t *testing.T) *SimpleFS {
+			return openMemTestFS(t, NewMemoryBackend())
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := open(t)
+			if err := fs.WriteFile("a.txt", []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			before, err := fs.Stat("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.Chmod("a.txt", 0600); err != nil {
+				t.Fatalf("Chmod: %v", err)
+			}
+			if err := fs.Chown("a.txt", -1, -1); err != nil {
+				t.Fatalf("Chown: %v", err)
+			}
+			atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+			if err := fs.Chtimes("a.txt", atime, mtime); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+			newMtime := mtime.Add(time.Hour)
+			if err := fs.Chtimes("a.txt", time.Time{}, newMtime); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+
+			info, err := fs.Stat("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode.Perm() != 0600 {
+				t.Fatalf("mode = %v, want 0600", info.Mode.Perm())
+			}
+			if info.UID != before.UID || info.GID != before.GID {
+				t.Fatalf("owner = %d:%d, want it unchanged at %d:%d", info.UID, info.GID, before.UID, before.GID)
+			}
+			if !info.ModTime.Equal(newMtime) {
+				t.Fatalf("mtime = %v, want %v", info.ModTime, newMtime)
+			}
+			if !info.AccessTime.IsZero() && !info.AccessTime.Equal(atime) {
+				t.Fatalf("atime = %v, want it left at %v", info.AccessTime, atime)
+			}
+
+			if err := fs.Chmod("missing.txt", 0600); err == nil {
+				t.Fatal("Chmod of a missing file succeeded")
+			}
+			want := []string{"write a.txt", "chmod a.txt", "chown a.txt", "chtimes a.txt", "chtimes a.txt"}
+			if got := changes(t, fs); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("changes = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mount is a filesystem attached below a path of another
+type mount struct {
+	fs    *SimpleFS
+	owned bool // Created by MountBackend, so closed when unmounted
+}
+
+// Mount attaches target below prefix, so that paths under prefix are
+// served by target relative to its own root, with its hooks, journal,
+// attributes and versions. The mount point directory is created if it
+// does not exist. Mounts are not persisted; they have to be set up again
+// after the filesystem is reopened.
+//
+// Mounts cannot overlap, cover the root or internal directories. Closing
+// the filesystem does not close target.
+func (fs *SimpleFS) Mount(prefix string, target *SimpleFS) error {
+	return fs.mount(prefix, &mount{fs: target})
+}
+
+// MountBackend creates a filesystem rooted at root on backend and mounts
+// it below prefix. It is configured by opts like NewSimpleFS, and closed
+// when it is unmounted or the filesystem is closed.
+func (fs *SimpleFS) MountBackend(prefix string, backend Backend, root string, opts *Options) error {
+	mountOpts := DefaultOptions()
+	if opts != nil {
+		copied := *opts
+		mountOpts = &copied
+	}
+	mountOpts.Backend = backend
+
+	target, err := NewSimpleFS(root, mountOpts)
+	if err != nil {
+		return err
+	}
+	if err := fs.mount(prefix, &mount{fs: target, owned: true}); err != nil {
+		target.Close()
+		return err
+	}
+	return nil
+}
+
+func (fs *SimpleFS) mount(prefix string, m *mount) error {
+	if m.fs == fs {
+		return errors.New("cannot mount a filesystem on itself")
+	}
+	if c := filepath.Clean(prefix); c == ".." || strings.HasPrefix(c, ".."+string(filepath.Separator)) {
+		return errors.New("path attempts to escape the root directory")
+	}
+	key := cleanRelPath(prefix)
+	if key == "" {
+		return errors.New("cannot mount over the root of the filesystem")
+	}
+	if fs.parent != nil {
+		return fs.parent.mount(filepath.Join(fs.prefix, key), m)
+	}
+	if isInternalName(strings.SplitN(filepath.ToSlash(key), "/", 2)[0]) {
+		return fmt.Errorf("cannot mount over internal directory: %s", prefix)
+	}
+
+	if err := fs.checkMountPoint(prefix, key); err != nil {
+		return err
+	}
+
+	fullPath, err := fs.localPath(key)
+	if err != nil {
+		return err
+	}
+	if info, err := fs.fsys.Stat(fullPath); err == nil && !info.IsDir() {
+		return fmt.Errorf("mount point is not a directory: %s", prefix)
+	} else if os.IsNotExist(err) {
+		if err := fs.CreateDir(key); err != nil {
+			return fmt.Errorf("failed to create mount point: %w", err)
+		}
+	}
+
+	fs.mountsGuard.Lock()
+	defer fs.mountsGuard.Unlock()
+
+	// Checked again, another mount may have been added meanwhile
+	if err := fs.overlappingMount(prefix, key); err != nil {
+		return err
+	}
+	if fs.mounts == nil {
+		fs.mounts = make(map[string]*mount)
+	}
+	fs.mounts[key] = m
+	return nil
+}
+
+// checkMountPoint fails when a mount at key would overlap an existing one
+func (fs *SimpleFS) checkMountPoint(prefix, key string) error {
+	fs.mountsGuard.RLock()
+	defer fs.mountsGuard.RUnlock()
+
+	return fs.overlappingMount(prefix, key)
+}
+
+// overlappingMount fails when a mount at key would overlap an existing
+// one. The caller must hold fs.mountsGuard.
+func (fs *SimpleFS) overlappingMount(prefix, key string) error {
+	for existing := range fs.mounts {
+		if existing == key || isBelow(key, existing) || isBelow(existing, key) {
+			return fmt.Errorf("mount point %s overlaps mount point %s", prefix, existing)
+		}
+	}
+	return nil
+}
+
+// Unmount detaches the filesystem mounted below prefix. The mount point
+// directory is left in place.
+func (fs *SimpleFS) Unmount(prefix string) error {
+	key := cleanRelPath(prefix)
+	if fs.parent != nil {
+		if _, err := fs.parentPath(prefix); err != nil || key == "" {
+			return fmt.Errorf("not a mount point: %s", prefix)
+		}
+		return fs.parent.Unmount(filepath.Join(fs.prefix, key))
+	}
+
+	fs.mountsGuard.Lock()
+	m, ok := fs.mounts[key]
+	delete(fs.mounts, key)
+	fs.mountsGuard.Unlock()
+
+	if !ok {
+		return fmt.Errorf("not a mount point: %s", prefix)
+	}
+	if m.owned {
+		return m.fs.Close()
+	}
+	return nil
+}
+
+// Mounts returns the mount points of the filesystem in sorted order
+func (fs *SimpleFS) Mounts() []string {
+	if fs.parent != nil {
+		prefixes := make([]string, 0)
+		for _, key := range fs.parent.Mounts() {
+			if path, ok := fs.viewPath(key); ok {
+				prefixes = append(prefixes, path)
+			}
+		}
+		return prefixes
+	}
+
+	fs.mountsGuard.RLock()
+	defer fs.mountsGuard.RUnlock()
+
+	prefixes := make([]string, 0, len(fs.mounts))
+	for key := range fs.mounts {
+		prefixes = append(prefixes, key)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// closeMounts unmounts everything and closes the filesystems created by
+// MountBackend
+func (fs *SimpleFS) closeMounts() error {
+	fs.mountsGuard.Lock()
+	mounts := fs.mounts
+	fs.mounts = nil
+	fs.mountsGuard.Unlock()
+
+	var err error
+	for _, m := range mounts {
+		if m.owned {
+			if closeErr := m.fs.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// mounted returns the filesystem serving path and the path relative to
+// its root, when path is below a mount point. Paths escaping the root are
+// never mounted, so they fail the usual checks.
+func (fs *SimpleFS) mounted(path string) (*SimpleFS, string, bool) {
+	if fs.parent != nil {
+		// A view is served entirely by its parent
+		parentPath, err := fs.parentPath(path)
+		if err != nil {
+			return nil, "", false
+		}
+		return fs.parent, parentPath, true
+	}
+
+	fs.mountsGuard.RLock()
+	defer fs.mountsGuard.RUnlock()
+
+	if len(fs.mounts) == 0 {
+		return nil, "", false
+	}
+	if c := filepath.Clean(path); c == ".." || strings.HasPrefix(c, ".."+string(filepath.Separator)) {
+		return nil, "", false
+	}
+
+	key := cleanRelPath(path)
+	for dir := key; dir != "." && dir != ""; dir = filepath.Dir(dir) {
+		if m, ok := fs.mounts[dir]; ok {
+			rel, _ := filepath.Rel(dir, key)
+			if rel == "." {
+				rel = ""
+			}
+			return m.fs, rel, true
+		}
+	}
+	return nil, "", false
+}
+
+// resolve returns the filesystem serving path and the path within it,
+// which is fs and path itself outside of mounts
+func (fs *SimpleFS) resolve(path string) (*SimpleFS, string) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.resolve(rel)
+	}
+	return fs, path
+}
+
+// mountsIn returns the filesystems mounted directly in dir by name
+func (fs *SimpleFS) mountsIn(dir string) map[string]*SimpleFS {
+	fs.mountsGuard.RLock()
+	defer fs.mountsGuard.RUnlock()
+
+	dir = cleanRelPath(dir)
+	if dir == "" {
+		dir = "."
+	}
+
+	var found map[string]*SimpleFS
+	for key, m := range fs.mounts {
+		if filepath.Dir(key) == dir {
+			if found == nil {
+				found = make(map[string]*SimpleFS)
+			}
+			found[filepath.Base(key)] = m.fs
+		}
+	}
+	return found
+}
+
+// mountBelow returns a mount point at or below path, if there is one
+func (fs *SimpleFS) mountBelow(path string) (string, bool) {
+	fs.mountsGuard.RLock()
+	defer fs.mountsGuard.RUnlock()
+
+	key := cleanRelPath(path)
+	for existing := range fs.mounts {
+		if key == "" || existing == key || isBelow(existing, key) {
+			return existing, true
+		}
+	}
+	return "", false
+}
+
+// isBelow reports whether the relative path lies inside dir
+func isBelow(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// transfer copies a file between filesystems through their public
+// operations, so hooks and journaling run on both sides: a write of the
+// content with its mode and a SetAttribute for each attribute. With
+// remove the source is deleted afterwards, and the OpMoveFile hooks of the
+// source filesystem run around the whole transfer, with Path naming the
+// destination within its own filesystem.
+//
+// A move is not atomic: each step is journaled on its own side, so a crash
+// in between can leave the file in both filesystems, or its copy without
+// all of its attributes.
+func transfer(srcFS *SimpleFS, src string, dstFS *SimpleFS, dst string, remove bool) error {
+	var ctx *HookContext
+	if remove {
+		ctx = &HookContext{
+			Operation: OpMoveFile,
+			Path:      dst,
+			SrcPath:   src,
+		}
+		if err := srcFS.executeHooks(HookTypePre, ctx); err != nil {
+			return err
+		}
+	}
+
+	info, err := srcFS.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if info.IsDir {
+		return fmt.Errorf("source is a directory: %s", src)
+	}
+	data, err := srcFS.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := dstFS.WriteFileWithMode(dst, data, info.Mode.Perm()); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(info.Attributes))
+	for key := range info.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := dstFS.SetAttribute(dst, key, info.Attributes[key]); err != nil {
+			return fmt.Errorf("failed to copy attributes: %w", err)
+		}
+	}
+
+	if remove {
+		if err := srcFS.DeleteFile(src); err != nil {
+			return fmt.Errorf("copied to %s but failed to delete source: %w", dst, err)
+		}
+		return srcFS.executeHooks(HookTypePost, ctx)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMountTable(t *testing.T) {
+	root := openTestFS(t, t.TempDir())
+	disk := openTestFS(t, t.TempDir())
+	if err := root.Mount("data/disk", disk); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	// Paths below the prefix are served by the mounted filesystem
+	if err := root.WriteFile("data/disk/a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, disk, "a.txt", "a")
+	if got := listNames(t, root, "data"); len(got) != 1 || got[0] != "disk" {
+		t.Fatalf("ListDir(data) = %v, want the mount point", got)
+	}
+
+	for _, prefix := range []string{"data/disk", "data/disk/sub", "data", ""} {
+		if err := root.Mount(prefix, openTestFS(t, t.TempDir())); err == nil {
+			t.Fatalf("Mount(%q) overlapping data/disk succeeded", prefix)
+		}
+	}
+	if err := root.DeleteDir("data"); err == nil {
+		t.Fatal("DeleteDir removed a directory containing a mount point")
+	}
+	if got := root.Mounts(); fmt.Sprint(got) != "[data/disk]" {
+		t.Fatalf("Mounts = %v, want data/disk", got)
+	}
+
+	if err := root.Unmount("data/disk"); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	wantMissing(t, root, "data/disk/a.txt")
+	wantContent(t, disk, "a.txt", "a")
+	if got := root.Mounts(); len(got) != 0 {
+		t.Fatalf("Mounts after Unmount = %v", got)
+	}
+}
+
+func TestMoveAcrossMounts(t *testing.T) {
+	root := openTestFS(t, t.TempDir())
+	disk := openTestFS(t, t.TempDir())
+	if err := root.Mount("disk", disk); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if err := root.WriteFileWithMode("a.txt", []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetAttribute("a.txt", "tag", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	for _, typ := range []HookType{HookTypePre, HookTypePost} {
+		typ := typ
+		root.RegisterHook(OpMoveFile, typ, func(ctx *HookContext) error {
+			calls = append(calls, fmt.Sprintf("%v %s %s", typ, ctx.SrcPath, ctx.Path))
+			if ctx.SrcPath == "vetoed.txt" {
+				return errors.New("vetoed")
+			}
+			return nil
+		})
+	}
+
+	if err := root.MoveFile("a.txt", "disk/b.txt"); err != nil {
+		t.Fatalf("MoveFile: %v", err)
+	}
+	wantMissing(t, root, "a.txt")
+	wantContent(t, disk, "b.txt", "a")
+	wantAttribute(t, disk, "b.txt", "tag", "x")
+	info, err := disk.Stat("b.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode.Perm() != 0600 {
+		t.Fatalf("moved file has mode %v, want 0600", info.Mode.Perm())
+	}
+	want := fmt.Sprintf("[%v a.txt b.txt %v a.txt b.txt]", HookTypePre, HookTypePost)
+	if fmt.Sprint(calls) != want {
+		t.Fatalf("hooks = %v, want %s", calls, want)
+	}
+
+	// A failing pre hook leaves both sides alone
+	if err := root.WriteFile("vetoed.txt", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.MoveFile("vetoed.txt", "disk/vetoed.txt"); err == nil {
+		t.Fatal("MoveFile succeeded despite the failing pre hook")
+	}
+	wantContent(t, root, "vetoed.txt", "v")
+	wantMissing(t, disk, "vetoed.txt")
+}
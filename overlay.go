@@ -0,0 +1,670 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// Names an overlay keeps in the upper layer to hide entries of the lower
+// one. A whiteout .wh.<name> hides <name>; an opaque marker in a directory
+// hides everything the lower layer has in it.
+const (
+	whiteoutPrefix = ".wh."
+	opaqueName     = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// NewOverlayFS combines a read-only lower filesystem with a writable upper
+// one. Reads fall through to the lower layer for anything the upper layer
+// does not have. Writes copy files and their parent directories up into
+// the upper layer first, and deletes of lower entries leave whiteout
+// markers (.wh.<name>) in the upper layer. ListDir merges both layers.
+//
+// The overlay is rooted at the upper root and uses its journal and
+// versioning settings, so attributes, versions and the journal live in the
+// upper layer; lower attributes stay visible until they are changed. The
+// lower layer is never modified, and neither layer should be changed
+// directly while the overlay is in use. Recover the overlay rather than
+// the upper layer after a crash. Closing the overlay leaves both layers
+// open.
+func NewOverlayFS(lower, upper *SimpleFS) (*SimpleFS, error) {
+	if upper.readOnly {
+		return nil, fmt.Errorf("upper layer must be writable: %w", ErrReadOnly)
+	}
+	if lower.rootPath == upper.rootPath && lower.fsys == upper.fsys {
+		return nil, errors.New("lower and upper layers are the same filesystem")
+	}
+
+	return &SimpleFS{
+		rootPath:      upper.rootPath,
+		fsys:          &overlayBackend{lower: lower.fsys, lowerRoot: lower.rootPath, upper: upper.fsys, upperRoot: upper.rootPath},
+		journal:       upper.journal,
+		sharedJournal: true,
+		locks:         make(map[string]*sync.RWMutex),
+		hooks:         make(map[HookKey][]HookFunc),
+		versioning:    upper.versioning,
+		versionPath:   upper.versionPath,
+		maxVersions:   upper.maxVersions,
+		atomicWrites:  upper.atomicWrites,
+	}, nil
+}
+
+// overlayBackend merges a lower and an upper backend. Names are paths
+// below upperRoot; the same relative path below lowerRoot is the lower
+// entry.
+type overlayBackend struct {
+	lower     vfs.FS
+	lowerRoot string
+	upper     vfs.FS
+	upperRoot string
+}
+
+// rel returns the path of name relative to the upper root, and false for
+// names that only exist in the upper layer: the journal, versions and
+// replication state, and names outside the root
+func (o *overlayBackend) rel(name string) (string, bool) {
+	rel, err := filepath.Rel(o.upperRoot, filepath.Clean(name))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	switch strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] {
+	case ".journal", ".versions", replicationStateName:
+		return "", false
+	}
+	return rel, true
+}
+
+func (o *overlayBackend) upperPath(rel string) string { return filepath.Join(o.upperRoot, rel) }
+func (o *overlayBackend) lowerPath(rel string) string { return filepath.Join(o.lowerRoot, rel) }
+
+// exists reports whether fsys has name, failing on errors other than a
+// missing entry
+func exists(fsys vfs.FS, name string) (bool, error) {
+	_, err := fsys.Lstat(name)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return false, nil
+	}
+	return false, err
+}
+
+// lowerVisible reports whether the lower entry at rel is visible, that is
+// not hidden by a whiteout, an opaque directory or a file in the upper
+// layer along its path
+func (o *overlayBackend) lowerVisible(rel string) (bool, error) {
+	if rel == "." {
+		return true, nil
+	}
+
+	dir := "."
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		upperDir := o.upperPath(dir)
+		info, err := o.upper.Lstat(upperDir)
+		if err == nil {
+			if !info.IsDir() {
+				return false, nil
+			}
+			if hidden, err := exists(o.upper, filepath.Join(upperDir, whiteoutPrefix+part)); err != nil || hidden {
+				return false, err
+			}
+			if opaque, err := exists(o.upper, filepath.Join(upperDir, opaqueName)); err != nil || opaque {
+				return false, err
+			}
+		} else if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return false, err
+		} else {
+			// Nothing of the path is in the upper layer from here on
+			break
+		}
+		if i < len(parts)-1 {
+			dir = filepath.Join(dir, part)
+		}
+	}
+	return true, nil
+}
+
+// stat returns the merged view of rel and whether it comes from the upper
+// layer
+func (o *overlayBackend) stat(op, name, rel string, lstat bool) (os.FileInfo, bool, error) {
+	statUpper, statLower := o.upper.Stat, o.lower.Stat
+	if lstat {
+		statUpper, statLower = o.upper.Lstat, o.lower.Lstat
+	}
+
+	info, err := statUpper(o.upperPath(rel))
+	if err == nil {
+		return info, true, nil
+	}
+	if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+		return nil, false, err
+	}
+
+	visible, err := o.lowerVisible(rel)
+	if err != nil {
+		return nil, false, err
+	}
+	if !visible {
+		return nil, false, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	info, err = statLower(o.lowerPath(rel))
+	if err != nil {
+		return nil, false, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return info, false, nil
+}
+
+// copyUp makes sure rel is in the upper layer, copying the lower entry and
+// its parent directories when it is not. Directories are created empty,
+// since their other entries still fall through.
+func (o *overlayBackend) copyUp(rel string) error {
+	info, inUpper, err := o.stat("copyup", o.upperPath(rel), rel, true)
+	if err != nil || inUpper {
+		return err
+	}
+	if rel != "." {
+		if err := o.copyUp(filepath.Dir(rel)); err != nil {
+			return err
+		}
+	}
+
+	if info.IsDir() {
+		if err := o.upper.Mkdir(o.upperPath(rel), info.Mode().Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := o.lower.Readlink(o.lowerPath(rel))
+		if err != nil {
+			return err
+		}
+		return o.upper.Symlink(target, o.upperPath(rel))
+	}
+
+	src, err := vfs.Open(o.lower, o.lowerPath(rel))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := o.upper.OpenFile(o.upperPath(rel), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = o.upper.Chmod(o.upperPath(rel), info.Mode().Perm())
+	}
+	if err == nil {
+		// Copying up is not a modification of the file
+		atime, _ := vfs.AccessTime(info)
+		err = o.upper.Chtimes(o.upperPath(rel), atime, info.ModTime())
+	}
+	return err
+}
+
+// prepareCreate readies the upper layer for a new entry at rel: its parent
+// is copied up and a whiteout of an earlier lower entry is removed. It
+// reports whether there was one.
+func (o *overlayBackend) prepareCreate(op, name, rel string) (bool, error) {
+	if strings.HasPrefix(filepath.Base(rel), whiteoutPrefix) {
+		return false, &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+
+	parent := filepath.Dir(rel)
+	info, _, err := o.stat(op, o.upperPath(parent), parent, false)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	if err := o.copyUp(parent); err != nil {
+		return false, err
+	}
+
+	whiteout := filepath.Join(o.upperPath(parent), whiteoutPrefix+filepath.Base(rel))
+	err = o.upper.Remove(whiteout)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// whiteout hides the lower entry at rel, if there is a visible one
+func (o *overlayBackend) whiteout(rel string) error {
+	visible, err := o.lowerVisible(rel)
+	if err != nil || !visible {
+		return err
+	}
+	if found, err := exists(o.lower, o.lowerPath(rel)); err != nil || !found {
+		return err
+	}
+
+	parent := filepath.Dir(rel)
+	if err := o.copyUp(parent); err != nil {
+		return err
+	}
+	return vfs.WriteFile(o.upper, filepath.Join(o.upperPath(parent), whiteoutPrefix+filepath.Base(rel)), nil, 0644)
+}
+
+func (o *overlayBackend) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.OpenFile(name, flag, perm)
+	}
+
+	if !isWriteFlag(flag) && flag&(os.O_CREATE|os.O_TRUNC) == 0 {
+		_, inUpper, err := o.stat("open", name, rel, false)
+		if err != nil {
+			return nil, err
+		}
+		if inUpper {
+			return o.upper.OpenFile(o.upperPath(rel), flag, perm)
+		}
+		return o.lower.OpenFile(o.lowerPath(rel), flag, perm)
+	}
+
+	info, inUpper, err := o.stat("open", name, rel, false)
+	switch {
+	case err == nil && flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case err == nil && !inUpper && flag&os.O_TRUNC == 0:
+		if err := o.copyUp(rel); err != nil {
+			return nil, err
+		}
+	case err == nil && !inUpper:
+		// Truncated anyway, so only the parent needs copying
+		if _, err := o.prepareCreate("open", name, rel); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		if _, err := o.prepareCreate("open", name, rel); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	return o.upper.OpenFile(o.upperPath(rel), flag, perm)
+}
+
+func (o *overlayBackend) Stat(name string) (os.FileInfo, error) {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Stat(name)
+	}
+	info, _, err := o.stat("stat", name, rel, false)
+	return info, err
+}
+
+func (o *overlayBackend) Lstat(name string) (os.FileInfo, error) {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Lstat(name)
+	}
+	info, _, err := o.stat("lstat", name, rel, true)
+	return info, err
+}
+
+// ReadDir merges the entries of both layers. Upper entries win, and
+// whiteouts, opaque markers and the lower layer's own journal, versions
+// and replication state are left out.
+func (o *overlayBackend) ReadDir(name string) ([]os.DirEntry, error) {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.ReadDir(name)
+	}
+
+	info, _, err := o.stat("readdir", name, rel, false)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	merged := make(map[string]os.DirEntry)
+	hidden := make(map[string]bool)
+	opaque := false
+	upperEntries, err := o.upper.ReadDir(o.upperPath(rel))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range upperEntries {
+		switch {
+		case entry.Name() == opaqueName:
+			opaque = true
+		case strings.HasPrefix(entry.Name(), whiteoutPrefix):
+			hidden[strings.TrimPrefix(entry.Name(), whiteoutPrefix)] = true
+		default:
+			merged[entry.Name()] = entry
+		}
+	}
+
+	if !opaque {
+		visible, err := o.lowerVisible(rel)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			lowerEntries, err := o.lower.ReadDir(o.lowerPath(rel))
+			if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+				return nil, err
+			}
+			for _, entry := range lowerEntries {
+				if _, ok := merged[entry.Name()]; ok || hidden[entry.Name()] {
+					continue
+				}
+				if _, ok := o.rel(filepath.Join(name, entry.Name())); !ok {
+					continue
+				}
+				merged[entry.Name()] = entry
+			}
+		}
+	}
+
+	entries := make([]os.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *overlayBackend) Mkdir(name string, perm os.FileMode) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Mkdir(name, perm)
+	}
+
+	if _, _, err := o.stat("mkdir", name, rel, true); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	replaced, err := o.prepareCreate("mkdir", name, rel)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(o.upperPath(rel), perm); err != nil {
+		return err
+	}
+	if replaced {
+		// The deleted lower directory must not show through the new one
+		return vfs.WriteFile(o.upper, filepath.Join(o.upperPath(rel), opaqueName), nil, 0644)
+	}
+	return nil
+}
+
+func (o *overlayBackend) MkdirAll(name string, perm os.FileMode) error {
+	if _, ok := o.rel(name); !ok {
+		return o.upper.MkdirAll(name, perm)
+	}
+
+	info, err := o.Stat(name)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := o.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := o.Mkdir(name, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (o *overlayBackend) Remove(name string) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Remove(name)
+	}
+
+	info, inUpper, err := o.stat("remove", name, rel, true)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := o.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if inUpper {
+		// An empty merged directory may still hold whiteouts
+		if err := o.upper.RemoveAll(o.upperPath(rel)); err != nil {
+			return err
+		}
+	}
+	return o.whiteout(rel)
+}
+
+func (o *overlayBackend) RemoveAll(name string) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.RemoveAll(name)
+	}
+
+	if _, _, err := o.stat("remove", name, rel, true); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := o.upper.RemoveAll(o.upperPath(rel)); err != nil {
+		return err
+	}
+	return o.whiteout(rel)
+}
+
+// Rename moves an entry within the upper layer, copying it up first. A
+// directory with lower entries is copied up with everything below it.
+func (o *overlayBackend) Rename(oldpath, newpath string) error {
+	oldRel, oldOK := o.rel(oldpath)
+	newRel, newOK := o.rel(newpath)
+	if !oldOK && !newOK {
+		return o.upper.Rename(oldpath, newpath)
+	}
+	if !oldOK || !newOK {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	info, _, err := o.stat("rename", oldpath, oldRel, true)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = o.copyUpTree(oldRel)
+	} else {
+		err = o.copyUp(oldRel)
+	}
+	if err != nil {
+		return err
+	}
+
+	replaced, err := o.prepareCreate("rename", newpath, newRel)
+	if err != nil {
+		return err
+	}
+	target, err := o.Lstat(newpath)
+	if err == nil && target.IsDir() {
+		replaced = true
+	}
+	if err := o.upper.Rename(o.upperPath(oldRel), o.upperPath(newRel)); err != nil {
+		return err
+	}
+	if info.IsDir() && replaced {
+		if err := vfs.WriteFile(o.upper, filepath.Join(o.upperPath(newRel), opaqueName), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return o.whiteout(oldRel)
+}
+
+// copyUpTree copies a directory and everything visible below it into the
+// upper layer and makes it opaque, so it no longer depends on the lower
+// path it came from
+func (o *overlayBackend) copyUpTree(rel string) error {
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	entries, err := o.ReadDir(o.upperPath(rel))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(rel, entry.Name())
+		if entry.IsDir() {
+			err = o.copyUpTree(child)
+		} else {
+			err = o.copyUp(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return vfs.WriteFile(o.upper, filepath.Join(o.upperPath(rel), opaqueName), nil, 0644)
+}
+
+func (o *overlayBackend) Chmod(name string, mode os.FileMode) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Chmod(name, mode)
+	}
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	return o.upper.Chmod(o.upperPath(rel), mode)
+}
+
+func (o *overlayBackend) Chown(name string, uid, gid int) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Chown(name, uid, gid)
+	}
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	return o.upper.Chown(o.upperPath(rel), uid, gid)
+}
+
+func (o *overlayBackend) Chtimes(name string, atime, mtime time.Time) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Chtimes(name, atime, mtime)
+	}
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	return o.upper.Chtimes(o.upperPath(rel), atime, mtime)
+}
+
+func (o *overlayBackend) Symlink(oldname, newname string) error {
+	rel, ok := o.rel(newname)
+	if !ok {
+		return o.upper.Symlink(oldname, newname)
+	}
+
+	if _, _, err := o.stat("symlink", newname, rel, true); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := o.prepareCreate("symlink", newname, rel); err != nil {
+		return err
+	}
+	return o.upper.Symlink(oldname, o.upperPath(rel))
+}
+
+func (o *overlayBackend) Readlink(name string) (string, error) {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Readlink(name)
+	}
+
+	_, inUpper, err := o.stat("readlink", name, rel, true)
+	if err != nil {
+		return "", err
+	}
+	if inUpper {
+		return o.upper.Readlink(o.upperPath(rel))
+	}
+	return o.lower.Readlink(o.lowerPath(rel))
+}
+
+// Link copies a lower file up first, so both names share the upper copy
+func (o *overlayBackend) Link(oldname, newname string) error {
+	oldRel, oldOK := o.rel(oldname)
+	newRel, newOK := o.rel(newname)
+	if !oldOK && !newOK {
+		return o.upper.Link(oldname, newname)
+	}
+	if !oldOK || !newOK {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+
+	info, _, err := o.stat("link", oldname, oldRel, true)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if _, _, err := o.stat("link", newname, newRel, true); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := o.copyUp(oldRel); err != nil {
+		return err
+	}
+	if _, err := o.prepareCreate("link", newname, newRel); err != nil {
+		return err
+	}
+	return o.upper.Link(o.upperPath(oldRel), o.upperPath(newRel))
+}
+
+func (o *overlayBackend) Truncate(name string, size int64) error {
+	rel, ok := o.rel(name)
+	if !ok {
+		return o.upper.Truncate(name, size)
+	}
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	return o.upper.Truncate(o.upperPath(rel), size)
+}
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// listNames returns the names ListDir reports for path
+func listNames(t *testing.T, fs *SimpleFS, path string) []string {
+	t.Helper()
+	entries, err := fs.ListDir(path)
+	if err != nil {
+		t.Fatalf("ListDir(%s): %v", path, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestOverlayWhiteouts(t *testing.T) {
+	lower := openTestFS(t, t.TempDir())
+	for path, content := range map[string]string{
+		"a.txt":     "lower a",
+		"dir/b.txt": "lower b",
+		"dir/c.txt": "lower c",
+		"old/d.txt": "lower d",
+	} {
+		if err := lower.WriteFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upperDir := t.TempDir()
+	upper := openTestFS(t, upperDir)
+	overlay, err := NewOverlayFS(lower, upper)
+	if err != nil {
+		t.Fatalf("NewOverlayFS: %v", err)
+	}
+
+	// Writes are copied up, the lower layer keeps its content
+	wantContent(t, overlay, "a.txt", "lower a")
+	if err := overlay.WriteFile("a.txt", []byte("upper a")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, overlay, "a.txt", "upper a")
+	wantContent(t, lower, "a.txt", "lower a")
+
+	// Deleting a lower file leaves a whiteout that hides it
+	if err := overlay.DeleteFile("dir/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	wantMissing(t, overlay, "dir/b.txt")
+	wantContent(t, lower, "dir/b.txt", "lower b")
+	if _, err := os.Lstat(filepath.Join(upperDir, "dir", whiteoutPrefix+"b.txt")); err != nil {
+		t.Fatalf("no whiteout in the upper layer: %v", err)
+	}
+	if got := listNames(t, overlay, "dir"); len(got) != 1 || got[0] != "c.txt" {
+		t.Fatalf("ListDir(dir) = %v, want c.txt only", got)
+	}
+
+	// Creating the file again removes the whiteout
+	if err := overlay.WriteFile("dir/b.txt", []byte("upper b")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, overlay, "dir/b.txt", "upper b")
+	if got := listNames(t, overlay, "dir"); len(got) != 2 {
+		t.Fatalf("ListDir(dir) = %v, want b.txt and c.txt", got)
+	}
+
+	// A directory deleted and created again is opaque
+	if err := overlay.DeleteFile("old/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.DeleteDir("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.CreateDir("old"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, overlay, "old"); len(got) != 0 {
+		t.Fatalf("ListDir(old) = %v, want an empty directory", got)
+	}
+	wantMissing(t, overlay, "old/d.txt")
+	wantContent(t, lower, "old/d.txt", "lower d")
+
+	// Whiteouts and markers never show up in listings
+	if got := listNames(t, overlay, ""); len(got) != 3 {
+		t.Fatalf("ListDir = %v, want a.txt, dir and old", got)
+	}
+}
@@ -14,7 +14,8 @@ func (fs *SimpleFS) IsValidPath(path string) (bool, error) {
 		return false, errors.New("empty path")
 	}
 
-	fullPath, err := fs.fullPath(path)
+	// Mounts do not change whether a path stays inside the namespace
+	fullPath, err := fs.localPath(path)
 	if err != nil {
 		return false, err
 	}
@@ -58,7 +59,7 @@ func SplitPath(path string) []string {
 
 // GetRelativePath gets the relative path from the root
 func (fs *SimpleFS) GetRelativePath(path string) (string, error) {
-	fullPath, err := fs.fullPath(path)
+	fullPath, err := fs.lexicalPath(path)
 	if err != nil {
 		return "", err
 	}
@@ -91,6 +92,14 @@ type PathInfo struct {
 // GetPathInfo returns information about a path
 func (fs *SimpleFS) GetPathInfo(path string) (*PathInfo, error) {
 	path = SanitizePath(path)
+	if target, rel, ok := fs.mounted(path); ok {
+		info, err := target.GetPathInfo(rel)
+		if err != nil {
+			return nil, err
+		}
+		info.Path, info.Relative, info.Components = path, path, SplitPath(path)
+		return info, nil
+	}
 	abs, err := fs.GetAbsolutePath(path)
 	if err != nil {
 		return nil, err
@@ -103,7 +112,7 @@ func (fs *SimpleFS) GetPathInfo(path string) (*PathInfo, error) {
 
 	components := SplitPath(path)
 
-	info, err := os.Stat(abs)
+	info, err := fs.fsys.Stat(abs)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return &PathInfo{
@@ -142,23 +151,31 @@ func (fs *SimpleFS) GetBasename(path string) string {
 
 // PathExists checks if a path exists
 func (fs *SimpleFS) PathExists(path string) bool {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.PathExists(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return false
 	}
 
-	_, err = os.Stat(fullPath)
+	_, err = fs.fsys.Stat(fullPath)
 	return err == nil
 }
 
 // IsDir checks if a path is a directory
 func (fs *SimpleFS) IsDir(path string) bool {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.IsDir(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return false
 	}
 
-	info, err := os.Stat(fullPath)
+	info, err := fs.fsys.Stat(fullPath)
 	if err != nil {
 		return false
 	}
@@ -168,12 +185,16 @@ func (fs *SimpleFS) IsDir(path string) bool {
 
 // IsFile checks if a path is a file
 func (fs *SimpleFS) IsFile(path string) bool {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.IsFile(rel)
+	}
+
 	fullPath, err := fs.fullPath(path)
 	if err != nil {
 		return false
 	}
 
-	info, err := os.Stat(fullPath)
+	info, err := fs.fsys.Stat(fullPath)
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,724 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// RecoveryStatus describes what recovery did with a journaled operation
+type RecoveryStatus string
+
+// Recovery statuses
+const (
+	RecoveryApplied RecoveryStatus = "applied" // Operation was redone
+	RecoverySkipped RecoveryStatus = "skipped" // Effect was already on disk
+	RecoveryFailed  RecoveryStatus = "failed"  // Operation could not be redone
+	RecoveryPending RecoveryStatus = "pending" // Operation would be redone (dry run)
+)
+
+// RecoveredOperation is the outcome of replaying one journaled operation
+type RecoveredOperation struct {
+	LSN       uint64         // Log sequence number of the entry
+	TxID      uint64         // Transaction the entry belongs to
+	Path      string         // Path the operation targets
+	Operation string         // Journal operation (write, delete, ...)
+	Status    RecoveryStatus // What recovery did with the operation
+	Error     string         `json:",omitempty"` // Why the operation failed
+}
+
+// RecoveryReport describes the outcome of a journal recovery
+type RecoveryReport struct {
+	DryRun       bool                 // Whether the report was computed without touching disk
+	EntriesRead  int                  // Journal entries successfully decoded
+	Corrupted    []CorruptedEntry     // Entries skipped because they could not be decoded
+	TornBytes    int64                // Length of an incomplete record at the end of the journal, cut off unless DryRun
+	RolledBack   []uint64             // Transactions rolled back because they never committed
+	Operations   []RecoveredOperation // Operations of committed but unapplied transactions
+	Applied      int                  // Operations redone (or that would be, in a dry run)
+	Skipped      int                  // Operations already present on disk
+	Failed       int                  // Operations that could not be redone
+	TempsRemoved int                  // Temporary files of interrupted writes removed
+	Duration     time.Duration        // How long recovery took
+}
+
+// add records an operation and updates the counters
+func (r *RecoveryReport) add(op RecoveredOperation) {
+	r.Operations = append(r.Operations, op)
+	switch op.Status {
+	case RecoveryApplied, RecoveryPending:
+		r.Applied++
+	case RecoverySkipped:
+		r.Skipped++
+	case RecoveryFailed:
+		r.Failed++
+	}
+}
+
+// journalTx collects the records of one transaction
+type journalTx struct {
+	id           uint64
+	firstLSN     uint64
+	entries      []JournalEntry
+	committed    bool
+	committedAt  time.Time
+	aborted      bool
+	checkpointed bool
+}
+
+// groupTransactions groups journal entries by transaction. It returns the
+// transactions in the order they started, the committed ones in commit
+// order and the horizon of the last journal-wide checkpoint. Entries
+// written before transactions existed are returned as individually
+// committed transactions with ID 0 that are never checkpointed.
+func groupTransactions(entries []JournalEntry) (started, committed []*journalTx, horizon uint64) {
+	txs := make(map[uint64]*journalTx)
+
+	for _, entry := range entries {
+		if entry.TxID == 0 {
+			if entry.Operation == JournalCheckpoint {
+				if h := entry.horizon(); h > horizon {
+					horizon = h
+				}
+			} else if !entry.IsControl() {
+				committed = append(committed, &journalTx{
+					firstLSN:    entry.LSN,
+					entries:     []JournalEntry{entry},
+					committed:   true,
+					committedAt: entry.Timestamp,
+				})
+			}
+			continue
+		}
+
+		tx, ok := txs[entry.TxID]
+		if !ok {
+			tx = &journalTx{id: entry.TxID, firstLSN: entry.LSN}
+			txs[entry.TxID] = tx
+			started = append(started, tx)
+		}
+
+		switch entry.Operation {
+		case JournalBegin:
+		case JournalCommit:
+			tx.committed = true
+			tx.committedAt = entry.Timestamp
+			committed = append(committed, tx)
+		case JournalAbort:
+			tx.aborted = true
+		case JournalCheckpoint:
+			tx.checkpointed = true
+		default:
+			tx.entries = append(tx.entries, entry)
+		}
+	}
+
+	return started, committed, horizon
+}
+
+// pendingTransactions returns the transactions that committed but were
+// never applied, in commit order, and the IDs of the ones that never
+// committed. Transactions that began before the horizon of the last
+// journal-wide checkpoint are already resolved.
+func pendingTransactions(entries []JournalEntry) ([]*journalTx, []uint64) {
+	started, committed, horizon := groupTransactions(entries)
+
+	var redo []*journalTx
+	for _, tx := range committed {
+		if !tx.aborted && !tx.checkpointed && tx.firstLSN >= horizon {
+			redo = append(redo, tx)
+		}
+	}
+
+	var rollback []uint64
+	for _, tx := range started {
+		if !tx.committed && !tx.aborted && tx.firstLSN >= horizon {
+			rollback = append(rollback, tx.id)
+		}
+	}
+
+	return redo, rollback
+}
+
+// Recover attempts to recover from a crash by replaying the journal.
+// Committed transactions without a checkpoint are redone in commit order
+// and then checkpointed; transactions without a commit record are rolled
+// back by recording an abort, since their operations never reached the
+// filesystem. Operations whose effect is already present are skipped.
+//
+// In dry-run mode the report describes what recovery would do without
+// touching the filesystem or the journal.
+func (j *Journal) Recover(fs *SimpleFS, dryRun bool) (*RecoveryReport, error) {
+	start := time.Now()
+
+	j.mu.Lock()
+	scan, err := scanJournal(j.fsys, j.path)
+	tornAt, tornBytes := j.tornAt, j.tornBytes
+	if err == nil && !dryRun && j.file != nil {
+		// Reported once, by the recovery that cuts it off
+		err = j.cutTorn()
+		j.tornBytes = 0
+	}
+	j.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal for recovery: %w", err)
+	}
+
+	report := &RecoveryReport{
+		DryRun:      dryRun,
+		EntriesRead: len(scan.entries),
+		Corrupted:   scan.corrupted,
+		TornBytes:   tornBytes,
+	}
+	if tornBytes > 0 {
+		report.Corrupted = append(report.Corrupted, CorruptedEntry{
+			File:   j.path,
+			Offset: tornAt,
+			Error:  fmt.Sprintf("incomplete record of %d bytes", tornBytes),
+		})
+	}
+
+	redo, rollback := pendingTransactions(scan.entries)
+	report.RolledBack = rollback
+
+	if !dryRun {
+		for _, txID := range rollback {
+			if err := j.Abort(txID); err != nil {
+				return report, fmt.Errorf("failed to roll back transaction %d: %w", txID, err)
+			}
+		}
+	}
+
+	for _, tx := range redo {
+		failed := false
+		for _, entry := range tx.entries {
+			op := RecoveredOperation{
+				LSN:       entry.LSN,
+				TxID:      entry.TxID,
+				Path:      entry.Path,
+				Operation: entry.Operation,
+			}
+
+			applied, err := j.replay(fs, entry, dryRun)
+
+			switch {
+			case err != nil:
+				op.Status = RecoveryFailed
+				op.Error = err.Error()
+				failed = true
+			case !applied:
+				op.Status = RecoverySkipped
+			case dryRun:
+				op.Status = RecoveryPending
+			default:
+				op.Status = RecoveryApplied
+			}
+			report.add(op)
+		}
+
+		if !dryRun && tx.id != 0 && !failed {
+			if err := j.Checkpoint(tx.id); err != nil {
+				return report, fmt.Errorf("failed to checkpoint transaction %d: %w", tx.id, err)
+			}
+		}
+	}
+
+	if !dryRun {
+		// Writes interrupted before their rename leave a temporary file
+		// behind, whether or not the redo had to write the target again
+		removed, err := fs.removeWriteTemps(fs.rootPath)
+		report.TempsRemoved = removed
+		if err != nil {
+			return report, fmt.Errorf("failed to remove temporary files: %w", err)
+		}
+	}
+
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// replay redoes a single journaled operation, or in dry-run mode reports
+// whether it would be redone. Payloads spilled to blobs are loaded first.
+func (j *Journal) replay(fs *SimpleFS, entry JournalEntry, dryRun bool) (bool, error) {
+	if err := j.loadPayload(&entry); err != nil {
+		return false, err
+	}
+
+	if dryRun {
+		done, err := fs.entryApplied(entry)
+		return !done, err
+	}
+	return fs.redo(entry)
+}
+
+// redo reapplies a single journaled operation under its path lock, skipping
+// it when its effect is already on disk. It reports whether anything was
+// changed. Entries are applied directly, so replay neither journals nor
+// versions the files it restores.
+func (fs *SimpleFS) redo(entry JournalEntry) (bool, error) {
+	key, err := fs.entryLockKey(entry)
+	if err != nil {
+		return false, err
+	}
+
+	lock := fs.getFileLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	applied, err := fs.entryApplied(entry)
+	if err != nil {
+		return false, err
+	}
+	if applied {
+		return false, nil
+	}
+
+	return true, fs.applyEntry(entry)
+}
+
+// journalHandler replays one kind of journaled operation
+type journalHandler struct {
+	// lockKey returns the lock guarding the target of the operation
+	lockKey func(fs *SimpleFS, fullPath string, entry JournalEntry) (string, error)
+	// applied reports whether the effect of the operation is already on disk
+	applied func(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error)
+	// apply performs the operation without locking, running hooks,
+	// versioning or journaling
+	apply func(fs *SimpleFS, fullPath string, entry JournalEntry) error
+	// link is set for operations acting on a symlink in the last component
+	// of the path rather than on its target, which includes the attributes
+	// and versions kept under the path
+	link bool
+}
+
+// journalHandlers holds the replay support of every journaled operation
+var journalHandlers = map[string]journalHandler{
+	JournalWrite:         {pathLockKey, writeApplied, applyWrite, false},
+	JournalCopy:          {pathLockKey, writeApplied, applyWrite, false},
+	JournalDelete:        {pathLockKey, removeApplied, applyRemove, true},
+	JournalRmdir:         {pathLockKey, removeApplied, applyRemove, true},
+	JournalMkdir:         {pathLockKey, mkdirApplied, applyMkdir, false},
+	JournalSymlink:       {pathLockKey, symlinkApplied, applySymlink, true},
+	JournalLink:          {pathLockKey, linkApplied, applyLink, true},
+	JournalChmod:         {pathLockKey, chmodApplied, applyChmod, false},
+	JournalChown:         {pathLockKey, chownApplied, applyChown, false},
+	JournalChtimes:       {pathLockKey, chtimesApplied, applyChtimes, false},
+	JournalSetAttr:       {attrLockKey, attrApplied, applyAttr, true},
+	JournalDeleteAttr:    {attrLockKey, attrApplied, applyAttr, true},
+	JournalVersion:       {versionLockKey, versionApplied, applyVersion, true},
+	JournalDeleteVersion: {versionLockKey, deleteVersionApplied, applyDeleteVersion, true},
+	JournalVersionDesc:   {versionLockKey, versionDescApplied, applyVersionDesc, true},
+}
+
+// handler returns the replay support of a journal entry
+func (e *JournalEntry) handler() (journalHandler, error) {
+	h, ok := journalHandlers[e.Operation]
+	if !ok {
+		return journalHandler{}, fmt.Errorf("unknown journal operation: %s", e.Operation)
+	}
+	return h, nil
+}
+
+// entryLockKey returns the lock guarding the target of a journal entry
+func (fs *SimpleFS) entryLockKey(entry JournalEntry) (string, error) {
+	h, err := entry.handler()
+	if err != nil {
+		return "", err
+	}
+	fullPath, err := fs.entryPath(h, entry)
+	if err != nil {
+		return "", err
+	}
+	return h.lockKey(fs, fullPath, entry)
+}
+
+// entryPath returns the path a journal entry acts on
+func (fs *SimpleFS) entryPath(h journalHandler, entry JournalEntry) (string, error) {
+	if h.link {
+		return fs.localLinkPath(entry.Path)
+	}
+	return fs.localPath(entry.Path)
+}
+
+// entryApplied reports whether the effect of a journal entry is already
+// present on disk. Writes are compared by content hash.
+func (fs *SimpleFS) entryApplied(entry JournalEntry) (bool, error) {
+	h, err := entry.handler()
+	if err != nil {
+		return false, err
+	}
+	fullPath, err := fs.entryPath(h, entry)
+	if err != nil {
+		return false, err
+	}
+	return h.applied(fs, fullPath, entry)
+}
+
+// applyEntry applies a journaled operation directly to disk, without
+// locking, running hooks, versioning or journaling. Applying an entry
+// whose effect is already present leaves the filesystem unchanged.
+func (fs *SimpleFS) applyEntry(entry JournalEntry) error {
+	h, err := entry.handler()
+	if err != nil {
+		return err
+	}
+	fullPath, err := fs.entryPath(h, entry)
+	if err != nil {
+		return err
+	}
+	return h.apply(fs, fullPath, entry)
+}
+
+// mode returns the file mode recorded with a write entry
+func (e *JournalEntry) mode() os.FileMode {
+	mode := os.FileMode(0644) // Default mode
+	if modeStr, ok := e.Attributes["mode"]; ok {
+		if modeVal, err := strconv.ParseUint(modeStr, 10, 32); err == nil && modeVal > 0 {
+			mode = os.FileMode(modeVal)
+		}
+	}
+	return mode
+}
+
+func pathLockKey(fs *SimpleFS, fullPath string, entry JournalEntry) (string, error) {
+	return fullPath, nil
+}
+
+func attrLockKey(fs *SimpleFS, fullPath string, entry JournalEntry) (string, error) {
+	return fs.attributesPath(entry.Path), nil
+}
+
+func versionLockKey(fs *SimpleFS, fullPath string, entry JournalEntry) (string, error) {
+	return fs.versionDir(entry.Path), nil
+}
+
+// dataApplied reports whether a file holds exactly data
+func (fs *SimpleFS) dataApplied(path string, data []byte) bool {
+	info, err := fs.fsys.Stat(path)
+	if err != nil || info.IsDir() || info.Size() != int64(len(data)) {
+		return false
+	}
+	current, err := hashFile(fs.fsys, path)
+	if err != nil {
+		return false
+	}
+	return current == utils.HashBytes(data)
+}
+
+func writeApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	info, err := fs.fsys.Stat(fullPath)
+	if err != nil || info.Mode().Perm() != entry.mode().Perm() {
+		return false, nil
+	}
+	return fs.dataApplied(fullPath, entry.Data), nil
+}
+
+func applyWrite(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	return fs.writeFile(fullPath, entry.Data, entry.mode())
+}
+
+func removeApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	_, err := fs.fsys.Lstat(fullPath)
+	return os.IsNotExist(err), nil
+}
+
+func applyRemove(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	if entry.Operation == JournalRmdir {
+		return fs.fsys.RemoveAll(fullPath)
+	}
+	// As in DeleteFile, metadata shared by the links of the file goes back
+	// to the path with the last link. Transactions hold the attribute locks.
+	if key, ok := fs.lastLink(fullPath); ok {
+		if err := fs.unshareKey(entry.Path, key); err != nil {
+			return fmt.Errorf("failed to move metadata of deleted file: %w", err)
+		}
+	}
+	key, links, _ := fs.fileKey(fullPath)
+	if err := fs.fsys.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if links == 2 {
+		if err := fs.settleMeta(key, false); err != nil {
+			return fmt.Errorf("failed to move metadata to the remaining link: %w", err)
+		}
+	}
+	return nil
+}
+
+func mkdirApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	info, err := fs.fsys.Stat(fullPath)
+	return err == nil && info.IsDir(), nil
+}
+
+func applyMkdir(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	return fs.fsys.MkdirAll(fullPath, 0755)
+}
+
+func symlinkApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	target, err := fs.fsys.Readlink(fullPath)
+	return err == nil && target == entry.Attributes["target"], nil
+}
+
+func applySymlink(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	if err := fs.fsys.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.fsys.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	return fs.fsys.Symlink(entry.Attributes["target"], fullPath)
+}
+
+// linkApplied compares the linked file by identity, since the entries
+// after a link may move its source away or even recreate it. Without a
+// recorded identity an existing link whose source is gone counts as
+// applied, as after a move journaled as link and delete.
+func linkApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	if key, _, ok := fs.fileKey(fullPath); ok && key == entry.Attributes["file"] {
+		return true, nil
+	}
+	srcPath, err := fs.localPath(entry.Attributes["source"])
+	if err != nil {
+		return false, err
+	}
+	if _, err := fs.fsys.Lstat(srcPath); os.IsNotExist(err) {
+		_, err := fs.fsys.Lstat(fullPath)
+		return err == nil, nil
+	}
+	return fs.sameFile(srcPath, fullPath), nil
+}
+
+func applyLink(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	src := entry.Attributes["source"]
+	srcPath, err := fs.localPath(src)
+	if err != nil {
+		return err
+	}
+	if err := fs.fsys.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fs.linkFile(src, srcPath, fullPath)
+}
+
+// metaTarget returns the file a metadata change applies to. A file that
+// is gone was deleted by a later operation, so the change counts as
+// applied.
+func (fs *SimpleFS) metaTarget(fullPath string) (os.FileInfo, bool) {
+	info, err := fs.fsys.Stat(fullPath)
+	return info, err == nil
+}
+
+func chmodApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	mode, err := entry.perm()
+	if err != nil {
+		return false, err
+	}
+	info, ok := fs.metaTarget(fullPath)
+	return !ok || info.Mode().Perm() == mode, nil
+}
+
+func applyChmod(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	mode, err := entry.perm()
+	if err != nil {
+		return err
+	}
+	return fs.fsys.Chmod(fullPath, mode)
+}
+
+func chownApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	uid, gid, err := entry.owner()
+	if err != nil {
+		return false, err
+	}
+	info, ok := fs.metaTarget(fullPath)
+	if !ok {
+		return true, nil
+	}
+	currentUID, currentGID, ok := vfs.Owner(info)
+	return ok && (uid == -1 || uid == currentUID) && (gid == -1 || gid == currentGID), nil
+}
+
+func applyChown(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	uid, gid, err := entry.owner()
+	if err != nil {
+		return err
+	}
+	return fs.fsys.Chown(fullPath, uid, gid)
+}
+
+// chtimesApplied compares the times exactly, so on filesystems storing
+// them with less precision the change is applied again, which is harmless
+func chtimesApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	atime, mtime, err := entry.times()
+	if err != nil {
+		return false, err
+	}
+	info, ok := fs.metaTarget(fullPath)
+	if !ok {
+		return true, nil
+	}
+	if !mtime.IsZero() && !info.ModTime().Equal(mtime) {
+		return false, nil
+	}
+	if current, ok := vfs.AccessTime(info); !atime.IsZero() && (!ok || !current.Equal(atime)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func applyChtimes(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	atime, mtime, err := entry.times()
+	if err != nil {
+		return err
+	}
+	return fs.fsys.Chtimes(fullPath, atime, mtime)
+}
+
+func attrApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	attrs, err := fs.readAttributes(fs.attributesPath(entry.Path))
+	if err != nil {
+		return false, nil
+	}
+	for k, v := range entry.Attributes {
+		current, ok := attrs[k]
+		if entry.Operation == JournalSetAttr && (!ok || current != v) {
+			return false, nil
+		}
+		if entry.Operation == JournalDeleteAttr && ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func applyAttr(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	hashedPath := fs.attributesPath(entry.Path)
+	attrs, err := fs.readAttributes(hashedPath)
+	if err != nil {
+		attrs = make(map[string]string)
+	}
+
+	for k, v := range entry.Attributes {
+		if entry.Operation == JournalSetAttr {
+			attrs[k] = v
+		} else {
+			delete(attrs, k)
+		}
+	}
+
+	if len(attrs) == 0 {
+		if err := fs.fsys.Remove(hashedPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete empty attributes file: %w", err)
+		}
+		return nil
+	}
+	return fs.writeAttributes(hashedPath, attrs)
+}
+
+func versionApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	dataPath, _, err := fs.versionFiles(entry)
+	if err != nil {
+		return false, err
+	}
+	// Metadata written in place may be cut short
+	if _, _, err := fs.readVersionMeta(entry); err != nil {
+		return false, nil
+	}
+	return fs.dataApplied(dataPath, entry.Data), nil
+}
+
+func applyVersion(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	dataPath, metaPath, err := fs.versionFiles(entry)
+	if err != nil {
+		return err
+	}
+	if err := fs.writeFile(dataPath, entry.Data, 0644); err != nil {
+		return fmt.Errorf("failed to write version data: %w", err)
+	}
+	if err := fs.writeFile(metaPath, []byte(entry.Attributes[versionMetaAttribute]), 0644); err != nil {
+		return fmt.Errorf("failed to write version metadata: %w", err)
+	}
+	return nil
+}
+
+func deleteVersionApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	dataPath, metaPath, err := fs.versionFiles(entry)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range []string{dataPath, metaPath} {
+		if _, err := fs.fsys.Stat(path); !os.IsNotExist(err) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func applyDeleteVersion(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	dataPath, metaPath, err := fs.versionFiles(entry)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{metaPath, dataPath} {
+		if err := fs.fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete version: %w", err)
+		}
+	}
+	return nil
+}
+
+// readVersionMeta reads the metadata of the version an entry refers to
+func (fs *SimpleFS) readVersionMeta(entry JournalEntry) (*VersionInfo, string, error) {
+	_, metaPath, err := fs.versionFiles(entry)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := vfs.ReadFile(fs.fsys, metaPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read version metadata: %w", err)
+	}
+	var version VersionInfo
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, "", fmt.Errorf("failed to parse version metadata: %w", err)
+	}
+	return &version, metaPath, nil
+}
+
+func versionDescApplied(fs *SimpleFS, fullPath string, entry JournalEntry) (bool, error) {
+	version, _, err := fs.readVersionMeta(entry)
+	if err != nil {
+		// A version deleted later has nothing left to describe
+		return true, nil
+	}
+	return version.Description == entry.Attributes[versionDescAttribute], nil
+}
+
+func applyVersionDesc(fs *SimpleFS, fullPath string, entry JournalEntry) error {
+	version, metaPath, err := fs.readVersionMeta(entry)
+	if err != nil {
+		return err
+	}
+	version.Description = entry.Attributes[versionDescAttribute]
+
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal version metadata: %w", err)
+	}
+	// Replaced whole, as the description could not be set again on
+	// metadata cut short
+	err = fs.replaceWith(metaPath, 0644, true, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write version metadata: %w", err)
+	}
+	return nil
+}
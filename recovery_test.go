@@ -0,0 +1,674 @@
+package fs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/faultfs"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// openTestFS opens a journaled, versioned filesystem rooted at dir
+func openTestFS(t *testing.T, dir string) *SimpleFS {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.EnableVersioning = true
+	fs, err := NewSimpleFS(dir, opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+// openMemTestFS opens a journaled, versioned filesystem rooted at /root
+// of mem
+func openMemTestFS(t *testing.T, mem *MemoryBackend) *SimpleFS {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.EnableVersioning = true
+	opts.Backend = mem
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+// versionEntry builds the journal entry creating version id of path
+func versionEntry(t *testing.T, path, id string, data []byte) JournalEntry {
+	t.Helper()
+	meta, err := json.Marshal(VersionInfo{VersionID: id, Path: path, CreatedAt: time.Now(), Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return JournalEntry{
+		Operation: JournalVersion,
+		Path:      path,
+		Data:      data,
+		Timestamp: time.Now(),
+		Attributes: map[string]string{
+			versionAttribute:     id,
+			versionMetaAttribute: string(meta),
+		},
+	}
+}
+
+// firstVersion returns the ID of the only version of path
+func firstVersion(t *testing.T, fs *SimpleFS, path string) string {
+	t.Helper()
+	listing, err := fs.ListVersions(path)
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(listing.Versions) != 1 {
+		t.Fatalf("got %d versions of %s, want 1", len(listing.Versions), path)
+	}
+	return listing.Versions[0].VersionID
+}
+
+func wantContent(t *testing.T, fs *SimpleFS, path, want string) {
+	t.Helper()
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s = %q, want %q", path, data, want)
+	}
+}
+
+func wantMissing(t *testing.T, fs *SimpleFS, path string) {
+	t.Helper()
+	if fs.PathExists(path) {
+		t.Fatalf("%s still exists", path)
+	}
+}
+
+// TestRecoverRedoesOperations logs each kind of record as committed but
+// never applied, as a crash right after the commit leaves it, and checks
+// that Recover redoes it exactly once
+func TestRecoverRedoesOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, fs *SimpleFS)
+		entries func(t *testing.T, fs *SimpleFS) []JournalEntry
+		check   func(t *testing.T, fs *SimpleFS)
+	}{
+		{
+			name: "write",
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{writeEntry("a.txt", []byte("new"), 0600, time.Now())}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				wantContent(t, fs, "a.txt", "new")
+				info, err := fs.Stat("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode.Perm() != 0600 {
+					t.Fatalf("mode = %v, want 0600", info.Mode.Perm())
+				}
+			},
+		},
+		{
+			name: "copy",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFile("src.txt", []byte("copied")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				entry := writeEntry("dst.txt", []byte("copied"), 0644, time.Now())
+				entry.Operation = JournalCopy
+				return []JournalEntry{entry}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				wantContent(t, fs, "dst.txt", "copied")
+				wantContent(t, fs, "src.txt", "copied")
+			},
+		},
+		{
+			name: "move",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFile("from.txt", []byte("moved")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{
+					writeEntry("to.txt", []byte("moved"), 0644, time.Now()),
+					{Operation: JournalDelete, Path: "from.txt", Timestamp: time.Now()},
+				}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				wantContent(t, fs, "to.txt", "moved")
+				wantMissing(t, fs, "from.txt")
+			},
+		},
+		{
+			name: "mkdir",
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{{Operation: JournalMkdir, Path: "dir/sub", Timestamp: time.Now()}}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				if !fs.IsDir("dir/sub") {
+					t.Fatal("dir/sub was not created")
+				}
+			},
+		},
+		{
+			name: "rmdir",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFile("dir/a.txt", []byte("a")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{{Operation: JournalRmdir, Path: "dir", Timestamp: time.Now()}}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				wantMissing(t, fs, "dir")
+			},
+		},
+		{
+			name: "setattr and deleteattr",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFile("a.txt", []byte("a")); err != nil {
+					t.Fatal(err)
+				}
+				if err := fs.SetAttribute("a.txt", "old", "1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{
+					{Operation: JournalSetAttr, Path: "a.txt", Timestamp: time.Now(), Attributes: map[string]string{"new": "2"}},
+					{Operation: JournalDeleteAttr, Path: "a.txt", Timestamp: time.Now(), Attributes: map[string]string{"old": ""}},
+				}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				attrs, err := fs.GetAllAttributes("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(attrs) != 1 || attrs["new"] != "2" {
+					t.Fatalf("attributes = %v, want only new=2", attrs)
+				}
+			},
+		},
+		{
+			name: "chmod and chtimes",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFileWithMode("a.txt", []byte("a"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{
+					{Operation: JournalChmod, Path: "a.txt", Timestamp: time.Now(), Attributes: map[string]string{"mode": "384"}},
+					{Operation: JournalChtimes, Path: "a.txt", Timestamp: time.Now(), Attributes: map[string]string{
+						"atime": "",
+						"mtime": "2021-06-07T08:09:10Z",
+					}},
+				}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				info, err := fs.Stat("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode.Perm() != 0600 {
+					t.Fatalf("mode = %v, want 0600", info.Mode.Perm())
+				}
+				if want := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC); !info.ModTime.Equal(want) {
+					t.Fatalf("mtime = %v, want %v", info.ModTime, want)
+				}
+			},
+		},
+		{
+			name: "version",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				if err := fs.WriteFile("a.txt", []byte("current")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{versionEntry(t, "a.txt", "v1", []byte("old"))}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				data, _, err := fs.GetVersion("a.txt", "v1")
+				if err != nil {
+					t.Fatalf("GetVersion: %v", err)
+				}
+				if string(data) != "old" {
+					t.Fatalf("version = %q, want %q", data, "old")
+				}
+			},
+		},
+		{
+			name: "deleteversion",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				for _, content := range []string{"one", "two"} {
+					if err := fs.WriteFile("a.txt", []byte(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{{
+					Operation:  JournalDeleteVersion,
+					Path:       "a.txt",
+					Timestamp:  time.Now(),
+					Attributes: map[string]string{versionAttribute: firstVersion(t, fs, "a.txt")},
+				}}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				listing, err := fs.ListVersions("a.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(listing.Versions) != 0 {
+					t.Fatalf("got %d versions, want 0", len(listing.Versions))
+				}
+			},
+		},
+		{
+			name: "versiondesc",
+			setup: func(t *testing.T, fs *SimpleFS) {
+				for _, content := range []string{"one", "two"} {
+					if err := fs.WriteFile("a.txt", []byte(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			entries: func(t *testing.T, fs *SimpleFS) []JournalEntry {
+				return []JournalEntry{{
+					Operation: JournalVersionDesc,
+					Path:      "a.txt",
+					Timestamp: time.Now(),
+					Attributes: map[string]string{
+						versionAttribute:     firstVersion(t, fs, "a.txt"),
+						versionDescAttribute: "described",
+					},
+				}}
+			},
+			check: func(t *testing.T, fs *SimpleFS) {
+				_, info, err := fs.GetVersion("a.txt", firstVersion(t, fs, "a.txt"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Description != "described" {
+					t.Fatalf("description = %q, want %q", info.Description, "described")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs := openTestFS(t, dir)
+			if tt.setup != nil {
+				tt.setup(t, fs)
+			}
+			if _, err := fs.logTx(tt.entries(t, fs)...); err != nil {
+				t.Fatalf("logTx: %v", err)
+			}
+			fs.Close()
+
+			fs = openTestFS(t, dir)
+			report, err := fs.Recover()
+			if err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+			if report.Failed != 0 || report.Applied == 0 {
+				t.Fatalf("Recover applied %d and failed %d operations: %+v", report.Applied, report.Failed, report.Operations)
+			}
+			tt.check(t, fs)
+
+			report, err = fs.Recover()
+			if err != nil {
+				t.Fatalf("second Recover: %v", err)
+			}
+			if report.Applied != 0 {
+				t.Fatalf("second Recover applied %d operations", report.Applied)
+			}
+			tt.check(t, fs)
+		})
+	}
+}
+
+// TestRecoverSkipsAppliedOperations checks that an operation whose effect
+// is already on disk is not redone
+func TestRecoverSkipsAppliedOperations(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFS(t, dir)
+	if _, err := fs.logTx(writeEntry("a.txt", []byte("same"), 0644, time.Now())); err != nil {
+		t.Fatalf("logTx: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	fs = openTestFS(t, dir)
+	report, err := fs.Recover()
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if report.Applied != 0 || report.Skipped != 1 {
+		t.Fatalf("Recover applied %d and skipped %d operations, want 0 and 1", report.Applied, report.Skipped)
+	}
+}
+
+// TestAtomicWriteCrash crashes at every operation of a WriteFile replacing
+// a file, tearing the interrupted write, and checks that the file is left
+// with either its old or its new content, never part of either, and that
+// Recover removes the temporary file the write went through
+func TestAtomicWriteCrash(t *testing.T) {
+	old, updated := strings.Repeat("old ", 64), strings.Repeat("new ", 64)
+	// open writes the old content and reopens the filesystem on a backend
+	// crashing at the given operation after the reopen (0 = never)
+	open := func(crashAt int) (*MemoryBackend, *faultfs.FS, *SimpleFS, int) {
+		mem := NewMemoryBackend()
+		fs := openMemTestFS(t, mem)
+		if err := fs.WriteFile("a.txt", []byte(old)); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		fs.Close()
+
+		faulty := faultfs.New(mem, faultfs.Faults{CrashAt: crashAt, TornWrites: true})
+		opts := DefaultOptions()
+		opts.Backend = faulty
+		fs, err := NewSimpleFS("/root", opts)
+		if err != nil {
+			t.Fatalf("NewSimpleFS: %v", err)
+		}
+		return mem, faulty, fs, faulty.Ops()
+	}
+
+	_, _, fs, opened := open(0)
+	fs.Close()
+	for crashAt := opened + 1; ; crashAt++ {
+		mem, faulty, fs, _ := open(crashAt)
+		err := fs.WriteFile("a.txt", []byte(updated))
+		fs.Close()
+		if !faulty.Faulted() {
+			if err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if crashAt == opened+1 {
+				t.Fatal("WriteFile performed no operations")
+			}
+			return
+		}
+
+		fs = openMemTestFS(t, mem)
+		data, err := fs.ReadFile("a.txt")
+		if err != nil || (string(data) != old && string(data) != updated) {
+			t.Fatalf("crash at operation %d: a.txt = %q, %v, want the old or the new content", crashAt, data, err)
+		}
+		if _, err := fs.Recover(); err != nil {
+			t.Fatalf("crash at operation %d: Recover: %v", crashAt, err)
+		}
+		if _, err := mem.Lstat("/root/" + atomicTempPrefix + "a.txt"); !os.IsNotExist(err) {
+			t.Fatalf("crash at operation %d: temporary file left after Recover: %v", crashAt, err)
+		}
+		fs.Close()
+	}
+}
+
+// TestRecoverRollsBackUncommitted leaves one transaction uncommitted and
+// one committed but unapplied, and checks that Recover redoes only the
+// committed one and that the journal numbered every record in order
+func TestRecoverRollsBackUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFS(t, dir)
+	uncommitted, err := fs.journal.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := fs.journal.LogTx(uncommitted, writeEntry("lost.txt", []byte("lost"), 0644, time.Now())); err != nil {
+		t.Fatalf("LogTx: %v", err)
+	}
+	if _, err := fs.logTx(writeEntry("kept.txt", []byte("kept"), 0644, time.Now())); err != nil {
+		t.Fatalf("logTx: %v", err)
+	}
+	fs.Close()
+
+	fs = openTestFS(t, dir)
+	report, err := fs.Recover()
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if len(report.RolledBack) != 1 || report.RolledBack[0] != uncommitted {
+		t.Fatalf("rolled back = %v, want transaction %d", report.RolledBack, uncommitted)
+	}
+	if report.Applied != 1 {
+		t.Fatalf("Recover applied %d operations, want 1", report.Applied)
+	}
+	wantContent(t, fs, "kept.txt", "kept")
+	wantMissing(t, fs, "lost.txt")
+
+	r, err := fs.journal.NewReader(JournalFilter{})
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var last uint64
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if entry.LSN <= last {
+			t.Fatalf("LSN %d follows %d", entry.LSN, last)
+		}
+		last = entry.LSN
+	}
+}
+
+// TestRecoverReplaysInOrder redoes a transaction whose operations depend on
+// each other across paths and checks that they are applied in log order,
+// without journaling again or versioning the files they restore
+func TestRecoverReplaysInOrder(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFS(t, dir)
+	if _, err := fs.logTx(
+		JournalEntry{Operation: JournalMkdir, Path: "d", Timestamp: time.Now()},
+		writeEntry("d/a.txt", []byte("first"), 0644, time.Now()),
+		writeEntry("d/a.txt", []byte("second"), 0644, time.Now()),
+		writeEntry("b.txt", []byte("second"), 0644, time.Now()),
+		JournalEntry{Operation: JournalDelete, Path: "d/a.txt", Timestamp: time.Now()},
+		JournalEntry{Operation: JournalSetAttr, Path: "b.txt", Timestamp: time.Now(), Attributes: map[string]string{"k": "v"}},
+	); err != nil {
+		t.Fatalf("logTx: %v", err)
+	}
+	fs.Close()
+
+	fs = openTestFS(t, dir)
+	report, err := fs.Recover()
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if report.Failed != 0 {
+		t.Fatalf("Recover failed %d operations: %+v", report.Failed, report.Operations)
+	}
+	wantContent(t, fs, "b.txt", "second")
+	wantMissing(t, fs, "d/a.txt")
+	wantAttribute(t, fs, "b.txt", "k", "v")
+	if !fs.IsDir("d") {
+		t.Fatal("d was not created")
+	}
+
+	// The feed shows transactions once they are applied
+	want := []string{"mkdir d", "write d/a.txt", "write d/a.txt", "write b.txt", "delete d/a.txt", "setattr b.txt"}
+	if got := changes(t, fs); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("changes after Recover = %v, want only the redone transaction %v", got, want)
+	}
+	listing, err := fs.ListVersions("b.txt")
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(listing.Versions) != 0 {
+		t.Fatalf("Recover versioned b.txt %d times", len(listing.Versions))
+	}
+}
+
+// TestRecoveryReport checks what Recover and RecoverDryRun report for a
+// journal with a corrupted record and an unapplied write, and that the
+// dry run leaves the disk alone
+func TestRecoveryReport(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFS(t, dir)
+	if _, err := fs.logTx(writeEntry("a.txt", []byte("a"), 0644, time.Now())); err != nil {
+		t.Fatalf("logTx: %v", err)
+	}
+	fs.Close()
+	log, err := os.OpenFile(filepath.Join(dir, ".journal", "fs.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.WriteString("{not json}\n"); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	fs = openTestFS(t, dir)
+	for _, dryRun := range []bool{true, false} {
+		run := fs.Recover
+		status := RecoveryApplied
+		if dryRun {
+			run, status = fs.RecoverDryRun, RecoveryPending
+		}
+		report, err := run()
+		if err != nil {
+			t.Fatalf("Recover (dry run %v): %v", dryRun, err)
+		}
+		if report.DryRun != dryRun || report.EntriesRead != 3 || len(report.Corrupted) != 1 {
+			t.Fatalf("report = dry run %v, %d entries read, corrupted %v, want %v, 3 and one corrupted",
+				report.DryRun, report.EntriesRead, report.Corrupted, dryRun)
+		}
+		if report.Applied != 1 || len(report.Operations) != 1 {
+			t.Fatalf("report = %d applied, operations %+v, want the write of a.txt", report.Applied, report.Operations)
+		}
+		if op := report.Operations[0]; op.Path != "a.txt" || op.Operation != JournalWrite || op.Status != status {
+			t.Fatalf("operation = %+v, want the write of a.txt %s", op, status)
+		}
+		if dryRun {
+			wantMissing(t, fs, "a.txt")
+		}
+	}
+	wantContent(t, fs, "a.txt", "a")
+}
+
+// TestRecoveryReportTornTail checks that an incomplete record at the end of
+// the journal is reported by a dry run without being cut off, and cut off by
+// the recovery after it
+func TestRecoveryReportTornTail(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFS(t, dir)
+	if _, err := fs.logTx(writeEntry("a.txt", []byte("a"), 0644, time.Now())); err != nil {
+		t.Fatalf("logTx: %v", err)
+	}
+	fs.Close()
+	path := filepath.Join(dir, ".journal", "fs.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.WriteString("{\"op"); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	fs = openTestFS(t, dir)
+	for _, dryRun := range []bool{true, false} {
+		run := fs.Recover
+		if dryRun {
+			run = fs.RecoverDryRun
+		}
+		report, err := run()
+		if err != nil {
+			t.Fatalf("Recover (dry run %v): %v", dryRun, err)
+		}
+		if report.TornBytes != 4 || len(report.Corrupted) != 1 || report.Corrupted[0].Offset != info.Size() {
+			t.Fatalf("report = %d torn bytes, corrupted %v, want 4 bytes at offset %d",
+				report.TornBytes, report.Corrupted, info.Size())
+		}
+		if dryRun {
+			if got, err := os.Stat(path); err != nil || got.Size() != info.Size()+4 {
+				t.Fatalf("journal size after dry run = %v (%v), want %d", got, err, info.Size()+4)
+			}
+		}
+	}
+	scan, err := scanJournalFile(vfs.Default, path)
+	if err != nil || scan.torn || len(scan.corrupted) != 0 {
+		t.Fatalf("scan after recovery = %+v, %v, want the torn record cut off", scan, err)
+	}
+	if report, err := fs.RecoverDryRun(); err != nil || report.TornBytes != 0 || len(report.Corrupted) != 0 {
+		t.Fatalf("RecoverDryRun after the cut = %+v, %v, want nothing torn", report, err)
+	}
+	if err := fs.WriteFile("b.txt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := fs.Journal().Verify(); err != nil || len(problems) != 0 {
+		t.Fatalf("Verify = %v, %v, want no problems", problems, err)
+	}
+	wantContent(t, fs, "a.txt", "a")
+}
+
+// TestMoveSpillsContent checks that a move journals large content in a
+// blob the record refers to rather than in the record
+func TestMoveSpillsContent(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Backend = NewMemoryBackend()
+	opts.JournalSpillThreshold = 16
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	defer fs.Close()
+
+	content := strings.Repeat("moved ", 16)
+	if err := fs.WriteFile("a.txt", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MoveFile("a.txt", "b.txt"); err != nil {
+		t.Fatalf("MoveFile: %v", err)
+	}
+
+	reader, err := fs.Journal().NewReader(JournalFilter{PathPrefix: "b.txt", Operations: []string{JournalWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := reader.Next()
+	if err != nil {
+		t.Fatalf("no write of b.txt journaled: %v", err)
+	}
+	if len(entry.Data) != 0 || entry.Blob() == "" {
+		t.Fatalf("move journaled %d bytes inline and blob %q, want only a blob", len(entry.Data), entry.Blob())
+	}
+	data, err := fs.Journal().ReadBlob(entry.Blob())
+	if err != nil {
+		t.Fatalf("ReadBlob: %v", err)
+	}
+	if string(data) != content {
+		t.Fatalf("blob holds %q, want %q", data, content)
+	}
+	wantContent(t, fs, "b.txt", content)
+	wantMissing(t, fs, "a.txt")
+}
@@ -0,0 +1,582 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// ErrReadOnly is returned by mutating operations on a filesystem that
+// cannot be written, such as an archive or a follower that has not been
+// promoted
+var ErrReadOnly = errors.New("filesystem is read-only")
+
+// replicationStateName is the file in the root of a follower that holds
+// its position in the leader's journal
+const replicationStateName = ".replication"
+
+// ReplicatedEntry is a journaled operation shipped to a follower
+type ReplicatedEntry struct {
+	Entry  JournalEntry // Operation with its payload loaded
+	Cursor Cursor       // Position right after the operation
+}
+
+// ReplicationBatch is a run of operations fetched from a leader
+type ReplicationBatch struct {
+	Entries []ReplicatedEntry // Operations in the order they took effect
+	Cursor  Cursor            // Position after the last operation
+	Head    uint64            // LSN of the newest record in the leader's journal
+	Drained bool              // Whether the batch reaches the end of the journal
+}
+
+// ReplicationSource supplies the operations applied on a leader
+type ReplicationSource interface {
+	// Fetch returns at most limit operations applied after cursor
+	Fetch(ctx context.Context, cursor Cursor, limit int) (*ReplicationBatch, error)
+}
+
+// errBatchFull stops the feed once a batch holds enough operations
+var errBatchFull = errors.New("replication batch is full")
+
+// journalSource reads a leader's journal directly
+type journalSource struct {
+	journal *Journal
+	local   bool // Whether the journal is open in this process
+}
+
+// NewLocalSource returns a source reading the journal of a leader open in
+// the same process
+func NewLocalSource(leader *SimpleFS) (ReplicationSource, error) {
+	if leader.parent != nil {
+		return nil, errors.New("cannot replicate a sub view")
+	}
+	if leader.journal == nil {
+		return nil, errors.New("journaling is not enabled")
+	}
+	return &journalSource{journal: leader.journal, local: true}, nil
+}
+
+// NewFileSource returns a source reading the journal file of a leader,
+// such as <root>/.journal/fs.log, that may be open in another process.
+// archiveDir is the leader's JournalRetention.ArchiveDir, if any.
+func NewFileSource(journalPath, archiveDir string) ReplicationSource {
+	if archiveDir != "" && !filepath.IsAbs(archiveDir) {
+		archiveDir = filepath.Join(filepath.Dir(journalPath), archiveDir)
+	}
+
+	// A journal that is never opened only lists and reads the files
+	view := &Journal{
+		path: journalPath,
+		fsys: vfs.Default,
+		opts: JournalOptions{Retention: JournalRetention{ArchiveDir: archiveDir}},
+	}
+	return &journalSource{journal: view}
+}
+
+func (s *journalSource) Fetch(ctx context.Context, cursor Cursor, limit int) (*ReplicationBatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var head uint64
+	if s.local {
+		s.journal.mu.Lock()
+		head = s.journal.nextLSN - 1
+		s.journal.mu.Unlock()
+	}
+
+	batch := &ReplicationBatch{Drained: true}
+	cursor, last, err := feed(s.journal.fsys, s.journal.feedFiles, cursor, func(entry JournalEntry, next Cursor) error {
+		if limit > 0 && len(batch.Entries) >= limit {
+			return errBatchFull
+		}
+		if err := s.journal.loadPayload(&entry); err != nil {
+			return err
+		}
+		batch.Entries = append(batch.Entries, ReplicatedEntry{Entry: entry, Cursor: next})
+		return nil
+	})
+	if err == errBatchFull {
+		batch.Drained = false
+	} else if err != nil {
+		return nil, err
+	}
+	batch.Cursor = cursor
+
+	switch {
+	case s.local:
+		batch.Head = head
+	case batch.Drained:
+		batch.Head = last
+	default:
+		if batch.Head, err = journalHead(s.journal.fsys, s.journal.path); err != nil {
+			return nil, err
+		}
+	}
+	if batch.Head < last {
+		batch.Head = last
+	}
+
+	return batch, nil
+}
+
+// journalHead returns the LSN of the newest record in a journal file
+func journalHead(fsys vfs.FS, path string) (uint64, error) {
+	scan, err := scanJournalFile(fsys, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read journal file %s: %w", path, err)
+	}
+	if n := len(scan.entries); n > 0 {
+		return scan.entries[n-1].LSN, nil
+	}
+	return 0, nil
+}
+
+// ReplicationHandler serves the journal of the filesystem to followers
+// using NewHTTPSource. It answers GET requests with the cursor and limit
+// query parameters.
+func (fs *SimpleFS) ReplicationHandler() (http.Handler, error) {
+	source, err := NewLocalSource(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var cursor Cursor
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			if cursor, err = ParseCursor(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		batch, err := source.Fetch(r.Context(), cursor, limit)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrCursorExpired) {
+				status = http.StatusGone
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch)
+	}), nil
+}
+
+// httpSource fetches operations from a ReplicationHandler
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSource returns a source fetching operations from a leader served
+// by ReplicationHandler at url. A nil client uses http.DefaultClient.
+func NewHTTPSource(url string, client *http.Client) ReplicationSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpSource{url: url, client: client}
+}
+
+func (s *httpSource) Fetch(ctx context.Context, cursor Cursor, limit int) (*ReplicationBatch, error) {
+	query := url.Values{}
+	query.Set("cursor", cursor.String())
+	query.Set("limit", strconv.Itoa(limit))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replication request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach leader: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return nil, ErrCursorExpired
+	default:
+		return nil, fmt.Errorf("leader returned %s", resp.Status)
+	}
+
+	var batch ReplicationBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode replication batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// FollowerOptions configures a follower
+type FollowerOptions struct {
+	PollInterval time.Duration // How long to wait for new operations once caught up (default 100ms)
+	BatchSize    int           // Maximum operations fetched at once (default 256)
+}
+
+// ReplicationStatus describes how far a follower is behind its leader
+type ReplicationStatus struct {
+	Cursor      Cursor    // Position in the leader's journal
+	AppliedLSN  uint64    // Leader LSN up to which the journal has been applied
+	LeaderLSN   uint64    // Newest LSN the leader reported
+	Lag         uint64    // Leader records not applied yet
+	AppliedAt   time.Time // Leader timestamp of the last operation applied
+	LastContact time.Time // When the leader was last reached
+	Err         error     // Error of the last attempt, nil if it succeeded
+	Running     bool      // Whether the follower is tailing the leader
+	Promoted    bool      // Whether the follower has been promoted
+}
+
+// Follower keeps a filesystem in sync with a leader by applying the
+// operations of the leader's journal in order. While following, the
+// filesystem rejects writes with ErrReadOnly.
+type Follower struct {
+	fs     *SimpleFS
+	source ReplicationSource
+	opts   FollowerOptions
+
+	mu     sync.Mutex
+	status ReplicationStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// replicationState is the position of a follower persisted in its root
+type replicationState struct {
+	Cursor     string `json:"cursor"`
+	AppliedLSN uint64 `json:"appliedLSN"`
+}
+
+// Follow makes the filesystem a follower of the leader behind source and
+// starts applying its operations in the background. The position in the
+// leader's journal is kept in the root, so a follower opened again on the
+// same root resumes where it stopped.
+//
+// Operations, including version changes, are applied without running
+// hooks. With journaling enabled they are journaled as well, so the
+// follower can recover and serve its own followers.
+func (fs *SimpleFS) Follow(source ReplicationSource, opts FollowerOptions) (*Follower, error) {
+	if fs.readOnly {
+		return nil, ErrReadOnly
+	}
+	if fs.parent != nil {
+		return nil, errors.New("a sub view cannot follow a leader")
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 256
+	}
+
+	// A new follower needs the leader's history from its very first record
+	f := &Follower{fs: fs, source: source, opts: opts}
+	f.status.Cursor = Cursor{Scan: 1}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	fs.followGuard.Lock()
+	defer fs.followGuard.Unlock()
+
+	if fs.follower != nil && fs.follower.running() {
+		return nil, errors.New("filesystem is already following a leader")
+	}
+	fs.follower = f
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	f.status.Running = true
+	go f.run(ctx)
+
+	return f, nil
+}
+
+// checkWritable fails with ErrReadOnly while the filesystem follows a
+// leader or when it is read-only
+func (fs *SimpleFS) checkWritable() error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	fs.followGuard.Lock()
+	defer fs.followGuard.Unlock()
+
+	if fs.follower != nil {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// load reads the persisted position of the follower
+func (f *Follower) load() error {
+	data, err := vfs.ReadFile(f.fs.fsys, f.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read replication state: %w", err)
+	}
+
+	var state replicationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse replication state: %w", err)
+	}
+	cursor, err := ParseCursor(state.Cursor)
+	if err != nil {
+		return fmt.Errorf("failed to parse replication state: %w", err)
+	}
+
+	f.status.Cursor = cursor
+	f.status.AppliedLSN = state.AppliedLSN
+	return nil
+}
+
+// save persists the position of the follower, replacing the previous
+// state atomically. It goes through a synced temporary file whatever the
+// AtomicWrites option, since a torn state would stop Follow for good.
+func (f *Follower) save(cursor Cursor, applied uint64) error {
+	data, err := json.Marshal(replicationState{Cursor: cursor.String(), AppliedLSN: applied})
+	if err != nil {
+		return err
+	}
+
+	err = f.fs.replaceWith(f.statePath(), 0644, true, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write replication state: %w", err)
+	}
+	return nil
+}
+
+func (f *Follower) statePath() string {
+	return filepath.Join(f.fs.rootPath, replicationStateName)
+}
+
+// run tails the leader until ctx is cancelled
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+
+	for {
+		drained, err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.status.Err = err
+		f.mu.Unlock()
+
+		if drained || err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(f.opts.PollInterval):
+			}
+		}
+	}
+}
+
+// sync fetches and applies one batch and reports whether it reached the
+// end of the leader's journal
+func (f *Follower) sync(ctx context.Context) (bool, error) {
+	f.mu.Lock()
+	cursor := f.status.Cursor
+	f.mu.Unlock()
+
+	batch, err := f.source.Fetch(ctx, cursor, f.opts.BatchSize)
+	if err != nil {
+		return false, &leaderError{err}
+	}
+
+	f.mu.Lock()
+	f.status.LastContact = time.Now()
+	f.status.LeaderLSN = batch.Head
+	f.mu.Unlock()
+
+	applied, appliedAt, err := f.apply(batch.Entries)
+	if err != nil {
+		return false, err
+	}
+
+	// Control records past the last operation are consumed once drained
+	cursor = batch.Cursor
+	if batch.Drained && batch.Head > applied {
+		applied = batch.Head
+	}
+
+	f.mu.Lock()
+	if applied < f.status.AppliedLSN {
+		applied = f.status.AppliedLSN
+	}
+	f.mu.Unlock()
+
+	if err := f.save(cursor, applied); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	f.status.Cursor = cursor
+	f.status.AppliedLSN = applied
+	if !appliedAt.IsZero() {
+		f.status.AppliedAt = appliedAt
+	}
+	f.mu.Unlock()
+
+	return batch.Drained, nil
+}
+
+// apply applies shipped operations in order, journaling each run of
+// operations from one leader transaction as a transaction of its own. It
+// returns the LSN and time of the last operation applied.
+func (f *Follower) apply(entries []ReplicatedEntry) (uint64, time.Time, error) {
+	var applied uint64
+	var appliedAt time.Time
+
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && entries[0].Entry.TxID != 0 && entries[n].Entry.TxID == entries[0].Entry.TxID {
+			n++
+		}
+
+		ops := make([]JournalEntry, n)
+		for i, shipped := range entries[:n] {
+			ops[i] = shipped.Entry
+			ops[i].LSN = 0
+			ops[i].TxID = 0
+		}
+
+		txID, err := f.fs.logTx(ops...)
+		if err != nil {
+			return applied, appliedAt, fmt.Errorf("failed to journal replicated operations: %w", err)
+		}
+		for _, op := range ops {
+			if _, err = f.fs.redo(op); err != nil {
+				err = fmt.Errorf("failed to apply %s of %s: %w", op.Operation, op.Path, err)
+				break
+			}
+		}
+		f.fs.finishTx(txID, err)
+		if err != nil {
+			return applied, appliedAt, err
+		}
+
+		last := entries[n-1]
+		applied, appliedAt = last.Cursor.LSN, last.Entry.Timestamp
+		entries = entries[n:]
+	}
+
+	return applied, appliedAt, nil
+}
+
+// leaderError is a failure to fetch operations from the leader
+type leaderError struct {
+	err error
+}
+
+func (e *leaderError) Error() string { return e.err.Error() }
+func (e *leaderError) Unwrap() error { return e.err }
+
+// Status returns the replication progress and lag of the follower
+func (f *Follower) Status() ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := f.status
+	if status.LeaderLSN > status.AppliedLSN {
+		status.Lag = status.LeaderLSN - status.AppliedLSN
+	}
+	return status
+}
+
+// Lag returns the number of leader journal records not applied yet
+func (f *Follower) Lag() uint64 {
+	return f.Status().Lag
+}
+
+// running reports whether the follower is still tailing its leader
+func (f *Follower) running() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.status.Running
+}
+
+// Stop stops tailing the leader. The filesystem stays read-only until
+// the follower is promoted; calling Follow again resumes replication.
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+
+	f.mu.Lock()
+	f.status.Running = false
+	f.mu.Unlock()
+}
+
+// Promote stops tailing the leader, applies the operations the leader
+// still delivers and makes the filesystem writable. Errors reaching the
+// leader are ignored, since it is usually gone when its follower is
+// promoted; an operation that fails to apply aborts the promotion.
+func (f *Follower) Promote(ctx context.Context) error {
+	f.Stop()
+
+	for {
+		drained, err := f.sync(ctx)
+		if err != nil {
+			f.mu.Lock()
+			f.status.Err = err
+			f.mu.Unlock()
+
+			var unreachable *leaderError
+			if !errors.As(err, &unreachable) {
+				return err
+			}
+			break
+		}
+		if drained {
+			break
+		}
+	}
+
+	f.fs.followGuard.Lock()
+	if f.fs.follower == f {
+		f.fs.follower = nil
+	}
+	f.fs.followGuard.Unlock()
+
+	if err := f.fs.fsys.Remove(f.statePath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove replication state: %w", err)
+	}
+
+	f.mu.Lock()
+	f.status.Promoted = true
+	f.mu.Unlock()
+	return nil
+}
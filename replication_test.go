@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitCaughtUp waits until the follower has applied everything the leader
+// has journaled
+func waitCaughtUp(t *testing.T, leader *SimpleFS, f *Follower) {
+	t.Helper()
+	leader.journal.mu.Lock()
+	head := leader.journal.nextLSN - 1
+	leader.journal.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := f.Status()
+		if status.Err != nil {
+			t.Fatalf("follower: %v", status.Err)
+		}
+		if status.AppliedLSN >= head {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower applied LSN %d, want %d", status.AppliedLSN, head)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowAndPromote(t *testing.T) {
+	leader := openTestFS(t, t.TempDir())
+	if err := leader.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.SetAttribute("a.txt", "tag", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.WriteFile("gone.txt", []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.DeleteFile("gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	standby := openTestFS(t, t.TempDir())
+	source, err := NewLocalSource(leader)
+	if err != nil {
+		t.Fatalf("NewLocalSource: %v", err)
+	}
+	follower, err := standby.Follow(source, FollowerOptions{PollInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Follow: %v", err)
+	}
+	waitCaughtUp(t, leader, follower)
+
+	wantContent(t, standby, "a.txt", "a")
+	wantAttribute(t, standby, "a.txt", "tag", "x")
+	wantMissing(t, standby, "gone.txt")
+	if err := standby.WriteFile("b.txt", []byte("b")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("WriteFile on a follower = %v, want ErrReadOnly", err)
+	}
+
+	// Promotion applies what the leader journaled since the last poll
+	follower.Stop()
+	if err := leader.WriteFile("late.txt", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Promote(context.Background()); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	wantContent(t, standby, "late.txt", "late")
+	if !follower.Status().Promoted {
+		t.Fatal("Status does not report the promotion")
+	}
+	if err := standby.WriteFile("b.txt", []byte("b")); err != nil {
+		t.Fatalf("WriteFile after promotion: %v", err)
+	}
+}
+
+func TestFollowResumesAfterReopen(t *testing.T) {
+	leader := openTestFS(t, t.TempDir())
+	source, err := NewLocalSource(leader)
+	if err != nil {
+		t.Fatalf("NewLocalSource: %v", err)
+	}
+	if err := leader.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	standby := openTestFS(t, dir)
+	follower, err := standby.Follow(source, FollowerOptions{PollInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Follow: %v", err)
+	}
+	waitCaughtUp(t, leader, follower)
+	follower.Stop()
+	applied := follower.Status().AppliedLSN
+	standby.Close()
+
+	if err := leader.WriteFile("b.txt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.MoveFile("b.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	standby = openTestFS(t, dir)
+	follower, err = standby.Follow(source, FollowerOptions{PollInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Follow: %v", err)
+	}
+	defer follower.Stop()
+	if got := follower.Status().AppliedLSN; got != applied {
+		t.Fatalf("resumed at LSN %d, want %d", got, applied)
+	}
+	waitCaughtUp(t, leader, follower)
+	wantContent(t, standby, "a.txt", "a")
+	wantContent(t, standby, "c.txt", "b")
+	wantMissing(t, standby, "b.txt")
+}
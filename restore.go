@@ -0,0 +1,668 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// ErrHistoryIncomplete is returned when the journal no longer reaches back
+// to its first record, so the tree at an earlier time can't be rebuilt
+var ErrHistoryIncomplete = errors.New("journal history is incomplete")
+
+// RestoreToTime reconstructs the files, directories and attributes of the
+// filesystem as they were at time t, replaying every transaction that
+// committed at or before t.
+//
+// A relative target names a subdirectory of this filesystem. The restored
+// tree is written into it through the regular operations, so hooks run
+// and the restore is journaled itself. An absolute target is a directory
+// outside the filesystem that becomes the root of a fresh tree. Either way
+// the target must be empty or not exist yet.
+//
+// A Sub view restores the files below its root into a subdirectory of
+// itself.
+//
+// The journal must still hold its full history: once segments have been
+// compacted without an archive directory, ErrHistoryIncomplete is
+// returned. Set JournalRetention.ArchiveDir before relying on it.
+func (fs *SimpleFS) RestoreToTime(t time.Time, target string) error {
+	if fs.parent != nil {
+		// Only the view's own tree is restored, and only inside the view
+		if filepath.IsAbs(target) || cleanRelPath(target) == "" {
+			return errors.New("restore target of a sub view must be a subdirectory of it")
+		}
+		parentTarget, err := fs.parentPath(target)
+		if err != nil {
+			return err
+		}
+		return fs.parent.restoreToTime(t, parentTarget, fs.prefix)
+	}
+	return fs.restoreToTime(t, target, "")
+}
+
+// restoreToTime restores the tree below scope, or the whole filesystem for
+// an empty scope, into target
+func (fs *SimpleFS) restoreToTime(t time.Time, target, scope string) error {
+	if fs.journal == nil {
+		return errors.New("journaling is not enabled")
+	}
+
+	dst, prefix, err := fs.restoreTarget(target)
+	if err != nil {
+		return err
+	}
+	if dst != fs {
+		defer dst.Close()
+	}
+
+	history, err := fs.journal.history()
+	if err != nil {
+		return err
+	}
+	if len(history.corrupted) > 0 {
+		c := history.corrupted[0]
+		return fmt.Errorf("journal history is corrupted at %s offset %d: %s", c.File, c.Offset, c.Error)
+	}
+	if len(history.entries) > 0 && history.entries[0].LSN > 1 {
+		return ErrHistoryIncomplete
+	}
+
+	_, committed, _ := groupTransactions(history.entries)
+	state := newRestoreState()
+	for _, tx := range committed {
+		if tx.aborted || tx.committedAt.After(t) {
+			continue
+		}
+		for _, entry := range tx.entries {
+			state.apply(entry)
+		}
+	}
+
+	if scope != "" {
+		state = state.within(scope)
+	}
+	return state.materialize(fs.journal, dst, prefix)
+}
+
+// restoreTarget validates a restore target and returns the filesystem the
+// restored tree is written to and the path prefix inside it
+func (fs *SimpleFS) restoreTarget(target string) (*SimpleFS, string, error) {
+	if target == "" {
+		return nil, "", errors.New("restore target must not be empty")
+	}
+
+	if filepath.IsAbs(target) {
+		if err := checkEmptyDir(fs.fsys, target); err != nil {
+			return nil, "", err
+		}
+		// The restored tree is a plain copy, not a journaled filesystem, on
+		// the backend checkEmptyDir looked at
+		dst, err := NewSimpleFS(target, &Options{Backend: fs.fsys})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create restore target: %w", err)
+		}
+		return dst, "", nil
+	}
+
+	prefix := cleanRelPath(target)
+	if prefix == "" {
+		return nil, "", errors.New("cannot restore into the root of the filesystem")
+	}
+	if isInternalName(strings.SplitN(filepath.ToSlash(prefix), "/", 2)[0]) {
+		return nil, "", fmt.Errorf("cannot restore into internal directory: %s", target)
+	}
+
+	if _, _, ok := fs.mounted(prefix); ok {
+		return nil, "", fmt.Errorf("cannot restore into a mounted filesystem: %s", target)
+	}
+	if point, ok := fs.mountBelow(prefix); ok {
+		return nil, "", fmt.Errorf("restore target contains mount point %s", point)
+	}
+
+	fullPath, err := fs.fullPath(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkEmptyDir(fs.fsys, fullPath); err != nil {
+		return nil, "", err
+	}
+
+	return fs, prefix, nil
+}
+
+// checkEmptyDir fails unless path is an empty directory or doesn't exist
+func checkEmptyDir(fsys vfs.FS, path string) error {
+	entries, err := fsys.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid restore target: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("restore target is not empty: %s", path)
+	}
+	return nil
+}
+
+// cleanRelPath normalizes a path relative to the filesystem root, so that
+// "a/b", "/a/b" and "./a//b" compare equal
+func cleanRelPath(path string) string {
+	sep := string(filepath.Separator)
+	clean := strings.TrimPrefix(filepath.Clean(sep+path), sep)
+	if clean == "." {
+		return ""
+	}
+	return clean
+}
+
+// history returns every journal record still available, archived
+// segments first. Only the list of files is taken under the journal lock;
+// they are read while records are being appended, sealed and compacted.
+func (j *Journal) history() (*journalScan, error) {
+	segments, tail, err := j.historyFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &journalScan{}
+	for _, segment := range segments {
+		scan, path, err := j.scanSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		result.add(path, scan)
+		if scan.torn {
+			result.corrupted = append(result.corrupted, CorruptedEntry{
+				File:   path,
+				Offset: scan.validSize,
+				Error:  "incomplete record",
+			})
+		}
+	}
+
+	if tail.size > tail.start {
+		scan, path, err := j.scanTail(tail)
+		if err != nil {
+			return nil, err
+		}
+		result.add(path, scan)
+	}
+
+	return result, nil
+}
+
+// journalTail is the part of the active journal file written by the time
+// history listed the files
+type journalTail struct {
+	format   JournalFormat
+	firstLSN uint64 // LSN of the first record in the file
+	start    int64  // Offset of the first record
+	size     int64  // Offset of the end of the last record
+}
+
+// historyFiles returns the archived and sealed segments in log order and
+// the written part of the active file
+func (j *Journal) historyFiles() ([]string, journalTail, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var files []string
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		archived, err := listSegments(j.fsys, filepath.Join(archive, filepath.Base(j.path)))
+		if err != nil {
+			return nil, journalTail{}, fmt.Errorf("failed to list archived journal segments: %w", err)
+		}
+		for _, segment := range archived {
+			files = append(files, segment.path)
+		}
+	}
+	segments, err := listSegments(j.fsys, j.path)
+	if err != nil {
+		return nil, journalTail{}, fmt.Errorf("failed to list journal segments: %w", err)
+	}
+	for _, segment := range segments {
+		files = append(files, segment.path)
+	}
+
+	tail := journalTail{format: j.format, firstLSN: j.segmentStart, size: j.size}
+	if j.format == JournalFormatBinary {
+		tail.start = int64(len(binaryJournalMagic))
+	}
+	if j.nextLSN == j.segmentStart {
+		// Nothing written, or only records cut off after a failed write
+		tail.size = tail.start
+	}
+	return files, tail, nil
+}
+
+// scanSegment reads a sealed segment, which compaction may have moved to
+// the archive since it was listed, and returns the path it was read from
+func (j *Journal) scanSegment(path string) (*journalScan, string, error) {
+	candidates := []string{path}
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		candidates = append(candidates, filepath.Join(archive, filepath.Base(path)))
+	}
+	for _, candidate := range candidates {
+		scan, err := scanJournalFile(j.fsys, candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read journal segment %s: %w", candidate, err)
+		}
+		return scan, candidate, nil
+	}
+	return nil, "", fmt.Errorf("%w: journal segment %s was removed while being read", ErrHistoryIncomplete, path)
+}
+
+// scanTail reads the written part of the active file. The file may have
+// been sealed since, so it is looked for under its segment name as well,
+// and a new active file in its place is recognized by its first LSN.
+func (j *Journal) scanTail(tail journalTail) (*journalScan, string, error) {
+	sealed := segmentPath(j.path, tail.firstLSN)
+	candidates := []string{sealed}
+	if archive := j.opts.Retention.ArchiveDir; archive != "" {
+		candidates = append(candidates, filepath.Join(archive, filepath.Base(sealed)))
+	}
+	candidates = append(candidates, j.path)
+
+	// A second round finds the file if it is sealed while being looked for
+	for round := 0; round < 2; round++ {
+		for _, candidate := range candidates {
+			scan, err := scanJournalPrefix(j.fsys, candidate, tail)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to read journal: %w", err)
+			}
+			if candidate != j.path || len(scan.corrupted) > 0 ||
+				len(scan.entries) > 0 && scan.entries[0].LSN == tail.firstLSN {
+				return scan, candidate, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("%w: active journal file was replaced while being read", ErrHistoryIncomplete)
+}
+
+// scanJournalPrefix reads the records of a journal file up to the end of
+// the tail
+func scanJournalPrefix(fsys vfs.FS, path string, tail journalTail) (*journalScan, error) {
+	file, err := vfs.Open(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return scanJournalFrom(file, tail.format, tail.start, tail.size)
+}
+
+// restoreState is the tree rebuilt from journal history
+type restoreState struct {
+	files map[string]JournalEntry      // Last write of each existing file
+	dirs  map[string]bool              // Explicitly created directories
+	links map[string]string            // Target of each symlink
+	attrs map[string]map[string]string // Attributes by path; like on disk, they outlive deletes
+	meta  map[string][]JournalEntry    // Mode, owner and time changes since the last write
+
+	inodes map[string]int // Hard link group of each file with links
+	groups int            // Last hard link group handed out
+}
+
+func newRestoreState() *restoreState {
+	return &restoreState{
+		files: make(map[string]JournalEntry),
+		dirs:  make(map[string]bool),
+		links: make(map[string]string),
+		attrs: make(map[string]map[string]string),
+		meta:  make(map[string][]JournalEntry),
+
+		inodes: make(map[string]int),
+	}
+}
+
+// apply updates the tree with one journaled operation
+func (s *restoreState) apply(entry JournalEntry) {
+	path := cleanRelPath(entry.Path)
+	if path == "" {
+		return
+	}
+
+	// Operations went through the symlinks of the tree at the time, as
+	// the final one does for those following it
+	follow := false
+	switch entry.Operation {
+	case JournalWrite, JournalCopy, JournalMkdir, JournalChmod, JournalChown, JournalChtimes:
+		follow = true
+	}
+	if entry.Operation != JournalSetAttr && entry.Operation != JournalDeleteAttr {
+		resolved, ok := s.resolve(path, follow)
+		if !ok {
+			// Rejected when it was made
+			return
+		}
+		path = resolved
+	}
+
+	switch entry.Operation {
+	case JournalWrite, JournalCopy:
+		s.write(path, entry)
+	case JournalMkdir:
+		s.dirs[path] = true
+	case JournalSymlink:
+		delete(s.files, path)
+		delete(s.inodes, path)
+		delete(s.meta, path)
+		s.links[path] = entry.Attributes["target"]
+	case JournalLink:
+		if src, ok := s.resolve(cleanRelPath(entry.Attributes["source"]), true); ok {
+			s.link(src, path)
+		}
+	case JournalDelete, JournalRmdir:
+		s.remove(path)
+	case JournalSetAttr:
+		if s.attrs[path] == nil {
+			s.attrs[path] = make(map[string]string)
+		}
+		for k, v := range entry.Attributes {
+			s.attrs[path][k] = v
+		}
+	case JournalDeleteAttr:
+		for k := range entry.Attributes {
+			delete(s.attrs[path], k)
+		}
+	case JournalChmod, JournalChown, JournalChtimes:
+		for _, p := range s.group(path) {
+			s.meta[p] = append(s.meta[p], entry)
+		}
+	}
+}
+
+// resolve follows the restored symlinks in path component by component,
+// the final one only with follow set, as resolvePath does on disk. It
+// fails for paths leaving the restored tree, which includes every
+// absolute symlink.
+func (s *restoreState) resolve(path string, follow bool) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	resolved := ""
+
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", false
+			}
+			resolved = cleanRelPath(filepath.Dir(resolved))
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		target, ok := s.links[next]
+		if !ok || (len(parts) == 0 && !follow) {
+			resolved = next
+			continue
+		}
+		if links++; links > maxRestoreLinks || filepath.IsAbs(target) {
+			return "", false
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+
+	return resolved, resolved != ""
+}
+
+// maxRestoreLinks is the number of symlinks resolve follows before giving
+// up, as resolvePath does
+const maxRestoreLinks = 40
+
+// group returns path and the other links to its file
+func (s *restoreState) group(path string) []string {
+	g, ok := s.inodes[path]
+	if !ok {
+		return []string{path}
+	}
+	var paths []string
+	for p, group := range s.inodes {
+		if group == g {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// write sets the content of a file, and of every link to it, since files
+// with links are written in place. The write sets the mode and times of
+// the file anew and, as with atomic writes, its owner.
+func (s *restoreState) write(path string, entry JournalEntry) {
+	for _, p := range s.group(path) {
+		s.files[p] = entry
+		delete(s.meta, p)
+	}
+}
+
+// link adds path as a hard link to the file src
+func (s *restoreState) link(src, path string) {
+	entry, ok := s.files[src]
+	if !ok {
+		return
+	}
+	g, ok := s.inodes[src]
+	if !ok {
+		s.groups++
+		g = s.groups
+		s.inodes[src] = g
+	}
+	delete(s.links, path)
+	s.files[path] = entry
+	s.inodes[path] = g
+	s.meta[path] = append([]JournalEntry(nil), s.meta[src]...)
+}
+
+// remove deletes a path and everything below it
+func (s *restoreState) remove(path string) {
+	below := path + string(filepath.Separator)
+	for p := range s.files {
+		if p == path || strings.HasPrefix(p, below) {
+			delete(s.files, p)
+		}
+	}
+	for p := range s.dirs {
+		if p == path || strings.HasPrefix(p, below) {
+			delete(s.dirs, p)
+		}
+	}
+	for p := range s.links {
+		if p == path || strings.HasPrefix(p, below) {
+			delete(s.links, p)
+		}
+	}
+	for p := range s.inodes {
+		if p == path || strings.HasPrefix(p, below) {
+			delete(s.inodes, p)
+		}
+	}
+	for p := range s.meta {
+		if p == path || strings.HasPrefix(p, below) {
+			delete(s.meta, p)
+		}
+	}
+}
+
+// within returns the part of the restored tree below prefix, with paths
+// relative to it
+func (s *restoreState) within(prefix string) *restoreState {
+	scoped := newRestoreState()
+	below := prefix + string(filepath.Separator)
+	for path, entry := range s.files {
+		if strings.HasPrefix(path, below) {
+			scoped.files[strings.TrimPrefix(path, below)] = entry
+		}
+	}
+	for path := range s.dirs {
+		if strings.HasPrefix(path, below) {
+			scoped.dirs[strings.TrimPrefix(path, below)] = true
+		}
+	}
+	for path, target := range s.links {
+		if strings.HasPrefix(path, below) {
+			scoped.links[strings.TrimPrefix(path, below)] = target
+		}
+	}
+	for path, g := range s.inodes {
+		if strings.HasPrefix(path, below) {
+			scoped.inodes[strings.TrimPrefix(path, below)] = g
+		}
+	}
+	for path, attrs := range s.attrs {
+		if strings.HasPrefix(path, below) {
+			scoped.attrs[strings.TrimPrefix(path, below)] = attrs
+		}
+	}
+	for path, entries := range s.meta {
+		if strings.HasPrefix(path, below) {
+			scoped.meta[strings.TrimPrefix(path, below)] = entries
+		}
+	}
+	return scoped
+}
+
+// exists reports whether a path is part of the restored tree
+func (s *restoreState) exists(path string) bool {
+	if _, ok := s.files[path]; ok || s.dirs[path] {
+		return true
+	}
+	if _, ok := s.links[path]; ok {
+		return true
+	}
+
+	below := path + string(filepath.Separator)
+	for p := range s.files {
+		if strings.HasPrefix(p, below) {
+			return true
+		}
+	}
+	for p := range s.dirs {
+		if strings.HasPrefix(p, below) {
+			return true
+		}
+	}
+	for p := range s.links {
+		if strings.HasPrefix(p, below) {
+			return true
+		}
+	}
+	return false
+}
+
+// materialize writes the tree below prefix in dst, loading spilled
+// payloads from the journal one file at a time
+func (s *restoreState) materialize(j *Journal, dst *SimpleFS, prefix string) error {
+	if prefix != "" {
+		if err := dst.CreateDir(prefix); err != nil {
+			return fmt.Errorf("failed to create restore target: %w", err)
+		}
+	}
+
+	for _, path := range sortedKeys(s.dirs) {
+		if err := dst.CreateDir(filepath.Join(prefix, path)); err != nil {
+			return fmt.Errorf("failed to restore directory %s: %w", path, err)
+		}
+	}
+
+	// Links come before files, which may have been written through them
+	for _, path := range sortedKeys(s.links) {
+		if err := dst.CreateSymlink(s.links[path], filepath.Join(prefix, path)); err != nil {
+			return fmt.Errorf("failed to restore symlink %s: %w", path, err)
+		}
+	}
+
+	linked := make(map[int]string) // First restored name of each hard link group
+	for _, path := range sortedKeys(s.files) {
+		if g, ok := s.inodes[path]; ok {
+			if first, ok := linked[g]; ok {
+				if err := dst.Link(filepath.Join(prefix, first), filepath.Join(prefix, path)); err != nil {
+					return fmt.Errorf("failed to restore link %s: %w", path, err)
+				}
+				continue
+			}
+			linked[g] = path
+		}
+
+		entry := s.files[path]
+		if err := j.loadPayload(&entry); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+		if err := dst.WriteFileWithMode(filepath.Join(prefix, path), entry.Data, entry.mode()); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+
+	for _, path := range sortedKeys(s.attrs) {
+		if !s.exists(path) {
+			continue
+		}
+		attrs := s.attrs[path]
+		for _, key := range sortedKeys(attrs) {
+			if err := dst.SetAttribute(filepath.Join(prefix, path), key, attrs[key]); err != nil {
+				return fmt.Errorf("failed to restore attribute %s of %s: %w", key, path, err)
+			}
+		}
+	}
+
+	// Last, since writing the tree changes the times of its files
+	for _, path := range sortedKeys(s.meta) {
+		for _, entry := range s.meta[path] {
+			if err := restoreMeta(dst, filepath.Join(prefix, path), entry); err != nil {
+				return fmt.Errorf("failed to restore %s of %s: %w", entry.Operation, path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreMeta replays a mode, owner or time change on dst
+func restoreMeta(dst *SimpleFS, path string, entry JournalEntry) error {
+	switch entry.Operation {
+	case JournalChmod:
+		mode, err := entry.perm()
+		if err != nil {
+			return err
+		}
+		return dst.Chmod(path, mode)
+	case JournalChown:
+		uid, gid, err := entry.owner()
+		if err != nil {
+			return err
+		}
+		return dst.Chown(path, uid, gid)
+	default:
+		atime, mtime, err := entry.times()
+		if err != nil {
+			return err
+		}
+		return dst.Chtimes(path, atime, mtime)
+	}
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
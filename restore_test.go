@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRestoreWriteThroughSymlink writes a file through a symlink and checks
+// that the restored file has the content written through the link rather
+// than the one written to the file directly before
+func TestRestoreWriteThroughSymlink(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	if err := fs.WriteFile("real/data.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSymlink("real", "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSymlink("dir/data.txt", "alias"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("alias", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, fs, "real/data.txt", "new")
+
+	if err := fs.RestoreToTime(time.Now(), "restored"); err != nil {
+		t.Fatalf("RestoreToTime: %v", err)
+	}
+	wantContent(t, fs, "restored/real/data.txt", "new")
+	wantContent(t, fs, "restored/alias", "new")
+	if target, err := fs.ReadLink("restored/alias"); err != nil || target != "dir/data.txt" {
+		t.Fatalf("ReadLink(restored/alias) = %q, %v, want dir/data.txt", target, err)
+	}
+}
+
+// TestRestoreToTime changes a tree after an instant and checks that the
+// tree restored to that instant, into a subdirectory and into a fresh
+// root, has the files, directories and attributes it had then
+func TestRestoreToTime(t *testing.T) {
+	fs := openTestFS(t, t.TempDir())
+	if err := fs.WriteFile("a.txt", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("d/b.txt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("a.txt", "k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := fs.WriteFile("a.txt", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteFile("d/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("a.txt", "k", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("c.txt", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	wantRestored := func(fs *SimpleFS, prefix string) {
+		t.Helper()
+		wantContent(t, fs, prefix+"a.txt", "one")
+		wantContent(t, fs, prefix+"d/b.txt", "b")
+		wantAttribute(t, fs, prefix+"a.txt", "k", "1")
+		wantMissing(t, fs, prefix+"c.txt")
+	}
+
+	if err := fs.RestoreToTime(at, "restored"); err != nil {
+		t.Fatalf("RestoreToTime: %v", err)
+	}
+	wantRestored(fs, "restored/")
+	wantContent(t, fs, "a.txt", "two")
+
+	root := t.TempDir()
+	if err := fs.RestoreToTime(at, root); err != nil {
+		t.Fatalf("RestoreToTime: %v", err)
+	}
+	wantRestored(openTestFS(t, root), "")
+
+	if err := fs.journal.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if err := fs.journal.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if err := fs.RestoreToTime(at, "again"); !errors.Is(err, ErrHistoryIncomplete) {
+		t.Fatalf("RestoreToTime after compaction = %v, want ErrHistoryIncomplete", err)
+	}
+}
+
+// TestRestoreWhileWriting restores while other writes seal segments and
+// compaction archives them, so the files history lists move while they
+// are being read
+func TestRestoreWhileWriting(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Backend = NewMemoryBackend()
+	opts.JournalSegmentSize = 512
+	opts.JournalRetention = JournalRetention{ArchiveDir: "/archive"}
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	defer fs.Close()
+
+	if err := fs.WriteFile("a.txt", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if err := fs.WriteFile("a.txt", []byte(fmt.Sprint(i))); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		target := fmt.Sprintf("restored%d", i)
+		if err := fs.RestoreToTime(at, target); err != nil {
+			t.Errorf("RestoreToTime: %v", err)
+			break
+		}
+		wantContent(t, fs, target+"/a.txt", "first")
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sub returns a view of the directory prefix whose paths are relative to
+// it, so that it can be handed out without exposing the rest of the tree.
+// Paths escaping the view are rejected by the same checks as for the
+// filesystem itself. The directory is created if it does not exist.
+//
+// The view is not a separate filesystem: every operation is carried out by
+// the parent under the parent's path, with its locks, hooks, journal and
+// version store. Hooks therefore see parent paths, and hooks registered
+// through the view are registered on the parent. The change feed and
+// RestoreToTime only cover the files below prefix, while the journal
+// itself, recovery and replication are only available on the parent.
+// Closing the view does not close the parent.
+func (fs *SimpleFS) Sub(prefix string) (*SimpleFS, error) {
+	if fs.parent != nil {
+		path, err := fs.parentPath(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return fs.parent.Sub(path)
+	}
+
+	if c := filepath.Clean(prefix); c == ".." || strings.HasPrefix(c, ".."+string(filepath.Separator)) {
+		return nil, errors.New("path attempts to escape the root directory")
+	}
+	key := cleanRelPath(prefix)
+	if key == "" {
+		return nil, errors.New("cannot create a view of the root of the filesystem")
+	}
+	if isInternalName(strings.SplitN(filepath.ToSlash(key), "/", 2)[0]) {
+		return nil, fmt.Errorf("cannot create a view of internal directory: %s", prefix)
+	}
+
+	info, err := fs.Stat(key)
+	if os.IsNotExist(err) {
+		if err := fs.CreateDir(key); err != nil {
+			return nil, fmt.Errorf("failed to create view directory: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir {
+		return nil, fmt.Errorf("view root is not a directory: %s", prefix)
+	}
+
+	// Paths of the view are resolved on the backend holding its root, which
+	// is not ours for a view inside a mount
+	target, rel := fs.resolve(key)
+	rootPath, err := target.localPath(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SimpleFS{
+		rootPath: rootPath,
+		fsys:     target.fsys,
+		locks:    make(map[string]*sync.RWMutex),
+		hooks:    make(map[HookKey][]HookFunc),
+		parent:   fs,
+		prefix:   key,
+	}, nil
+}
+
+// parentPath maps a path of a Sub view to the path in its parent, failing
+// for paths that escape the view. The symlinks along the path are resolved
+// beneath the view's root and the parent gets the resolved path, so it
+// cannot follow them out of the view. A final symlink is left for the
+// operation to follow or not, once it is known to stay inside the view.
+func (fs *SimpleFS) parentPath(path string) (string, error) {
+	resolved, err := fs.localLinkPath(path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := fs.fsys.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if _, err := fs.localPath(path); err != nil {
+			return "", err
+		}
+	}
+
+	rel, err := filepath.Rel(fs.rootPath, resolved)
+	if err != nil {
+		return "", fmt.Errorf("invalid path: %w", err)
+	}
+	return filepath.Join(fs.prefix, rel), nil
+}
+
+// viewPath maps a path of the parent to the path in a Sub view, reporting
+// whether it lies below the view's root
+func (fs *SimpleFS) viewPath(path string) (string, bool) {
+	path = cleanRelPath(path)
+	if !isBelow(path, fs.prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, fs.prefix+string(filepath.Separator)), true
+}
+
+// viewChanges wraps a change callback of a Sub view, so it is only called
+// for changes below the view's root, with paths relative to it. Skipped
+// changes still advance the cursor.
+func (fs *SimpleFS) viewChanges(fn func(Change) error) func(Change) error {
+	return func(change Change) error {
+		path, ok := fs.viewPath(change.Path)
+		if !ok {
+			return nil
+		}
+		change.Path = path
+		return fn(change)
+	}
+}
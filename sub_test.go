@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"testing"
+)
+
+func TestSubView(t *testing.T) {
+	root := openTestFS(t, t.TempDir())
+	if err := root.WriteFile("secret.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	view, err := root.Sub("tenant")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+
+	if err := view.WriteFile("dir/a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, root, "tenant/dir/a.txt", "a")
+	if _, err := view.ReadFile("../secret.txt"); err == nil {
+		t.Fatal("ReadFile escaped the view with ..")
+	}
+
+	// Only changes below the view are delivered, relative to it
+	var got []string
+	if _, err := view.ChangesSince(Cursor{}, func(c Change) error {
+		got = append(got, c.Operation+" "+c.Path)
+		return nil
+	}); err != nil {
+		t.Fatalf("ChangesSince: %v", err)
+	}
+	if len(got) == 0 || got[len(got)-1] != "write dir/a.txt" {
+		t.Fatalf("changes = %v, want the write of dir/a.txt last", got)
+	}
+	for _, change := range got {
+		if change == "write secret.txt" {
+			t.Fatalf("changes = %v include the parent's file", got)
+		}
+	}
+
+	// A view of a view is a view of the parent
+	inner, err := view.Sub("dir")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+	wantContent(t, inner, "a.txt", "a")
+}
+
+// TestSubViewSymlinks checks that symlinks inside a view cannot lead
+// operations out of it, while symlinks within it keep working
+func TestSubViewSymlinks(t *testing.T) {
+	root := openTestFS(t, t.TempDir())
+	if err := root.WriteFile("secret.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.CreateDir("outside"); err != nil {
+		t.Fatal(err)
+	}
+	view, err := root.Sub("tenant")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+	if err := view.WriteFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both links are valid in the parent, but leave the view
+	if err := root.CreateSymlink("../secret.txt", "tenant/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.CreateSymlink("../outside", "tenant/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := view.ReadFile("file"); err == nil {
+		t.Fatal("ReadFile followed a symlink out of the view")
+	}
+	if err := view.WriteFile("file", []byte("overwritten")); err == nil {
+		t.Fatal("WriteFile followed a symlink out of the view")
+	}
+	if err := view.WriteFile("dir/new.txt", []byte("new")); err == nil {
+		t.Fatal("WriteFile followed a directory symlink out of the view")
+	}
+	wantContent(t, root, "secret.txt", "secret")
+	wantMissing(t, root, "outside/new.txt")
+
+	if err := view.CreateSymlink("a.txt", "inside"); err != nil {
+		t.Fatalf("CreateSymlink: %v", err)
+	}
+	wantContent(t, view, "inside", "a")
+	target, err := view.ReadLink("inside")
+	if err != nil {
+		t.Fatalf("ReadLink: %v", err)
+	}
+	if target != "a.txt" {
+		t.Fatalf("ReadLink = %q, want a.txt", target)
+	}
+
+	// The parent is handed the resolved path
+	if err := view.CreateDir("real"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.CreateSymlink("real", "alias"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.WriteFile("alias/b.txt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, root, "tenant/real/b.txt", "b")
+}
@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CreateSymlink creates a symlink at link pointing to target. As with
+// os.Symlink the target is relative to the directory of the link. It must
+// be relative and stay inside the root of the filesystem, so absolute
+// targets and targets climbing out of the root are rejected. Symlinks do
+// not reach across mount points. Missing parent directories are created.
+func (fs *SimpleFS) CreateSymlink(target, link string) error {
+	if err := fs.checkLinkTarget(target, link); err != nil {
+		return err
+	}
+	if t, rel, ok := fs.mounted(link); ok {
+		return t.CreateSymlink(target, rel)
+	}
+
+	key := cleanRelPath(link)
+	if key == "" {
+		return errors.New("cannot replace the root of the filesystem with a symlink")
+	}
+	if isInternalName(strings.SplitN(filepath.ToSlash(key), "/", 2)[0]) {
+		return fmt.Errorf("cannot create a symlink in internal directory: %s", link)
+	}
+
+	fullPath, err := fs.linkPath(link)
+	if err != nil {
+		return err
+	}
+
+	fileLock := fs.getFileLock(fullPath)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	dirLock := fs.getFileLock(filepath.Dir(fullPath))
+	dirLock.Lock()
+	defer dirLock.Unlock()
+
+	// pre-hooks
+	ctx := &HookContext{
+		Operation: OpCreateSymlink,
+		Path:      link,
+		Target:    target,
+	}
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return err
+	}
+
+	if _, err := fs.fsys.Lstat(fullPath); err == nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: os.ErrExist}
+	}
+
+	txID, err := fs.logTx(symlinkEntry(link, target, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to log symlink creation: %w", err)
+	}
+
+	err = fs.fsys.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err == nil {
+		err = fs.fsys.Symlink(target, fullPath)
+	}
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
+	}
+
+	return fs.executeHooks(HookTypePost, ctx)
+}
+
+// checkLinkTarget rejects symlink targets that are absolute or, taken
+// lexically from the directory of the link, lead out of the root
+func (fs *SimpleFS) checkLinkTarget(target, link string) error {
+	if target == "" {
+		return errors.New("symlink target cannot be empty")
+	}
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink target must be relative: %s", target)
+	}
+	if _, err := fs.lexicalPath(filepath.Join(filepath.Dir(filepath.Clean(link)), target)); err != nil {
+		return fmt.Errorf("symlink target escapes the root directory: %s", target)
+	}
+	return nil
+}
+
+// ReadLink returns the target of a symlink
+func (fs *SimpleFS) ReadLink(path string) (string, error) {
+	if t, rel, ok := fs.mounted(path); ok {
+		return t.ReadLink(rel)
+	}
+
+	fullPath, err := fs.linkPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	fileLock := fs.getFileLock(fullPath)
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+
+	// pre-hooks
+	ctx := &HookContext{
+		Operation: OpReadLink,
+		Path:      path,
+	}
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return "", err
+	}
+
+	target, err := fs.fsys.Readlink(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	ctx.Target = target
+	if err := fs.executeHooks(HookTypePost, ctx); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// Lstat returns file information like Stat, but describes a symlink
+// itself rather than the file it points to
+func (fs *SimpleFS) Lstat(path string) (*FileInfo, error) {
+	if t, rel, ok := fs.mounted(path); ok {
+		return t.Lstat(rel)
+	}
+
+	fullPath, err := fs.linkPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// pre-hooks
+	ctx := &HookContext{
+		Operation: OpLstat,
+		Path:      path,
+	}
+	if err := fs.executeHooks(HookTypePre, ctx); err != nil {
+		return nil, err
+	}
+
+	info, err := fs.fsys.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, _ := fs.GetAllAttributes(path)
+
+	if err := fs.executeHooks(HookTypePost, ctx); err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(info, attrs), nil
+}
@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// wantEscapesRejected checks that reading and writing through the
+// symlinks abs, an absolute link to outside, and up, a relative link to
+// it through "..", fails and leaves outside untouched
+func wantEscapesRejected(t *testing.T, fs *SimpleFS, fsys vfs.FS, outside string) {
+	t.Helper()
+	for _, link := range []string{"abs", "up"} {
+		if _, err := fs.ReadFile(link + "/secret.txt"); err == nil {
+			t.Errorf("ReadFile through %s succeeded", link)
+		}
+		if err := fs.WriteFile(link+"/new.txt", []byte("escaped")); err == nil {
+			t.Errorf("WriteFile through %s succeeded", link)
+		}
+	}
+	if _, err := fsys.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("a write through a symlink reached outside of the root: %v", err)
+	}
+}
+
+// TestSymlinkEscapeOS resolves paths on the host filesystem, where Linux
+// uses openat2 and keeps every later operation below the root as well
+func TestSymlinkEscapeOS(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openTestFS(t, root)
+	if err := os.Symlink(outside, filepath.Join(root, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
+	}
+	wantEscapesRejected(t, fs, vfs.OS{}, outside)
+
+	if _, ok := fs.fsys.(vfs.OS); ok {
+		t.Skip("operations are not confined to the root on this system")
+	}
+	// A path checked before a symlink was swapped into it still cannot
+	// lead out of the root
+	for _, name := range []string{"abs/secret.txt", "up/secret.txt"} {
+		if _, err := fs.fsys.OpenFile(filepath.Join(root, name), os.O_RDONLY, 0); !errors.Is(err, vfs.ErrOutside) {
+			t.Errorf("opening %s = %v, want ErrOutside", name, err)
+		}
+	}
+	if err := fs.fsys.Chmod(filepath.Join(root, "abs/secret.txt"), 0600); !errors.Is(err, vfs.ErrOutside) {
+		t.Errorf("Chmod through abs = %v, want ErrOutside", err)
+	}
+}
+
+// TestSymlinkEscapeWalk resolves paths on a backend without openat2, which
+// walks them component by component
+func TestSymlinkEscapeWalk(t *testing.T) {
+	mem := NewMemoryBackend()
+	fs := openMemTestFS(t, mem)
+	if err := mem.MkdirAll("/outside", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(mem, "/outside/secret.txt", []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Symlink("/outside", "/root/abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Symlink("../outside", "/root/up"); err != nil {
+		t.Fatal(err)
+	}
+	wantEscapesRejected(t, fs, mem, "/outside")
+}
@@ -0,0 +1,925 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
+)
+
+// ErrTxDone is returned when using a transaction that was already committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a group of operations that become visible atomically on Commit.
+//
+// Operations are only recorded until Commit, which locks every affected
+// path, journals all operations as a single transaction and then applies
+// them. Recovery either applies all of them or none. Rollback discards the
+// recorded operations without touching the filesystem.
+type Tx struct {
+	fs   *SimpleFS
+	view *SimpleFS // Sub view the recorded paths are relative to, if any
+	mu   sync.Mutex
+	ops  []txOp
+	done bool
+}
+
+// txOp is a single operation recorded in a transaction
+type txOp struct {
+	op    OperationType
+	path  string
+	src   string      // Source path for moves
+	data  []byte      // Data for writes
+	mode  os.FileMode // Mode for writes
+	key   string      // Attribute key
+	value string      // Attribute value
+}
+
+// Begin starts a new transaction
+func (fs *SimpleFS) Begin() *Tx {
+	if fs.parent != nil {
+		// Committed by the parent, so it is journaled and locked there
+		return &Tx{fs: fs.parent, view: fs}
+	}
+	return &Tx{fs: fs}
+}
+
+// WriteFile records writing data to a file
+func (tx *Tx) WriteFile(path string, data []byte) error {
+	return tx.WriteFileWithMode(path, data, 0644)
+}
+
+// WriteFileWithMode records writing data to a file with specific permissions
+func (tx *Tx) WriteFileWithMode(path string, data []byte, mode os.FileMode) error {
+	return tx.record(txOp{op: OpWriteFile, path: path, data: data, mode: mode})
+}
+
+// DeleteFile records removing a file
+func (tx *Tx) DeleteFile(path string) error {
+	return tx.record(txOp{op: OpDeleteFile, path: path})
+}
+
+// MoveFile records moving a file from src to dst
+func (tx *Tx) MoveFile(src, dst string) error {
+	fs := tx.fs
+	if tx.view != nil {
+		fs = tx.view
+	}
+	srcPath, err := fs.fullPath(src)
+	if err != nil {
+		return err
+	}
+	if dstPath, err := fs.fullPath(dst); err == nil && dstPath == srcPath {
+		return fmt.Errorf("source and destination are the same file: %s", src)
+	}
+	return tx.record(txOp{op: OpMoveFile, path: dst, src: src})
+}
+
+// CreateDir records creating a directory
+func (tx *Tx) CreateDir(path string) error {
+	return tx.record(txOp{op: OpCreateDir, path: path})
+}
+
+// SetAttribute records setting an extended attribute on a file
+func (tx *Tx) SetAttribute(path, key, value string) error {
+	return tx.record(txOp{op: OpSetAttribute, path: path, key: key, value: value})
+}
+
+// Rollback discards the transaction
+func (tx *Tx) Rollback() error {
+	_, err := tx.finish()
+	return err
+}
+
+// Commit journals and applies all recorded operations
+func (tx *Tx) Commit() error {
+	ops, err := tx.finish()
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	fs := tx.fs
+
+	keys, err := fs.txLockKeys(ops)
+	if err != nil {
+		return err
+	}
+	unlock := fs.lockAll(keys)
+	defer unlock()
+
+	ctxs := make([]*HookContext, len(ops))
+	for i, op := range ops {
+		ctxs[i] = &HookContext{
+			Operation: op.op,
+			Path:      op.path,
+			SrcPath:   op.src,
+			Data:      op.data,
+			Mode:      op.mode,
+			Key:       op.key,
+			Value:     op.value,
+		}
+		if err := fs.executeHooks(HookTypePre, ctxs[i]); err != nil {
+			return err
+		}
+	}
+
+	plan, err := fs.planTx(ops)
+	if err != nil {
+		return err
+	}
+	logged := false
+	defer func() {
+		if !logged {
+			plan.release(fs.journal)
+		}
+	}()
+
+	if fs.versioning {
+		for _, path := range plan.versions {
+			if err := fs.createVersion(path); err != nil {
+				return fmt.Errorf("failed to create version of %s: %w", path, err)
+			}
+		}
+	}
+
+	entries := plan.entries()
+	snapshot, err := fs.snapshotTx(entries)
+	if err != nil {
+		return err
+	}
+
+	txID, err := fs.logTx(entries...)
+	if err != nil {
+		return fmt.Errorf("failed to log transaction: %w", err)
+	}
+	logged = true
+
+	for _, step := range plan.steps {
+		if err := fs.applyStep(step); err != nil {
+			// Undo what was applied so none of the transaction is visible.
+			// The abort is only logged once the undo is durable, until
+			// then recovery redoes the whole transaction instead.
+			if undoErr := snapshot.restore(); undoErr != nil {
+				return fmt.Errorf("%w (undoing it failed, so recovery will redo the transaction: %v)", err, undoErr)
+			}
+			fs.finishTx(txID, err)
+			return err
+		}
+	}
+	fs.finishTx(txID, nil)
+
+	for _, ctx := range ctxs {
+		if err := fs.executeHooks(HookTypePost, ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// record validates the operation's path and appends it to the transaction
+func (tx *Tx) record(op txOp) error {
+	if tx.view != nil {
+		var err error
+		if op.path, err = tx.view.parentPath(op.path); err != nil {
+			return err
+		}
+		if op.src != "" {
+			if op.src, err = tx.view.parentPath(op.src); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.fs.fullPath(op.path); err != nil {
+		return err
+	}
+	for _, path := range []string{op.path, op.src} {
+		if _, _, ok := tx.fs.mounted(path); ok && path != "" {
+			return fmt.Errorf("transactions cannot include paths on mounted filesystems: %s", path)
+		}
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// finish marks the transaction as done and returns its operations
+func (tx *Tx) finish() ([]txOp, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.done = true
+	return tx.ops, nil
+}
+
+// txLockKeys returns the locks a transaction needs in the order they are
+// taken: the paths first, as other operations lock the attributes of a
+// path only after the path itself, then the attributes files
+func (fs *SimpleFS) txLockKeys(ops []txOp) ([]string, error) {
+	paths := make(map[string]struct{})
+	meta := make(map[string]struct{})
+	add := func(path string) error {
+		fullPath, err := fs.fullPath(path)
+		if err != nil {
+			return err
+		}
+		linkPath, err := fs.linkPath(path)
+		if err != nil {
+			return err
+		}
+		paths[fullPath] = struct{}{}
+		paths[filepath.Dir(fullPath)] = struct{}{}
+		// Moves rename the link itself
+		paths[linkPath] = struct{}{}
+		paths[filepath.Dir(linkPath)] = struct{}{}
+		meta[fs.attributesPath(path)] = struct{}{}
+		// Where the attributes go if the transaction deletes the last link
+		meta[fs.pathAttributesPath(path)] = struct{}{}
+		return nil
+	}
+
+	for _, op := range ops {
+		if err := add(op.path); err != nil {
+			return nil, err
+		}
+		if op.src != "" {
+			if err := add(op.src); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sorted := func(set map[string]struct{}) []string {
+		keys := make([]string, 0, len(set))
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sortLockKeys(keys)
+		return keys
+	}
+	return append(sorted(paths), sorted(meta)...), nil
+}
+
+// sortLockKeys puts lock keys in the order operations take them, which
+// keeps concurrent operations from deadlocking: a path before the
+// directory containing it, so deeper paths first, and paths of the same
+// depth by name
+func sortLockKeys(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		di := strings.Count(keys[i], string(filepath.Separator))
+		dj := strings.Count(keys[j], string(filepath.Separator))
+		if di != dj {
+			return di > dj
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+// lockAll acquires the locks for all keys and returns a function releasing them
+func (fs *SimpleFS) lockAll(keys []string) func() {
+	locks := make([]*sync.RWMutex, len(keys))
+	for i, key := range keys {
+		locks[i] = fs.getFileLock(key)
+		locks[i].Lock()
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// txPlan is the journal form of a transaction and how it is applied
+type txPlan struct {
+	steps    []txStep
+	versions []string // Existing files the transaction overwrites or deletes
+	blobs    []string // Blobs holding moved content, released unless the transaction is logged
+}
+
+// txStep applies part of a transaction. Its entries are applied as
+// journaled, except for a move: that is journaled as the entries
+// recreating the file at its destination, but applied as a rename.
+type txStep struct {
+	entries  []JournalEntry
+	src, dst string // Paths of a move
+}
+
+// entries returns all journal entries of the plan in order
+func (p *txPlan) entries() []JournalEntry {
+	var entries []JournalEntry
+	for _, step := range p.steps {
+		entries = append(entries, step.entries...)
+	}
+	return entries
+}
+
+// release drops the protection of the plan's blobs
+func (p *txPlan) release(j *Journal) {
+	for _, hash := range p.blobs {
+		j.releaseBlob(hash)
+	}
+}
+
+// txFile is the state of a file as seen by a transaction in progress
+type txFile struct {
+	exists bool
+	from   string // Path whose content on disk the file has, "" if written by the transaction
+	data   []byte // Content written by the transaction
+	mode   os.FileMode
+	key    string // Identity of the file on disk, which writes keep
+	links  uint64 // Names of the file on disk
+	shared bool   // Metadata shared between links, see SimpleFS.linked
+}
+
+// planTx turns recorded operations into journal entries, resolving each
+// operation against the effects of the operations before it. Files are
+// not read, except for the content of moved files, which is journaled
+// like MoveFile journals it.
+func (fs *SimpleFS) planTx(ops []txOp) (_ *txPlan, err error) {
+	plan := &txPlan{}
+	defer func() {
+		if err != nil {
+			plan.release(fs.journal)
+		}
+	}()
+	files := make(map[string]*txFile)
+	attrs := make(map[string]map[string]string)
+	dirs := make(map[string]bool)
+	versioned := make(map[string]bool)
+	now := time.Now()
+
+	add := func(entries ...JournalEntry) {
+		plan.steps = append(plan.steps, txStep{entries: entries})
+	}
+
+	lookup := func(path string) (*txFile, error) {
+		fullPath, err := fs.fullPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := files[fullPath]; ok {
+			return f, nil
+		}
+
+		info, err := fs.fsys.Stat(fullPath)
+		if os.IsNotExist(err) {
+			return &txFile{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", path)
+		}
+
+		if !versioned[path] {
+			versioned[path] = true
+			plan.versions = append(plan.versions, path)
+		}
+		key, links, _ := fs.fileKey(fullPath)
+		return &txFile{exists: true, from: path, mode: info.Mode().Perm(), key: key, links: links, shared: fs.linked(fullPath)}, nil
+	}
+
+	stage := func(path string, f *txFile) {
+		fullPath, _ := fs.fullPath(path)
+		files[fullPath] = f
+	}
+
+	lookupAttrs := func(path string) map[string]string {
+		if a, ok := attrs[path]; ok {
+			return a
+		}
+		a, err := fs.readAttributes(fs.attributesPath(path))
+		if err != nil {
+			a = make(map[string]string)
+		}
+		attrs[path] = a
+		return a
+	}
+
+	exists := func(path string) (bool, error) {
+		if dirs[path] {
+			return true, nil
+		}
+		fullPath, err := fs.fullPath(path)
+		if err != nil {
+			return false, err
+		}
+		if f, ok := files[fullPath]; ok {
+			return f.exists, nil
+		}
+		_, err = fs.fsys.Stat(fullPath)
+		return err == nil, nil
+	}
+
+	for _, op := range ops {
+		switch op.op {
+		case OpWriteFile:
+			f, err := lookup(op.path)
+			if err != nil {
+				return nil, err
+			}
+			add(writeEntry(op.path, op.data, op.mode, now))
+			stage(op.path, &txFile{exists: true, data: op.data, mode: op.mode, key: f.key, links: f.links, shared: f.shared})
+
+		case OpDeleteFile:
+			f, err := lookup(op.path)
+			if err != nil {
+				return nil, err
+			}
+			if !f.exists {
+				return nil, fmt.Errorf("file does not exist: %s", op.path)
+			}
+			add(JournalEntry{
+				Operation: JournalDelete,
+				Path:      op.path,
+				Timestamp: now,
+			})
+			stage(op.path, &txFile{})
+
+		case OpMoveFile:
+			src, err := lookup(op.src)
+			if err != nil {
+				return nil, err
+			}
+			if !src.exists {
+				return nil, fmt.Errorf("file does not exist: %s", op.src)
+			}
+			dst, err := lookup(op.path)
+			if err != nil {
+				return nil, err
+			}
+			srcPath, err := fs.linkPath(op.src)
+			if err != nil {
+				return nil, err
+			}
+			dstPath, err := fs.linkPath(op.path)
+			if err != nil {
+				return nil, err
+			}
+			if srcPath == dstPath || dst.exists && src.key != "" && src.key == dst.key {
+				// Journaled as write and delete, replaying it would lose the file
+				return nil, fmt.Errorf("source and destination are the same file: %s", op.src)
+			}
+
+			// Content the transaction wrote is already in memory, so its
+			// move is applied as journaled, as a write or, if the source
+			// shares metadata with other links, as a link. Content still
+			// on disk is renamed and journaled as MoveFile journals it.
+			var moved []JournalEntry
+			switch {
+			case src.from == "" && src.shared:
+				moved = []JournalEntry{linkEntry(op.path, op.src, src.key, now)}
+			case src.from == "":
+				moved = []JournalEntry{writeEntry(op.path, src.data, src.mode, now)}
+			case fs.journal == nil:
+				// Nothing is journaled, the entry only names the path
+				moved = []JournalEntry{writeEntry(op.path, nil, src.mode, now)}
+			default:
+				fromPath, err := fs.linkPath(src.from)
+				if err != nil {
+					return nil, err
+				}
+				var hash string
+				moved, hash, err = fs.movedEntries(op.src, fromPath, op.path, now)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read source file for move: %w", err)
+				}
+				if hash != "" {
+					plan.blobs = append(plan.blobs, hash)
+				}
+			}
+
+			// A destination symlink or a destination with other links is
+			// deleted first, as replaying the write would follow the
+			// symlink the rename replaces or change the other links too
+			var entries []JournalEntry
+			if info, err := fs.fsys.Lstat(dstPath); err == nil && info.Mode()&os.ModeSymlink != 0 ||
+				dst.links > 1 && moved[0].Operation == JournalWrite {
+				entries = append(entries, JournalEntry{
+					Operation: JournalDelete,
+					Path:      op.path,
+					Timestamp: now,
+				})
+			}
+			entries = append(entries, moved...)
+			entries = append(entries, JournalEntry{
+				Operation: JournalDelete,
+				Path:      op.src,
+				Timestamp: now,
+			})
+			step := txStep{entries: entries}
+			if src.from != "" {
+				step.src, step.dst = op.src, op.path
+			}
+			plan.steps = append(plan.steps, step)
+			stage(op.path, &txFile{exists: true, from: src.from, data: src.data, mode: src.mode, key: src.key, links: src.links, shared: src.shared})
+			stage(op.src, &txFile{})
+
+			// Attributes follow the file, as they do for MoveFile
+			if srcAttrs := lookupAttrs(op.src); len(srcAttrs) > 0 {
+				moved := make(map[string]string, len(srcAttrs))
+				dstAttrs := lookupAttrs(op.path)
+				for k, v := range srcAttrs {
+					moved[k] = v
+					dstAttrs[k] = v
+				}
+				add(JournalEntry{
+					Operation:  JournalSetAttr,
+					Path:       op.path,
+					Timestamp:  now,
+					Attributes: moved,
+				})
+			}
+
+		case OpCreateDir:
+			add(JournalEntry{
+				Operation: JournalMkdir,
+				Path:      op.path,
+				Timestamp: now,
+			})
+			dirs[op.path] = true
+
+		case OpSetAttribute:
+			ok, err := exists(op.path)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("file does not exist: %s", op.path)
+			}
+			lookupAttrs(op.path)[op.key] = op.value
+			add(JournalEntry{
+				Operation:  JournalSetAttr,
+				Path:       op.path,
+				Timestamp:  now,
+				Attributes: map[string]string{op.key: op.value},
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// applyStep applies a step of a transaction. The caller holds the locks
+// of every path the transaction touches.
+func (fs *SimpleFS) applyStep(step txStep) error {
+	if step.src == "" {
+		for _, entry := range step.entries {
+			if err := fs.applyEntry(entry); err != nil {
+				return fmt.Errorf("failed to apply %s of %s: %w", entry.Operation, entry.Path, err)
+			}
+		}
+		return nil
+	}
+
+	srcPath, err := fs.linkPath(step.src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := fs.linkPath(step.dst)
+	if err != nil {
+		return err
+	}
+
+	// As in MoveFile, the replaced destination loses a name, maybe its last one
+	dstKey, dstLinks, _ := fs.fileKey(dstPath)
+	if key, ok := fs.lastLink(dstPath); ok {
+		if err := fs.unshareKey(step.dst, key); err != nil {
+			return fmt.Errorf("failed to move metadata of %s: %w", step.dst, err)
+		}
+	}
+	err = fs.fsys.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err == nil {
+		err = fs.fsys.Rename(srcPath, dstPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", step.src, step.dst, err)
+	}
+	if dstLinks == 2 {
+		if err := fs.settleMeta(dstKey, false); err != nil {
+			return fmt.Errorf("failed to move metadata to the remaining link of %s: %w", step.dst, err)
+		}
+	}
+	return nil
+}
+
+// writeEntry builds a journal entry for a file write
+func writeEntry(path string, data []byte, mode os.FileMode, ts time.Time) JournalEntry {
+	return JournalEntry{
+		Operation: JournalWrite,
+		Path:      path,
+		Data:      data,
+		Timestamp: ts,
+		Attributes: map[string]string{
+			"mode": fmt.Sprintf("%d", mode),
+		},
+	}
+}
+
+// symlinkEntry returns the journal entry of creating a symlink
+func symlinkEntry(path, target string, ts time.Time) JournalEntry {
+	return JournalEntry{
+		Operation: JournalSymlink,
+		Path:      path,
+		Timestamp: ts,
+		Attributes: map[string]string{
+			"target": target,
+		},
+	}
+}
+
+// txSnapshot holds the state of every path a transaction touches, and of
+// the attributes and versions kept for them, so a transaction that fails
+// halfway through applying can be undone
+type txSnapshot struct {
+	fs       *SimpleFS
+	items    []snapshotItem
+	versions []versionSnapshot
+}
+
+type snapshotItem struct {
+	path    string
+	existed bool
+	isDir   bool
+	data    []byte
+	mode    os.FileMode
+	atime   time.Time
+	mtime   time.Time
+	key     string // Identity of a file with several links, which must not be split
+}
+
+// versionSnapshot records which version files a directory held. Deleting
+// or linking a file moves them between the directory of a path and that of
+// the file's identity.
+type versionSnapshot struct {
+	dir     string
+	names   []string
+	existed bool
+}
+
+// snapshotTx records the current state of the paths the entries modify,
+// together with their attributes and versions
+func (fs *SimpleFS) snapshotTx(entries []JournalEntry) (*txSnapshot, error) {
+	snapshot := &txSnapshot{fs: fs}
+	seen := make(map[string]bool)
+
+	add := func(path string) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+
+		item := snapshotItem{path: path}
+		info, err := fs.fsys.Stat(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case info.IsDir():
+			item.existed = true
+			item.isDir = true
+		default:
+			data, err := vfs.ReadFile(fs.fsys, path)
+			if err != nil {
+				return err
+			}
+			item.existed = true
+			item.data = data
+			item.mode = info.Mode().Perm()
+			item.mtime = info.ModTime()
+			item.atime, _ = vfs.AccessTime(info)
+			if key, links, ok := fs.fileKey(path); ok && links > 1 {
+				item.key = key
+			}
+		}
+		snapshot.items = append(snapshot.items, item)
+		return nil
+	}
+
+	addVersions := func(dirs ...string) error {
+		for _, dir := range dirs {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+
+			v := versionSnapshot{dir: dir}
+			files, err := fs.fsys.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			v.existed = err == nil
+			for _, file := range files {
+				v.names = append(v.names, file.Name())
+			}
+			snapshot.versions = append(snapshot.versions, v)
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		h, err := entry.handler()
+		if err != nil {
+			return nil, err
+		}
+		fullPath, err := fs.entryPath(h, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		paths := []string{fs.attributesPath(entry.Path), fs.pathAttributesPath(entry.Path)}
+		if entry.Operation != JournalSetAttr && entry.Operation != JournalDeleteAttr {
+			paths = append(paths, fullPath)
+		}
+		if key, links, ok := fs.fileKey(fullPath); ok {
+			// Metadata moves between the path and the file's identity
+			// when the file is linked or loses its last link, and to the
+			// other link when it loses the second to last one
+			paths = append(paths, fs.inodeAttributesPath(key))
+			dirs := []string{fs.pathVersionDir(entry.Path), fs.inodeVersionDir(key)}
+			if links == 2 && fs.hasInodeMeta(key) {
+				other, ok, err := fs.findLink(key, fullPath)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					paths = append(paths, fs.pathAttributesPath(other))
+					dirs = append(dirs, fs.pathVersionDir(other))
+				}
+			}
+			if err := addVersions(dirs...); err != nil {
+				return nil, err
+			}
+		}
+		for _, path := range paths {
+			if err := add(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// restore puts every snapshotted path back in its original state and
+// syncs it, so the undo is durable once it returns without error
+func (s *txSnapshot) restore() error {
+	fsys := s.fs.fsys
+	keys := make(map[string]string) // Identity of each recreated linked file
+	for i := len(s.items) - 1; i >= 0; i-- {
+		item := s.items[i]
+		dir := filepath.Dir(item.path)
+		switch {
+		case !item.existed:
+			if err := fsys.Remove(item.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		case item.isDir:
+			if err := fsys.MkdirAll(item.path, 0755); err != nil {
+				return err
+			}
+		default:
+			if err := s.restoreFile(item, keys); err != nil {
+				return err
+			}
+		}
+		vfs.SyncDir(fsys, dir)
+	}
+
+	if err := s.restoreVersions(); err != nil {
+		return err
+	}
+	// The metadata of a recreated file follows it to its new identity
+	for old, key := range keys {
+		if key == old {
+			continue
+		}
+		if err := s.fs.moveMeta(s.fs.inodeAttributesPath(old), s.fs.inodeAttributesPath(key),
+			s.fs.inodeVersionDir(old), s.fs.inodeVersionDir(key)); err != nil {
+			return err
+		}
+		vfs.SyncDir(fsys, filepath.Dir(s.fs.inodeAttributesPath(key)))
+		vfs.SyncDir(fsys, filepath.Dir(s.fs.inodeVersionDir(key)))
+	}
+	return nil
+}
+
+// restoreFile rewrites a file with its snapshotted content. A file with
+// several links is relinked to another of its names if it lost this one,
+// and written in place so that it stays shared. When every name was lost
+// the file is recreated under a new identity, which keys records.
+func (s *txSnapshot) restoreFile(item snapshotItem, keys map[string]string) error {
+	fsys := s.fs.fsys
+	inPlace := false
+	if item.key != "" {
+		want := item.key
+		if restored, ok := keys[item.key]; ok {
+			want = restored
+		}
+		if key, _, ok := s.fs.fileKey(item.path); !ok || key != want {
+			// Another link may be outside of the transaction
+			other, ok, err := s.fs.findLink(want, item.path)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := fsys.Remove(item.path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				if err := fsys.MkdirAll(filepath.Dir(item.path), 0755); err != nil {
+					return err
+				}
+				if err := fsys.Link(filepath.Join(s.fs.rootPath, other), item.path); err != nil {
+					return err
+				}
+			}
+		}
+		key, _, ok := s.fs.fileKey(item.path)
+		inPlace = ok && key == want
+	}
+	if info, err := fsys.Stat(item.path); err == nil && info.Mode().Perm() == item.mode &&
+		(item.key == "" || inPlace) && s.fs.dataApplied(item.path, item.data) {
+		// Not changed by the part of the transaction that was applied
+		return nil
+	}
+
+	err := s.fs.replaceWith(item.path, item.mode, !inPlace, func(w io.Writer) error {
+		_, err := w.Write(item.data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if item.key != "" && !inPlace {
+		key, _, ok := s.fs.fileKey(item.path)
+		if !ok {
+			return fmt.Errorf("failed to identify restored file %s", item.path)
+		}
+		keys[item.key] = key
+	}
+	return fsys.Chtimes(item.path, item.atime, item.mtime)
+}
+
+// restoreVersions moves version files back to the directory they were in
+func (s *txSnapshot) restoreVersions() error {
+	fsys := s.fs.fsys
+	for _, v := range s.versions {
+		for _, name := range v.names {
+			if _, err := fsys.Lstat(filepath.Join(v.dir, name)); !os.IsNotExist(err) {
+				continue
+			}
+			for _, other := range s.versions {
+				from := filepath.Join(other.dir, name)
+				if slices.Contains(other.names, name) {
+					// Belongs where it is
+					continue
+				}
+				if _, err := fsys.Lstat(from); err != nil {
+					continue
+				}
+				if err := fsys.MkdirAll(v.dir, 0755); err != nil {
+					return err
+				}
+				if err := fsys.Rename(from, filepath.Join(v.dir, name)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	for _, v := range s.versions {
+		if !v.existed {
+			// Only removed if the transaction left it empty
+			if files, err := fsys.ReadDir(v.dir); err == nil && len(files) == 0 {
+				if err := fsys.Remove(v.dir); err != nil {
+					return err
+				}
+			}
+		}
+		vfs.SyncDir(fsys, v.dir)
+		vfs.SyncDir(fsys, filepath.Dir(v.dir))
+	}
+	return nil
+}
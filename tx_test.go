@@ -0,0 +1,385 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBackend fails to open files for writing whose name contains fail
+type failingBackend struct {
+	Backend
+	fail string
+}
+
+func (b *failingBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && strings.Contains(name, b.fail) {
+		return nil, errors.New("injected failure")
+	}
+	return b.Backend.OpenFile(name, flag, perm)
+}
+
+// openTxTestFS opens a journaled filesystem on mem that cannot write fail
+func openTxTestFS(t *testing.T, mem *MemoryBackend, fail string) *SimpleFS {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Backend = &failingBackend{Backend: mem, fail: fail}
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func wantAttribute(t *testing.T, fs *SimpleFS, path, key, want string) {
+	t.Helper()
+	got, err := fs.GetAttribute(path, key)
+	if err != nil {
+		t.Fatalf("GetAttribute(%s, %s): %v", path, key, err)
+	}
+	if got != want {
+		t.Fatalf("%s %s = %q, want %q", path, key, got, want)
+	}
+}
+
+// TestTxUndoesFailedApply fails the last operation of a transaction and
+// checks that the operations before it are undone durably, including the
+// attributes they changed and the metadata deleting a linked file moved
+func TestTxUndoesFailedApply(t *testing.T) {
+	mem := NewMemoryBackend()
+	fs := openTxTestFS(t, mem, "fail")
+	if err := fs.WriteFile("a.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("a.txt", "tag", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("l1", []byte("linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("l1", "l2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("l1", "tag", "shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("m1", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("m1", "m2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetAttribute("m1", "tag", "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	for _, err := range []error{
+		tx.WriteFile("a.txt", []byte("new")),
+		tx.SetAttribute("a.txt", "tag", "new"),
+		tx.DeleteFile("l1"),
+		tx.DeleteFile("l2"),
+		tx.DeleteFile("m1"), // Moves the metadata to m2, which is not part of it
+		tx.WriteFile("fail.txt", []byte("never written")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Commit succeeded despite the failing write")
+	}
+
+	check := func(t *testing.T, fs *SimpleFS, linked string) {
+		t.Helper()
+		wantContent(t, fs, "a.txt", "old")
+		wantAttribute(t, fs, "a.txt", "tag", "old")
+		wantMissing(t, fs, "fail.txt")
+		wantContent(t, fs, "l1", linked)
+		wantContent(t, fs, "l2", linked)
+		wantAttribute(t, fs, "l1", "tag", "shared")
+		wantAttribute(t, fs, "l2", "tag", "shared")
+		// Still links of one file
+		if err := fs.WriteFile("l2", []byte("both")); err != nil {
+			t.Fatal(err)
+		}
+		wantContent(t, fs, "l1", "both")
+		wantAttribute(t, fs, "m1", "tag", "kept")
+		if err := fs.SetAttribute("m2", "tag", "m2"); err != nil {
+			t.Fatal(err)
+		}
+		wantAttribute(t, fs, "m1", "tag", "m2")
+		if err := fs.SetAttribute("m1", "tag", "kept"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, fs, "linked")
+	fs.Close()
+
+	// The undo and the abort survive a crash, so recovery has nothing to redo
+	mem.Crash()
+	fs = openTxTestFS(t, mem, "fail")
+	report, err := fs.Recover()
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if report.Applied != 0 {
+		t.Fatalf("Recover applied %d operations of the aborted transaction", report.Applied)
+	}
+	check(t, fs, "both")
+}
+
+// TestTxLockOrder commits transactions while DeleteFile and MoveFile work
+// on the same files, which lock a file before its directory, and checks
+// that none of them deadlocks
+func TestTxLockOrder(t *testing.T) {
+	fs := openMemTestFS(t, NewMemoryBackend())
+	var dirs []*sync.RWMutex
+	for _, dir := range []string{"a", "a/c"} {
+		fullPath, err := fs.fullPath(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, fs.getFileLock(fullPath))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			if err := fs.WriteFile("a/b", []byte("a")); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := fs.WriteFile("a/c/d", []byte("a")); err != nil {
+				t.Error(err)
+				return
+			}
+			// Hold the directories so all three line up on them at once
+			for _, lock := range dirs {
+				lock.Lock()
+			}
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				tx := fs.Begin()
+				tx.WriteFile("a/b", []byte("tx"))
+				tx.WriteFile("a/c/d", []byte("tx"))
+				tx.Commit()
+			}()
+			go func() {
+				defer wg.Done()
+				fs.DeleteFile("a/b")
+			}()
+			go func() {
+				defer wg.Done()
+				fs.MoveFile("a/c/d", "e")
+			}()
+			time.Sleep(5 * time.Millisecond)
+			for _, lock := range dirs {
+				lock.Unlock()
+			}
+			wg.Wait()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transactions deadlocked with DeleteFile and MoveFile")
+	}
+}
+
+// TestTxCommit checks that recorded operations stay invisible until Commit
+// applies all of them as one journaled transaction
+func TestTxCommit(t *testing.T) {
+	fs := openMemTestFS(t, NewMemoryBackend())
+	if err := fs.WriteFile("a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("b", []byte("moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("c", []byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	for _, err := range []error{
+		tx.WriteFile("a", []byte("new")),
+		tx.SetAttribute("a", "tag", "new"),
+		tx.MoveFile("b", "d/b"),
+		tx.DeleteFile("c"),
+		tx.CreateDir("e"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantContent(t, fs, "a", "old")
+	wantContent(t, fs, "b", "moved")
+	wantContent(t, fs, "c", "deleted")
+	wantMissing(t, fs, "d/b")
+	wantMissing(t, fs, "e")
+
+	stats, err := fs.Journal().Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	wantContent(t, fs, "a", "new")
+	wantAttribute(t, fs, "a", "tag", "new")
+	wantMissing(t, fs, "b")
+	wantContent(t, fs, "d/b", "moved")
+	wantMissing(t, fs, "c")
+	if info, err := fs.Stat("e"); err != nil || !info.IsDir {
+		t.Fatalf("e is not a directory after Commit: %v", err)
+	}
+
+	// Versions of the overwritten files are journaled on their own, the
+	// operations themselves as a single transaction
+	reader, err := fs.Journal().NewReader(JournalFilter{
+		Operations: []string{JournalWrite, JournalSetAttr, JournalDelete, JournalMkdir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txIDs := make(map[uint64]int)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if entry.LSN > stats.LastLSN {
+			txIDs[entry.TxID]++
+		}
+	}
+	if len(txIDs) != 1 {
+		t.Fatalf("Commit journaled its operations in %d transactions, want 1", len(txIDs))
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("second Commit = %v, want ErrTxDone", err)
+	}
+}
+
+// TestTxRollback checks that Rollback leaves both the filesystem and the
+// journal as they were
+func TestTxRollback(t *testing.T) {
+	fs := openMemTestFS(t, NewMemoryBackend())
+	if err := fs.WriteFile("a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := fs.Journal().Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	for _, err := range []error{
+		tx.WriteFile("a", []byte("new")),
+		tx.WriteFile("b", []byte("new")),
+		tx.MoveFile("a", "c"),
+		tx.SetAttribute("c", "tag", "new"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	wantContent(t, fs, "a", "old")
+	wantMissing(t, fs, "b")
+	wantMissing(t, fs, "c")
+
+	after, err := fs.Journal().Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size != stats.Size || after.Entries != stats.Entries || after.LastLSN != stats.LastLSN {
+		t.Fatalf("Rollback changed the journal: %d entries up to LSN %d, was %d up to %d",
+			after.Entries, after.LastLSN, stats.Entries, stats.LastLSN)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("Commit after Rollback = %v, want ErrTxDone", err)
+	}
+	if err := tx.WriteFile("a", []byte("late")); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("WriteFile after Rollback = %v, want ErrTxDone", err)
+	}
+}
+
+// TestTxMoveRenames checks that moving a file the transaction did not write
+// renames it, keeping its times and links, while its content is journaled
+// in a blob when it is large
+func TestTxMoveRenames(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Backend = NewMemoryBackend()
+	opts.JournalSpillThreshold = 16
+	fs, err := NewSimpleFS("/root", opts)
+	if err != nil {
+		t.Fatalf("NewSimpleFS: %v", err)
+	}
+	defer fs.Close()
+
+	content := strings.Repeat("moved ", 16)
+	mtime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := fs.WriteFile("a", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chtimes("a", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("l1", []byte("linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("l1", "l2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	if err := tx.MoveFile("a", "d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.MoveFile("l1", "d/l1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	wantMissing(t, fs, "a")
+	wantContent(t, fs, "d/b", content)
+	info, err := fs.Stat("d/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime.Equal(mtime) {
+		t.Fatalf("d/b modified at %v, want %v kept by the rename", info.ModTime, mtime)
+	}
+	if err := fs.WriteFile("l2", []byte("both")); err != nil {
+		t.Fatal(err)
+	}
+	wantContent(t, fs, "d/l1", "both")
+
+	reader, err := fs.Journal().NewReader(JournalFilter{PathPrefix: "d/b", Operations: []string{JournalWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := reader.Next()
+	if err != nil {
+		t.Fatalf("no write of d/b journaled: %v", err)
+	}
+	if len(entry.Data) != 0 || entry.Blob() == "" {
+		t.Fatalf("move journaled %d bytes inline and blob %q, want only a blob", len(entry.Data), entry.Blob())
+	}
+}
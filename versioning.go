@@ -11,6 +11,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/unkn0wn-root/simplefs/internal/utils"
+	"github.com/unkn0wn-root/simplefs/internal/vfs"
 )
 
 // VersionInfo contains information about a file version
@@ -29,6 +30,40 @@ type VersionListing struct {
 	Versions []VersionInfo // Available versions
 }
 
+// Attributes of version journal entries
+const (
+	versionAttribute     = "version"     // ID of the version
+	versionMetaAttribute = "meta"        // Metadata of a created version
+	versionDescAttribute = "description" // New description of a version
+)
+
+// versionDir returns the directory holding the versions of a path, which
+// belong to the file itself while it has several links
+func (fs *SimpleFS) versionDir(path string) string {
+	if key, ok := fs.sharedKey(path); ok {
+		return fs.inodeVersionDir(key)
+	}
+	return fs.pathVersionDir(path)
+}
+
+// pathVersionDir returns the directory holding the versions kept under a
+// path. The path is hashed to avoid issues with special characters in
+// filenames.
+func (fs *SimpleFS) pathVersionDir(path string) string {
+	return filepath.Join(fs.rootPath, ".versions", utils.HashString(path))
+}
+
+// versionFiles returns the data and metadata files of the version an
+// entry refers to
+func (fs *SimpleFS) versionFiles(entry JournalEntry) (string, string, error) {
+	id := entry.Attributes[versionAttribute]
+	if id == "" || id != filepath.Base(id) {
+		return "", "", fmt.Errorf("invalid version ID: %q", id)
+	}
+	dir := fs.versionDir(entry.Path)
+	return filepath.Join(dir, id+".data"), filepath.Join(dir, id+".json"), nil
+}
+
 // createVersion creates a new version of a file
 func (fs *SimpleFS) createVersion(path string) error {
 	if !fs.versioning {
@@ -49,7 +84,7 @@ func (fs *SimpleFS) createVersion(path string) error {
 		return err
 	}
 
-	fileInfo, err := os.Stat(fullPath)
+	fileInfo, err := fs.fsys.Stat(fullPath)
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
@@ -59,12 +94,14 @@ func (fs *SimpleFS) createVersion(path string) error {
 		return fmt.Errorf("cannot version a directory")
 	}
 
-	data, err := fs.ReadFile(path)
+	// Read directly: callers already hold the path lock for writing
+	data, err := vfs.ReadFile(fs.fsys, fullPath)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	attrs, _ := fs.GetAllAttributes(path)
+	// Read attributes without locking for the same reason
+	attrs, _ := fs.readAttributes(fs.attributesPath(path))
 	// Create a unique ID for this version
 	versionID := uuid.New().String()
 	versionInfo := VersionInfo{
@@ -75,41 +112,52 @@ func (fs *SimpleFS) createVersion(path string) error {
 		Attributes: attrs,
 	}
 
-	// Hash the path to create a directory
-	hashedPath := utils.HashString(path)
-	versionDir := filepath.Join(fs.versionPath, hashedPath)
-
-	if err := os.MkdirAll(versionDir, 0755); err != nil {
-		return fmt.Errorf("failed to create version directory: %w", err)
-	}
-
-	dataPath := filepath.Join(versionDir, versionID+".data")
-	if err := os.WriteFile(dataPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write version data: %w", err)
-	}
-
-	metaPath := filepath.Join(versionDir, versionID+".json")
 	metaData, err := json.MarshalIndent(versionInfo, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal version metadata: %w", err)
 	}
 
-	if err := os.WriteFile(metaPath, metaData, 0644); err != nil {
-		return fmt.Errorf("failed to write version metadata: %w", err)
+	entry := JournalEntry{
+		Operation: JournalVersion,
+		Path:      path,
+		Data:      data,
+		Timestamp: versionInfo.CreatedAt,
+		Attributes: map[string]string{
+			versionAttribute:     versionID,
+			versionMetaAttribute: string(metaData),
+		},
+	}
+	// Old versions over maxVersions are pruned in the same transaction
+	pruned, err := fs.pruneEntries(path, versionInfo.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to prune old versions: %w", err)
 	}
 
-	// Prune old versions if maxVersions is set
-	if fs.maxVersions > 0 {
-		if err := fs.pruneVersions(path); err != nil {
-			return fmt.Errorf("failed to prune old versions: %w", err)
+	txID, err := fs.logTx(append([]JournalEntry{entry}, pruned...)...)
+	if err != nil {
+		return fmt.Errorf("failed to log version creation: %w", err)
+	}
+
+	err = applyVersion(fs, fullPath, entry)
+	for _, entry := range pruned {
+		if err == nil {
+			err = applyDeleteVersion(fs, fullPath, entry)
 		}
 	}
+	fs.finishTx(txID, err)
+	if err != nil {
+		return err
+	}
 
 	return fs.executeHooks(HookTypePost, ctx)
 }
 
 // ListVersions lists all versions of a file
 func (fs *SimpleFS) ListVersions(path string) (*VersionListing, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.ListVersions(rel)
+	}
+
 	if !fs.versioning {
 		return nil, fmt.Errorf("versioning is not enabled")
 	}
@@ -123,11 +171,9 @@ func (fs *SimpleFS) ListVersions(path string) (*VersionListing, error) {
 		return nil, err
 	}
 
-	// Hash the path to find the version directory
-	hashedPath := utils.HashString(path)
-	versionDir := filepath.Join(fs.versionPath, hashedPath)
+	versionDir := fs.versionDir(path)
 
-	if _, err := os.Stat(versionDir); os.IsNotExist(err) {
+	if _, err := fs.fsys.Stat(versionDir); os.IsNotExist(err) {
 		// No versions found
 		return &VersionListing{
 			Path:     path,
@@ -135,20 +181,20 @@ func (fs *SimpleFS) ListVersions(path string) (*VersionListing, error) {
 		}, nil
 	}
 
-	entries, err := os.ReadDir(versionDir)
+	entries, err := fs.fsys.ReadDir(versionDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read version directory: %w", err)
 	}
 
 	versions := make([]VersionInfo, 0)
 	for _, entry := range entries {
-		// Only process metadata files
-		if !strings.HasSuffix(entry.Name(), ".json") {
+		// Only process metadata files, not leftovers of interrupted writes
+		if !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), atomicTempPrefix) {
 			continue
 		}
 
 		metaPath := filepath.Join(versionDir, entry.Name())
-		metaData, err := os.ReadFile(metaPath)
+		metaData, err := vfs.ReadFile(fs.fsys, metaPath)
 		if err != nil {
 			continue // Skip if can't read
 		}
@@ -180,6 +226,10 @@ func (fs *SimpleFS) ListVersions(path string) (*VersionListing, error) {
 
 // GetVersion gets a specific version of a file
 func (fs *SimpleFS) GetVersion(path, versionID string) ([]byte, *VersionInfo, error) {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.GetVersion(rel, versionID)
+	}
+
 	if !fs.versioning {
 		return nil, nil, fmt.Errorf("versioning is not enabled")
 	}
@@ -192,15 +242,14 @@ func (fs *SimpleFS) GetVersion(path, versionID string) ([]byte, *VersionInfo, er
 		return nil, nil, err
 	}
 
-	hashedPath := utils.HashString(path)
-	versionDir := filepath.Join(fs.versionPath, hashedPath)
+	versionDir := fs.versionDir(path)
 
 	metaPath := filepath.Join(versionDir, versionID+".json")
-	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
+	if _, err := fs.fsys.Stat(metaPath); os.IsNotExist(err) {
 		return nil, nil, fmt.Errorf("version not found")
 	}
 
-	metaData, err := os.ReadFile(metaPath)
+	metaData, err := vfs.ReadFile(fs.fsys, metaPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read version metadata: %w", err)
 	}
@@ -211,7 +260,7 @@ func (fs *SimpleFS) GetVersion(path, versionID string) ([]byte, *VersionInfo, er
 	}
 
 	dataPath := filepath.Join(versionDir, versionID+".data")
-	data, err := os.ReadFile(dataPath)
+	data, err := vfs.ReadFile(fs.fsys, dataPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read version data: %w", err)
 	}
@@ -225,6 +274,10 @@ func (fs *SimpleFS) GetVersion(path, versionID string) ([]byte, *VersionInfo, er
 
 // RestoreVersion restores a file to a specific version
 func (fs *SimpleFS) RestoreVersion(path, versionID string) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.RestoreVersion(rel, versionID)
+	}
+
 	if !fs.versioning {
 		return fmt.Errorf("versioning is not enabled")
 	}
@@ -259,90 +312,105 @@ func (fs *SimpleFS) RestoreVersion(path, versionID string) error {
 
 // DeleteVersion deletes a specific version of a file
 func (fs *SimpleFS) DeleteVersion(path, versionID string) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.DeleteVersion(rel, versionID)
+	}
+
 	if !fs.versioning {
 		return fmt.Errorf("versioning is not enabled")
 	}
-
-	hashedPath := utils.HashString(path)
-	versionDir := filepath.Join(fs.versionPath, hashedPath)
-
-	metaPath := filepath.Join(versionDir, versionID+".json")
-	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
-		return fmt.Errorf("version not found")
+	if err := fs.checkWritable(); err != nil {
+		return err
 	}
 
-	if err := os.Remove(metaPath); err != nil {
-		return fmt.Errorf("failed to delete version metadata: %w", err)
+	entry := JournalEntry{
+		Operation:  JournalDeleteVersion,
+		Path:       path,
+		Timestamp:  getNow(),
+		Attributes: map[string]string{versionAttribute: versionID},
+	}
+	_, metaPath, err := fs.versionFiles(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.fsys.Stat(metaPath); os.IsNotExist(err) {
+		return fmt.Errorf("version not found")
 	}
 
-	dataPath := filepath.Join(versionDir, versionID+".data")
-	if err := os.Remove(dataPath); err != nil {
-		return fmt.Errorf("failed to delete version data: %w", err)
+	txID, err := fs.logTx(entry)
+	if err != nil {
+		return fmt.Errorf("failed to log version deletion: %w", err)
 	}
 
-	return nil
+	err = applyDeleteVersion(fs, "", entry)
+	fs.finishTx(txID, err)
+	return err
 }
 
-// pruneVersions removes old versions to keep the version count within limits
-func (fs *SimpleFS) pruneVersions(path string) error {
+// pruneEntries returns the journal entries deleting the oldest versions,
+// so the count stays within maxVersions once one more is created
+func (fs *SimpleFS) pruneEntries(path string, ts time.Time) ([]JournalEntry, error) {
+	if fs.maxVersions <= 0 {
+		return nil, nil
+	}
+
 	// Get all versions
 	listing, err := fs.ListVersions(path)
 	if err != nil {
-		return err
-	}
-
-	// Check if pruning is needed
-	if len(listing.Versions) <= fs.maxVersions {
-		return nil
+		return nil, err
 	}
 
-	// Determine how many versions to delete
-	toDelete := len(listing.Versions) - fs.maxVersions
-	for i := len(listing.Versions) - 1; i >= len(listing.Versions)-toDelete; i-- {
-		version := listing.Versions[i]
-		if err := fs.DeleteVersion(path, version.VersionID); err != nil {
-			return err
-		}
+	// Determine how many versions to delete, oldest last in the listing
+	var entries []JournalEntry
+	toDelete := len(listing.Versions) + 1 - fs.maxVersions
+	for i := len(listing.Versions) - 1; i >= 0 && i >= len(listing.Versions)-toDelete; i-- {
+		entries = append(entries, JournalEntry{
+			Operation:  JournalDeleteVersion,
+			Path:       path,
+			Timestamp:  ts,
+			Attributes: map[string]string{versionAttribute: listing.Versions[i].VersionID},
+		})
 	}
 
-	return nil
+	return entries, nil
 }
 
 // SetVersionDescription sets a description for a specific version
 func (fs *SimpleFS) SetVersionDescription(path, versionID, description string) error {
+	if target, rel, ok := fs.mounted(path); ok {
+		return target.SetVersionDescription(rel, versionID, description)
+	}
+
 	if !fs.versioning {
 		return fmt.Errorf("versioning is not enabled")
 	}
-
-	hashedPath := utils.HashString(path)
-	versionDir := filepath.Join(fs.versionPath, hashedPath)
-
-	metaPath := filepath.Join(versionDir, versionID+".json")
-	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
-		return fmt.Errorf("version not found")
+	if err := fs.checkWritable(); err != nil {
+		return err
 	}
 
-	metaData, err := os.ReadFile(metaPath)
+	entry := JournalEntry{
+		Operation: JournalVersionDesc,
+		Path:      path,
+		Timestamp: getNow(),
+		Attributes: map[string]string{
+			versionAttribute:     versionID,
+			versionDescAttribute: description,
+		},
+	}
+	_, metaPath, err := fs.versionFiles(entry)
 	if err != nil {
-		return fmt.Errorf("failed to read version metadata: %w", err)
+		return err
 	}
-
-	var version VersionInfo
-	if err := json.Unmarshal(metaData, &version); err != nil {
-		return fmt.Errorf("failed to parse version metadata: %w", err)
+	if _, err := fs.fsys.Stat(metaPath); os.IsNotExist(err) {
+		return fmt.Errorf("version not found")
 	}
 
-	version.Description = description
-
-	// Write back metadata
-	updatedMetaData, err := json.MarshalIndent(version, "", "  ")
+	txID, err := fs.logTx(entry)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated metadata: %w", err)
-	}
-
-	if err := os.WriteFile(metaPath, updatedMetaData, 0644); err != nil {
-		return fmt.Errorf("failed to write updated metadata: %w", err)
+		return fmt.Errorf("failed to log version description: %w", err)
 	}
 
-	return nil
+	err = applyVersionDesc(fs, "", entry)
+	fs.finishTx(txID, err)
+	return err
 }